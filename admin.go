@@ -0,0 +1,199 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"bufio"
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// NodeStats describes a single Redis node of a remote cache
+type NodeStats struct {
+	Addr             string
+	Keys             int64 // Number of keys held by the node
+	UsedMemory       int64 // Bytes allocated by the node
+	ConnectedClients int64
+	KeyspaceHits     int64
+	KeyspaceMisses   int64
+	ExpiredKeys      int64
+	EvictedKeys      int64
+}
+
+// Stats returns the statistics of every master node of the cluster. Nodes that do not allow INFO
+// report only their number of keys.
+func (rc RemoteCache) Stats(ctx context.Context) ([]NodeStats, error) {
+	var span Span
+	if rc.TracingEnabled {
+		span, _ = startRemoteSpan(ctx, rc.Tracer, "remote-cache-stats", "INFO")
+	}
+	addrs, conns, err := rc.nodeConns()
+	var stats []NodeStats
+	for i, conn := range conns {
+		if err == nil {
+			var node NodeStats
+			node, err = nodeStats(conn, addrs[i])
+			stats = append(stats, node)
+		}
+		conn.Close()
+	}
+	if rc.TracingEnabled {
+		if err != nil {
+			span.SetTag("result", "fail")
+		} else {
+			span.SetTag("result", "stats")
+		}
+		span.Finish()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// nodeStats reads the statistics of the node conn is connected to
+func nodeStats(conn redis.Conn, addr string) (NodeStats, error) {
+	stats := NodeStats{Addr: addr}
+	var err error
+	if stats.Keys, err = redis.Int64(conn.Do("DBSIZE")); err != nil {
+		return stats, err
+	}
+	info, err := redis.String(conn.Do("INFO"))
+	if _, ok := err.(redis.Error); ok {
+		// The server rejected INFO, as some managed services do
+		return stats, nil
+	} else if err != nil {
+		return stats, err
+	}
+	fields := map[string]*int64{
+		"used_memory":       &stats.UsedMemory,
+		"connected_clients": &stats.ConnectedClients,
+		"keyspace_hits":     &stats.KeyspaceHits,
+		"keyspace_misses":   &stats.KeyspaceMisses,
+		"expired_keys":      &stats.ExpiredKeys,
+		"evicted_keys":      &stats.EvictedKeys,
+	}
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		// INFO replies with "name:value" lines grouped under "# Section" headers
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if field, ok := fields[parts[0]]; ok && len(parts) == 2 {
+			*field, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+	}
+	return stats, nil
+}
+
+// PurgeNamespace deletes every key in remote cache that begins with namespace, along with the chunk,
+// lease and fencing keys stored alongside them, and returns the number of keys deleted. Keys are
+// found with SCAN on every master node, so keys written during the purge may survive it.
+func (rc RemoteCache) PurgeNamespace(ctx context.Context, namespace string) (int, error) {
+	var span Span
+	if rc.TracingEnabled {
+		span, _ = startRemoteSpan(ctx, rc.Tracer, "remote-cache-purge-namespace", "SCAN:DEL")
+		span.SetTag("namespace", namespace)
+	}
+	start := time.Now()
+	// Keys stored alongside a key are prefixed with a hash tag of slotTagWidth digits
+	patterns := []string{
+		escapePattern(namespace) + "*",
+		"{" + strings.Repeat("[0-9]", slotTagWidth) + "}" + escapePattern(namespace) + "*",
+	}
+	var deleted int
+	batch := make([]string, 0, scanCount)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := rc.pipeline(batch, func(conn redis.Conn, key string) error {
+			return conn.Send("DEL", key)
+		}, func(conn redis.Conn, key string, reply interface{}, err error) error {
+			// Keys that expired or were deleted since they were scanned are not counted
+			n, err := redis.Int(reply, err)
+			deleted += n
+			return err
+		})
+		batch = batch[:0]
+		return err
+	}
+	var err error
+	for _, pattern := range patterns {
+		if err == nil {
+			err = rc.ScanKeys(ctx, pattern, func(key string) error {
+				if batch = append(batch, key); len(batch) == scanCount {
+					return flush()
+				}
+				return nil
+			})
+		}
+	}
+	if err == nil {
+		err = flush()
+	}
+	observeOperation(rc.Metrics, TierRemote, OperationPurge, resultOf(err, ResultOK, ResultError), start)
+	if rc.TracingEnabled {
+		if err != nil {
+			span.SetTag("result", "fail")
+		} else {
+			span.SetTag("result", "purge")
+		}
+		span.SetTag("num_keys", deleted)
+		span.Finish()
+	}
+	return deleted, err
+}
+
+// DeleteKey deletes key, along with the chunks of a value written with SetReader and any lease on
+// key, and reports whether key existed. Unlike Delete, key is not treated as a pattern.
+func (rc RemoteCache) DeleteKey(ctx context.Context, key string) (bool, error) {
+	var existed bool
+	err := rc.observe(ctx, OperationDelete, "DEL", key, func(conn redis.Conn) (Result, error) {
+		chunkKeys, err := chunkKeysOf(conn, []string{key})
+		if err != nil {
+			return ResultError, err
+		}
+		conn.Send("MULTI")
+		conn.Send("DEL", key)
+		for _, chunkKey := range chunkKeys {
+			conn.Send("DEL", chunkKey)
+		}
+		conn.Send("DEL", leaseKey(key))
+		replies, err := redis.Values(conn.Do("EXEC"))
+		if err != nil {
+			return ResultError, err
+		}
+		deleted, err := redis.Int(replies[0], nil)
+		existed = deleted > 0
+		return existsResult(existed, err), err
+	})
+	return existed, err
+}
+
+// escapePattern escapes the characters of s that have special meaning in a SCAN or KEYS pattern
+func escapePattern(s string) string {
+	var escaped strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/server"
+	"github.com/mna/redisc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteStats(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	for _, key := range []string{"user:1", "user:2", "item:1"} {
+		s.Set(key, "test-value")
+	}
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}}
+
+	// miniredis rejects INFO, so only the number of keys is reported
+	stats, err := rc.Stats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []NodeStats{{Addr: s.Addr(), Keys: 3}}, stats)
+
+	s.Close()
+	_, err = rc.Stats(context.Background())
+	assert.Error(t, err)
+}
+
+func TestRemotePurgeNamespace(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	for _, key := range []string{
+		"user:1", "user:2", leaseKey("user:1"), chunkKey("user:2", "v1", 0), "item:1", leaseKey("item:1"), "user*:1",
+	} {
+		s.Set(key, "test-value")
+	}
+	mcm := &MockCacheMetrics{}
+	mcm.On("PurgeHit")
+	mcm.On("PurgeMiss")
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Metrics: mcm}
+
+	deleted, err := rc.PurgeNamespace(context.Background(), "user:")
+	require.NoError(t, err)
+	assert.Equal(t, 4, deleted)
+	assert.ElementsMatch(t, []string{"item:1", leaseKey("item:1"), "user*:1"}, s.Keys())
+	mcm.AssertCalled(t, "PurgeHit")
+
+	// Pattern characters in the namespace match literally
+	deleted, err = rc.PurgeNamespace(context.Background(), "user*")
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.ElementsMatch(t, []string{"item:1", leaseKey("item:1")}, s.Keys())
+
+	s.Close()
+	_, err = rc.PurgeNamespace(context.Background(), "item:")
+	assert.Error(t, err)
+	mcm.AssertCalled(t, "PurgeMiss")
+}
+
+func TestRemoteDeleteKey(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, ChunkSize: 4}
+	ctx := context.Background()
+	require.NoError(t, rc.SetReader(ctx, "user:1", strings.NewReader("streamed value")))
+	s.Set(leaseKey("user:1"), "lease")
+	s.Set("user:2", "test-value")
+
+	// Keys are matched literally rather than as patterns
+	existed, err := rc.DeleteKey(ctx, "user:*")
+	require.NoError(t, err)
+	assert.False(t, existed)
+	assert.True(t, s.Exists("user:2"))
+
+	// The chunks and lease of the key go with it
+	existed, err = rc.DeleteKey(ctx, "user:1")
+	require.NoError(t, err)
+	assert.True(t, existed)
+	assert.Equal(t, []string{"user:2"}, s.Keys())
+}
+
+func TestRemoteNodeAuth(t *testing.T) {
+	srv, err := server.NewServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer srv.Close()
+	// The node serves every slot itself and only answers DBSIZE once authenticated
+	require.NoError(t, srv.Register("CLUSTER", func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(1)
+		c.WriteLen(3)
+		c.WriteInt(0)
+		c.WriteInt(16383)
+		c.WriteLen(2)
+		c.WriteBulk(srv.Addr().IP.String())
+		c.WriteInt(srv.Addr().Port)
+	}))
+	require.NoError(t, srv.Register("AUTH", func(c *server.Peer, cmd string, args []string) {
+		if len(args) != 1 || args[0] != "secret" {
+			c.WriteError("ERR invalid password")
+			return
+		}
+		c.Ctx = true
+		c.WriteOK()
+	}))
+	require.NoError(t, srv.Register("DBSIZE", func(c *server.Peer, cmd string, args []string) {
+		if c.Ctx != true {
+			c.WriteError("NOAUTH Authentication required.")
+			return
+		}
+		c.WriteInt(3)
+	}))
+	require.NoError(t, srv.Register("INFO", func(c *server.Peer, cmd string, args []string) {
+		c.WriteError("ERR unknown command 'INFO'")
+	}))
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{srv.Addr().String()}}}
+
+	_, err = rc.Stats(context.Background())
+	assert.Error(t, err)
+	rc.authToken = "secret"
+	stats, err := rc.Stats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []NodeStats{{Addr: srv.Addr().String(), Keys: 3}}, stats)
+}
+
+func TestEscapePattern(t *testing.T) {
+	tests := []struct {
+		namespace string
+		expected  string
+	}{
+		{"user:", "user:"},
+		{"user*", `user\*`},
+		{"a?[b]\\c", `a\?\[b\]\\c`},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%q", test.namespace), func(t *testing.T) {
+			assert.Equal(t, test.expected, escapePattern(test.namespace))
+		})
+	}
+}
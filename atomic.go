@@ -0,0 +1,276 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// maxUpdateAttempts is the number of times Update reads and writes a value before giving up on
+// concurrent modifications
+const maxUpdateAttempts = 10
+
+// ErrUpdateConflict is returned by Update when the value kept changing between reading and writing
+// it
+var ErrUpdateConflict = fmt.Errorf("value was modified concurrently on every update attempt")
+
+// compareAndSwapScript sets KEYS[1] to ARGV[2] if the SHA-1 of its current value is ARGV[1], or if
+// it is missing and ARGV[1] is empty. The remaining TTL of the key is kept. It returns 0 if the
+// value was not set.
+var compareAndSwapScript = redis.NewScript(1, `
+local current = redis.call("GET", KEYS[1])
+if current then
+	if redis.sha1hex(current) ~= ARGV[1] then
+		return 0
+	end
+elseif ARGV[1] ~= "" then
+	return 0
+end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ttl)
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// AtomicCache is implemented by caches that support conditional and read-modify-write operations
+type AtomicCache interface {
+	// Update reads the value at key into target and passes it to fn, or passes nil if key is
+	// missing, then stores the value fn returns unless key was modified in the meantime, in which
+	// case it tries again. target holds the stored value on success.
+	Update(ctx context.Context, key string, target interface{}, fn func(current interface{}) (interface{}, error)) error
+	// SetIfNotExists sets the value only if key is missing and reports whether it was set
+	SetIfNotExists(ctx context.Context, key string, value interface{}) (bool, error)
+	// GetWithVersion is like Get, but also returns the version of the value for CompareAndSwap
+	GetWithVersion(ctx context.Context, key string, target interface{}) (string, error)
+	// CompareAndSwap sets the value only if the current version matches, or if key is missing and
+	// version is empty, and reports whether it was set
+	CompareAndSwap(ctx context.Context, key, version string, value interface{}) (bool, error)
+}
+
+// valueVersion returns the version of an encoded value, the hex SHA-1 of its bytes
+func valueVersion(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// decodeFresh decodes data into target after resetting it to its zero value, so that fields absent
+// from data are not left over from a previous decode
+func decodeFresh(encoder CacheEncoder, key string, data []byte, target interface{}) error {
+	if value := reflect.ValueOf(target); value.Kind() == reflect.Ptr && !value.IsNil() {
+		value.Elem().Set(reflect.Zero(value.Elem().Type()))
+	}
+	return decodeValue(encoder, key, data, target)
+}
+
+// Update atomically reads, modifies and writes the value at key using WATCH, MULTI and EXEC. The
+// remaining TTL of the key is kept. ErrUpdateConflict is returned if key was modified concurrently
+// on every attempt, and errors returned by fn are returned as is without writing.
+func (rc RemoteCache) Update(
+	ctx context.Context, key string, target interface{}, fn func(current interface{}) (interface{}, error),
+) error {
+	return rc.observe(ctx, OperationUpdate, "EXEC", key, func(conn redis.Conn) (Result, error) {
+		for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+			committed, err := rc.tryUpdate(conn, key, target, fn)
+			if err != nil {
+				return ResultError, err
+			}
+			if committed {
+				return ResultOK, nil
+			}
+		}
+		return ResultConflict, ErrUpdateConflict
+	})
+}
+
+// tryUpdate makes one attempt at Update, returning false if key was modified between reading and
+// writing it
+func (rc RemoteCache) tryUpdate(
+	conn redis.Conn, key string, target interface{}, fn func(current interface{}) (interface{}, error),
+) (bool, error) {
+	if _, err := conn.Do("WATCH", key); err != nil {
+		return false, err
+	}
+	var current interface{}
+	data, ttl, err := getWithPTTL(conn, key)
+	switch err {
+	case nil:
+		if err := decodeFresh(rc.Encoder, key, data, target); err != nil {
+			return false, err
+		}
+		current = target
+	case redis.ErrNil:
+	default:
+		return false, err
+	}
+	next, err := fn(current)
+	if err != nil {
+		return false, err
+	}
+	encoded, err := encodeValue(rc.Encoder, key, next)
+	if err != nil {
+		return false, err
+	}
+	conn.Send("MULTI")
+	if ttl > 0 {
+		conn.Send("SET", key, encoded, "PX", expiryMilliseconds(ttl))
+	} else {
+		conn.Send("SET", key, encoded)
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err == redis.ErrNil || (err == nil && len(replies) == 0) {
+		// The transaction was aborted because key was modified
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, decodeFresh(rc.Encoder, key, encoded, target)
+}
+
+// SetIfNotExists encodes the provided value and sets it in remote cache only if key is missing,
+// reporting whether it was set
+func (rc RemoteCache) SetIfNotExists(ctx context.Context, key string, value interface{}) (bool, error) {
+	var set bool
+	err := rc.observe(ctx, OperationSet, "SET", key, func(conn redis.Conn) (Result, error) {
+		encoded, err := encodeValue(rc.Encoder, key, value)
+		if err != nil {
+			return ResultError, err
+		}
+		_, err = redis.String(conn.Do("SET", key, encoded, "NX"))
+		switch err {
+		case nil:
+			set = true
+			return ResultOK, nil
+		case redis.ErrNil:
+			return ResultConflict, nil
+		}
+		return ResultError, err
+	})
+	return set, err
+}
+
+// GetWithVersion is like Get, but also returns the version of the value for CompareAndSwap
+func (rc RemoteCache) GetWithVersion(ctx context.Context, key string, target interface{}) (string, error) {
+	var version string
+	err := rc.observe(ctx, OperationGet, "GET", key, func(conn redis.Conn) (Result, error) {
+		data, err := redis.Bytes(conn.Do("GET", key))
+		if err != nil {
+			return missOrError(err), err
+		}
+		if err := decodeValue(rc.Encoder, key, data, target); err != nil {
+			return ResultDecodeError, err
+		}
+		version = valueVersion(data)
+		return ResultHit, nil
+	})
+	return version, err
+}
+
+// CompareAndSwap encodes the provided value and sets it in remote cache only if the version of the
+// current value, as returned by GetWithVersion, matches version. An empty version matches a
+// missing key. The remaining TTL of the key is kept.
+func (rc RemoteCache) CompareAndSwap(ctx context.Context, key, version string, value interface{}) (bool, error) {
+	var swapped bool
+	err := rc.observe(ctx, OperationCompareAndSwap, "EVALSHA", key, func(conn redis.Conn) (Result, error) {
+		encoded, err := encodeValue(rc.Encoder, key, value)
+		if err != nil {
+			return ResultError, err
+		}
+		swapped, err = redis.Bool(compareAndSwapScript.Do(conn, key, version, encoded))
+		switch {
+		case err != nil:
+			return ResultError, err
+		case !swapped:
+			return ResultConflict, nil
+		}
+		return ResultOK, nil
+	})
+	return swapped, err
+}
+
+// Update atomically reads, modifies and writes the value at key in remote cache, then removes any
+// local copy so the next read sees the new value. See AtomicCache for details.
+func (tc TieredCache) Update(
+	ctx context.Context, key string, target interface{}, fn func(current interface{}) (interface{}, error),
+) error {
+	remote, err := tc.atomicRemote()
+	if err != nil {
+		return err
+	}
+	err = remote.Update(ctx, key, target, fn)
+	tc.invalidateLocal(ctx, key, err == nil)
+	return err
+}
+
+// SetIfNotExists sets the value in remote cache only if key is missing there, reporting whether it
+// was set. Local cache is not written, so the next read backfills it.
+func (tc TieredCache) SetIfNotExists(ctx context.Context, key string, value interface{}) (bool, error) {
+	remote, err := tc.atomicRemote()
+	if err != nil {
+		return false, err
+	}
+	set, err := remote.SetIfNotExists(ctx, key, value)
+	tc.invalidateLocal(ctx, key, set)
+	return set, err
+}
+
+// GetWithVersion reads the value and its version from remote cache, which owns versions
+func (tc TieredCache) GetWithVersion(ctx context.Context, key string, target interface{}) (string, error) {
+	remote, err := tc.atomicRemote()
+	if err != nil {
+		return "", err
+	}
+	return remote.GetWithVersion(ctx, key, target)
+}
+
+// CompareAndSwap sets the value in remote cache only if its version matches, then removes any
+// local copy so the next read sees the new value
+func (tc TieredCache) CompareAndSwap(ctx context.Context, key, version string, value interface{}) (bool, error) {
+	remote, err := tc.atomicRemote()
+	if err != nil {
+		return false, err
+	}
+	swapped, err := remote.CompareAndSwap(ctx, key, version, value)
+	tc.invalidateLocal(ctx, key, swapped)
+	return swapped, err
+}
+
+// atomicRemote returns remote cache as an AtomicCache
+func (tc TieredCache) atomicRemote() (AtomicCache, error) {
+	remote, ok := tc.Remote.(AtomicCache)
+	if !ok {
+		return nil, fmt.Errorf("remote cache does not support atomic operations")
+	}
+	return remote, nil
+}
+
+// invalidateLocal removes the local copy of key after it was written to remote cache, if written
+func (tc TieredCache) invalidateLocal(ctx context.Context, key string, written bool) {
+	if !written {
+		return
+	}
+	tc.KeyFilter.Add(key)
+	// The local copy may not exist, so failing to delete it is not an error
+	tc.Local.Delete(ctx, key)
+}
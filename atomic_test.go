@@ -0,0 +1,201 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/mna/redisc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type availability struct {
+	Facility string
+	Spaces   int
+}
+
+func TestRemoteUpdate(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: &GobCacheEncoder{}}
+	ctx := context.Background()
+
+	// Missing keys are passed to fn as nil
+	var target availability
+	err = rc.Update(ctx, "test-key", &target, func(current interface{}) (interface{}, error) {
+		assert.Nil(t, current)
+		return availability{Facility: "a", Spaces: 1}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, availability{Facility: "a", Spaces: 1}, target)
+
+	// The current value is decoded into target, and target holds the stored value afterwards
+	s.SetTTL("test-key", time.Minute)
+	err = rc.Update(ctx, "test-key", &target, func(current interface{}) (interface{}, error) {
+		value := *current.(*availability)
+		value.Spaces--
+		return value, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, availability{Facility: "a"}, target)
+	assert.Equal(t, time.Minute, s.TTL("test-key"))
+	var stored availability
+	require.NoError(t, rc.Get(ctx, "test-key", &stored))
+	assert.Equal(t, availability{Facility: "a"}, stored)
+
+	// Errors from fn abort the update
+	fnErr := fmt.Errorf("no spaces left")
+	err = rc.Update(ctx, "test-key", &target, func(current interface{}) (interface{}, error) {
+		return nil, fnErr
+	})
+	assert.Equal(t, fnErr, err)
+}
+
+func TestRemoteUpdateConflict(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	encoder := &GobCacheEncoder{}
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	ctx := context.Background()
+	require.NoError(t, rc.Set(ctx, "test-key", 1))
+
+	// A concurrent write between reading and writing causes a retry with the new value
+	attempts := 0
+	var target int
+	err = rc.Update(ctx, "test-key", &target, func(current interface{}) (interface{}, error) {
+		attempts++
+		if attempts == 1 {
+			require.NoError(t, rc.Set(ctx, "test-key", 10))
+		}
+		return *current.(*int) + 1, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 11, target)
+
+	// Updates give up if every attempt conflicts
+	attempts = 0
+	err = rc.Update(ctx, "test-key", &target, func(current interface{}) (interface{}, error) {
+		attempts++
+		require.NoError(t, rc.Set(ctx, "test-key", attempts))
+		return 0, nil
+	})
+	assert.Equal(t, ErrUpdateConflict, err)
+	assert.Equal(t, maxUpdateAttempts, attempts)
+}
+
+func TestRemoteSetIfNotExists(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: &GobCacheEncoder{}}
+	ctx := context.Background()
+
+	set, err := rc.SetIfNotExists(ctx, "test-key", "first")
+	require.NoError(t, err)
+	assert.True(t, set)
+	set, err = rc.SetIfNotExists(ctx, "test-key", "second")
+	require.NoError(t, err)
+	assert.False(t, set)
+	var target string
+	require.NoError(t, rc.Get(ctx, "test-key", &target))
+	assert.Equal(t, "first", target)
+}
+
+func TestRemoteCompareAndSwap(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: &GobCacheEncoder{}}
+	ctx := context.Background()
+
+	// An empty version only matches a missing key
+	swapped, err := rc.CompareAndSwap(ctx, "test-key", "", "first")
+	require.NoError(t, err)
+	assert.True(t, swapped)
+	swapped, err = rc.CompareAndSwap(ctx, "test-key", "", "second")
+	require.NoError(t, err)
+	assert.False(t, swapped)
+
+	var target string
+	version, err := rc.GetWithVersion(ctx, "test-key", &target)
+	require.NoError(t, err)
+	assert.Equal(t, "first", target)
+	s.SetTTL("test-key", time.Minute)
+	swapped, err = rc.CompareAndSwap(ctx, "test-key", version, "second")
+	require.NoError(t, err)
+	assert.True(t, swapped)
+	assert.Equal(t, time.Minute, s.TTL("test-key"))
+
+	// The version changes with the value
+	swapped, err = rc.CompareAndSwap(ctx, "test-key", version, "third")
+	require.NoError(t, err)
+	assert.False(t, swapped)
+	newVersion, err := rc.GetWithVersion(ctx, "test-key", &target)
+	require.NoError(t, err)
+	assert.Equal(t, "second", target)
+	assert.NotEqual(t, version, newVersion)
+
+	_, err = rc.GetWithVersion(ctx, "missing", &target)
+	assert.Error(t, err)
+}
+
+func TestTieredAtomicInvalidatesLocal(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	encoder := &GobCacheEncoder{}
+	local := NewMockCache(encoder)
+	remote := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	mtc := TieredCache{Local: local, Remote: remote}
+	ctx := context.Background()
+	require.NoError(t, mtc.Set(ctx, "test-key", "first"))
+
+	// Failed conditional writes leave the local copy in place
+	set, err := mtc.SetIfNotExists(ctx, "test-key", "second")
+	require.NoError(t, err)
+	assert.False(t, set)
+	assert.Contains(t, local.Cache, "test-key")
+
+	var target string
+	version, err := mtc.GetWithVersion(ctx, "test-key", &target)
+	require.NoError(t, err)
+	swapped, err := mtc.CompareAndSwap(ctx, "test-key", version, "second")
+	require.NoError(t, err)
+	assert.True(t, swapped)
+	assert.NotContains(t, local.Cache, "test-key")
+
+	require.NoError(t, mtc.Get(ctx, "test-key", &target))
+	assert.Equal(t, "second", target)
+	assert.Contains(t, local.Cache, "test-key")
+	err = mtc.Update(ctx, "test-key", &target, func(current interface{}) (interface{}, error) {
+		return *current.(*string) + "!", nil
+	})
+	require.NoError(t, err)
+	assert.NotContains(t, local.Cache, "test-key")
+	require.NoError(t, mtc.Get(ctx, "test-key", &target))
+	assert.Equal(t, "second!", target)
+
+	unsupported := TieredCache{Local: local, Remote: NewMockCache(encoder)}
+	_, err = unsupported.SetIfNotExists(ctx, "test-key", "value")
+	assert.Error(t, err)
+}
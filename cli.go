@@ -34,14 +34,23 @@ func (rcc *RemoteCacheConfig) RegisterFlags(flags *pflag.FlagSet) {
 	flags.StringVar(&rcc.AuthToken, "cache-auth-token", "", "Redis Auth Token, If Any")
 	flags.DurationVar(&rcc.Timeout, "cache-timeout", time.Duration(time.Second*5), "Remote Redis Cache Connection Timeout")
 	flags.BoolVar(&rcc.TracingEnabled, "remote-cache-tracing-enabled", true, "Enable tracing on remote cache")
+	flags.StringVar(&rcc.TracerBackend, "remote-cache-tracer", TracerOpenTracing, "Tracer backend for remote cache, opentracing or opentelemetry")
+	flags.IntVar(&rcc.ChunkSize, "cache-chunk-size", DefaultChunkSize, "Size in bytes of the chunks streamed values are split into in remote cache")
+	flags.DurationVar(&rcc.LeaseTTL, "cache-lease-ttl", DefaultLeaseTTL, "Lifetime of the leases handed out on remote cache misses")
 }
 
 // RegisterFlags registers LocalCache pflags
 func (lcc *LocalCacheConfig) RegisterFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&lcc.Backend, "cache-backend", LocalBackendBigCache, "Local cache backend, one of bigcache, lru, tinylfu or map. lru and tinylfu require cache-hard-max-size.")
 	flags.DurationVar(&lcc.Eviction, "cache-eviction", time.Duration(time.Second*5), "How frequently to evict from cache")
 	flags.DurationVar(&lcc.TTL, "cache-ttl", time.Duration(time.Minute*60), "Cache Entry TTL for local cache")
 	flags.UintVar(&lcc.Shards, "cache-shards", 0, "Number of shards for local cluster. 0 means the program decides itself. Must be power of 2.")
+	flags.IntVar(&lcc.HardMaxCacheSize, "cache-hard-max-size", 0, "Memory limit for local cache entries in MB. 0 means no limit.")
+	flags.IntVar(&lcc.MaxEntriesInWindow, "cache-max-entries-in-window", 0, "Expected number of local cache entries within the TTL, used to size the initial allocation. 0 means the program decides itself.")
+	flags.IntVar(&lcc.MaxEntrySize, "cache-max-entry-size", 0, "Largest local cache entry in bytes, also used to size the initial allocation. Larger values are only stored in remote cache. 0 means no limit.")
+	flags.DurationVar(&lcc.CleanWindow, "cache-clean-window", 0, "Interval between removals of expired local cache entries. 0 disables removal.")
 	flags.BoolVar(&lcc.TracingEnabled, "local-cache-tracing-enabled", true, "Enable tracing on local cache")
+	flags.StringVar(&lcc.TracerBackend, "local-cache-tracer", TracerOpenTracing, "Tracer backend for local cache, opentracing or opentelemetry")
 }
 
 // RegisterFlags registers TieredCache pflags
@@ -49,4 +58,7 @@ func (tcc *TieredCacheConfig) RegisterFlags(flags *pflag.FlagSet) {
 	tcc.RemoteConfig.RegisterFlags(flags)
 	tcc.LocalConfig.RegisterFlags(flags)
 	flags.BoolVar(&tcc.TracingEnabled, "tiered-cache-tracing-enabled", true, "Enable tracing on tiered cache")
+	flags.StringVar(&tcc.TracerBackend, "tiered-cache-tracer", TracerOpenTracing, "Tracer backend for tiered cache, opentracing or opentelemetry")
+	flags.DurationVar(&tcc.SlidingTTL, "cache-sliding-ttl", 0, "Expire keys this long after they were last set or read. 0 disables sliding expiration.")
+	flags.DurationVar(&tcc.SlidingTTLRefreshInterval, "cache-sliding-ttl-refresh-interval", 0, "Interval between batched remote TTL refreshes for sliding expiration. 0 means 1s when cache-sliding-ttl is set.")
 }
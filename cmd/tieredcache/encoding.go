@@ -0,0 +1,195 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/spf13/pflag"
+	"github.com/spothero/tieredcache"
+)
+
+// Formats of cached values
+const (
+	formatGob  = "gob"
+	formatJSON = "json"
+	formatRaw  = "raw"
+)
+
+func init() {
+	// Values set with --type json are held in these types, which gob must know to encode them
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// encoderConfig describes how the values in remote cache were encoded, so that they can be
+// decoded for printing and new values encoded the same way
+type encoderConfig struct {
+	Format         string
+	Compression    string
+	SigningSecret  string
+	EncryptionKeys map[string]string // Hex-encoded AES keys, by key ID
+	ActiveKeyID    string
+}
+
+// registerFlags registers the encoder flags
+func (ec *encoderConfig) registerFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&ec.Format, "encoder", formatGob, "Format of cached values, one of gob, json or raw")
+	flags.StringVar(&ec.Compression, "compression", "", "Compression algorithm for set values, one of none, gzip, snappy or zstd. Any algorithm decodes every compressed value. Leave empty if values are not compressed.")
+	flags.StringVar(&ec.SigningSecret, "signing-secret", "", "Secret values are signed with, if any")
+	flags.StringToStringVar(&ec.EncryptionKeys, "encryption-keys", nil, "Hex-encoded AES keys values are encrypted with, as key ID=key pairs, if any")
+	flags.StringVar(&ec.ActiveKeyID, "encryption-active-key", "", "ID of the encryption key set values are encrypted with. Defaults to the only key if there is one.")
+}
+
+// newEncoder creates the encoder described by the configuration. Values are encoded in the
+// configured format, then compressed, then encrypted, then signed.
+func (ec encoderConfig) newEncoder() (tieredcache.CacheEncoder, error) {
+	var encoder tieredcache.CacheEncoder
+	switch ec.Format {
+	case formatGob:
+		encoder = gobFormat{}
+	case formatJSON:
+		encoder = jsonFormat{}
+	case formatRaw:
+		encoder = rawFormat{}
+	default:
+		return nil, fmt.Errorf("unknown encoder %q", ec.Format)
+	}
+	if ec.Compression != "" {
+		algorithm, err := compressionAlgorithm(ec.Compression)
+		if err != nil {
+			return nil, err
+		}
+		if encoder, err = tieredcache.NewCompressingCacheEncoder(encoder, algorithm, 0, nil); err != nil {
+			return nil, err
+		}
+	}
+	if len(ec.EncryptionKeys) > 0 {
+		keyring := tieredcache.Keyring{ActiveKeyID: ec.ActiveKeyID, Keys: make(map[string][]byte)}
+		for id, key := range ec.EncryptionKeys {
+			decoded, err := hex.DecodeString(key)
+			if err != nil {
+				return nil, fmt.Errorf("encryption key %q is not hex-encoded: %v", id, err)
+			}
+			keyring.Keys[id] = decoded
+			if keyring.ActiveKeyID == "" && len(ec.EncryptionKeys) == 1 {
+				keyring.ActiveKeyID = id
+			}
+		}
+		var err error
+		if encoder, err = tieredcache.NewEncryptingCacheEncoder(encoder, keyring); err != nil {
+			return nil, err
+		}
+	}
+	if ec.SigningSecret != "" {
+		var err error
+		if encoder, err = tieredcache.NewSigningCacheEncoder(encoder, []byte(ec.SigningSecret)); err != nil {
+			return nil, err
+		}
+	}
+	return encoder, nil
+}
+
+// compressionAlgorithm returns the compression algorithm with the given name
+func compressionAlgorithm(name string) (tieredcache.CompressionAlgorithm, error) {
+	for _, algorithm := range []tieredcache.CompressionAlgorithm{
+		tieredcache.CompressionNone,
+		tieredcache.CompressionGzip,
+		tieredcache.CompressionSnappy,
+		tieredcache.CompressionZstd,
+	} {
+		if algorithm.String() == name {
+			return algorithm, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown compression algorithm %q", name)
+}
+
+// decodeTarget returns the *interface{} the value of a format is decoded into
+func decodeTarget(target interface{}) (*interface{}, error) {
+	value, ok := target.(*interface{})
+	if !ok {
+		return nil, fmt.Errorf("target must be a *interface{}, got %T", target)
+	}
+	return value, nil
+}
+
+// gobFormat encodes values with gob and decodes them without knowing their types
+type gobFormat struct{}
+
+// Encode encodes the value with gob
+func (gobFormat) Encode(value interface{}) ([]byte, error) {
+	return (&tieredcache.GobCacheEncoder{}).Encode(value)
+}
+
+// Decode decodes the cached value into target, which must be a *interface{}. See gobDecoder.
+func (gobFormat) Decode(cachedValue []byte, target interface{}) error {
+	value, err := decodeTarget(target)
+	if err != nil {
+		return err
+	}
+	*value, err = decodeGob(cachedValue)
+	return err
+}
+
+// jsonFormat encodes values as JSON
+type jsonFormat struct{}
+
+// Encode encodes the value as JSON
+func (jsonFormat) Encode(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+// Decode decodes the cached value into target, which must be a *interface{}
+func (jsonFormat) Decode(cachedValue []byte, target interface{}) error {
+	value, err := decodeTarget(target)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(cachedValue, value)
+}
+
+// rawFormat stores strings and byte slices as they are
+type rawFormat struct{}
+
+// Encode returns the bytes of value, which must be a string or a byte slice
+func (rawFormat) Encode(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	}
+	return nil, fmt.Errorf("raw values must be strings, got %T", value)
+}
+
+// Decode sets target, which must be a *interface{}, to the cached value as a string if it is valid
+// UTF-8 and as bytes otherwise
+func (rawFormat) Decode(cachedValue []byte, target interface{}) error {
+	value, err := decodeTarget(target)
+	if err != nil {
+		return err
+	}
+	if utf8.Valid(cachedValue) {
+		*value = string(cachedValue)
+	} else {
+		*value = cachedValue
+	}
+	return nil
+}
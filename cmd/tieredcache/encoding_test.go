@@ -0,0 +1,117 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/spothero/tieredcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAESKey = "000102030405060708090a0b0c0d0e0f"
+
+func TestEncoderConfigRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   encoderConfig
+		value    interface{}
+		expected interface{}
+	}{
+		{"gob", encoderConfig{Format: formatGob}, int64(42), int64(42)},
+		{"json", encoderConfig{Format: formatJSON}, map[string]interface{}{"a": 1}, map[string]interface{}{"a": 1.0}},
+		{"raw", encoderConfig{Format: formatRaw}, "value", "value"},
+		{"compressed", encoderConfig{Format: formatGob, Compression: "zstd"}, "value", "value"},
+		{"signed", encoderConfig{Format: formatGob, SigningSecret: "secret"}, "value", "value"},
+		{"encrypted", encoderConfig{
+			Format:         formatGob,
+			EncryptionKeys: map[string]string{"v1": testAESKey},
+		}, "value", "value"},
+		{"everything", encoderConfig{
+			Format:         formatJSON,
+			Compression:    "gzip",
+			SigningSecret:  "secret",
+			EncryptionKeys: map[string]string{"v1": testAESKey, "v2": testAESKey},
+			ActiveKeyID:    "v2",
+		}, "value", "value"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoder, err := test.config.newEncoder()
+			require.NoError(t, err)
+			encoded, err := encoder.Encode(test.value)
+			require.NoError(t, err)
+			var decoded interface{}
+			require.NoError(t, encoder.Decode(encoded, &decoded))
+			assert.Equal(t, test.expected, decoded)
+		})
+	}
+}
+
+func TestEncoderConfigMatchesLibrary(t *testing.T) {
+	// Values written by the library decode with the matching configuration
+	gobEncoder, err := tieredcache.NewCompressingCacheEncoder(
+		&tieredcache.GobCacheEncoder{}, tieredcache.CompressionSnappy, 0, nil)
+	require.NoError(t, err)
+	value := "value"
+	encoded, err := gobEncoder.Encode(&value)
+	require.NoError(t, err)
+
+	encoder, err := encoderConfig{Format: formatGob, Compression: "none"}.newEncoder()
+	require.NoError(t, err)
+	var decoded interface{}
+	require.NoError(t, encoder.Decode(encoded, &decoded))
+	assert.Equal(t, "value", decoded)
+}
+
+func TestEncoderConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config encoderConfig
+	}{
+		{"unknown format", encoderConfig{Format: "xml"}},
+		{"unknown compression", encoderConfig{Format: formatGob, Compression: "lz4"}},
+		{"invalid key", encoderConfig{Format: formatGob, EncryptionKeys: map[string]string{"v1": "not hex"}}},
+		{"no active key", encoderConfig{
+			Format:         formatGob,
+			EncryptionKeys: map[string]string{"v1": testAESKey, "v2": testAESKey},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.config.newEncoder()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRawFormat(t *testing.T) {
+	encoded, err := rawFormat{}.Encode([]byte{0xff})
+	require.NoError(t, err)
+	var decoded interface{}
+	require.NoError(t, rawFormat{}.Decode(encoded, &decoded))
+	assert.Equal(t, []byte{0xff}, decoded)
+
+	_, err = rawFormat{}.Encode(1)
+	assert.Error(t, err)
+}
+
+func TestFormatDecodeTarget(t *testing.T) {
+	var target string
+	for _, format := range []tieredcache.CacheEncoder{gobFormat{}, jsonFormat{}, rawFormat{}} {
+		assert.Error(t, format.Decode([]byte("value"), &target))
+	}
+}
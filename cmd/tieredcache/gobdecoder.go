@@ -0,0 +1,450 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// Type IDs predefined by encoding/gob
+const (
+	gobBool      = 1
+	gobInt       = 2
+	gobUint      = 3
+	gobFloat     = 4
+	gobBytes     = 5
+	gobString    = 6
+	gobComplex   = 7
+	gobInterface = 8
+)
+
+// gobKind identifies the kind of a type defined in a gob stream
+type gobKind int
+
+const (
+	gobArray gobKind = iota
+	gobSlice
+	gobStruct
+	gobMap
+	gobOpaque // Encoded by the type itself with GobEncode, MarshalBinary or MarshalText
+)
+
+// gobType is a type defined in a gob stream
+type gobType struct {
+	kind   gobKind
+	name   string
+	key    int // Map key type ID
+	elem   int // Array, slice or map element type ID
+	length int // Array length
+	fields []gobField
+}
+
+// gobField is a field of a struct type defined in a gob stream
+type gobField struct {
+	name string
+	id   int
+}
+
+// gobDecoder decodes gob streams without the Go types they were encoded from, using the type
+// definitions every stream carries. Structs decode to maps of their field names to values, without
+// the fields gob left out because they held zero values. Maps decode to maps keyed by the string
+// form of their keys, arrays and slices to slices, and values of types that encode themselves to
+// their encoded bytes.
+type gobDecoder struct {
+	types map[int]gobType
+}
+
+// decodeGob decodes the first value in a gob stream
+func decodeGob(data []byte) (interface{}, error) {
+	dec := gobDecoder{types: make(map[int]gobType)}
+	r := &gobReader{data: data}
+	for len(r.data) > 0 {
+		msg, err := r.message()
+		if err != nil {
+			return nil, err
+		}
+		id, err := msg.int()
+		if err != nil {
+			return nil, err
+		}
+		if id < 0 {
+			if err := dec.defineType(msg, int(-id)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return dec.topLevel(msg, int(id))
+	}
+	return nil, fmt.Errorf("gob: no value in stream")
+}
+
+// topLevel decodes a value sent on its own, rather than as part of another value
+func (dec gobDecoder) topLevel(r *gobReader, id int) (interface{}, error) {
+	if t, ok := dec.types[id]; ok && t.kind == gobStruct {
+		return dec.structValue(r, t)
+	}
+	// Other values are sent as a struct with a single field
+	delta, err := r.uint()
+	if err != nil {
+		return nil, err
+	}
+	if delta != 0 {
+		return nil, fmt.Errorf("gob: corrupted data: non-zero delta for singleton")
+	}
+	return dec.value(r, id)
+}
+
+// value decodes a value of the type with the given ID
+func (dec gobDecoder) value(r *gobReader, id int) (interface{}, error) {
+	switch id {
+	case gobBool:
+		u, err := r.uint()
+		return u != 0, err
+	case gobInt:
+		return r.int()
+	case gobUint:
+		return r.uint()
+	case gobFloat:
+		return r.float()
+	case gobBytes:
+		return r.bytes()
+	case gobString:
+		b, err := r.bytes()
+		return string(b), err
+	case gobComplex:
+		re, err := r.float()
+		if err != nil {
+			return nil, err
+		}
+		im, err := r.float()
+		return fmt.Sprint(complex(re, im)), err
+	case gobInterface:
+		return dec.interfaceValue(r)
+	}
+	t, ok := dec.types[id]
+	if !ok {
+		return nil, fmt.Errorf("gob: unknown type id %v", id)
+	}
+	switch t.kind {
+	case gobArray, gobSlice:
+		n, err := r.length()
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = dec.value(r, t.elem); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case gobMap:
+		n, err := r.length()
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			key, err := dec.value(r, t.key)
+			if err != nil {
+				return nil, err
+			}
+			if values[fmt.Sprint(key)], err = dec.value(r, t.elem); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case gobStruct:
+		return dec.structValue(r, t)
+	default:
+		return r.bytes()
+	}
+}
+
+// structValue decodes a struct as a sequence of field number deltas and values ending in zero
+func (dec gobDecoder) structValue(r *gobReader, t gobType) (interface{}, error) {
+	values := make(map[string]interface{}, len(t.fields))
+	err := r.fields(func(field int) error {
+		if field >= len(t.fields) {
+			return fmt.Errorf("gob: field %v out of range for %v", field, t.name)
+		}
+		var err error
+		values[t.fields[field].name], err = dec.value(r, t.fields[field].id)
+		return err
+	})
+	return values, err
+}
+
+// interfaceValue decodes an interface value, which is the name of its concrete type, followed by
+// the definitions of any types it uses that have not been sent yet, the ID of its concrete type and
+// the value itself. The definitions may split the value across messages.
+func (dec gobDecoder) interfaceValue(r *gobReader) (interface{}, error) {
+	name, err := r.bytes()
+	if err != nil || len(name) == 0 {
+		// Nil interfaces have no concrete type
+		return nil, err
+	}
+	for {
+		if len(r.data) == 0 && r.stream != nil {
+			// A definition ended the message, so the rest of the value is in the next one
+			next, err := r.stream.message()
+			if err != nil {
+				return nil, err
+			}
+			r.data = next.data
+		}
+		id, err := r.int()
+		if err != nil {
+			return nil, err
+		}
+		if id >= 0 {
+			// The length of the value is sent ahead of it so it can be skipped
+			if _, err := r.uint(); err != nil {
+				return nil, err
+			}
+			return dec.topLevel(r, int(id))
+		}
+		if err := dec.defineType(r, int(-id)); err != nil {
+			return nil, err
+		}
+		if len(r.data) > 0 {
+			// Each definition is followed by the length of the next message
+			if _, err := r.uint(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// defineType decodes the definition of the type with the given ID. Definitions are sent as gob's
+// wireType struct, which has one field for each kind of type.
+func (dec gobDecoder) defineType(r *gobReader, id int) error {
+	var t gobType
+	err := r.fields(func(field int) error {
+		switch field {
+		case 0:
+			t.kind = gobArray
+			return r.fields(func(field int) error {
+				switch field {
+				case 0:
+					return dec.commonType(r, &t)
+				case 1:
+					return r.intInto(&t.elem)
+				case 2:
+					return r.intInto(&t.length)
+				}
+				return fmt.Errorf("gob: unknown array type field %v", field)
+			})
+		case 1:
+			t.kind = gobSlice
+			return r.fields(func(field int) error {
+				switch field {
+				case 0:
+					return dec.commonType(r, &t)
+				case 1:
+					return r.intInto(&t.elem)
+				}
+				return fmt.Errorf("gob: unknown slice type field %v", field)
+			})
+		case 2:
+			t.kind = gobStruct
+			return r.fields(func(field int) error {
+				switch field {
+				case 0:
+					return dec.commonType(r, &t)
+				case 1:
+					return dec.structFields(r, &t)
+				}
+				return fmt.Errorf("gob: unknown struct type field %v", field)
+			})
+		case 3:
+			t.kind = gobMap
+			return r.fields(func(field int) error {
+				switch field {
+				case 0:
+					return dec.commonType(r, &t)
+				case 1:
+					return r.intInto(&t.key)
+				case 2:
+					return r.intInto(&t.elem)
+				}
+				return fmt.Errorf("gob: unknown map type field %v", field)
+			})
+		case 4, 5, 6:
+			t.kind = gobOpaque
+			return r.fields(func(field int) error {
+				if field == 0 {
+					return dec.commonType(r, &t)
+				}
+				return fmt.Errorf("gob: unknown encoder type field %v", field)
+			})
+		}
+		return fmt.Errorf("gob: unknown type definition field %v", field)
+	})
+	if err != nil {
+		return err
+	}
+	dec.types[id] = t
+	return nil
+}
+
+// commonType decodes the name and ID shared by every type definition
+func (dec gobDecoder) commonType(r *gobReader, t *gobType) error {
+	return r.fields(func(field int) error {
+		switch field {
+		case 0:
+			name, err := r.bytes()
+			t.name = string(name)
+			return err
+		case 1:
+			var id int
+			return r.intInto(&id)
+		}
+		return fmt.Errorf("gob: unknown common type field %v", field)
+	})
+}
+
+// structFields decodes the fields of a struct type definition
+func (dec gobDecoder) structFields(r *gobReader, t *gobType) error {
+	n, err := r.length()
+	if err != nil {
+		return err
+	}
+	t.fields = make([]gobField, n)
+	for i := range t.fields {
+		f := &t.fields[i]
+		err := r.fields(func(field int) error {
+			switch field {
+			case 0:
+				name, err := r.bytes()
+				f.name = string(name)
+				return err
+			case 1:
+				return r.intInto(&f.id)
+			}
+			return fmt.Errorf("gob: unknown struct field definition field %v", field)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gobReader reads the primitive encodings of a gob stream
+type gobReader struct {
+	data   []byte
+	stream *gobReader // Rest of the stream after a message, nil for the stream itself
+}
+
+// uint reads an unsigned integer, which is sent as a single byte if it is less than 128 and
+// otherwise as the negated byte count followed by its big-endian bytes
+func (r *gobReader) uint() (uint64, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := r.data[0]
+	if b < 0x80 {
+		r.data = r.data[1:]
+		return uint64(b), nil
+	}
+	n := -int(int8(b))
+	if n > 8 || len(r.data) < n+1 {
+		return 0, fmt.Errorf("gob: invalid uint encoding")
+	}
+	var u uint64
+	for _, b := range r.data[1 : n+1] {
+		u = u<<8 | uint64(b)
+	}
+	r.data = r.data[n+1:]
+	return u, nil
+}
+
+// int reads a signed integer, which is sent as an unsigned integer with the sign in its lowest bit
+func (r *gobReader) int() (int64, error) {
+	u, err := r.uint()
+	if u&1 != 0 {
+		return ^int64(u >> 1), err
+	}
+	return int64(u >> 1), err
+}
+
+// intInto reads a signed integer into i
+func (r *gobReader) intInto(i *int) error {
+	v, err := r.int()
+	*i = int(v)
+	return err
+}
+
+// float reads a floating-point number, which is sent as an unsigned integer holding its
+// byte-reversed bits
+func (r *gobReader) float() (float64, error) {
+	u, err := r.uint()
+	return math.Float64frombits(bits.ReverseBytes64(u)), err
+}
+
+// length reads the element count of an array, slice or map. Every element takes at least one
+// byte, so counts beyond the remaining data are rejected rather than allocated.
+func (r *gobReader) length() (int, error) {
+	n, err := r.uint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(r.data)) {
+		return 0, fmt.Errorf("gob: length %v exceeds remaining data", n)
+	}
+	return int(n), nil
+}
+
+// bytes reads a byte slice or string, which is sent as its length followed by its bytes
+func (r *gobReader) bytes() ([]byte, error) {
+	n, err := r.length()
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte(nil), r.data[:n]...)
+	r.data = r.data[n:]
+	return b, nil
+}
+
+// message reads a message, which is sent as its length followed by its contents
+func (r *gobReader) message() (*gobReader, error) {
+	b, err := r.bytes()
+	return &gobReader{data: b, stream: r}, err
+}
+
+// fields calls fn with the number of each field of a struct in turn. fn must read the field.
+func (r *gobReader) fields(fn func(field int) error) error {
+	field := -1
+	for {
+		delta, err := r.uint()
+		if err != nil {
+			return err
+		}
+		if delta == 0 {
+			return nil
+		}
+		if delta > math.MaxInt32 {
+			return fmt.Errorf("gob: field delta %v out of range", delta)
+		}
+		field += int(delta)
+		if err := fn(field); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type facility struct {
+	Name     string
+	Spaces   int
+	Rate     float64
+	Open     bool
+	Address  *address
+	Tags     []string
+	Prices   map[string]uint
+	Grid     [2]int8
+	Extra    interface{}
+	Photo    []byte
+	Updated  time.Time
+	Children []address
+}
+
+type address struct {
+	City string
+	Zip  int
+}
+
+func init() {
+	gob.Register(address{})
+}
+
+func encodeGob(t *testing.T, value interface{}) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(value))
+	return buf.Bytes()
+}
+
+func TestDecodeGob(t *testing.T) {
+	updated := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	updatedBytes, err := updated.GobEncode()
+	require.NoError(t, err)
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected interface{}
+	}{
+		{"string", "value", "value"},
+		{"int", -42, int64(-42)},
+		{"large int", int64(1) << 40, int64(1) << 40},
+		{"uint", uint(300), uint64(300)},
+		{"float", 1.5, 1.5},
+		{"bool", true, true},
+		{"bytes", []byte{0, 1, 2}, []byte{0, 1, 2}},
+		{"complex", complex(1, 2), "(1+2i)"},
+		{"slice", []string{"a", "b"}, []interface{}{"a", "b"}},
+		{"map", map[int]bool{1: true}, map[string]interface{}{"1": true}},
+		{"self-encoding", updated, updatedBytes},
+		{"struct", facility{
+			Name:     "Garage",
+			Spaces:   100,
+			Rate:     2.5,
+			Open:     true,
+			Address:  &address{City: "Chicago", Zip: 60601},
+			Tags:     []string{"covered"},
+			Prices:   map[string]uint{"hour": 5},
+			Grid:     [2]int8{1, -1},
+			Extra:    address{City: "Evanston"},
+			Photo:    []byte("jpg"),
+			Updated:  updated,
+			Children: []address{{City: "Oak Park"}},
+		}, map[string]interface{}{
+			"Name":     "Garage",
+			"Spaces":   int64(100),
+			"Rate":     2.5,
+			"Open":     true,
+			"Address":  map[string]interface{}{"City": "Chicago", "Zip": int64(60601)},
+			"Tags":     []interface{}{"covered"},
+			"Prices":   map[string]interface{}{"hour": uint64(5)},
+			"Grid":     []interface{}{int64(1), int64(-1)},
+			"Extra":    map[string]interface{}{"City": "Evanston"},
+			"Photo":    []byte("jpg"),
+			"Updated":  updatedBytes,
+			"Children": []interface{}{map[string]interface{}{"City": "Oak Park"}},
+		}},
+		{"zero fields omitted", facility{Name: "Lot"}, map[string]interface{}{
+			// Arrays are always sent
+			"Name": "Lot",
+			"Grid": []interface{}{int64(0), int64(0)},
+		}},
+		{"pointer", &address{City: "Chicago"}, map[string]interface{}{"City": "Chicago"}},
+		{"interface slice", []interface{}{"a", 1, address{Zip: 1}}, []interface{}{
+			"a", int64(1), map[string]interface{}{"Zip": int64(1)},
+		}},
+		{"nested interface", []interface{}{[]interface{}{address{Zip: 2}}}, []interface{}{
+			[]interface{}{map[string]interface{}{"Zip": int64(2)}},
+		}},
+		{"nil interface", []interface{}{nil}, []interface{}{nil}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := decodeGob(encodeGob(t, test.value))
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, value)
+		})
+	}
+}
+
+func TestDecodeGobErrors(t *testing.T) {
+	valid := encodeGob(t, address{City: "Chicago"})
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated", valid[:len(valid)-3]},
+		{"type definitions only", valid[:valid[0]+1]},
+		{"unknown type", []byte{3, 0x7e, 0, 0}},
+		{"non-zero singleton delta", []byte{3, 0x0c, 1, 0}},
+		{"invalid uint", []byte{0xf0}},
+		{"huge length", []byte{5, 0x0c, 0, 0xfe, 0xff, 0xff}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodeGob(test.data)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestDecodeGobUint(t *testing.T) {
+	for _, u := range []uint64{0, 1, 127, 128, 255, 256, 1 << 32, 1<<64 - 1} {
+		t.Run(fmt.Sprint(u), func(t *testing.T) {
+			// Values of every length are sent in as few bytes as they fit in
+			value, err := decodeGob(encodeGob(t, u))
+			require.NoError(t, err)
+			assert.Equal(t, u, value)
+		})
+	}
+}
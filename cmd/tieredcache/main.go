@@ -0,0 +1,394 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command tieredcache inspects and manages the contents of the remote cache of a tieredcache,
+// decoding values the way the services that cached them encoded them.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/spf13/pflag"
+	"github.com/spothero/tieredcache"
+)
+
+const usage = `Usage: tieredcache <command> [flags] [arguments]
+
+Commands:
+  get KEY          Print the value stored at KEY
+  set KEY VALUE    Store VALUE at KEY
+  del KEY...       Delete keys
+  scan             List the keys matching --pattern on every node
+  ttl KEY...       Print the time left until keys expire
+  purge            Delete the keys in --namespace
+  stats            Print the statistics of every node
+
+Run "tieredcache <command> --help" for the flags of a command.
+`
+
+// cli holds the configuration and remote cache shared by every command
+type cli struct {
+	remoteConfig  tieredcache.RemoteCacheConfig
+	encoderConfig encoderConfig
+	output        string
+	encoder       tieredcache.CacheEncoder
+	remote        tieredcache.RemoteCache
+	stdout        io.Writer
+}
+
+// command is a subcommand of the CLI. setup registers the flags of the command and returns the
+// function that runs it with its positional arguments.
+type command struct {
+	args    string
+	minArgs int
+	maxArgs int // -1 for no limit
+	setup   func(flags *pflag.FlagSet) func(ctx context.Context, c *cli, args []string) error
+}
+
+var commands = map[string]command{
+	"get":   {"KEY", 1, 1, getCommand},
+	"set":   {"KEY VALUE", 2, 2, setCommand},
+	"del":   {"KEY...", 1, -1, delCommand},
+	"scan":  {"", 0, 0, scanCommand},
+	"ttl":   {"KEY...", 1, -1, ttlCommand},
+	"purge": {"", 0, 0, purgeCommand},
+	"stats": {"", 0, 0, statsCommand},
+}
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command named by the first argument and returns the exit code of the process
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	switch args[0] {
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n%v", args[0], usage)
+		return 2
+	}
+	c := &cli{stdout: stdout}
+	flags := pflag.NewFlagSet(args[0], pflag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: tieredcache %v [flags] %v\n\nFlags:\n%v", args[0], cmd.args, flags.FlagUsages())
+	}
+	c.remoteConfig.RegisterFlags(flags)
+	c.encoderConfig.registerFlags(flags)
+	flags.StringVarP(&c.output, "output", "o", outputTable, "Output format, json or table")
+	runCommand := cmd.setup(flags)
+	if err := flags.Parse(args[1:]); err == pflag.ErrHelp {
+		return 0
+	} else if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		flags.Usage()
+		return 2
+	}
+	if flags.NArg() < cmd.minArgs || (cmd.maxArgs >= 0 && flags.NArg() > cmd.maxArgs) {
+		flags.Usage()
+		return 2
+	}
+	err := c.connect()
+	if err == nil {
+		err = runCommand(ctx, c, flags.Args())
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// connect validates the configuration and connects to remote cache
+func (c *cli) connect() error {
+	if c.output != outputJSON && c.output != outputTable {
+		return fmt.Errorf("unknown output format %q", c.output)
+	}
+	var err error
+	if c.encoder, err = c.encoderConfig.newEncoder(); err != nil {
+		return err
+	}
+	c.remote, err = c.remoteConfig.NewCache(c.encoder, nil)
+	return err
+}
+
+// write writes the output of a command in the configured format
+func (c *cli) write(value interface{}, t table) error {
+	return writeOutput(c.stdout, c.output, value, t)
+}
+
+// decode decodes the value stored at key
+func (c *cli) decode(key string, data []byte) (interface{}, error) {
+	var value interface{}
+	var err error
+	if keyed, ok := c.encoder.(tieredcache.KeyedCacheEncoder); ok {
+		err = keyed.DecodeKey(key, data, &value)
+	} else {
+		err = c.encoder.Decode(data, &value)
+	}
+	return value, err
+}
+
+// keyInfo describes a key in remote cache
+type keyInfo struct {
+	Key    string      `json:"key"`
+	Exists bool        `json:"exists"`
+	TTL    string      `json:"ttl,omitempty"` // Empty if the key does not expire
+	Size   int         `json:"size,omitempty"`
+	Value  interface{} `json:"value,omitempty"`
+}
+
+// formatTTL formats the time left until a key expires, which is zero if it does not expire
+func formatTTL(ttl time.Duration) string {
+	if ttl == 0 {
+		return ""
+	}
+	return ttl.String()
+}
+
+// tableTTL returns the TTL of a key for a table cell
+func (ki keyInfo) tableTTL() string {
+	if ki.TTL == "" {
+		return "none"
+	}
+	return ki.TTL
+}
+
+func getCommand(flags *pflag.FlagSet) func(ctx context.Context, c *cli, args []string) error {
+	return func(ctx context.Context, c *cli, args []string) error {
+		key := args[0]
+		data, ttl, err := c.remote.GetBytesWithTTL(ctx, key)
+		if err == redis.ErrNil {
+			return fmt.Errorf("key %q not found", key)
+		} else if err != nil {
+			return err
+		}
+		value, err := c.decode(key, data)
+		if err != nil {
+			return fmt.Errorf("failed to decode %q with the %v encoder, use --encoder raw to print the stored bytes: %v",
+				key, c.encoderConfig.Format, err)
+		}
+		info := keyInfo{Key: key, Exists: true, TTL: formatTTL(ttl), Size: len(data), Value: value}
+		return c.write(info, table{
+			header: []string{"KEY", "TTL", "SIZE", "VALUE"},
+			rows:   [][]string{{key, info.tableTTL(), strconv.Itoa(len(data)), formatValue(value)}},
+		})
+	}
+}
+
+func setCommand(flags *pflag.FlagSet) func(ctx context.Context, c *cli, args []string) error {
+	var ttl time.Duration
+	var valueType string
+	flags.DurationVar(&ttl, "ttl", 0, "Time until the value expires. 0 means it does not expire.")
+	flags.StringVar(&valueType, "type", "string", "Type of the value, one of string, int, float, bool or json")
+	return func(ctx context.Context, c *cli, args []string) error {
+		key := args[0]
+		value, err := parseValue(valueType, args[1])
+		if err != nil {
+			return err
+		}
+		if err := c.remote.SetWithTTL(ctx, key, value, ttl); err != nil {
+			return err
+		}
+		info := keyInfo{Key: key, Exists: true, TTL: formatTTL(ttl)}
+		return c.write(info, table{
+			header: []string{"KEY", "TTL"},
+			rows:   [][]string{{key, info.tableTTL()}},
+		})
+	}
+}
+
+// parseValue parses a value given on the command line as the named type
+func parseValue(valueType, s string) (interface{}, error) {
+	switch valueType {
+	case "string":
+		return s, nil
+	case "int":
+		return strconv.ParseInt(s, 10, 64)
+	case "float":
+		return strconv.ParseFloat(s, 64)
+	case "bool":
+		return strconv.ParseBool(s)
+	case "json":
+		var value interface{}
+		err := json.Unmarshal([]byte(s), &value)
+		return value, err
+	}
+	return nil, fmt.Errorf("unknown value type %q", valueType)
+}
+
+func delCommand(flags *pflag.FlagSet) func(ctx context.Context, c *cli, args []string) error {
+	return func(ctx context.Context, c *cli, args []string) error {
+		var infos []keyInfo
+		t := table{header: []string{"KEY", "RESULT"}}
+		for _, key := range args {
+			exists, err := c.remote.DeleteKey(ctx, key)
+			if err != nil {
+				return err
+			}
+			infos = append(infos, keyInfo{Key: key, Exists: exists})
+			result := "deleted"
+			if !exists {
+				result = "not found"
+			}
+			t.rows = append(t.rows, []string{key, result})
+		}
+		return c.write(infos, t)
+	}
+}
+
+// errScanLimit stops a scan once the requested number of keys has been found
+var errScanLimit = fmt.Errorf("scan limit reached")
+
+func scanCommand(flags *pflag.FlagSet) func(ctx context.Context, c *cli, args []string) error {
+	var pattern string
+	var limit int
+	flags.StringVar(&pattern, "pattern", "*", "Pattern matching the keys to list")
+	flags.IntVar(&limit, "limit", 0, "Largest number of keys to list. 0 means no limit.")
+	return func(ctx context.Context, c *cli, args []string) error {
+		keys := []string{}
+		err := c.remote.ScanKeys(ctx, pattern, func(key string) error {
+			keys = append(keys, key)
+			if len(keys) == limit {
+				return errScanLimit
+			}
+			return nil
+		})
+		if err != nil && err != errScanLimit {
+			return err
+		}
+		sort.Strings(keys)
+		t := table{header: []string{"KEY"}}
+		for _, key := range keys {
+			t.rows = append(t.rows, []string{key})
+		}
+		return c.write(keys, t)
+	}
+}
+
+func ttlCommand(flags *pflag.FlagSet) func(ctx context.Context, c *cli, args []string) error {
+	return func(ctx context.Context, c *cli, args []string) error {
+		var infos []keyInfo
+		t := table{header: []string{"KEY", "TTL"}}
+		for _, key := range args {
+			ttl, err := c.remote.TTL(ctx, key)
+			info := keyInfo{Key: key, Exists: err == nil, TTL: formatTTL(ttl)}
+			cell := info.tableTTL()
+			switch {
+			case err == redis.ErrNil:
+				cell = "not found"
+			case err != nil:
+				return err
+			}
+			infos = append(infos, info)
+			t.rows = append(t.rows, []string{key, cell})
+		}
+		return c.write(infos, t)
+	}
+}
+
+// purgeResult describes the keys removed by a purge
+type purgeResult struct {
+	Namespace string `json:"namespace,omitempty"`
+	Deleted   int    `json:"deleted"`
+}
+
+func purgeCommand(flags *pflag.FlagSet) func(ctx context.Context, c *cli, args []string) error {
+	var namespace string
+	flags.StringVar(&namespace, "namespace", "", "Prefix of the keys to delete")
+	return func(ctx context.Context, c *cli, args []string) error {
+		// Deliberately no way to flush the whole cluster, which other services share
+		if namespace == "" {
+			return fmt.Errorf("--namespace is required")
+		}
+		deleted, err := c.remote.PurgeNamespace(ctx, namespace)
+		if err != nil {
+			return err
+		}
+		return c.write(purgeResult{Namespace: namespace, Deleted: deleted}, table{
+			header: []string{"NAMESPACE", "DELETED"},
+			rows:   [][]string{{namespace, strconv.Itoa(deleted)}},
+		})
+	}
+}
+
+// nodeStats describes a single Redis node
+type nodeStats struct {
+	Addr             string  `json:"addr"`
+	Keys             int64   `json:"keys"`
+	UsedMemory       int64   `json:"used_memory"`
+	ConnectedClients int64   `json:"connected_clients"`
+	KeyspaceHits     int64   `json:"keyspace_hits"`
+	KeyspaceMisses   int64   `json:"keyspace_misses"`
+	HitRate          float64 `json:"hit_rate"`
+	ExpiredKeys      int64   `json:"expired_keys"`
+	EvictedKeys      int64   `json:"evicted_keys"`
+}
+
+func statsCommand(flags *pflag.FlagSet) func(ctx context.Context, c *cli, args []string) error {
+	return func(ctx context.Context, c *cli, args []string) error {
+		stats, err := c.remote.Stats(ctx)
+		if err != nil {
+			return err
+		}
+		nodes := make([]nodeStats, 0, len(stats))
+		t := table{header: []string{
+			"ADDR", "KEYS", "USED_MEMORY", "CLIENTS", "HITS", "MISSES", "HIT_RATE", "EXPIRED", "EVICTED",
+		}}
+		for _, s := range stats {
+			node := nodeStats{
+				Addr:             s.Addr,
+				Keys:             s.Keys,
+				UsedMemory:       s.UsedMemory,
+				ConnectedClients: s.ConnectedClients,
+				KeyspaceHits:     s.KeyspaceHits,
+				KeyspaceMisses:   s.KeyspaceMisses,
+				ExpiredKeys:      s.ExpiredKeys,
+				EvictedKeys:      s.EvictedKeys,
+			}
+			if lookups := s.KeyspaceHits + s.KeyspaceMisses; lookups > 0 {
+				node.HitRate = float64(s.KeyspaceHits) / float64(lookups)
+			}
+			nodes = append(nodes, node)
+			t.rows = append(t.rows, []string{
+				node.Addr,
+				strconv.FormatInt(node.Keys, 10),
+				strconv.FormatInt(node.UsedMemory, 10),
+				strconv.FormatInt(node.ConnectedClients, 10),
+				strconv.FormatInt(node.KeyspaceHits, 10),
+				strconv.FormatInt(node.KeyspaceMisses, 10),
+				strconv.FormatFloat(node.HitRate, 'f', 3, 64),
+				strconv.FormatInt(node.ExpiredKeys, 10),
+				strconv.FormatInt(node.EvictedKeys, 10),
+			})
+		}
+		return c.write(nodes, t)
+	}
+}
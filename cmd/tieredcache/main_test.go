@@ -0,0 +1,408 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/alicebob/miniredis/server"
+	"github.com/gomodule/redigo/redis"
+	"github.com/spothero/tieredcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer is shared by every test, since the connections of remote caches are shared by the
+// whole process
+var testServer *miniredis.Miniredis
+
+// clusterServer poses as a cluster node serving every slot in front of testServer, since miniredis
+// does not implement cluster commands
+var clusterServer *server.Server
+
+// proxiedCommands are the commands clusterServer forwards to testServer
+var proxiedCommands = []string{
+	"DBSIZE", "DEL", "DISCARD", "EVAL", "EVALSHA", "EXEC", "EXISTS", "GET", "GETRANGE", "GETSET",
+	"INCRBY", "INFO", "KEYS", "MULTI", "PERSIST", "PEXPIRE", "PING", "PTTL", "SCAN", "SCRIPT",
+	"SET", "UNWATCH", "WATCH",
+}
+
+func TestMain(m *testing.M) {
+	var err error
+	if testServer, err = miniredis.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if clusterServer, err = newClusterServer(testServer); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	clusterServer.Close()
+	testServer.Close()
+	os.Exit(code)
+}
+
+// newClusterServer starts a single-node cluster that forwards commands to backend, with a
+// connection to backend per client so that transactions keep working
+func newClusterServer(backend *miniredis.Miniredis) (*server.Server, error) {
+	srv, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	err = srv.Register("CLUSTER", func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(1)
+		c.WriteLen(3)
+		c.WriteInt(0)
+		c.WriteInt(16383)
+		c.WriteLen(2)
+		c.WriteBulk(srv.Addr().IP.String())
+		c.WriteInt(srv.Addr().Port)
+	})
+	for _, name := range proxiedCommands {
+		if err != nil {
+			break
+		}
+		err = srv.Register(name, func(c *server.Peer, cmd string, args []string) {
+			if c.Ctx == nil {
+				conn, err := redis.Dial("tcp", backend.Addr())
+				if err != nil {
+					c.WriteError(err.Error())
+					return
+				}
+				c.Ctx = conn
+			}
+			commandArgs := make([]interface{}, len(args))
+			for i, arg := range args {
+				commandArgs[i] = arg
+			}
+			reply, err := c.Ctx.(redis.Conn).Do(cmd, commandArgs...)
+			writeReply(c, reply, err)
+		})
+	}
+	return srv, err
+}
+
+// writeReply writes a reply received from Redis back to a client
+func writeReply(c *server.Peer, reply interface{}, err error) {
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+	switch reply := reply.(type) {
+	case nil:
+		c.WriteNull()
+	case string:
+		c.WriteInline(reply)
+	case []byte:
+		c.WriteBulk(string(reply))
+	case int64:
+		c.WriteInt(int(reply))
+	case redis.Error:
+		c.WriteError(reply.Error())
+	case []interface{}:
+		c.WriteLen(len(reply))
+		for _, element := range reply {
+			writeReply(c, element, nil)
+		}
+	}
+}
+
+// runCLI runs the CLI against the test server with a fresh database and returns its exit code,
+// output and errors
+func runCLI(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	args = append(args, "--cache-urls", clusterServer.Addr().String(), "--remote-cache-tracing-enabled=false")
+	code := run(context.Background(), args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// setGob stores value at key gob-encoded, as a service using the library would
+func setGob(t *testing.T, key string, value interface{}) {
+	encoded, err := (&tieredcache.GobCacheEncoder{}).Encode(value)
+	require.NoError(t, err)
+	require.NoError(t, testServer.Set(key, string(encoded)))
+}
+
+func TestRunUsage(t *testing.T) {
+	var stdout, errs bytes.Buffer
+	assert.Equal(t, 2, run(context.Background(), nil, &stdout, &errs))
+	assert.Contains(t, errs.String(), "Usage: tieredcache <command>")
+
+	stdout.Reset()
+	assert.Equal(t, 0, run(context.Background(), []string{"help"}, &stdout, &errs))
+	assert.Contains(t, stdout.String(), "Commands:")
+
+	code, _, stderr := runCLI("frobnicate")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, `unknown command "frobnicate"`)
+
+	code, _, stderr = runCLI("get")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "Usage: tieredcache get [flags] KEY")
+
+	code, _, stderr = runCLI("get", "--bogus")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "unknown flag: --bogus")
+
+	code, _, stderr = runCLI("get", "key", "--output", "yaml")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, `unknown output format "yaml"`)
+
+	code, _, stderr = runCLI("get", "key", "--encoder", "xml")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, `unknown encoder "xml"`)
+}
+
+type reservation struct {
+	Facility string
+	Spaces   int
+	Start    time.Time
+}
+
+func TestGet(t *testing.T) {
+	testServer.FlushAll()
+	setGob(t, "reservation:1", &reservation{Facility: "Garage", Spaces: 2})
+	testServer.SetTTL("reservation:1", time.Minute)
+
+	code, stdout, stderr := runCLI("get", "reservation:1", "--output", "json")
+	require.Equal(t, 0, code, stderr)
+	var info keyInfo
+	require.NoError(t, json.Unmarshal([]byte(stdout), &info))
+	assert.Equal(t, "reservation:1", info.Key)
+	assert.True(t, info.Exists)
+	assert.Equal(t, "1m0s", info.TTL)
+	assert.NotZero(t, info.Size)
+	assert.Equal(t, map[string]interface{}{"Facility": "Garage", "Spaces": 2.0}, info.Value)
+
+	code, stdout, _ = runCLI("get", "reservation:1")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "KEY")
+	assert.Contains(t, stdout, `{"Facility":"Garage","Spaces":2}`)
+
+	// Values that are not gob-encoded can be printed raw
+	testServer.Set("plain", "text")
+	code, _, stderr = runCLI("get", "plain")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "use --encoder raw")
+	code, stdout, _ = runCLI("get", "plain", "--encoder", "raw")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "text")
+
+	code, _, stderr = runCLI("get", "missing")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, `key "missing" not found`)
+}
+
+func TestGetSigned(t *testing.T) {
+	testServer.FlushAll()
+	encoder, err := tieredcache.NewSigningCacheEncoder(&tieredcache.GobCacheEncoder{}, []byte("secret"))
+	require.NoError(t, err)
+	value := "signed"
+	encoded, err := encoder.EncodeKey("key", &value)
+	require.NoError(t, err)
+	testServer.Set("key", string(encoded))
+
+	code, stdout, stderr := runCLI("get", "key", "--signing-secret", "secret")
+	require.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, "signed")
+
+	code, _, _ = runCLI("get", "key", "--signing-secret", "wrong")
+	assert.Equal(t, 1, code)
+}
+
+func TestSet(t *testing.T) {
+	testServer.FlushAll()
+	tests := []struct {
+		args     []string
+		target   interface{}
+		expected interface{}
+	}{
+		{[]string{"value"}, new(string), "value"},
+		{[]string{"42", "--type", "int"}, new(int), 42},
+		{[]string{"1.5", "--type", "float"}, new(float64), 1.5},
+		{[]string{"true", "--type", "bool"}, new(bool), true},
+		{[]string{`{"Facility":"Garage"}`, "--type", "json"}, new(map[string]interface{}),
+			map[string]interface{}{"Facility": "Garage"}},
+	}
+	for _, test := range tests {
+		t.Run(test.args[0], func(t *testing.T) {
+			args := append([]string{"set", "key"}, test.args...)
+			code, _, stderr := runCLI(args...)
+			require.Equal(t, 0, code, stderr)
+			stored, err := testServer.Get("key")
+			require.NoError(t, err)
+			require.NoError(t, (&tieredcache.GobCacheEncoder{}).Decode([]byte(stored), test.target))
+			assert.Equal(t, test.expected, reflectElem(test.target))
+			assert.Zero(t, testServer.TTL("key"))
+		})
+	}
+
+	code, stdout, stderr := runCLI("set", "expiring", "value", "--ttl", "1m", "--output", "json")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, time.Minute, testServer.TTL("expiring"))
+	assert.Contains(t, stdout, `"ttl": "1m0s"`)
+
+	code, _, stderr = runCLI("set", "key", "nan", "--type", "int")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "invalid syntax")
+	code, _, stderr = runCLI("set", "key", "value", "--type", "uuid")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, `unknown value type "uuid"`)
+}
+
+// reflectElem returns the value target points to
+func reflectElem(target interface{}) interface{} {
+	switch v := target.(type) {
+	case *string:
+		return *v
+	case *int:
+		return *v
+	case *float64:
+		return *v
+	case *bool:
+		return *v
+	case *map[string]interface{}:
+		return *v
+	}
+	return nil
+}
+
+func TestSetAndGetEncoded(t *testing.T) {
+	testServer.FlushAll()
+	flags := []string{"--encoder", "json", "--compression", "gzip", "--signing-secret", "secret"}
+	code, _, stderr := runCLI(append([]string{"set", "key", `[1,2]`, "--type", "json"}, flags...)...)
+	require.Equal(t, 0, code, stderr)
+	code, stdout, stderr := runCLI(append([]string{"get", "key"}, flags...)...)
+	require.Equal(t, 0, code, stderr)
+	assert.Contains(t, stdout, "[1,2]")
+}
+
+func TestDel(t *testing.T) {
+	testServer.FlushAll()
+	testServer.Set("key", "value")
+
+	code, stdout, stderr := runCLI("del", "key", "missing", "--output", "json")
+	require.Equal(t, 0, code, stderr)
+	var infos []keyInfo
+	require.NoError(t, json.Unmarshal([]byte(stdout), &infos))
+	assert.Equal(t, []keyInfo{{Key: "key", Exists: true}, {Key: "missing"}}, infos)
+	assert.False(t, testServer.Exists("key"))
+
+	testServer.Set("key", "value")
+	code, stdout, _ = runCLI("del", "key", "missing")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "deleted")
+	assert.Contains(t, stdout, "not found")
+
+	// Keys are deleted literally, not as patterns
+	testServer.Set("key", "value")
+	code, stdout, stderr = runCLI("del", "k*", "--output", "json")
+	require.Equal(t, 0, code, stderr)
+	require.NoError(t, json.Unmarshal([]byte(stdout), &infos))
+	assert.Equal(t, []keyInfo{{Key: "k*"}}, infos)
+	assert.True(t, testServer.Exists("key"))
+}
+
+func TestScan(t *testing.T) {
+	testServer.FlushAll()
+	for _, key := range []string{"user:2", "user:1", "item:1"} {
+		testServer.Set(key, "value")
+	}
+
+	code, stdout, stderr := runCLI("scan", "--pattern", "user:*", "--output", "json")
+	require.Equal(t, 0, code, stderr)
+	var keys []string
+	require.NoError(t, json.Unmarshal([]byte(stdout), &keys))
+	assert.Equal(t, []string{"user:1", "user:2"}, keys)
+
+	code, stdout, _ = runCLI("scan", "--limit", "1", "--output", "json")
+	assert.Equal(t, 0, code)
+	require.NoError(t, json.Unmarshal([]byte(stdout), &keys))
+	assert.Len(t, keys, 1)
+
+	code, stdout, _ = runCLI("scan", "--pattern", "none:*", "--output", "json")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "[]\n", stdout)
+
+	code, stdout, _ = runCLI("scan")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "KEY\nitem:1\nuser:1\nuser:2\n", stdout)
+}
+
+func TestTTL(t *testing.T) {
+	testServer.FlushAll()
+	testServer.Set("expiring", "value")
+	testServer.SetTTL("expiring", time.Minute)
+	testServer.Set("persistent", "value")
+
+	code, stdout, stderr := runCLI("ttl", "expiring", "persistent", "missing", "--output", "json")
+	require.Equal(t, 0, code, stderr)
+	var infos []keyInfo
+	require.NoError(t, json.Unmarshal([]byte(stdout), &infos))
+	assert.Equal(t, []keyInfo{
+		{Key: "expiring", Exists: true, TTL: "1m0s"},
+		{Key: "persistent", Exists: true},
+		{Key: "missing"},
+	}, infos)
+
+	code, stdout, _ = runCLI("ttl", "persistent", "missing")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "KEY         TTL\npersistent  none\nmissing     not found\n", stdout)
+}
+
+func TestPurge(t *testing.T) {
+	testServer.FlushAll()
+	for _, key := range []string{"user:1", "user:2", "{009372}user:1:lease", "item:1"} {
+		testServer.Set(key, "value")
+	}
+
+	code, stdout, stderr := runCLI("purge", "--namespace", "user:", "--output", "json")
+	require.Equal(t, 0, code, stderr)
+	var result purgeResult
+	require.NoError(t, json.Unmarshal([]byte(stdout), &result))
+	assert.Equal(t, purgeResult{Namespace: "user:", Deleted: 3}, result)
+	assert.Equal(t, []string{"item:1"}, testServer.Keys())
+
+	code, _, stderr = runCLI("purge")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "--namespace is required")
+	code, _, _ = runCLI("purge", "--all")
+	assert.Equal(t, 2, code)
+	assert.Equal(t, []string{"item:1"}, testServer.Keys())
+}
+
+func TestStats(t *testing.T) {
+	testServer.FlushAll()
+	testServer.Set("key", "value")
+
+	code, stdout, stderr := runCLI("stats", "--output", "json")
+	require.Equal(t, 0, code, stderr)
+	var nodes []nodeStats
+	require.NoError(t, json.Unmarshal([]byte(stdout), &nodes))
+	assert.Equal(t, []nodeStats{{Addr: clusterServer.Addr().String(), Keys: 1}}, nodes)
+
+	code, stdout, _ = runCLI("stats")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stdout, "HIT_RATE")
+	assert.Contains(t, stdout, clusterServer.Addr().String())
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats
+const (
+	outputJSON  = "json"
+	outputTable = "table"
+)
+
+// table is the tabular form of the output of a command
+type table struct {
+	header []string
+	rows   [][]string
+}
+
+// writeOutput writes value to w as indented JSON, or t as a table with aligned columns
+func writeOutput(w io.Writer, format string, value interface{}, t table) error {
+	switch format {
+	case outputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case outputTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(t.header, "\t"))
+		for _, row := range t.rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+// formatValue formats a decoded value for a table cell. Strings are printed as they are unless they
+// would break the table, in which case they are quoted, and other values as compact JSON.
+func formatValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		if strings.ContainsAny(s, "\t\r\n") {
+			return strconv.Quote(s)
+		}
+		return s
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteOutput(t *testing.T) {
+	value := map[string]int{"keys": 1}
+	t1 := table{header: []string{"NAME", "KEYS"}, rows: [][]string{{"node-one", "1"}, {"n2", "10"}}}
+
+	var buf bytes.Buffer
+	require.NoError(t, writeOutput(&buf, outputJSON, value, t1))
+	assert.Equal(t, "{\n  \"keys\": 1\n}\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, writeOutput(&buf, outputTable, value, t1))
+	assert.Equal(t, "NAME      KEYS\nnode-one  1\nn2        10\n", buf.String())
+
+	assert.Error(t, writeOutput(&buf, "yaml", value, t1))
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected string
+	}{
+		{"string", "value", "value"},
+		{"multiline string", "a\tb\n", `"a\tb\n"`},
+		{"number", int64(1), "1"},
+		{"map", map[string]interface{}{"b": 1, "a": "x"}, `{"a":"x","b":1}`},
+		{"bytes", []byte("jpg"), `"anBn"`},
+		{"nil", nil, "null"},
+		{"unencodable", complex(1, 2), "(1+2i)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, formatValue(test.value))
+		})
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultMaxDecompressedSize is the largest value in bytes a CompressingCacheEncoder decompresses
+// when no limit is configured
+const DefaultMaxDecompressedSize = 64 * 1024 * 1024
+
+// CompressionAlgorithm identifies the algorithm used to compress cached values
+type CompressionAlgorithm byte
+
+const (
+	// CompressionNone marks a value that was stored without compression
+	CompressionNone CompressionAlgorithm = iota
+	// CompressionGzip compresses values with compress/gzip
+	CompressionGzip
+	// CompressionSnappy compresses values with snappy block encoding
+	CompressionSnappy
+	// CompressionZstd compresses values with zstandard
+	CompressionZstd
+)
+
+// String returns the name of the compression algorithm
+func (ca CompressionAlgorithm) String() string {
+	switch ca {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(ca))
+}
+
+// CompressionMetrics defines an interface for recording the effect of compression on cached values
+type CompressionMetrics interface {
+	Compressed(originalBytes, storedBytes int)
+}
+
+// CompressingCacheEncoder wraps another CacheEncoder and compresses its output. Every value is
+// prefixed with a single header byte recording the CompressionAlgorithm used, so values stored
+// raw (because they were below Threshold, or did not shrink when compressed) and compressed values
+// can both be decoded.
+type CompressingCacheEncoder struct {
+	Encoder   CacheEncoder
+	Algorithm CompressionAlgorithm
+	Threshold int // Values smaller than Threshold bytes are stored uncompressed
+	// MaxDecompressedSize is the largest value in bytes Decode decompresses, so that a small
+	// corrupt or malicious value cannot expand to fill memory. Larger values are stored
+	// uncompressed. Zero uses DefaultMaxDecompressedSize. Set it before the first call to
+	// Decode.
+	MaxDecompressedSize int
+	Metrics             CompressionMetrics
+	zstdEnc             *zstd.Encoder
+	zstdDecoders        sync.Pool // Of *zstd.Decoder, reused between calls to Decode
+}
+
+// NewCompressingCacheEncoder constructs and returns a CompressingCacheEncoder wrapping encoder.
+// metrics may be nil.
+func NewCompressingCacheEncoder(
+	encoder CacheEncoder,
+	algorithm CompressionAlgorithm,
+	threshold int,
+	metrics CompressionMetrics,
+) (*CompressingCacheEncoder, error) {
+	cce := &CompressingCacheEncoder{
+		Encoder:   encoder,
+		Algorithm: algorithm,
+		Threshold: threshold,
+		Metrics:   metrics,
+	}
+	switch algorithm {
+	case CompressionNone, CompressionGzip, CompressionSnappy, CompressionZstd:
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %v", algorithm)
+	}
+	if algorithm == CompressionZstd {
+		var err error
+		if cce.zstdEnc, err = zstd.NewWriter(nil); err != nil {
+			return nil, err
+		}
+	}
+	return cce, nil
+}
+
+// maxDecompressedSize returns the configured decompression limit, or the default if none is set
+func (cce *CompressingCacheEncoder) maxDecompressedSize() int {
+	if cce.MaxDecompressedSize <= 0 {
+		return DefaultMaxDecompressedSize
+	}
+	return cce.MaxDecompressedSize
+}
+
+// Encode encodes the value with the wrapped encoder and compresses the result if it is at least
+// Threshold bytes long. Values that compression would not shrink, and values larger than
+// MaxDecompressedSize, are stored uncompressed. value must be a pointer.
+func (cce *CompressingCacheEncoder) Encode(value interface{}) ([]byte, error) {
+	data, err := cce.Encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	raw := func() []byte {
+		return append([]byte{byte(CompressionNone)}, data...)
+	}
+	if cce.Algorithm == CompressionNone || len(data) < cce.Threshold || len(data) > cce.maxDecompressedSize() {
+		return raw(), nil
+	}
+	compressed, err := cce.compress(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) > len(data) {
+		// Both forms carry a header byte, so the raw form is no larger
+		return raw(), nil
+	}
+	if cce.Metrics != nil {
+		cce.Metrics.Compressed(len(data), len(compressed))
+	}
+	return compressed, nil
+}
+
+// Decode decompresses the cached value, if necessary, and decodes it with the wrapped encoder.
+// target must be a pointer.
+func (cce *CompressingCacheEncoder) Decode(cachedValue []byte, target interface{}) error {
+	if len(cachedValue) == 0 {
+		return fmt.Errorf("cached value is missing its compression header")
+	}
+	data, err := cce.decompress(CompressionAlgorithm(cachedValue[0]), cachedValue[1:])
+	if err != nil {
+		return err
+	}
+	return cce.Encoder.Decode(data, target)
+}
+
+// compress compresses data with the configured algorithm and returns it with the header byte
+func (cce *CompressingCacheEncoder) compress(data []byte) ([]byte, error) {
+	header := []byte{byte(cce.Algorithm)}
+	switch cce.Algorithm {
+	case CompressionGzip:
+		buf := bytes.NewBuffer(header)
+		zw := gzip.NewWriter(buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return append(header, snappy.Encode(nil, data)...), nil
+	case CompressionZstd:
+		if cce.zstdEnc == nil {
+			return nil, fmt.Errorf("zstd encoder not initialized, use NewCompressingCacheEncoder")
+		}
+		return cce.zstdEnc.EncodeAll(data, header), nil
+	}
+	return nil, fmt.Errorf("unsupported compression algorithm %v", cce.Algorithm)
+}
+
+// decompress reverses compress for a payload stored with the given algorithm. Payloads that would
+// decompress to more than MaxDecompressedSize bytes are rejected without being fully expanded.
+func (cce *CompressingCacheEncoder) decompress(algorithm CompressionAlgorithm, payload []byte) ([]byte, error) {
+	maxSize := cce.maxDecompressedSize()
+	switch algorithm {
+	case CompressionNone:
+		return payload, nil
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return readLimited(zr, maxSize)
+	case CompressionSnappy:
+		size, err := snappy.DecodedLen(payload)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxSize {
+			return nil, errDecompressedTooLarge(maxSize)
+		}
+		return snappy.Decode(nil, payload)
+	case CompressionZstd:
+		zr, ok := cce.zstdDecoders.Get().(*zstd.Decoder)
+		if !ok {
+			var err error
+			zr, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxSize)))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := zr.Reset(bytes.NewReader(payload)); err != nil {
+			if err == zstd.ErrDecoderSizeExceeded {
+				err = errDecompressedTooLarge(maxSize)
+			}
+			return nil, err
+		}
+		data, err := readLimited(zr, maxSize)
+		if err == zstd.ErrDecoderSizeExceeded {
+			err = errDecompressedTooLarge(maxSize)
+		}
+		// Release the payload before pooling the decoder
+		zr.Reset(nil)
+		cce.zstdDecoders.Put(zr)
+		return data, err
+	}
+	return nil, fmt.Errorf("unsupported compression algorithm %v", algorithm)
+}
+
+// readLimited reads all of r, failing once more than maxSize bytes have been read
+func readLimited(r io.Reader, maxSize int) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSize {
+		return nil, errDecompressedTooLarge(maxSize)
+	}
+	return data, nil
+}
+
+// errDecompressedTooLarge returns the error for a value that decompresses to more than maxSize
+// bytes
+func errDecompressedTooLarge(maxSize int) error {
+	return fmt.Errorf("decompressed value exceeds the limit of %d bytes", maxSize)
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressingCacheEncoder_EncodeDecode(t *testing.T) {
+	result := testEncodable{
+		A: 5,
+		B: map[int]int{0: 5, 1: 6, 2: 7},
+		C: &testNestedEncodable{strings.Repeat("compress me ", 100)},
+	}
+	for _, algorithm := range []CompressionAlgorithm{
+		CompressionNone, CompressionGzip, CompressionSnappy, CompressionZstd,
+	} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			enc, err := NewCompressingCacheEncoder(&GobCacheEncoder{}, algorithm, 0, nil)
+			require.NoError(t, err)
+			data, err := enc.Encode(result)
+			require.NoError(t, err)
+			assert.Equal(t, byte(algorithm), data[0])
+			decodedResult := testEncodable{}
+			require.NoError(t, enc.Decode(data, &decodedResult))
+			assert.Equal(t, result, decodedResult)
+		})
+	}
+}
+
+// Test that values below the threshold are stored raw and still decode
+func TestCompressingCacheEncoder_Threshold(t *testing.T) {
+	enc, err := NewCompressingCacheEncoder(&GobCacheEncoder{}, CompressionGzip, 1<<20, nil)
+	require.NoError(t, err)
+	data, err := enc.Encode(testEncodable{A: 1})
+	require.NoError(t, err)
+	assert.Equal(t, byte(CompressionNone), data[0])
+	decodedResult := testEncodable{}
+	require.NoError(t, enc.Decode(data, &decodedResult))
+	assert.Equal(t, 1, decodedResult.A)
+}
+
+// Test that a value written with one algorithm can be read by an encoder configured with another
+func TestCompressingCacheEncoder_DecodeOtherAlgorithm(t *testing.T) {
+	snappyEnc, err := NewCompressingCacheEncoder(&GobCacheEncoder{}, CompressionSnappy, 0, nil)
+	require.NoError(t, err)
+	zstdEnc, err := NewCompressingCacheEncoder(&GobCacheEncoder{}, CompressionZstd, 0, nil)
+	require.NoError(t, err)
+	data, err := zstdEnc.Encode(testEncodable{A: 7, C: &testNestedEncodable{strings.Repeat("zstd ", 100)}})
+	require.NoError(t, err)
+	require.Equal(t, byte(CompressionZstd), data[0])
+	decodedResult := testEncodable{}
+	require.NoError(t, snappyEnc.Decode(data, &decodedResult))
+	assert.Equal(t, 7, decodedResult.A)
+}
+
+// Test that values which do not shrink when compressed are stored raw
+func TestCompressingCacheEncoder_Incompressible(t *testing.T) {
+	value := make([]byte, 1000)
+	_, err := rand.Read(value)
+	require.NoError(t, err)
+	for _, algorithm := range []CompressionAlgorithm{CompressionGzip, CompressionSnappy, CompressionZstd} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			enc, err := NewCompressingCacheEncoder(&GobCacheEncoder{}, algorithm, 0, nil)
+			require.NoError(t, err)
+			data, err := enc.Encode(value)
+			require.NoError(t, err)
+			assert.Equal(t, byte(CompressionNone), data[0])
+			var decoded []byte
+			require.NoError(t, enc.Decode(data, &decoded))
+			assert.Equal(t, value, decoded)
+		})
+	}
+}
+
+// Test that values expanding past MaxDecompressedSize are rejected, and that values larger than
+// the limit are stored raw so they remain readable
+func TestCompressingCacheEncoder_MaxDecompressedSize(t *testing.T) {
+	value := strings.Repeat("a", 10000)
+	for _, algorithm := range []CompressionAlgorithm{CompressionGzip, CompressionSnappy, CompressionZstd} {
+		t.Run(algorithm.String(), func(t *testing.T) {
+			enc, err := NewCompressingCacheEncoder(&GobCacheEncoder{}, algorithm, 0, nil)
+			require.NoError(t, err)
+			data, err := enc.Encode(value)
+			require.NoError(t, err)
+			require.Equal(t, byte(algorithm), data[0])
+
+			enc.MaxDecompressedSize = 1000
+			var decoded string
+			err = enc.Decode(data, &decoded)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "exceeds the limit of 1000 bytes")
+
+			data, err = enc.Encode(value)
+			require.NoError(t, err)
+			assert.Equal(t, byte(CompressionNone), data[0])
+			require.NoError(t, enc.Decode(data, &decoded))
+			assert.Equal(t, value, decoded)
+		})
+	}
+}
+
+func TestCompressingCacheEncoder_Metrics(t *testing.T) {
+	mcm := &MockCacheMetrics{}
+	mcm.On("Compressed", mock.Anything, mock.Anything)
+	enc, err := NewCompressingCacheEncoder(&GobCacheEncoder{}, CompressionGzip, 0, mcm)
+	require.NoError(t, err)
+	_, err = enc.Encode(strings.Repeat("a", 1000))
+	require.NoError(t, err)
+	mcm.AssertCalled(t, "Compressed", mock.Anything, mock.Anything)
+	original := mcm.Calls[0].Arguments.Int(0)
+	stored := mcm.Calls[0].Arguments.Int(1)
+	assert.True(t, stored < original)
+}
+
+func TestCompressingCacheEncoder_Errors(t *testing.T) {
+	_, err := NewCompressingCacheEncoder(&GobCacheEncoder{}, CompressionAlgorithm(42), 0, nil)
+	assert.Error(t, err)
+
+	enc, err := NewCompressingCacheEncoder(&GobCacheEncoder{}, CompressionGzip, 0, nil)
+	require.NoError(t, err)
+	assert.Error(t, enc.Decode([]byte{}, &testEncodable{}))
+	assert.Error(t, enc.Decode([]byte{42, 1, 2, 3}, &testEncodable{}))
+	assert.Error(t, enc.Decode([]byte{byte(CompressionGzip), 1, 2, 3}, &testEncodable{}))
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// DefaultCounterFlushInterval is the interval between flushes of a CounterBuffer when none is
+// configured
+const DefaultCounterFlushInterval = time.Second
+
+// incrScript adds ARGV[1] to the counter at KEYS[1] and returns its new value. A counter created
+// by the call expires after ARGV[2] milliseconds if ARGV[2] is positive.
+var incrScript = redis.NewScript(1, `
+local created = redis.call("EXISTS", KEYS[1]) == 0
+local value = redis.call("INCRBY", KEYS[1], ARGV[1])
+if created and tonumber(ARGV[2]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return value
+`)
+
+// Counter is implemented by caches that hold atomic counters. Counters are stored as decimal
+// integers rather than through the cache's encoder, so they are read with GetBytes or by
+// incrementing by zero.
+type Counter interface {
+	// IncrWithTTL adds delta to the counter at key, creating it at zero if it is missing, and
+	// returns the new value. A counter created by the call expires after ttl if ttl is positive.
+	IncrWithTTL(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+}
+
+// BatchIncrementer is implemented by caches that can add to many counters at once
+type BatchIncrementer interface {
+	IncrBatch(ctx context.Context, deltas map[string]int64, ttl time.Duration) error
+}
+
+// Incr adds delta to the counter at key in remote cache, creating it at zero if it is missing, and
+// returns the new value
+func (rc RemoteCache) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	return rc.IncrWithTTL(ctx, key, delta, 0)
+}
+
+// Decr subtracts delta from the counter at key in remote cache, creating it at zero if it is
+// missing, and returns the new value
+func (rc RemoteCache) Decr(ctx context.Context, key string, delta int64) (int64, error) {
+	return rc.IncrWithTTL(ctx, key, -delta, 0)
+}
+
+// IncrWithTTL is like Incr, but a counter created by the call expires after ttl if ttl is
+// positive. The expiry of an existing counter is left unchanged.
+func (rc RemoteCache) IncrWithTTL(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	var value int64
+	command := "INCRBY"
+	if ttl > 0 {
+		command = "EVALSHA"
+	}
+	err := rc.observe(ctx, OperationIncr, command, key, func(conn redis.Conn) (Result, error) {
+		var err error
+		if ttl > 0 {
+			value, err = redis.Int64(incrScript.Do(conn, key, delta, expiryMilliseconds(ttl)))
+		} else {
+			value, err = redis.Int64(conn.Do("INCRBY", key, delta))
+		}
+		return resultOf(err, ResultOK, ResultError), err
+	})
+	return value, err
+}
+
+// IncrBatch adds each delta to its counter, pipelining the commands. Counters created by the batch
+// expire after ttl if ttl is positive.
+func (rc RemoteCache) IncrBatch(ctx context.Context, deltas map[string]int64, ttl time.Duration) error {
+	start := time.Now()
+	var span Span
+	if rc.TracingEnabled {
+		span, _ = startRemoteSpan(ctx, rc.Tracer, "remote-cache-incr-batch", "INCRBY")
+		span.SetTag("keys", len(deltas))
+	}
+	keys := make([]string, 0, len(deltas))
+	for key := range deltas {
+		keys = append(keys, key)
+	}
+	err := rc.pipeline(keys, func(conn redis.Conn, key string) error {
+		if ttl > 0 {
+			return incrScript.Send(conn, key, deltas[key], expiryMilliseconds(ttl))
+		}
+		return conn.Send("INCRBY", key, deltas[key])
+	}, nil)
+	result := resultOf(err, ResultOK, ResultError)
+	observeOperation(rc.Metrics, TierRemote, OperationIncr, result, start)
+	finishSpan(span, OperationIncr, result)
+	return err
+}
+
+// CounterBufferConfig is the necessary configuration for instantiating a CounterBuffer
+type CounterBufferConfig struct {
+	FlushInterval time.Duration // Interval between flushes to remote cache
+	TTL           time.Duration // Expiry of counters created by a flush, zero for none
+}
+
+// CounterBuffer aggregates counter increments in process and adds them to remote cache in batches,
+// so that a hot counter costs one remote command per flush rather than one per increment. It is
+// meant for high-volume counters that tolerate loss: increments buffered when the process exits
+// without calling Stop, and those in a flush that fails, are dropped.
+type CounterBuffer struct {
+	remote    Counter
+	config    CounterBufferConfig
+	keyFilter *KeyFilter // Told about flushed counters if set
+	mutex     sync.Mutex
+	pending   map[string]int64
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+}
+
+// NewCounterBuffer creates a CounterBuffer that flushes increments to remote every FlushInterval
+// until Stop is called
+func NewCounterBuffer(remote Counter, config CounterBufferConfig) (*CounterBuffer, error) {
+	return newCounterBuffer(remote, config, nil)
+}
+
+// newCounterBuffer is NewCounterBuffer for a buffer that also adds the keys it flushes to
+// keyFilter, which may be nil
+func newCounterBuffer(remote Counter, config CounterBufferConfig, keyFilter *KeyFilter) (*CounterBuffer, error) {
+	if config.FlushInterval < 0 || config.TTL < 0 {
+		return nil, fmt.Errorf("counter flush interval and TTL must not be negative")
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultCounterFlushInterval
+	}
+	cb := &CounterBuffer{
+		remote:    remote,
+		config:    config,
+		keyFilter: keyFilter,
+		pending:   make(map[string]int64),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go cb.run()
+	return cb, nil
+}
+
+// Add buffers delta for the counter at key until the next flush
+func (cb *CounterBuffer) Add(key string, delta int64) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.pending[key] += delta
+}
+
+// Pending returns the sum of the increments buffered for key that have not yet been flushed
+func (cb *CounterBuffer) Pending(key string) int64 {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return cb.pending[key]
+}
+
+// Flush adds every buffered increment to remote cache now
+func (cb *CounterBuffer) Flush(ctx context.Context) error {
+	cb.mutex.Lock()
+	pending := cb.pending
+	cb.pending = make(map[string]int64)
+	cb.mutex.Unlock()
+	for key, delta := range pending {
+		if delta == 0 {
+			delete(pending, key)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	// Counters are recorded before they are written, so the filter never rules out one that exists
+	for key := range pending {
+		cb.keyFilter.Add(key)
+	}
+	if remote, ok := cb.remote.(BatchIncrementer); ok {
+		return remote.IncrBatch(ctx, pending, cb.config.TTL)
+	}
+	var firstErr error
+	for key, delta := range pending {
+		if _, err := cb.remote.IncrWithTTL(ctx, key, delta, cb.config.TTL); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Stop flushes any buffered increments and ends periodic flushing. Stop is a no-op on a nil
+// *CounterBuffer.
+func (cb *CounterBuffer) Stop() {
+	if cb == nil {
+		return
+	}
+	cb.stopOnce.Do(func() {
+		close(cb.stop)
+	})
+	<-cb.done
+}
+
+// run flushes buffered increments every flush interval until stopped
+func (cb *CounterBuffer) run() {
+	defer close(cb.done)
+	ticker := time.NewTicker(cb.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cb.Flush(context.Background())
+		case <-cb.stop:
+			cb.Flush(context.Background())
+			return
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/mna/redisc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// counterRecorder is a Counter that records increments in memory
+type counterRecorder struct {
+	mutex  sync.Mutex
+	values map[string]int64
+	ttls   map[string]time.Duration
+}
+
+func (cr *counterRecorder) IncrWithTTL(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.values[key] += delta
+	cr.ttls[key] = ttl
+	return cr.values[key], nil
+}
+
+func TestRemoteIncrDecr(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mcm := &MockCacheMetrics{}
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Metrics: mcm}
+	ctx := context.Background()
+
+	value, err := rc.Incr(ctx, "counter", 5)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), value)
+	value, err = rc.Decr(ctx, "counter", 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+	assert.Zero(t, s.TTL("counter"))
+	data, err := s.Get("counter")
+	require.NoError(t, err)
+	assert.Equal(t, "3", data)
+
+	s.Set("not-a-counter", "value")
+	_, err = rc.Incr(ctx, "not-a-counter", 1)
+	assert.Error(t, err)
+}
+
+func TestRemoteIncrWithTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}}
+	ctx := context.Background()
+
+	// The TTL applies only to counters created by the call
+	value, err := rc.IncrWithTTL(ctx, "counter", 1, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+	assert.Equal(t, time.Minute, s.TTL("counter"))
+	value, err = rc.IncrWithTTL(ctx, "counter", 1, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), value)
+	assert.Equal(t, time.Minute, s.TTL("counter"))
+}
+
+func TestRemoteIncrBatch(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	s.Set("existing", "10")
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}}
+	ctx := context.Background()
+
+	require.NoError(t, rc.IncrBatch(ctx, map[string]int64{"existing": 5, "created": -2}, time.Minute))
+	existing, err := s.Get("existing")
+	require.NoError(t, err)
+	assert.Equal(t, "15", existing)
+	assert.Zero(t, s.TTL("existing"))
+	created, err := s.Get("created")
+	require.NoError(t, err)
+	assert.Equal(t, "-2", created)
+	assert.Equal(t, time.Minute, s.TTL("created"))
+
+	require.NoError(t, rc.IncrBatch(ctx, map[string]int64{"untimed": 1}, 0))
+	assert.Zero(t, s.TTL("untimed"))
+}
+
+func TestCounterBuffer(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}}
+	cb, err := NewCounterBuffer(rc, CounterBufferConfig{FlushInterval: time.Hour})
+	require.NoError(t, err)
+	defer cb.Stop()
+
+	// Increments to a counter are aggregated into one command per flush
+	for i := 0; i < 100; i++ {
+		cb.Add("views", 1)
+	}
+	cb.Add("likes", 2)
+	cb.Add("unchanged", 1)
+	cb.Add("unchanged", -1)
+	assert.Equal(t, int64(100), cb.Pending("views"))
+	before := s.CommandCount()
+	require.NoError(t, cb.Flush(context.Background()))
+	assert.Equal(t, 2, s.CommandCount()-before)
+	views, err := s.Get("views")
+	require.NoError(t, err)
+	assert.Equal(t, "100", views)
+	assert.False(t, s.Exists("unchanged"))
+	assert.Zero(t, cb.Pending("views"))
+}
+
+func TestCounterBufferKeyFilter(t *testing.T) {
+	cr := &counterRecorder{values: make(map[string]int64), ttls: make(map[string]time.Duration)}
+	kf, err := NewKeyFilter(KeyFilterConfig{ExpectedKeys: 100, RebuildInterval: time.Minute})
+	require.NoError(t, err)
+	require.NoError(t, kf.Rebuild(context.Background(), sliceScanner{}))
+	cb, err := newCounterBuffer(cr, CounterBufferConfig{FlushInterval: time.Hour}, kf)
+	require.NoError(t, err)
+	defer cb.Stop()
+
+	// Flushed counters are no longer ruled out by the key filter
+	cb.Add("views", 1)
+	assert.False(t, kf.MayContain("views"))
+	require.NoError(t, cb.Flush(context.Background()))
+	assert.True(t, kf.MayContain("views"))
+}
+
+func TestCounterBufferStop(t *testing.T) {
+	cr := &counterRecorder{values: make(map[string]int64), ttls: make(map[string]time.Duration)}
+	cb, err := NewCounterBuffer(cr, CounterBufferConfig{FlushInterval: time.Hour, TTL: time.Minute})
+	require.NoError(t, err)
+
+	// Stopping flushes buffered increments
+	cb.Add("views", 3)
+	cb.Stop()
+	cb.Stop()
+	assert.Equal(t, int64(3), cr.values["views"])
+	assert.Equal(t, time.Minute, cr.ttls["views"])
+
+	_, err = NewCounterBuffer(cr, CounterBufferConfig{FlushInterval: -time.Second})
+	assert.Error(t, err)
+	var nilBuffer *CounterBuffer
+	nilBuffer.Stop()
+}
+
+func TestTieredIncr(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	encoder := &GobCacheEncoder{}
+	local := NewMockCache(encoder)
+	remote := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	mtc := TieredCache{Local: local, Remote: remote}
+	ctx := context.Background()
+
+	// Counters live in remote cache only, so stale local copies are removed
+	require.NoError(t, local.Set(ctx, "counter", "stale"))
+	value, err := mtc.Incr(ctx, "counter", 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), value)
+	assert.NotContains(t, local.Cache, "counter")
+	value, err = mtc.Decr(ctx, "counter", 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+	value, err = mtc.IncrWithTTL(ctx, "timed", 1, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+	assert.Equal(t, time.Minute, s.TTL("timed"))
+
+	_, err = TieredCache{Local: local, Remote: NewMockCache(encoder)}.Incr(ctx, "counter", 1)
+	assert.Error(t, err)
+}
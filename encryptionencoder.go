@@ -0,0 +1,133 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// encryptionEnvelopeVersion is the first byte of every value written by EncryptingCacheEncoder
+const encryptionEnvelopeVersion byte = 1
+
+// Keyring holds the AES keys used to encrypt and decrypt cached values. Values are always
+// encrypted with the key named by ActiveKeyID, but may be decrypted with any key in Keys. To rotate
+// keys, add the new key, make it active, and remove the old key once its values have expired.
+type Keyring struct {
+	ActiveKeyID string
+	Keys        map[string][]byte // AES-128, AES-192 or AES-256 keys, by key ID
+}
+
+// DecryptionError is returned when a cached value cannot be decrypted, either because it was
+// encrypted with a key that is no longer in the Keyring or because it has been corrupted
+type DecryptionError struct {
+	KeyID string
+	Err   error
+}
+
+// Error returns a description of the decryption failure
+func (de *DecryptionError) Error() string {
+	if de.KeyID == "" {
+		return fmt.Sprintf("failed to decrypt cached value: %v", de.Err)
+	}
+	return fmt.Sprintf("failed to decrypt cached value with key %q: %v", de.KeyID, de.Err)
+}
+
+// EncryptingCacheEncoder wraps another CacheEncoder and encrypts its output with AES-GCM. Each
+// value is stored in an envelope of the form
+//
+//	version (1 byte) | key ID length (1 byte) | key ID | nonce | ciphertext
+//
+// The version and key ID are authenticated along with the ciphertext.
+type EncryptingCacheEncoder struct {
+	Encoder     CacheEncoder
+	activeKeyID string
+	aeads       map[string]cipher.AEAD
+}
+
+// NewEncryptingCacheEncoder constructs and returns an EncryptingCacheEncoder wrapping encoder
+func NewEncryptingCacheEncoder(encoder CacheEncoder, keyring Keyring) (*EncryptingCacheEncoder, error) {
+	if _, ok := keyring.Keys[keyring.ActiveKeyID]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the keyring", keyring.ActiveKeyID)
+	}
+	ece := &EncryptingCacheEncoder{
+		Encoder:     encoder,
+		activeKeyID: keyring.ActiveKeyID,
+		aeads:       make(map[string]cipher.AEAD, len(keyring.Keys)),
+	}
+	for keyID, key := range keyring.Keys {
+		if len(keyID) > 255 {
+			return nil, fmt.Errorf("key ID %q is longer than 255 bytes", keyID)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %v", keyID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %v", keyID, err)
+		}
+		ece.aeads[keyID] = aead
+	}
+	return ece, nil
+}
+
+// Encode encodes the value with the wrapped encoder and encrypts the result with the active key.
+// value must be a pointer.
+func (ece *EncryptingCacheEncoder) Encode(value interface{}) ([]byte, error) {
+	data, err := ece.Encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	aead := ece.aeads[ece.activeKeyID]
+	header := append([]byte{encryptionEnvelopeVersion, byte(len(ece.activeKeyID))}, ece.activeKeyID...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	envelope := make([]byte, 0, len(header)+len(nonce)+len(data)+aead.Overhead())
+	envelope = append(envelope, header...)
+	envelope = append(envelope, nonce...)
+	return aead.Seal(envelope, nonce, data, header), nil
+}
+
+// Decode decrypts the cached value and decodes it with the wrapped encoder. Any failure to decrypt
+// is returned as a *DecryptionError. target must be a pointer.
+func (ece *EncryptingCacheEncoder) Decode(cachedValue []byte, target interface{}) error {
+	if len(cachedValue) < 2 || cachedValue[0] != encryptionEnvelopeVersion {
+		return &DecryptionError{Err: fmt.Errorf("unrecognized envelope")}
+	}
+	headerLen := 2 + int(cachedValue[1])
+	if len(cachedValue) < headerLen {
+		return &DecryptionError{Err: fmt.Errorf("truncated envelope")}
+	}
+	keyID := string(cachedValue[2:headerLen])
+	aead, ok := ece.aeads[keyID]
+	if !ok {
+		return &DecryptionError{KeyID: keyID, Err: fmt.Errorf("key is not in the keyring")}
+	}
+	if len(cachedValue) < headerLen+aead.NonceSize() {
+		return &DecryptionError{KeyID: keyID, Err: fmt.Errorf("truncated envelope")}
+	}
+	nonce := cachedValue[headerLen : headerLen+aead.NonceSize()]
+	data, err := aead.Open(nil, nonce, cachedValue[headerLen+aead.NonceSize():], cachedValue[:headerLen])
+	if err != nil {
+		return &DecryptionError{KeyID: keyID, Err: err}
+	}
+	return ece.Encoder.Decode(data, target)
+}
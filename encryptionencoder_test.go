@@ -0,0 +1,93 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKeyring(active string, keyIDs ...string) Keyring {
+	keyring := Keyring{ActiveKeyID: active, Keys: make(map[string][]byte)}
+	for i, keyID := range keyIDs {
+		keyring.Keys[keyID] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+	return keyring
+}
+
+func TestEncryptingCacheEncoder_EncodeDecode(t *testing.T) {
+	result := testEncodable{
+		A: 5,
+		B: map[int]int{0: 5, 1: 6, 2: 7},
+		C: &testNestedEncodable{"license plate"},
+	}
+	enc, err := NewEncryptingCacheEncoder(&GobCacheEncoder{}, newTestKeyring("k1", "k1"))
+	require.NoError(t, err)
+	data, err := enc.Encode(result)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(data, []byte("license plate")))
+	decodedResult := testEncodable{}
+	require.NoError(t, enc.Decode(data, &decodedResult))
+	assert.Equal(t, result, decodedResult)
+}
+
+// Test that values written with a retired active key can still be read after rotation
+func TestEncryptingCacheEncoder_Rotation(t *testing.T) {
+	oldEnc, err := NewEncryptingCacheEncoder(&GobCacheEncoder{}, newTestKeyring("k1", "k1"))
+	require.NoError(t, err)
+	newEnc, err := NewEncryptingCacheEncoder(&GobCacheEncoder{}, newTestKeyring("k2", "k1", "k2"))
+	require.NoError(t, err)
+	data, err := oldEnc.Encode(testEncodable{A: 3})
+	require.NoError(t, err)
+	decodedResult := testEncodable{}
+	require.NoError(t, newEnc.Decode(data, &decodedResult))
+	assert.Equal(t, 3, decodedResult.A)
+
+	// values written with the new key cannot be read by an encoder that does not have it
+	data, err = newEnc.Encode(testEncodable{A: 4})
+	require.NoError(t, err)
+	err = oldEnc.Decode(data, &decodedResult)
+	require.Error(t, err)
+	decryptionErr, ok := err.(*DecryptionError)
+	require.True(t, ok)
+	assert.Equal(t, "k2", decryptionErr.KeyID)
+}
+
+func TestEncryptingCacheEncoder_Tampered(t *testing.T) {
+	enc, err := NewEncryptingCacheEncoder(&GobCacheEncoder{}, newTestKeyring("k1", "k1"))
+	require.NoError(t, err)
+	data, err := enc.Encode(testEncodable{A: 3})
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	err = enc.Decode(data, &testEncodable{})
+	assert.IsType(t, &DecryptionError{}, err)
+	err = enc.Decode([]byte("not an envelope"), &testEncodable{})
+	assert.IsType(t, &DecryptionError{}, err)
+	err = enc.Decode([]byte{encryptionEnvelopeVersion, 10, 'k'}, &testEncodable{})
+	assert.IsType(t, &DecryptionError{}, err)
+}
+
+func TestEncryptingCacheEncoder_InvalidKeyring(t *testing.T) {
+	_, err := NewEncryptingCacheEncoder(&GobCacheEncoder{}, newTestKeyring("missing", "k1"))
+	assert.Error(t, err)
+	_, err = NewEncryptingCacheEncoder(&GobCacheEncoder{}, Keyring{
+		ActiveKeyID: "k1",
+		Keys:        map[string][]byte{"k1": []byte("too short")},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,307 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHotKeyTopK is the number of hot keys tracked per tier when none is configured
+	DefaultHotKeyTopK = 10
+	// DefaultHotKeyWindow is the period hot-key access rates are measured over when none is
+	// configured
+	DefaultHotKeyWindow = time.Minute
+	// DefaultHotKeyExpectedKeys is the number of distinct keys per window the hot-key sketch is
+	// sized for when none is configured
+	DefaultHotKeyExpectedKeys = 4096
+)
+
+// HotKeyTrackerConfig is the necessary configuration for instantiating a HotKeyTracker
+type HotKeyTrackerConfig struct {
+	TopK         int           // Number of hottest keys tracked per tier
+	SampleRate   float64       // Fraction of accesses recorded, between 0 and 1, zero to record all
+	Window       time.Duration // Period access rates are measured over
+	ExpectedKeys int           // Approximate number of distinct keys accessed per window
+	PinThreshold float64       // Remote accesses per second at which a key is pinned, zero to disable
+	PinTTL       time.Duration // Local TTL given to pinned keys, bounded by the local cache TTL
+	KeySanitizer KeySanitizer  // Applied to keys before they are exported as metric labels
+}
+
+// HotKey is a frequently accessed key and its estimated access rate
+type HotKey struct {
+	Key  string
+	Rate float64 // Accesses per second
+}
+
+// HotKeyTracker estimates the most frequently accessed keys in each cache tier. Accesses are
+// sampled and counted in a count-min sketch, and the keys with the highest counts are kept in a
+// heap, so memory use is fixed regardless of the number of distinct keys. Rates are measured over
+// consecutive windows. All methods are safe to call on a nil *HotKeyTracker, which tracks nothing.
+type HotKeyTracker struct {
+	config  HotKeyTrackerConfig
+	mutex   sync.Mutex
+	windows map[Tier]*hotKeyWindow
+	now     func() time.Time
+	sample  func() float64
+}
+
+// NewHotKeyTracker constructs and returns a HotKeyTracker given configuration
+func NewHotKeyTracker(config HotKeyTrackerConfig) (*HotKeyTracker, error) {
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		return nil, fmt.Errorf("sample rate must be between 0 and 1 - %v is invalid", config.SampleRate)
+	}
+	if config.TopK < 0 || config.ExpectedKeys < 0 || config.Window < 0 || config.PinTTL < 0 {
+		return nil, fmt.Errorf("hot key tracker sizes and durations must not be negative")
+	}
+	if config.PinThreshold > 0 && config.PinTTL == 0 {
+		return nil, fmt.Errorf("pin TTL must be set when a pin threshold is configured")
+	}
+	if config.TopK == 0 {
+		config.TopK = DefaultHotKeyTopK
+	}
+	if config.SampleRate == 0 {
+		config.SampleRate = 1
+	}
+	if config.Window == 0 {
+		config.Window = DefaultHotKeyWindow
+	}
+	if config.ExpectedKeys == 0 {
+		config.ExpectedKeys = DefaultHotKeyExpectedKeys
+	}
+	return &HotKeyTracker{
+		config:  config,
+		windows: make(map[Tier]*hotKeyWindow),
+		now:     time.Now,
+		sample:  rand.Float64,
+	}, nil
+}
+
+// Record records an access to key in the given tier, subject to sampling
+func (hkt *HotKeyTracker) Record(tier Tier, key string) {
+	hkt.record(key, tier)
+}
+
+// record records an access to key in each of the given tiers, sampling once and taking the mutex
+// once, so that a lookup touching several tiers does not contend for the mutex repeatedly
+func (hkt *HotKeyTracker) record(key string, tiers ...Tier) {
+	if hkt == nil {
+		return
+	}
+	if hkt.config.SampleRate < 1 && hkt.sample() >= hkt.config.SampleRate {
+		return
+	}
+	hkt.mutex.Lock()
+	defer hkt.mutex.Unlock()
+	for _, tier := range tiers {
+		hkt.window(tier).record(key, hkt.config.TopK)
+	}
+}
+
+// Top returns the hottest keys in the given tier, hottest first. Rates are measured over the last
+// complete window. Until one has completed, the accesses counted so far are spread over a whole
+// window, so a few accesses just after tracking starts do not look like a high rate.
+func (hkt *HotKeyTracker) Top(tier Tier) []HotKey {
+	if hkt == nil {
+		return nil
+	}
+	hkt.mutex.Lock()
+	defer hkt.mutex.Unlock()
+	window := hkt.window(tier)
+	if window.complete {
+		return append([]HotKey{}, window.previous...)
+	}
+	return window.rates(hkt.config.Window, hkt.config.SampleRate)
+}
+
+// Tiers returns the tiers in which accesses have been recorded
+func (hkt *HotKeyTracker) Tiers() []Tier {
+	if hkt == nil {
+		return nil
+	}
+	hkt.mutex.Lock()
+	defer hkt.mutex.Unlock()
+	tiers := make([]Tier, 0, len(hkt.windows))
+	for tier := range hkt.windows {
+		tiers = append(tiers, tier)
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i] < tiers[j] })
+	return tiers
+}
+
+// pinTTL returns the local TTL for a value of key backfilled from remote cache with the given
+// remaining TTL. Keys read from remote cache at least PinThreshold times per second are kept
+// locally for PinTTL instead, so that a hot key stops loading a single Redis node.
+func (hkt *HotKeyTracker) pinTTL(key string, ttl time.Duration) time.Duration {
+	if hkt == nil || hkt.config.PinThreshold <= 0 || ttl <= 0 || ttl >= hkt.config.PinTTL {
+		return ttl
+	}
+	for _, hotKey := range hkt.Top(TierRemote) {
+		if hotKey.Key == key && hotKey.Rate >= hkt.config.PinThreshold {
+			return hkt.config.PinTTL
+		}
+	}
+	return ttl
+}
+
+// window returns the current window for tier, starting a new one if the current window has ended.
+// The caller must hold the mutex.
+func (hkt *HotKeyTracker) window(tier Tier) *hotKeyWindow {
+	now := hkt.now()
+	window, ok := hkt.windows[tier]
+	if !ok {
+		window = newHotKeyWindow(now, hkt.config.ExpectedKeys)
+		hkt.windows[tier] = window
+		return window
+	}
+	if elapsed := now.Sub(window.start); elapsed >= hkt.config.Window {
+		previous := window.rates(elapsed, hkt.config.SampleRate)
+		if elapsed >= 2*hkt.config.Window {
+			// Nothing was recorded during the last complete window
+			previous = nil
+		}
+		*window = *newHotKeyWindow(now, hkt.config.ExpectedKeys)
+		window.previous = previous
+		window.complete = true
+	}
+	return window
+}
+
+// hotKeyWindow counts the accesses in one tier during one window
+type hotKeyWindow struct {
+	start    time.Time
+	sketch   *hotKeySketch
+	top      hotKeyHeap
+	index    map[string]*hotKeyCount
+	previous []HotKey // Rates measured over the last complete window
+	complete bool     // Whether a window has completed
+}
+
+// newHotKeyWindow creates a window starting at start
+func newHotKeyWindow(start time.Time, expectedKeys int) *hotKeyWindow {
+	return &hotKeyWindow{
+		start:  start,
+		sketch: newHotKeySketch(expectedKeys),
+		index:  make(map[string]*hotKeyCount),
+	}
+}
+
+// record counts an access to key and updates the topK hottest keys
+func (hkw *hotKeyWindow) record(key string, topK int) {
+	count := hkw.sketch.increment(key)
+	if item, ok := hkw.index[key]; ok {
+		item.count = count
+		heap.Fix(&hkw.top, item.index)
+		return
+	}
+	if len(hkw.top) < topK {
+		item := &hotKeyCount{key: key, count: count}
+		heap.Push(&hkw.top, item)
+		hkw.index[key] = item
+		return
+	}
+	if coldest := hkw.top[0]; count > coldest.count {
+		delete(hkw.index, coldest.key)
+		coldest.key, coldest.count = key, count
+		hkw.index[key] = coldest
+		heap.Fix(&hkw.top, 0)
+	}
+}
+
+// rates returns the access rates of the hottest keys, hottest first, given the time counted and
+// the fraction of accesses that were recorded
+func (hkw *hotKeyWindow) rates(elapsed time.Duration, sampleRate float64) []HotKey {
+	if elapsed <= 0 || len(hkw.top) == 0 {
+		return nil
+	}
+	hotKeys := make([]HotKey, len(hkw.top))
+	for i, item := range hkw.top {
+		hotKeys[i] = HotKey{Key: item.key, Rate: float64(item.count) / sampleRate / elapsed.Seconds()}
+	}
+	sort.Slice(hotKeys, func(i, j int) bool { return hotKeys[i].Rate > hotKeys[j].Rate })
+	return hotKeys
+}
+
+// hotKeySketch is a count-min sketch with counters wide enough to count every access in a window
+type hotKeySketch struct {
+	rows [countMinDepth][]uint32
+	mask uint64
+}
+
+// newHotKeySketch creates a sketch sized for the given number of distinct keys
+func newHotKeySketch(expectedKeys int) *hotKeySketch {
+	width := 16
+	for width < expectedKeys {
+		width *= 2
+	}
+	hks := &hotKeySketch{mask: uint64(width - 1)}
+	for i := range hks.rows {
+		hks.rows[i] = make([]uint32, width)
+	}
+	return hks
+}
+
+// increment records an occurrence of key and returns the new estimate of its occurrences
+func (hks *hotKeySketch) increment(key string) uint32 {
+	estimate := ^uint32(0)
+	for row, index := range sketchIndexes(key, hks.mask) {
+		if hks.rows[row][index] < ^uint32(0) {
+			hks.rows[row][index]++
+		}
+		if count := hks.rows[row][index]; count < estimate {
+			estimate = count
+		}
+	}
+	return estimate
+}
+
+// hotKeyCount is a key and its estimated occurrences, held in a hotKeyHeap
+type hotKeyCount struct {
+	key   string
+	count uint32
+	index int
+}
+
+// hotKeyHeap is a min-heap of keys by estimated occurrences, so the coldest tracked key is first
+type hotKeyHeap []*hotKeyCount
+
+func (hkh hotKeyHeap) Len() int           { return len(hkh) }
+func (hkh hotKeyHeap) Less(i, j int) bool { return hkh[i].count < hkh[j].count }
+
+func (hkh hotKeyHeap) Swap(i, j int) {
+	hkh[i], hkh[j] = hkh[j], hkh[i]
+	hkh[i].index = i
+	hkh[j].index = j
+}
+
+// Push adds an item to the heap
+func (hkh *hotKeyHeap) Push(x interface{}) {
+	item := x.(*hotKeyCount)
+	item.index = len(*hkh)
+	*hkh = append(*hkh, item)
+}
+
+// Pop removes the last item from the heap
+func (hkh *hotKeyHeap) Pop() interface{} {
+	old := *hkh
+	item := old[len(old)-1]
+	*hkh = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HotKeyCollector is a Prometheus collector that reports the access rates of the hottest keys
+// tracked by registered HotKeyTrackers. Keys are passed through the tracker's KeySanitizer before
+// they become label values; keys the sanitizer omits are not reported, and keys it maps to the
+// same value are reported together.
+type HotKeyCollector struct {
+	rate     *prometheus.Desc
+	mutex    sync.RWMutex
+	trackers map[cacheID]*HotKeyTracker
+}
+
+// NewHotKeyCollector creates a HotKeyCollector and registers it as described by opts. If a
+// collector was already registered with the same options it is returned instead.
+func NewHotKeyCollector(opts PrometheusCacheMetricsOptions) (*HotKeyCollector, error) {
+	hkc := &HotKeyCollector{
+		rate: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, "cache_hot_key_rate"),
+			"Estimated accesses per second of the hottest keys in each tier",
+			[]string{"client", "cache_name", "tier", "key"},
+			opts.ConstLabels,
+		),
+		trackers: make(map[cacheID]*HotKeyTracker),
+	}
+	collector, err := registerCollector(opts.registerer(), hkc)
+	if err != nil {
+		return nil, err
+	}
+	existing, ok := collector.(*HotKeyCollector)
+	if !ok {
+		return nil, fmt.Errorf("collector registered for hot key metrics is not a HotKeyCollector")
+	}
+	return existing, nil
+}
+
+// Register adds a HotKeyTracker to the collector under the given client and cache name, replacing
+// any tracker previously registered under the same names
+func (hkc *HotKeyCollector) Register(client, cacheName string, tracker *HotKeyTracker) {
+	hkc.mutex.Lock()
+	defer hkc.mutex.Unlock()
+	hkc.trackers[cacheID{client, cacheName}] = tracker
+}
+
+// Unregister removes the HotKeyTracker registered under the given client and cache name
+func (hkc *HotKeyCollector) Unregister(client, cacheName string) {
+	hkc.mutex.Lock()
+	defer hkc.mutex.Unlock()
+	delete(hkc.trackers, cacheID{client, cacheName})
+}
+
+// Describe sends the descriptor of the hot key metric
+func (hkc *HotKeyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hkc.rate
+}
+
+// Collect reports the hottest keys of every registered HotKeyTracker
+func (hkc *HotKeyCollector) Collect(ch chan<- prometheus.Metric) {
+	hkc.mutex.RLock()
+	defer hkc.mutex.RUnlock()
+	for id, tracker := range hkc.trackers {
+		if tracker == nil {
+			continue
+		}
+		for _, tier := range tracker.Tiers() {
+			rates := make(map[string]float64)
+			for _, hotKey := range tracker.Top(tier) {
+				if key := tracker.config.KeySanitizer.sanitize(hotKey.Key); key != "" {
+					rates[key] += hotKey.Rate
+				}
+			}
+			for key, rate := range rates {
+				ch <- prometheus.MustNewConstMetric(
+					hkc.rate, prometheus.GaugeValue, rate, id.client, id.name, string(tier), key,
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatherHotKeyRates returns the gathered hot key rates keyed by tier and key
+func gatherHotKeyRates(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	rates := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			rates[labels["tier"]+":"+labels["key"]] = metricValue(metric)
+		}
+	}
+	return rates
+}
+
+func TestHotKeyCollector(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	hkc, err := NewHotKeyCollector(PrometheusCacheMetricsOptions{Registerer: registry})
+	require.NoError(t, err)
+	tracker, advance := newTestHotKeyTracker(t, HotKeyTrackerConfig{KeySanitizer: TruncateKey(4), Window: time.Second})
+	hkc.Register("client", "name", tracker)
+
+	recordTimes(tracker, TierRemote, "user:1", 3)
+	recordTimes(tracker, TierRemote, "user:2", 2)
+	recordTimes(tracker, TierLocal, "item", 1)
+	advance(time.Second)
+	// Keys sanitized to the same value are reported together
+	assert.Equal(t, map[string]float64{"remote:user": 5, "local:item": 1}, gatherHotKeyRates(t, registry))
+
+	// Registering again with the same options returns the existing collector
+	again, err := NewHotKeyCollector(PrometheusCacheMetricsOptions{Registerer: registry})
+	require.NoError(t, err)
+	assert.Same(t, hkc, again)
+
+	hkc.Unregister("client", "name")
+	assert.Empty(t, gatherHotKeyRates(t, registry))
+}
+
+func TestHotKeyCollectorOmitKey(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	hkc, err := NewHotKeyCollector(PrometheusCacheMetricsOptions{Registerer: registry})
+	require.NoError(t, err)
+	tracker, advance := newTestHotKeyTracker(t, HotKeyTrackerConfig{KeySanitizer: OmitKey})
+	hkc.Register("client", "name", tracker)
+	recordTimes(tracker, TierLocal, "secret", 1)
+	advance(time.Second)
+	assert.Empty(t, gatherHotKeyRates(t, registry))
+}
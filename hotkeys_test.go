@@ -0,0 +1,161 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestHotKeyTracker returns a tracker whose clock is advanced by the returned function
+func newTestHotKeyTracker(t *testing.T, config HotKeyTrackerConfig) (*HotKeyTracker, func(time.Duration)) {
+	tracker, err := NewHotKeyTracker(config)
+	require.NoError(t, err)
+	now := time.Unix(0, 0)
+	tracker.now = func() time.Time { return now }
+	return tracker, func(d time.Duration) { now = now.Add(d) }
+}
+
+// recordTimes records n accesses to key in tier
+func recordTimes(tracker *HotKeyTracker, tier Tier, key string, n int) {
+	for i := 0; i < n; i++ {
+		tracker.Record(tier, key)
+	}
+}
+
+func TestHotKeyTrackerTop(t *testing.T) {
+	tracker, advance := newTestHotKeyTracker(t, HotKeyTrackerConfig{TopK: 2, Window: time.Minute})
+	recordTimes(tracker, TierLocal, "a", 50)
+	recordTimes(tracker, TierLocal, "b", 20)
+	recordTimes(tracker, TierLocal, "c", 5)
+	recordTimes(tracker, TierRemote, "c", 10)
+
+	// Until a window completes, the accesses so far are spread over a whole window
+	advance(10 * time.Second)
+	assert.Equal(t, []HotKey{{"a", 50.0 / 60}, {"b", 20.0 / 60}}, tracker.Top(TierLocal))
+	assert.Equal(t, []HotKey{{"c", 10.0 / 60}}, tracker.Top(TierRemote))
+	assert.Empty(t, tracker.Top(TierTiered))
+	assert.Equal(t, []Tier{TierLocal, TierRemote, TierTiered}, tracker.Tiers())
+
+	// Afterwards, rates are measured over the last complete window
+	advance(50 * time.Second)
+	recordTimes(tracker, TierLocal, "b", 100)
+	assert.Equal(t, []HotKey{{"a", 50.0 / 60}, {"b", 20.0 / 60}}, tracker.Top(TierLocal))
+
+	// Windows without accesses report no hot keys
+	advance(3 * time.Minute)
+	assert.Empty(t, tracker.Top(TierLocal))
+}
+
+func TestHotKeyTrackerSampling(t *testing.T) {
+	tracker, advance := newTestHotKeyTracker(t, HotKeyTrackerConfig{SampleRate: 0.5, Window: 10 * time.Second})
+	sample := 0.9
+	tracker.sample = func() float64 { return sample }
+	recordTimes(tracker, TierLocal, "skipped", 10)
+	sample = 0.1
+	recordTimes(tracker, TierLocal, "sampled", 10)
+	advance(10 * time.Second)
+	// Sampled accesses are scaled up by the sample rate
+	assert.Equal(t, []HotKey{{"sampled", 2}}, tracker.Top(TierLocal))
+}
+
+func TestHotKeyTrackerPinTTL(t *testing.T) {
+	tracker, advance := newTestHotKeyTracker(t, HotKeyTrackerConfig{PinThreshold: 1, PinTTL: time.Hour})
+	recordTimes(tracker, TierRemote, "hot", 100)
+	recordTimes(tracker, TierRemote, "cold", 1)
+	advance(10 * time.Second)
+	assert.Equal(t, time.Hour, tracker.pinTTL("hot", time.Minute))
+	assert.Equal(t, time.Minute, tracker.pinTTL("cold", time.Minute))
+	assert.Equal(t, 2*time.Hour, tracker.pinTTL("hot", 2*time.Hour))
+	// Values without a TTL already live as long as local cache allows
+	assert.Equal(t, time.Duration(0), tracker.pinTTL("hot", 0))
+}
+
+func TestHotKeyTrackerPinTTLWindowStart(t *testing.T) {
+	tracker, advance := newTestHotKeyTracker(t, HotKeyTrackerConfig{PinThreshold: 1, PinTTL: time.Hour})
+
+	// A read just after tracking starts is not mistaken for a high rate
+	recordTimes(tracker, TierRemote, "key", 1)
+	advance(time.Millisecond)
+	assert.Equal(t, time.Minute, tracker.pinTTL("key", time.Minute))
+
+	// A key is pinned once it has been read at the threshold rate for a whole window
+	recordTimes(tracker, TierRemote, "key", 59)
+	assert.Equal(t, time.Hour, tracker.pinTTL("key", time.Minute))
+}
+
+func TestHotKeyTrackerConfigValidation(t *testing.T) {
+	for name, config := range map[string]HotKeyTrackerConfig{
+		"sample rate above one":     {SampleRate: 1.5},
+		"negative sample rate":      {SampleRate: -0.5},
+		"negative top k":            {TopK: -1},
+		"negative window":           {Window: -time.Second},
+		"pin threshold without ttl": {PinThreshold: 10},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewHotKeyTracker(config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestHotKeyTrackerRecordTiers(t *testing.T) {
+	tracker, advance := newTestHotKeyTracker(t, HotKeyTrackerConfig{SampleRate: 0.5, Window: time.Second})
+	samples := 0
+	tracker.sample = func() float64 {
+		samples++
+		return float64(samples%2) * 0.9
+	}
+	// A single sampling decision covers every tier of an access
+	for i := 0; i < 4; i++ {
+		tracker.record("key", TierTiered, TierLocal, TierRemote)
+	}
+	assert.Equal(t, 4, samples)
+
+	advance(time.Second)
+	for _, tier := range []Tier{TierTiered, TierLocal, TierRemote} {
+		assert.Equal(t, []HotKey{{"key", 4}}, tracker.Top(tier), tier)
+	}
+}
+
+func TestHotKeyTrackerNil(t *testing.T) {
+	var tracker *HotKeyTracker
+	tracker.Record(TierLocal, "key")
+	assert.Nil(t, tracker.Top(TierLocal))
+	assert.Nil(t, tracker.Tiers())
+	assert.Equal(t, time.Minute, tracker.pinTTL("key", time.Minute))
+}
+
+func TestTieredHotKeys(t *testing.T) {
+	tracker, advance := newTestHotKeyTracker(t, HotKeyTrackerConfig{Window: time.Second})
+	encoder := &GobCacheEncoder{}
+	mtc := TieredCache{Local: NewMockCache(encoder), Remote: NewMockCache(encoder), HotKeys: tracker}
+	ctx := context.Background()
+	require.NoError(t, mtc.Remote.Set(ctx, "remote-key", "value"))
+	var target string
+	require.NoError(t, mtc.Get(ctx, "remote-key", &target))
+	require.NoError(t, mtc.Get(ctx, "remote-key", &target))
+	require.NoError(t, mtc.Set(ctx, "set-key", "value"))
+
+	advance(time.Second)
+	assert.Equal(t, []HotKey{{"remote-key", 2}, {"set-key", 1}}, tracker.Top(TierTiered))
+	assert.Equal(t, []HotKey{{"remote-key", 2}, {"set-key", 1}}, tracker.Top(TierLocal))
+	// The second read was served by the backfilled local copy
+	assert.Equal(t, []HotKey{{"remote-key", 1}, {"set-key", 1}}, tracker.Top(TierRemote))
+}
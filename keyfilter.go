@@ -0,0 +1,286 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultKeyFilterExpectedKeys is the number of keys a KeyFilter is sized for when none is
+	// configured
+	DefaultKeyFilterExpectedKeys = 100000
+	// DefaultKeyFilterFalsePositiveRate is the false-positive rate a KeyFilter is sized for when
+	// none is configured
+	DefaultKeyFilterFalsePositiveRate = 0.01
+	// DefaultKeyFilterScanPattern matches every key in Redis
+	DefaultKeyFilterScanPattern = "*"
+)
+
+// KeyFilterResult identifies the outcome of checking a key against a KeyFilter
+type KeyFilterResult string
+
+const (
+	// KeyFilterNegative is a key the filter has never seen, so the remote lookup was skipped
+	KeyFilterNegative KeyFilterResult = "negative"
+	// KeyFilterTruePositive is a key the filter may have seen that was found remotely
+	KeyFilterTruePositive KeyFilterResult = "true_positive"
+	// KeyFilterFalsePositive is a key the filter may have seen that was not found remotely
+	KeyFilterFalsePositive KeyFilterResult = "false_positive"
+)
+
+// KeyFilterMetrics defines an interface for recording the outcome of KeyFilter checks. CacheMetrics
+// implementations may optionally implement it.
+type KeyFilterMetrics interface {
+	KeyFilterCheck(result KeyFilterResult)
+}
+
+// KeyScanner is implemented by caches that can list the keys they hold
+type KeyScanner interface {
+	ScanKeys(ctx context.Context, pattern string, fn func(key string) error) error
+}
+
+// KeyFilterConfig is the necessary configuration for instantiating a KeyFilter
+type KeyFilterConfig struct {
+	ExpectedKeys      int           // Number of keys the filter is sized for
+	FalsePositiveRate float64       // False-positive rate once ExpectedKeys keys have been added
+	RebuildInterval   time.Duration // Interval between rebuilds from remote cache, which must be positive
+	ScanPattern       string        // Pattern matching the keys loaded into the filter
+}
+
+// KeyFilter is a Bloom filter of the keys known to be present in remote cache. A key the filter has
+// never seen is treated as absent, so the remote lookup can be skipped. Keys are added as they are
+// set by this process, and the filter is rebuilt from a scan of remote cache every
+// RebuildInterval, which drops deleted keys and picks up keys set by other processes. The filter is
+// local to the process, so it is not authoritative: a key set by another process reads as a miss
+// until the next rebuild completes, up to RebuildInterval plus the duration of the scan after it
+// was set. Use a filter only where such stale misses are acceptable, with a RebuildInterval no
+// longer than they may last. Until the first rebuild completes, every key is reported as possibly
+// present.
+type KeyFilter struct {
+	config     KeyFilterConfig
+	mutex      sync.RWMutex
+	current    *bloomFilter
+	rebuilding *bloomFilter // Receives keys added while a rebuild is in progress
+	ready      bool
+	stop       chan struct{}
+	stopOnce   sync.Once
+	checks     [3]uint64 // Indexed by keyFilterResultIndex
+}
+
+// NewKeyFilter constructs and returns a KeyFilter given configuration
+func NewKeyFilter(config KeyFilterConfig) (*KeyFilter, error) {
+	if config.ExpectedKeys < 0 {
+		return nil, fmt.Errorf("expected keys must not be negative - %v is invalid", config.ExpectedKeys)
+	}
+	if config.FalsePositiveRate < 0 || config.FalsePositiveRate >= 1 {
+		return nil, fmt.Errorf(
+			"false positive rate must be between 0 and 1 - %v is invalid", config.FalsePositiveRate)
+	}
+	if config.RebuildInterval <= 0 {
+		// Without rebuilds, keys set by other processes would read as misses forever
+		return nil, fmt.Errorf("rebuild interval must be positive - %v is invalid", config.RebuildInterval)
+	}
+	if config.ExpectedKeys == 0 {
+		config.ExpectedKeys = DefaultKeyFilterExpectedKeys
+	}
+	if config.FalsePositiveRate == 0 {
+		config.FalsePositiveRate = DefaultKeyFilterFalsePositiveRate
+	}
+	if config.ScanPattern == "" {
+		config.ScanPattern = DefaultKeyFilterScanPattern
+	}
+	return &KeyFilter{
+		config:  config,
+		current: newBloomFilter(config.ExpectedKeys, config.FalsePositiveRate),
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// Add records that key is present in remote cache. Add is a no-op on a nil *KeyFilter.
+func (kf *KeyFilter) Add(key string) {
+	if kf == nil {
+		return
+	}
+	kf.mutex.Lock()
+	defer kf.mutex.Unlock()
+	kf.current.add(key)
+	if kf.rebuilding != nil {
+		kf.rebuilding.add(key)
+	}
+}
+
+// MayContain returns false if key was absent from remote cache at the last rebuild and has not been
+// added since. A nil *KeyFilter and a filter that has not yet been built report every key as
+// possibly present.
+func (kf *KeyFilter) MayContain(key string) bool {
+	if kf == nil {
+		return true
+	}
+	kf.mutex.RLock()
+	defer kf.mutex.RUnlock()
+	return !kf.ready || kf.current.mayContain(key)
+}
+
+// Ready returns whether the filter has been built and can rule keys out
+func (kf *KeyFilter) Ready() bool {
+	if kf == nil {
+		return false
+	}
+	kf.mutex.RLock()
+	defer kf.mutex.RUnlock()
+	return kf.ready
+}
+
+// Rebuild replaces the contents of the filter with the keys reported by scanner. The filter keeps
+// answering from its previous contents until the scan completes.
+func (kf *KeyFilter) Rebuild(ctx context.Context, scanner KeyScanner) error {
+	next := newBloomFilter(kf.config.ExpectedKeys, kf.config.FalsePositiveRate)
+	kf.mutex.Lock()
+	kf.rebuilding = next
+	kf.mutex.Unlock()
+	err := scanner.ScanKeys(ctx, kf.config.ScanPattern, func(key string) error {
+		kf.mutex.Lock()
+		defer kf.mutex.Unlock()
+		next.add(key)
+		return nil
+	})
+	kf.mutex.Lock()
+	defer kf.mutex.Unlock()
+	kf.rebuilding = nil
+	if err != nil {
+		return err
+	}
+	kf.current = next
+	kf.ready = true
+	return nil
+}
+
+// Start builds the filter from scanner in the background, then rebuilds it every RebuildInterval
+// until Stop is called. Failed rebuilds are retried at the next interval.
+func (kf *KeyFilter) Start(scanner KeyScanner) {
+	go func() {
+		kf.Rebuild(context.Background(), scanner)
+		ticker := time.NewTicker(kf.config.RebuildInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				kf.Rebuild(context.Background(), scanner)
+			case <-kf.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends periodic rebuilds. Stop is a no-op on a nil *KeyFilter.
+func (kf *KeyFilter) Stop() {
+	if kf == nil {
+		return
+	}
+	kf.stopOnce.Do(func() {
+		close(kf.stop)
+	})
+}
+
+// FalsePositiveRate returns the observed fraction of absent keys the filter reported as possibly
+// present, assuming keys it ruled out were absent
+func (kf *KeyFilter) FalsePositiveRate() float64 {
+	if kf == nil {
+		return 0
+	}
+	falsePositives := atomic.LoadUint64(&kf.checks[keyFilterResultIndex(KeyFilterFalsePositive)])
+	negatives := atomic.LoadUint64(&kf.checks[keyFilterResultIndex(KeyFilterNegative)])
+	if falsePositives+negatives == 0 {
+		return 0
+	}
+	return float64(falsePositives) / float64(falsePositives+negatives)
+}
+
+// record counts the outcome of a check and reports it on metrics, which may be nil
+func (kf *KeyFilter) record(metrics CacheMetrics, result KeyFilterResult) {
+	atomic.AddUint64(&kf.checks[keyFilterResultIndex(result)], 1)
+	if kfm, ok := metrics.(KeyFilterMetrics); ok {
+		kfm.KeyFilterCheck(result)
+	}
+}
+
+// keyFilterResultIndex returns the index of result in KeyFilter.checks
+func keyFilterResultIndex(result KeyFilterResult) int {
+	switch result {
+	case KeyFilterNegative:
+		return 0
+	case KeyFilterTruePositive:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// bloomFilter is a Bloom filter over strings. It is not safe for concurrent use.
+type bloomFilter struct {
+	bits   []uint64
+	size   uint64 // Number of bits
+	hashes int
+}
+
+// newBloomFilter creates a Bloom filter with the given false-positive rate after n additions
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	size := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if size < 64 {
+		size = 64
+	}
+	hashes := int(math.Round(float64(size) / float64(n) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (size+63)/64), size: size, hashes: hashes}
+}
+
+// locations returns the hash of key split into the two halves used for double hashing
+func (bf *bloomFilter) locations(key string) (uint64, uint64) {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	hash := hasher.Sum64()
+	return hash, hash>>32 | hash<<32
+}
+
+// add sets the bits for key
+func (bf *bloomFilter) add(key string) {
+	h1, h2 := bf.locations(key)
+	for i := 0; i < bf.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % bf.size
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mayContain returns whether every bit for key is set
+func (bf *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bf.locations(key)
+	for i := 0; i < bf.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % bf.size
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
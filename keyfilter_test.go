@@ -0,0 +1,176 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sliceScanner is a KeyScanner over a fixed list of keys
+type sliceScanner struct {
+	keys   []string
+	during func() // Called halfway through the scan if set
+	err    error
+}
+
+func (ss sliceScanner) ScanKeys(ctx context.Context, pattern string, fn func(key string) error) error {
+	for i, key := range ss.keys {
+		if i == len(ss.keys)/2 && ss.during != nil {
+			ss.during()
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return ss.err
+}
+
+// keyFilterRecorder is a KeyFilterMetrics that remembers the results it observed
+type keyFilterRecorder struct {
+	MockCacheMetrics
+	results []KeyFilterResult
+}
+
+func (kfr *keyFilterRecorder) KeyFilterCheck(result KeyFilterResult) {
+	kfr.results = append(kfr.results, result)
+}
+
+func TestBloomFilter(t *testing.T) {
+	bf := newBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		bf.add("key-" + strconv.Itoa(i))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.True(t, bf.mayContain("key-"+strconv.Itoa(i)))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if bf.mayContain("absent-" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 300, "%d false positives", falsePositives)
+}
+
+func TestKeyFilterRebuild(t *testing.T) {
+	kf, err := NewKeyFilter(KeyFilterConfig{ExpectedKeys: 100, RebuildInterval: time.Minute})
+	require.NoError(t, err)
+	// Until the filter is built every key may be present
+	assert.False(t, kf.Ready())
+	assert.True(t, kf.MayContain("absent"))
+
+	scanner := sliceScanner{
+		keys:   []string{"a", "b", "c", "d"},
+		during: func() { kf.Add("added") },
+	}
+	require.NoError(t, kf.Rebuild(context.Background(), scanner))
+	assert.True(t, kf.Ready())
+	for _, key := range []string{"a", "b", "c", "d", "added"} {
+		assert.True(t, kf.MayContain(key), key)
+	}
+	assert.False(t, kf.MayContain("absent"))
+
+	// A failed rebuild keeps the previous contents
+	assert.Error(t, kf.Rebuild(context.Background(), sliceScanner{err: fmt.Errorf("error")}))
+	assert.True(t, kf.MayContain("a"))
+
+	// A successful rebuild drops keys that are no longer present
+	require.NoError(t, kf.Rebuild(context.Background(), sliceScanner{keys: []string{"e"}}))
+	assert.False(t, kf.MayContain("a"))
+	assert.True(t, kf.MayContain("e"))
+}
+
+func TestKeyFilterStart(t *testing.T) {
+	kf, err := NewKeyFilter(KeyFilterConfig{ExpectedKeys: 100, RebuildInterval: time.Millisecond})
+	require.NoError(t, err)
+	kf.Start(sliceScanner{keys: []string{"a"}})
+	defer kf.Stop()
+	assert.Eventually(t, kf.Ready, time.Second, time.Millisecond)
+	assert.True(t, kf.MayContain("a"))
+}
+
+func TestKeyFilterConfigValidation(t *testing.T) {
+	for name, config := range map[string]KeyFilterConfig{
+		"negative expected keys":      {ExpectedKeys: -1, RebuildInterval: time.Minute},
+		"false positive rate above 1": {FalsePositiveRate: 1, RebuildInterval: time.Minute},
+		"negative rebuild interval":   {RebuildInterval: -1},
+		"no rebuild interval":         {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewKeyFilter(config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestKeyFilterNil(t *testing.T) {
+	var kf *KeyFilter
+	kf.Add("key")
+	kf.Stop()
+	assert.True(t, kf.MayContain("key"))
+	assert.False(t, kf.Ready())
+	assert.Zero(t, kf.FalsePositiveRate())
+}
+
+func TestTieredKeyFilter(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	encoder := &GobCacheEncoder{}
+	data, err := encoder.Encode("value")
+	require.NoError(t, err)
+	s.Set("present", string(data))
+	remote := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	kf, err := NewKeyFilter(KeyFilterConfig{ExpectedKeys: 100, RebuildInterval: time.Minute})
+	require.NoError(t, err)
+	require.NoError(t, kf.Rebuild(context.Background(), remote))
+	metrics := &keyFilterRecorder{}
+	metrics.On("Hit")
+	metrics.On("Miss")
+	metrics.On("Set")
+	mtc := TieredCache{Local: NewMockCache(encoder), Remote: remote, Metrics: metrics, KeyFilter: kf}
+	ctx := context.Background()
+
+	// A definite negative never reaches Redis
+	commands := s.CommandCount()
+	var target string
+	assert.Equal(t, redis.ErrNil, mtc.Get(ctx, "absent", &target))
+	assert.Equal(t, commands, s.CommandCount())
+
+	require.NoError(t, mtc.Get(ctx, "present", &target))
+	assert.Equal(t, "value", target)
+
+	// A key the filter knows of that is missing from Redis is a false positive
+	kf.Add("deleted")
+	assert.Equal(t, redis.ErrNil, mtc.Get(ctx, "deleted", &target))
+	assert.Equal(t, []KeyFilterResult{
+		KeyFilterNegative, KeyFilterTruePositive, KeyFilterFalsePositive,
+	}, metrics.results)
+	assert.Equal(t, 0.5, kf.FalsePositiveRate())
+
+	// Keys set through the cache are added to the filter
+	require.NoError(t, mtc.Set(ctx, "new", "value"))
+	assert.True(t, kf.MayContain("new"))
+}
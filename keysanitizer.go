@@ -0,0 +1,78 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+)
+
+// KeySanitizer transforms a cache key before it is attached to a span, log line or metric label,
+// so that personal data embedded in keys does not leave the process. Returning an empty string
+// omits the key entirely. A nil KeySanitizer leaves keys unchanged.
+type KeySanitizer func(key string) string
+
+// OmitKey is a KeySanitizer that never reports keys
+func OmitKey(key string) string {
+	return ""
+}
+
+// HashKey is a KeySanitizer that reports the hex-encoded SHA-256 hash of keys. Hashed keys can
+// still be correlated with each other without revealing their contents.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// TruncateKey returns a KeySanitizer that reports at most the first length bytes of keys. A
+// negative length is treated as zero, omitting keys entirely.
+func TruncateKey(length int) KeySanitizer {
+	if length < 0 {
+		length = 0
+	}
+	return func(key string) string {
+		if len(key) <= length {
+			return key
+		}
+		return key[:length]
+	}
+}
+
+// MaskKey returns a KeySanitizer that replaces every match of pattern in keys with replacement.
+// replacement may refer to submatches as described by regexp.Regexp.ReplaceAllString.
+func MaskKey(pattern *regexp.Regexp, replacement string) KeySanitizer {
+	return func(key string) string {
+		return pattern.ReplaceAllString(key, replacement)
+	}
+}
+
+// sanitize returns key as transformed by the sanitizer, which may be nil
+func (ks KeySanitizer) sanitize(key string) string {
+	if ks == nil {
+		return key
+	}
+	return ks(key)
+}
+
+// tagKey tags span with the sanitized key, unless the sanitizer omits it. span may be nil.
+func tagKey(span Span, sanitizer KeySanitizer, key string) {
+	if span == nil {
+		return
+	}
+	if sanitized := sanitizer.sanitize(key); sanitized != "" {
+		span.SetTag("key", sanitized)
+	}
+}
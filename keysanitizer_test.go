@@ -0,0 +1,75 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/mna/redisc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySanitizers(t *testing.T) {
+	key := "user:jane@example.com:profile"
+	tests := []struct {
+		name      string
+		sanitizer KeySanitizer
+		expected  string
+	}{
+		{"nil", nil, key},
+		{"omit", OmitKey, ""},
+		{"truncate", TruncateKey(5), "user:"},
+		{"truncate short key", TruncateKey(100), key},
+		{"truncate negative length", TruncateKey(-1), ""},
+		{"mask", MaskKey(regexp.MustCompile(`[^:]+@[^:]+`), "<email>"), "user:<email>:profile"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.sanitizer.sanitize(key))
+		})
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	assert.Equal(t, "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b", HashKey("secret"))
+	assert.NotEqual(t, HashKey("secret"), HashKey("secret2"))
+}
+
+func TestKeySanitizerSpans(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	tracer, recorder := newRecordingTracer()
+	rc := RemoteCache{
+		cluster:        &redisc.Cluster{StartupNodes: []string{s.Addr()}},
+		TracingEnabled: true,
+		Tracer:         tracer,
+		KeySanitizer:   HashKey,
+	}
+	require.NoError(t, rc.SetBytes(context.Background(), "secret", []byte("value")))
+	rc.KeySanitizer = OmitKey
+	_, err = rc.GetBytes(context.Background(), "secret")
+	require.NoError(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, HashKey("secret"), spanAttributes(spans[0])["key"].AsString())
+	_, tagged := spanAttributes(spans[1])["key"]
+	assert.False(t, tagged)
+}
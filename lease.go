@@ -0,0 +1,186 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// DefaultLeaseTTL is the lifetime of the leases handed out by GetWithLease when none is configured
+const DefaultLeaseTTL = 10 * time.Second
+
+// getWithLeaseScript returns {1, value, pttl} if KEYS[1] exists, where pttl is its PTTL. Otherwise
+// it returns {0, lease, 0}, where lease is the outstanding lease at KEYS[2], or ARGV[1] stored there
+// for ARGV[2] milliseconds if there is none.
+var getWithLeaseScript = redis.NewScript(2, `
+local value = redis.call("GET", KEYS[1])
+if value then
+	return {1, value, redis.call("PTTL", KEYS[1])}
+end
+local lease = redis.call("GET", KEYS[2])
+if not lease then
+	lease = ARGV[1]
+	redis.call("SET", KEYS[2], lease, "PX", ARGV[2])
+end
+return {0, lease, 0}
+`)
+
+// setWithLeaseScript sets KEYS[1] to ARGV[2] and consumes the lease at KEYS[2] if it is ARGV[1],
+// expiring KEYS[1] after ARGV[3] milliseconds unless ARGV[3] is 0. It returns 0 if the lease is no
+// longer valid, or if KEYS[1] was written since the lease was handed out, in which case the lease
+// is invalidated.
+var setWithLeaseScript = redis.NewScript(2, `
+if redis.call("GET", KEYS[2]) ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[2])
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+local ttl = tonumber(ARGV[3])
+if ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ttl)
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// leaseKey returns the key under which the lease on key is stored, in the same hash slot as key
+func leaseKey(key string) string {
+	return hashSlotPrefix(key) + ":lease"
+}
+
+// GetWithLease is like Get, but a miss also returns a lease on key. The value loaded after the miss
+// should be stored with SetWithLease, which only succeeds while the lease is valid. Deleting key
+// invalidates its lease, so a value loaded before a delete is not stored after it. Callers that
+// miss while a lease is outstanding share it, and the first of them to set the value consumes it.
+// A hit returns an empty lease.
+func (rc RemoteCache) GetWithLease(ctx context.Context, key string, target interface{}) (string, error) {
+	lease, _, err := rc.getWithLease(ctx, key, target)
+	return lease, err
+}
+
+// getWithLease is like GetWithLease, but a hit also returns the time left until the value expires
+func (rc RemoteCache) getWithLease(
+	ctx context.Context, key string, target interface{},
+) (string, time.Duration, error) {
+	leaseTTL := rc.LeaseTTL
+	if leaseTTL <= 0 {
+		leaseTTL = DefaultLeaseTTL
+	}
+	var lease string
+	var ttl time.Duration
+	err := rc.observe(ctx, OperationGet, "EVALSHA", key, func(conn redis.Conn) (Result, error) {
+		token, err := newToken()
+		if err != nil {
+			return ResultError, err
+		}
+		reply, err := redis.Values(
+			getWithLeaseScript.Do(conn, key, leaseKey(key), token, expiryMilliseconds(leaseTTL)))
+		var found, pttl int64
+		var payload []byte
+		if err == nil {
+			_, err = redis.Scan(reply, &found, &payload, &pttl)
+		}
+		switch {
+		case err != nil:
+			return ResultError, err
+		case found == 0:
+			lease = string(payload)
+			return ResultMiss, redis.ErrNil
+		}
+		if ttl, err = pttlDuration(pttl); err != nil {
+			return ResultError, err
+		}
+		if err := decodeValue(rc.Encoder, key, payload, target); err != nil {
+			return ResultDecodeError, err
+		}
+		return ResultHit, nil
+	})
+	return lease, ttl, err
+}
+
+// SetWithLease encodes the provided value and sets it in remote cache if lease, returned by
+// GetWithLease, is still valid, reporting whether it was set. Setting the value consumes the lease.
+// A value written to key by other means since the lease was handed out is newer than the loaded
+// one, so it is kept and the lease is invalidated.
+func (rc RemoteCache) SetWithLease(ctx context.Context, key, lease string, value interface{}) (bool, error) {
+	return rc.SetWithLeaseTTL(ctx, key, lease, value, 0)
+}
+
+// SetWithLeaseTTL is like SetWithLease, but the value expires once ttl has passed. A ttl of zero
+// stores the value without an expiry.
+func (rc RemoteCache) SetWithLeaseTTL(
+	ctx context.Context, key, lease string, value interface{}, ttl time.Duration,
+) (bool, error) {
+	var set bool
+	err := rc.observe(ctx, OperationSet, "EVALSHA", key, func(conn redis.Conn) (Result, error) {
+		encoded, err := encodeValue(rc.Encoder, key, value)
+		if err != nil {
+			return ResultError, err
+		}
+		set, err = redis.Bool(setWithLeaseScript.Do(
+			conn, key, leaseKey(key), lease, encoded, expiryMilliseconds(ttl)))
+		switch {
+		case err != nil:
+			return ResultError, err
+		case !set:
+			return ResultConflict, nil
+		}
+		return ResultOK, nil
+	})
+	return set, err
+}
+
+// GetWithLease reads the value from local cache, then remote, returning a lease from remote cache
+// on a miss. Values found remotely are backfilled into local cache for the rest of their remote
+// TTL. See RemoteCache.GetWithLease.
+func (tc TieredCache) GetWithLease(ctx context.Context, key string, target interface{}) (string, error) {
+	if err := tc.Local.Get(ctx, key, target); err == nil {
+		return "", nil
+	}
+	remote, ok := tc.Remote.(RemoteCache)
+	if !ok {
+		return "", fmt.Errorf("remote cache does not support leases")
+	}
+	lease, ttl, err := remote.getWithLease(ctx, key, target)
+	if err == nil {
+		tieredLookup{tc}.backfill(ctx, key, target, ttl)
+	}
+	return lease, err
+}
+
+// SetWithLease sets the value in remote cache if lease is still valid, then in local cache,
+// reporting whether it was set. A value rejected by remote cache is not stored locally either. With
+// sliding expiration, the value expires from both tiers once the sliding TTL has passed without it
+// being read.
+func (tc TieredCache) SetWithLease(ctx context.Context, key, lease string, value interface{}) (bool, error) {
+	remote, ok := tc.Remote.(RemoteCache)
+	if !ok {
+		return false, fmt.Errorf("remote cache does not support leases")
+	}
+	ttl := tc.slidingTTL(ctx)
+	set, err := remote.SetWithLeaseTTL(ctx, key, lease, value, ttl)
+	if err != nil || !set {
+		return set, err
+	}
+	tc.KeyFilter.Add(key)
+	return true, tc.skipTooLarge(ctx, key, setWithTTL(ctx, tc.Local, key, value, ttl))
+}
@@ -0,0 +1,242 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteLease(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: &GobCacheEncoder{}}
+	ctx := context.Background()
+
+	// Misses share the outstanding lease
+	var target string
+	lease, err := rc.GetWithLease(ctx, "test-key", &target)
+	assert.Equal(t, redis.ErrNil, err)
+	assert.NotEmpty(t, lease)
+	assert.Equal(t, DefaultLeaseTTL, s.TTL(leaseKey("test-key")))
+	shared, err := rc.GetWithLease(ctx, "test-key", &target)
+	assert.Equal(t, redis.ErrNil, err)
+	assert.Equal(t, lease, shared)
+
+	// Setting the value consumes the lease
+	set, err := rc.SetWithLease(ctx, "test-key", lease, "loaded")
+	require.NoError(t, err)
+	assert.True(t, set)
+	assert.False(t, s.Exists(leaseKey("test-key")))
+	set, err = rc.SetWithLease(ctx, "test-key", lease, "again")
+	require.NoError(t, err)
+	assert.False(t, set)
+
+	lease, err = rc.GetWithLease(ctx, "test-key", &target)
+	require.NoError(t, err)
+	assert.Empty(t, lease)
+	assert.Equal(t, "loaded", target)
+}
+
+func TestRemoteLeaseInvalidatedByDelete(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{
+		cluster:  &redisc.Cluster{StartupNodes: []string{s.Addr()}},
+		Encoder:  &GobCacheEncoder{},
+		LeaseTTL: time.Minute,
+	}
+	ctx := context.Background()
+
+	// A value loaded before a delete is not stored after it
+	var target string
+	lease, err := rc.GetWithLease(ctx, "test-key", &target)
+	assert.Equal(t, redis.ErrNil, err)
+	assert.Equal(t, time.Minute, s.TTL(leaseKey("test-key")))
+	require.NoError(t, rc.Delete(ctx, "test-key"))
+	set, err := rc.SetWithLease(ctx, "test-key", lease, "stale")
+	require.NoError(t, err)
+	assert.False(t, set)
+	assert.False(t, s.Exists("test-key"))
+
+	// The next miss is handed a new lease
+	next, err := rc.GetWithLease(ctx, "test-key", &target)
+	assert.Equal(t, redis.ErrNil, err)
+	assert.NotEqual(t, lease, next)
+}
+
+func TestRemoteLeaseInvalidatedByPatternDelete(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: &GobCacheEncoder{}}
+	ctx := context.Background()
+
+	// Deleting by pattern invalidates the leases of every key it matched
+	var target string
+	lease, err := rc.GetWithLease(ctx, "test-key", &target)
+	assert.Equal(t, redis.ErrNil, err)
+	require.NoError(t, rc.Set(ctx, "test-key", "old"))
+	require.NoError(t, rc.Delete(ctx, "test-*"))
+	assert.False(t, s.Exists(leaseKey("test-key")))
+	set, err := rc.SetWithLease(ctx, "test-key", lease, "stale")
+	require.NoError(t, err)
+	assert.False(t, set)
+	assert.False(t, s.Exists("test-key"))
+}
+
+func TestRemoteLeaseKeysDoNotCollide(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: &GobCacheEncoder{}}
+	ctx := context.Background()
+
+	// "{a}" hashes like "a", but the two keys have leases of their own
+	var target string
+	lease, err := rc.GetWithLease(ctx, "a", &target)
+	assert.Equal(t, redis.ErrNil, err)
+	wrappedLease, err := rc.GetWithLease(ctx, "{a}", &target)
+	assert.Equal(t, redis.ErrNil, err)
+	assert.NotEqual(t, lease, wrappedLease)
+
+	// Deleting one key leaves the lease on the other in place
+	require.NoError(t, rc.Delete(ctx, "{a}"))
+	set, err := rc.SetWithLease(ctx, "{a}", lease, "loaded")
+	require.NoError(t, err)
+	assert.False(t, set)
+	set, err = rc.SetWithLease(ctx, "a", lease, "loaded")
+	require.NoError(t, err)
+	assert.True(t, set)
+}
+
+func TestRemoteLeaseKeepsNewerValue(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: &GobCacheEncoder{}}
+	ctx := context.Background()
+
+	// A value written while the load was in flight is not overwritten
+	var target string
+	lease, err := rc.GetWithLease(ctx, "test-key", &target)
+	assert.Equal(t, redis.ErrNil, err)
+	require.NoError(t, rc.Set(ctx, "test-key", "newer"))
+	set, err := rc.SetWithLease(ctx, "test-key", lease, "loaded")
+	require.NoError(t, err)
+	assert.False(t, set)
+	assert.False(t, s.Exists(leaseKey("test-key")))
+	require.NoError(t, rc.Get(ctx, "test-key", &target))
+	assert.Equal(t, "newer", target)
+}
+
+func TestRemoteLeaseTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: &GobCacheEncoder{}}
+	ctx := context.Background()
+
+	var target string
+	lease, err := rc.GetWithLease(ctx, "test-key", &target)
+	assert.Equal(t, redis.ErrNil, err)
+	set, err := rc.SetWithLeaseTTL(ctx, "test-key", lease, "loaded", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, set)
+	assert.Equal(t, time.Minute, s.TTL("test-key"))
+}
+
+func TestTieredLease(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	encoder := &GobCacheEncoder{}
+	local := NewMockCache(encoder)
+	remote := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	mtc := TieredCache{Local: local, Remote: remote}
+	ctx := context.Background()
+
+	var target string
+	lease, err := mtc.GetWithLease(ctx, "test-key", &target)
+	assert.Equal(t, redis.ErrNil, err)
+	set, err := mtc.SetWithLease(ctx, "test-key", lease, "loaded")
+	require.NoError(t, err)
+	assert.True(t, set)
+	assert.Contains(t, local.Cache, "test-key")
+	lease, err = mtc.GetWithLease(ctx, "test-key", &target)
+	require.NoError(t, err)
+	assert.Empty(t, lease)
+	assert.Equal(t, "loaded", target)
+
+	// Stale values are kept out of both tiers
+	require.NoError(t, mtc.Delete(ctx, "test-key"))
+	lease, err = mtc.GetWithLease(ctx, "test-key", &target)
+	assert.Equal(t, redis.ErrNil, err)
+	require.NoError(t, mtc.Delete(ctx, "test-key"))
+	set, err = mtc.SetWithLease(ctx, "test-key", lease, "stale")
+	require.NoError(t, err)
+	assert.False(t, set)
+	assert.NotContains(t, local.Cache, "test-key")
+
+	// With sliding expiration, the value expires from both tiers
+	sliding := TieredCache{Local: local, Remote: remote, SlidingTTL: time.Minute}
+	lease, err = sliding.GetWithLease(ctx, "test-key", &target)
+	assert.Equal(t, redis.ErrNil, err)
+	set, err = sliding.SetWithLease(ctx, "test-key", lease, "loaded")
+	require.NoError(t, err)
+	assert.True(t, set)
+	assert.Equal(t, time.Minute, s.TTL("test-key"))
+	assert.Contains(t, local.Expirations, "test-key")
+
+	unsupported := TieredCache{Local: NewMockCache(encoder), Remote: NewMockCache(encoder)}
+	_, err = unsupported.GetWithLease(ctx, "test-key", &target)
+	assert.Error(t, err)
+}
+
+func TestTieredLeaseBackfillsRemoteTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	encoder := &GobCacheEncoder{}
+	data, err := encoder.Encode("loaded")
+	require.NoError(t, err)
+	s.Set("test-key", string(data))
+	s.SetTTL("test-key", time.Minute)
+	lcc := LocalCacheConfig{TTL: time.Hour, Eviction: time.Hour}
+	local, err := lcc.NewCache(encoder, nil)
+	require.NoError(t, err)
+	remote := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	mtc := TieredCache{Local: local, Remote: remote}
+
+	before := time.Now()
+	var target string
+	lease, err := mtc.GetWithLease(context.Background(), "test-key", &target)
+	require.NoError(t, err)
+	assert.Empty(t, lease)
+	entry, err := local.Cache.Get("test-key")
+	require.NoError(t, err)
+	_, expiresAt, ok := decodeLocalEntry(entry)
+	require.True(t, ok)
+	assert.WithinDuration(t, before.Add(time.Minute), expiresAt, time.Second)
+}
@@ -0,0 +1,283 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLoadLeaseTTL is the lifetime of a distributed load lease when none is configured
+	DefaultLoadLeaseTTL = 10 * time.Second
+	// DefaultLoadWaitTimeout is the longest a process waits for another process to load a key
+	// before loading it itself when none is configured
+	DefaultLoadWaitTimeout = 5 * time.Second
+	// loadLeaseKeyPrefix is prepended to keys to form the names of their load leases
+	loadLeaseKeyPrefix = "load-lease:"
+)
+
+// LoadFunc computes the value of a key that is missing from cache
+type LoadFunc func(ctx context.Context) (interface{}, error)
+
+// LoaderConfig is the necessary configuration for instantiating a Loader
+type LoaderConfig struct {
+	Distributed bool          // Coalesce loads across processes with a lease in remote cache
+	LeaseTTL    time.Duration // Lifetime of a load lease, renewed while the load runs
+	WaitTimeout time.Duration // Longest wait for another process's load before loading locally
+	MinBackoff  time.Duration // First wait between checks for another process's load
+	MaxBackoff  time.Duration // Longest wait between checks for another process's load
+}
+
+// Loader coalesces the loads of keys missing from a TieredCache. Concurrent loads of a key in one
+// process share a single call to the load function. In distributed mode, the first process to
+// miss also takes a lease on the key in remote cache, and other processes poll remote cache with
+// backoff until the value appears rather than loading it themselves. A process whose lease holder
+// takes longer than WaitTimeout loads the value itself, and a lease whose holder died expires
+// after LeaseTTL so another process can take it over.
+type Loader struct {
+	config LoaderConfig
+	locker *Locker // Nil unless distributed
+	mutex  sync.Mutex
+	calls  map[string]*loadCall
+}
+
+// loadCall is a load in progress, shared by the callers loading the same key
+type loadCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// NewLoader constructs and returns a Loader given configuration. Distributed loaders take their
+// leases through locker, which must be set.
+func NewLoader(config LoaderConfig, locker *Locker) (*Loader, error) {
+	if config.LeaseTTL < 0 || config.WaitTimeout < 0 || config.MinBackoff < 0 || config.MaxBackoff < 0 {
+		return nil, fmt.Errorf("loader durations must not be negative")
+	}
+	if config.Distributed && locker == nil {
+		return nil, fmt.Errorf("distributed loader requires a locker")
+	}
+	if config.LeaseTTL == 0 {
+		config.LeaseTTL = DefaultLoadLeaseTTL
+	}
+	if config.WaitTimeout == 0 {
+		config.WaitTimeout = DefaultLoadWaitTimeout
+	}
+	if config.MinBackoff == 0 {
+		config.MinBackoff = DefaultLockMinBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = DefaultLockMaxBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		return nil, fmt.Errorf("maximum loader backoff must not be less than the minimum")
+	}
+	if !config.Distributed {
+		locker = nil
+	}
+	return &Loader{config: config, locker: locker, calls: make(map[string]*loadCall)}, nil
+}
+
+// do runs fn for key unless a call for key is already running, in which case it waits for that
+// call and returns its result. A call that failed because the context of the caller running it
+// ended is not shared: waiters whose own context is still live run fn themselves. A panic in fn is
+// returned as an error to the caller running it and to its waiters. do runs fn directly on a nil
+// *Loader.
+func (ld *Loader) do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	if ld == nil {
+		return fn()
+	}
+	for {
+		ld.mutex.Lock()
+		call, ok := ld.calls[key]
+		if !ok {
+			call = &loadCall{done: make(chan struct{})}
+			ld.calls[key] = call
+			ld.mutex.Unlock()
+			ld.run(key, call, fn)
+			return call.value, call.err
+		}
+		ld.mutex.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if !isContextError(call.err) || ctx.Err() != nil {
+			return call.value, call.err
+		}
+	}
+}
+
+// run runs fn as call, then removes it from the running calls and releases its waiters, even if fn
+// panics
+func (ld *Loader) run(key string, call *loadCall, fn func() (interface{}, error)) {
+	defer func() {
+		if r := recover(); r != nil {
+			call.value, call.err = nil, fmt.Errorf("load panicked: %v", r)
+		}
+		ld.mutex.Lock()
+		delete(ld.calls, key)
+		ld.mutex.Unlock()
+		close(call.done)
+	}()
+	call.value, call.err = fn()
+}
+
+// isContextError reports whether err is the error of a context that was canceled or timed out
+func isContextError(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// GetOrLoad retrieves the value at key into target like Get. If key is missing, the value is
+// computed by load, stored in cache and set in target. Values that cannot be read, because they
+// failed integrity verification or decoding or because remote cache is unreachable, are loaded
+// like missing ones; only ctx ending or a value written with SetReader stops the load. Concurrent loads are coalesced by the
+// Loader if one is set; callers that share a load share the value load returned. The value is
+// stored with a lease from GetWithLease, so it is not stored if key is deleted during the load.
+func (tc TieredCache) GetOrLoad(ctx context.Context, key string, target interface{}, load LoadFunc) error {
+	if value := reflect.ValueOf(target); value.Kind() != reflect.Ptr || value.IsNil() {
+		return fmt.Errorf("target must be a non-nil pointer, got %T", target)
+	}
+	// Any other failure to read key, such as remote cache being down or holding a value in an
+	// encoding that can no longer be decoded, is answered by loading the value. A streamed value is
+	// there to be read with GetReader, so it is not replaced.
+	if err := tc.Get(ctx, key, target); err == nil || isContextError(err) || err == ErrStreamedValue {
+		return err
+	}
+	value, err := tc.Loader.do(ctx, key, func() (interface{}, error) {
+		if tc.Loader == nil || tc.Loader.locker == nil {
+			return tc.loadAndSet(ctx, key, target, load)
+		}
+		return tc.loadDistributed(ctx, key, target, load)
+	})
+	if err != nil {
+		return err
+	}
+	return assignValue(target, value)
+}
+
+// loadAndSet computes the value of key and stores it in cache. When remote cache supports leases,
+// the value is stored with a lease taken before the load, so a value loaded before key is deleted
+// or written elsewhere is not stored after it. A value stored since the miss is decoded into
+// target and returned instead of loading. Failing to store the value only costs a later load, so
+// errors from storing it are ignored.
+func (tc TieredCache) loadAndSet(
+	ctx context.Context, key string, target interface{}, load LoadFunc,
+) (interface{}, error) {
+	if _, ok := tc.Remote.(RemoteCache); !ok {
+		value, err := load(ctx)
+		if err == nil {
+			tc.Set(ctx, key, value)
+		}
+		return value, err
+	}
+	lease, err := tc.GetWithLease(ctx, key, target)
+	if err == nil {
+		return reflect.ValueOf(target).Elem().Interface(), nil
+	}
+	value, err := load(ctx)
+	switch {
+	case err != nil:
+	case lease != "":
+		tc.SetWithLease(ctx, key, lease, value)
+	default:
+		// Without a lease, remote cache could not be read, so the value is set unconditionally
+		tc.Set(ctx, key, value)
+	}
+	return value, err
+}
+
+// loadDistributed loads key under a lease in remote cache, or waits for the process holding the
+// lease to store the value, decoding it into target
+func (tc TieredCache) loadDistributed(
+	ctx context.Context, key string, target interface{}, load LoadFunc,
+) (interface{}, error) {
+	config := tc.Loader.config
+	deadline := time.Now().Add(config.WaitTimeout)
+	backoff := config.MinBackoff
+	for {
+		// Loads need no fencing, and a fencing counter per loaded key would never be removed
+		lease, err := tc.Loader.locker.tryLease(ctx, loadLeaseKeyPrefix+key, config.LeaseTTL)
+		switch err {
+		case nil:
+			defer lease.Unlock(context.Background())
+			// The previous lease holder may have stored the value before releasing its lease
+			if value, ok := tc.readLoaded(ctx, key, target); ok {
+				return value, nil
+			}
+			return tc.loadAndSet(ctx, key, target, load)
+		case ErrLockNotAcquired:
+		default:
+			// Without remote cache there is nothing to coordinate on, so load locally
+			return tc.loadAndSet(ctx, key, target, load)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		if value, ok := tc.readLoaded(ctx, key, target); ok {
+			return value, nil
+		}
+		if time.Now().After(deadline) {
+			return tc.loadAndSet(ctx, key, target, load)
+		}
+		if backoff *= 2; backoff > config.MaxBackoff {
+			backoff = config.MaxBackoff
+		}
+	}
+}
+
+// readLoaded reads a value loaded by another process from remote cache into target and backfills
+// local cache with it for the rest of its remote TTL, returning the value target points to
+func (tc TieredCache) readLoaded(ctx context.Context, key string, target interface{}) (interface{}, bool) {
+	var ttl time.Duration
+	var err error
+	if remote, ok := tc.Remote.(TTLGetter); ok {
+		ttl, err = remote.GetWithTTL(ctx, key, target)
+	} else {
+		err = tc.Remote.Get(ctx, key, target)
+	}
+	if err != nil {
+		return nil, false
+	}
+	tieredLookup{tc}.backfill(ctx, key, target, ttl)
+	return reflect.ValueOf(target).Elem().Interface(), true
+}
+
+// assignValue sets the value pointed to by target, which must be a non-nil pointer, to value or to
+// the value value points to
+func assignValue(target, value interface{}) error {
+	dst := reflect.ValueOf(target)
+	src := reflect.ValueOf(value)
+	switch {
+	case !src.IsValid():
+		dst.Elem().Set(reflect.Zero(dst.Elem().Type()))
+	case src.Type().AssignableTo(dst.Elem().Type()):
+		dst.Elem().Set(src)
+	case src.Kind() == reflect.Ptr && !src.IsNil() && src.Elem().Type().AssignableTo(dst.Elem().Type()):
+		dst.Elem().Set(src.Elem())
+	default:
+		return fmt.Errorf("loaded value of type %T cannot be set in target of type %T", value, target)
+	}
+	return nil
+}
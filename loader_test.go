@@ -0,0 +1,411 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestLoaderCache returns a TieredCache, as run by one process, with remote cache on s and a
+// loader with the given configuration
+func newTestLoaderCache(t *testing.T, s *miniredis.Miniredis, config LoaderConfig) TieredCache {
+	encoder := &GobCacheEncoder{}
+	remote := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	locker, err := NewLocker(remote, LockerConfig{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+	require.NoError(t, err)
+	loader, err := NewLoader(config, locker)
+	require.NoError(t, err)
+	return TieredCache{Local: NewMockCache(encoder), Remote: remote, Loader: loader}
+}
+
+// countingLoad returns a LoadFunc that counts its calls and returns value once release is closed
+func countingLoad(calls *int32, release <-chan struct{}, value interface{}) LoadFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(calls, 1)
+		<-release
+		return value, nil
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mtc := newTestLoaderCache(t, s, LoaderConfig{})
+	mtc.Loader = nil
+	ctx := context.Background()
+	var calls int32
+	release := make(chan struct{})
+	close(release)
+
+	// Missing values are loaded and stored
+	var target string
+	require.NoError(t, mtc.GetOrLoad(ctx, "test-key", &target, countingLoad(&calls, release, "loaded")))
+	assert.Equal(t, "loaded", target)
+	var stored string
+	require.NoError(t, mtc.Remote.Get(ctx, "test-key", &stored))
+	assert.Equal(t, "loaded", stored)
+
+	// Present values are not loaded
+	target = ""
+	require.NoError(t, mtc.GetOrLoad(ctx, "test-key", &target, countingLoad(&calls, release, "reloaded")))
+	assert.Equal(t, "loaded", target)
+	assert.Equal(t, int32(1), calls)
+
+	// Load errors are returned and nothing is stored
+	loadErr := fmt.Errorf("database unavailable")
+	err = mtc.GetOrLoad(ctx, "other-key", &target, func(ctx context.Context) (interface{}, error) {
+		return nil, loadErr
+	})
+	assert.Equal(t, loadErr, err)
+	assert.False(t, s.Exists("other-key"))
+
+	assert.Error(t, mtc.GetOrLoad(ctx, "test-key", target, countingLoad(&calls, release, "loaded")))
+}
+
+func TestGetOrLoadTampered(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	encoder, err := NewSigningCacheEncoder(&GobCacheEncoder{}, []byte("secret"))
+	require.NoError(t, err)
+	remote := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	mtc := TieredCache{Local: NewMockCache(encoder), Remote: remote}
+	ctx := context.Background()
+
+	// Values that fail integrity verification are evicted by Get and loaded again
+	s.Set("test-key", "tampered")
+	var calls int32
+	release := make(chan struct{})
+	close(release)
+	var target string
+	require.NoError(t, mtc.GetOrLoad(ctx, "test-key", &target, countingLoad(&calls, release, "loaded")))
+	assert.Equal(t, "loaded", target)
+	assert.Equal(t, int32(1), calls)
+	var stored string
+	require.NoError(t, remote.Get(ctx, "test-key", &stored))
+	assert.Equal(t, "loaded", stored)
+}
+
+func TestGetOrLoadUndecodable(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mtc := newTestLoaderCache(t, s, LoaderConfig{})
+	ctx := context.Background()
+
+	// A value in an encoding that can no longer be decoded is loaded and replaced
+	s.Set("test-key", "stale-encoding")
+	var calls int32
+	release := make(chan struct{})
+	close(release)
+	var target string
+	require.NoError(t, mtc.GetOrLoad(ctx, "test-key", &target, countingLoad(&calls, release, "loaded")))
+	assert.Equal(t, "loaded", target)
+	assert.Equal(t, int32(1), calls)
+	var stored string
+	require.NoError(t, mtc.Remote.Get(ctx, "test-key", &stored))
+	assert.Equal(t, "loaded", stored)
+}
+
+func TestGetOrLoadRemoteDown(t *testing.T) {
+	for _, distributed := range []bool{false, true} {
+		s, err := miniredis.Run()
+		require.NoError(t, err)
+		mtc := newTestLoaderCache(t, s, LoaderConfig{Distributed: distributed})
+		s.Close()
+
+		// Without remote cache the value is loaded and served
+		var calls int32
+		release := make(chan struct{})
+		close(release)
+		var target string
+		err = mtc.GetOrLoad(context.Background(), "test-key", &target, countingLoad(&calls, release, "loaded"))
+		require.NoError(t, err, "distributed: %v", distributed)
+		assert.Equal(t, "loaded", target)
+		assert.Equal(t, int32(1), calls)
+	}
+}
+
+func TestGetOrLoadCoalescesInProcess(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mtc := newTestLoaderCache(t, s, LoaderConfig{})
+	var calls int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	targets := make([]string, 10)
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, mtc.GetOrLoad(context.Background(), "test-key", &targets[i],
+				countingLoad(&calls, release, "loaded")))
+		}(i)
+	}
+	// Give every caller time to join the load before it completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls)
+	for _, target := range targets {
+		assert.Equal(t, "loaded", target)
+	}
+}
+
+func TestLoaderPanic(t *testing.T) {
+	ld, err := NewLoader(LoaderConfig{}, nil)
+	require.NoError(t, err)
+	release := make(chan struct{})
+
+	// A panicking load fails its caller and every waiter instead of blocking them
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = ld.do(context.Background(), "test-key", func() (interface{}, error) {
+				<-release
+				panic("load failed")
+			})
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, err := range errs {
+		assert.EqualError(t, err, "load panicked: load failed")
+	}
+
+	// Later loads of the key run again
+	value, err := ld.do(context.Background(), "test-key", func() (interface{}, error) {
+		return "loaded", nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "loaded", value)
+}
+
+func TestLoaderLeaderCanceled(t *testing.T) {
+	ld, err := NewLoader(LoaderConfig{}, nil)
+	require.NoError(t, err)
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan error)
+	go func() {
+		_, err := ld.do(leaderCtx, "test-key", func() (interface{}, error) {
+			<-leaderCtx.Done()
+			return nil, leaderCtx.Err()
+		})
+		leaderDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// A waiter whose context is live loads the key itself when the caller it waited on is canceled
+	waiterDone := make(chan interface{})
+	go func() {
+		value, err := ld.do(context.Background(), "test-key", func() (interface{}, error) {
+			return "loaded", nil
+		})
+		assert.NoError(t, err)
+		waiterDone <- value
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.Equal(t, context.Canceled, <-leaderDone)
+	assert.Equal(t, "loaded", <-waiterDone)
+}
+
+func TestGetOrLoadDistributed(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	config := LoaderConfig{Distributed: true, WaitTimeout: 5 * time.Second}
+	first := newTestLoaderCache(t, s, config)
+	second := newTestLoaderCache(t, s, config)
+	ctx := context.Background()
+	var calls int32
+	release := make(chan struct{})
+
+	// The first process takes the lease and loads, while the second waits for its result
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var target string
+		assert.NoError(t, first.GetOrLoad(ctx, "test-key", &target, countingLoad(&calls, release, "loaded")))
+		assert.Equal(t, "loaded", target)
+	}()
+	require.Eventually(t, func() bool { return s.Exists("lock:load-lease:test-key") }, time.Second, time.Millisecond)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	var target string
+	require.NoError(t, second.GetOrLoad(ctx, "test-key", &target, countingLoad(&calls, release, "duplicate")))
+	<-done
+	assert.Equal(t, "loaded", target)
+	assert.Equal(t, int32(1), calls)
+	assert.Contains(t, second.Local.(*MockCache).Cache, "test-key")
+	assert.False(t, s.Exists("lock:load-lease:test-key"))
+}
+
+func TestGetOrLoadDistributedTimeout(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mtc := newTestLoaderCache(t, s, LoaderConfig{Distributed: true, WaitTimeout: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	// A lease holder that never stores the value is given up on after the wait timeout
+	lease, err := mtc.Loader.locker.tryLease(ctx, loadLeaseKeyPrefix+"test-key", time.Minute)
+	require.NoError(t, err)
+	defer lease.Unlock(ctx)
+	var calls int32
+	release := make(chan struct{})
+	close(release)
+	var target string
+	require.NoError(t, mtc.GetOrLoad(ctx, "test-key", &target, countingLoad(&calls, release, "loaded")))
+	assert.Equal(t, "loaded", target)
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestGetOrLoadDistributedTakeover(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mtc := newTestLoaderCache(t, s, LoaderConfig{Distributed: true, WaitTimeout: time.Minute})
+	ctx := context.Background()
+
+	// The lease of a holder that died expires, and a waiter takes it over
+	s.Set("lock:load-lease:test-key", "dead-holder")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.Del("lock:load-lease:test-key")
+	}()
+	var calls int32
+	release := make(chan struct{})
+	close(release)
+	var target string
+	require.NoError(t, mtc.GetOrLoad(ctx, "test-key", &target, countingLoad(&calls, release, "loaded")))
+	assert.Equal(t, "loaded", target)
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestGetOrLoadDistributedLeavesNoKeys(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mtc := newTestLoaderCache(t, s, LoaderConfig{Distributed: true, LeaseTTL: time.Second})
+	ctx := context.Background()
+
+	// A released load lease and one whose holder died leave nothing behind once the value is gone
+	var calls int32
+	release := make(chan struct{})
+	close(release)
+	var target string
+	require.NoError(t, mtc.GetOrLoad(ctx, "test-key", &target, countingLoad(&calls, release, "loaded")))
+	lease, err := mtc.Loader.locker.tryLease(ctx, loadLeaseKeyPrefix+"other-key", time.Second)
+	require.NoError(t, err)
+	lease.stop()
+	<-lease.stopped
+	s.Del("test-key")
+	s.FastForward(time.Minute)
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	size, err := redis.Int(conn.Do("DBSIZE"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, size, "keys left behind: %v", s.Keys())
+}
+
+func TestGetOrLoadDeletedDuringLoad(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mtc := newTestLoaderCache(t, s, LoaderConfig{Distributed: true})
+	ctx := context.Background()
+
+	// A value loaded before the key is deleted is returned but not stored
+	var target string
+	require.NoError(t, mtc.GetOrLoad(ctx, "test-key", &target, func(ctx context.Context) (interface{}, error) {
+		require.NoError(t, mtc.Delete(ctx, "test-key"))
+		return "stale", nil
+	}))
+	assert.Equal(t, "stale", target)
+	assert.False(t, s.Exists("test-key"))
+	assert.NotContains(t, mtc.Local.(*MockCache).Cache, "test-key")
+}
+
+func TestReadLoadedBackfillsRemoteTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	encoder := &GobCacheEncoder{}
+	data, err := encoder.Encode("loaded")
+	require.NoError(t, err)
+	s.Set("test-key", string(data))
+	s.SetTTL("test-key", time.Minute)
+	lcc := LocalCacheConfig{TTL: time.Hour, Eviction: time.Hour}
+	local, err := lcc.NewCache(encoder, nil)
+	require.NoError(t, err)
+	remote := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	mtc := TieredCache{Local: local, Remote: remote}
+
+	before := time.Now()
+	var target string
+	value, ok := mtc.readLoaded(context.Background(), "test-key", &target)
+	require.True(t, ok)
+	assert.Equal(t, "loaded", value)
+	entry, err := local.Cache.Get("test-key")
+	require.NoError(t, err)
+	_, expiresAt, ok := decodeLocalEntry(entry)
+	require.True(t, ok)
+	assert.WithinDuration(t, before.Add(time.Minute), expiresAt, time.Second)
+}
+
+func TestAssignValue(t *testing.T) {
+	var target availability
+	require.NoError(t, assignValue(&target, availability{Facility: "a"}))
+	assert.Equal(t, availability{Facility: "a"}, target)
+	require.NoError(t, assignValue(&target, &availability{Facility: "b"}))
+	assert.Equal(t, availability{Facility: "b"}, target)
+	require.NoError(t, assignValue(&target, nil))
+	assert.Equal(t, availability{}, target)
+	assert.Error(t, assignValue(&target, "not availability"))
+}
+
+func TestLoaderConfigValidation(t *testing.T) {
+	for _, config := range []LoaderConfig{
+		{LeaseTTL: -time.Second},
+		{Distributed: true},
+		{MinBackoff: time.Second, MaxBackoff: time.Millisecond},
+	} {
+		_, err := NewLoader(config, nil)
+		assert.Error(t, err)
+	}
+}
@@ -16,7 +16,9 @@ package tieredcache
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/allegro/bigcache"
@@ -25,18 +27,148 @@ import (
 // LocalCache defines a remote-caching approach in which keys are stored remotely in a separate
 // process.
 type LocalCache struct {
-	Cache          *bigcache.BigCache
+	Cache          *bigcache.BigCache // The BigCache holding the entries, nil with other backends
+	Store          LocalStore         // Holds the entries, or Cache if nil
 	Encoder        CacheEncoder
 	Metrics        CacheMetrics
 	TracingEnabled bool
+	Tracer         Tracer       // Defaults to OpenTracingTracer if nil
+	KeySanitizer   KeySanitizer // Applied to keys before they are attached to spans
+	MaxEntrySize   int          // Largest entry in bytes SetBytes accepts, zero for no limit
+	stats          *localCacheStats
+}
+
+// bigcacheEntryOverhead is the number of bytes BigCache stores alongside each entry's key and value
+const bigcacheEntryOverhead = 22
+
+// localEntryHeaderSize is the number of bytes LocalCache prefixes each stored value with. The
+// header holds the time the entry expires as big-endian Unix nanoseconds, or zero if it only
+// expires with the cache TTL.
+const localEntryHeaderSize = 8
+
+// encodeLocalEntry returns value prefixed with its expiry header
+func encodeLocalEntry(value []byte, expiresAt time.Time) []byte {
+	entry := make([]byte, localEntryHeaderSize+len(value))
+	if !expiresAt.IsZero() {
+		binary.BigEndian.PutUint64(entry, uint64(expiresAt.UnixNano()))
+	}
+	copy(entry[localEntryHeaderSize:], value)
+	return entry
+}
+
+// decodeLocalEntry splits a stored entry into its value and expiry. ok is false if the entry is
+// too short to hold a header.
+func decodeLocalEntry(entry []byte) (value []byte, expiresAt time.Time, ok bool) {
+	if len(entry) < localEntryHeaderSize {
+		return nil, time.Time{}, false
+	}
+	if nanos := binary.BigEndian.Uint64(entry); nanos != 0 {
+		expiresAt = time.Unix(0, int64(nanos))
+	}
+	return entry[localEntryHeaderSize:], expiresAt, true
+}
+
+// localEntryExpired returns whether an entry's own expiry has passed at now
+func localEntryExpired(expiresAt, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// expiryAfter returns the time an entry given ttl expires, or zero if ttl is zero
+func expiryAfter(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// EntryTooLargeError is returned when a value is too large to be stored in local cache
+type EntryTooLargeError struct {
+	Key     string
+	Size    int
+	MaxSize int
+}
+
+// Error returns a description of the rejected entry
+func (etle *EntryTooLargeError) Error() string {
+	return fmt.Sprintf(
+		"entry of %d bytes exceeds the local cache limit of %d bytes", etle.Size, etle.MaxSize)
+}
+
+// EvictionReason describes why an entry was removed from local cache
+type EvictionReason string
+
+const (
+	// EvictionExpired is an entry removed because it outlived the cache TTL
+	EvictionExpired EvictionReason = "expired"
+	// EvictionNoSpace is an entry removed to make room for a new entry in a full cache
+	EvictionNoSpace EvictionReason = "no_space"
+	// EvictionDeleted is an entry removed by Delete
+	EvictionDeleted EvictionReason = "deleted"
+)
+
+// evictionReasons maps BigCache removal reasons to eviction reasons
+var evictionReasons = [...]EvictionReason{
+	bigcache.Expired: EvictionExpired,
+	bigcache.NoSpace: EvictionNoSpace,
+	bigcache.Deleted: EvictionDeleted,
+}
+
+// EvictionMetrics defines an interface for recording entries removed from local cache. CacheMetrics
+// implementations may optionally implement it. With Prometheus, evictions are reported by the
+// LocalCacheCollector instead.
+type EvictionMetrics interface {
+	Evict(reason EvictionReason)
+}
+
+// localCacheStats holds statistics about a LocalCache which BigCache does not track itself
+type localCacheStats struct {
+	evictions [len(evictionReasons)]uint64 // Indexed by bigcache.RemoveReason
+	maxBytes  int                          // Zero if the cache size is unbounded
+	metrics   EvictionMetrics
+	onEvict   func(key string, value []byte, reason EvictionReason)
+}
+
+// onRemove records the removal of an entry from BigCache. Entries removed after their own expiry
+// passed, whether lazily by Get or to make room, are recorded as expired.
+func (lcs *localCacheStats) onRemove(key string, entry []byte, reason bigcache.RemoveReason) {
+	if int(reason) >= len(lcs.evictions) {
+		return
+	}
+	value, expiresAt, _ := decodeLocalEntry(entry)
+	if localEntryExpired(expiresAt, time.Now()) {
+		reason = bigcache.Expired
+	}
+	atomic.AddUint64(&lcs.evictions[reason], 1)
+	if lcs.metrics != nil {
+		lcs.metrics.Evict(evictionReasons[reason])
+	}
+	if lcs.onEvict != nil {
+		// BigCache builds the key with an unsafe conversion, so copy it before handing it out
+		lcs.onEvict(string(append([]byte{}, key...)), value, evictionReasons[reason])
+	}
+}
+
+// evictionCount returns the number of entries removed for the given reason
+func (lcs *localCacheStats) evictionCount(reason bigcache.RemoveReason) uint64 {
+	return atomic.LoadUint64(&lcs.evictions[reason])
 }
 
 // LocalCacheConfig is the necessary configuration for instantiating a LocalCache struct
 type LocalCacheConfig struct {
-	Eviction       time.Duration
-	TTL            time.Duration
-	Shards         uint // Must be power of 2
-	TracingEnabled bool
+	Backend            string // LocalBackendBigCache, LocalBackendLRU, LocalBackendTinyLFU or LocalBackendMap
+	Eviction           time.Duration
+	TTL                time.Duration
+	Shards             uint          // Must be power of 2
+	HardMaxCacheSize   int           // Memory limit for entries in MB, zero for no limit
+	MaxEntriesInWindow int           // Used with MaxEntrySize to size the initial allocation
+	MaxEntrySize       int           // Largest entry in bytes, zero for no limit
+	CleanWindow        time.Duration // Interval between removals of expired entries, zero to disable
+	TracingEnabled     bool
+	TracerBackend      string       // TracerOpenTracing or TracerOpenTelemetry
+	KeySanitizer       KeySanitizer // Applied to keys before they are attached to spans
+	// OnEvict is called with the key, encoded value and reason whenever an entry leaves the cache.
+	// It is called while the backend holds a lock, so it must be fast and must not use the cache.
+	OnEvict func(key string, value []byte, reason EvictionReason)
 }
 
 // NewCache constructs and returns a LocalCache given configuration
@@ -44,91 +176,320 @@ func (lcc LocalCacheConfig) NewCache(
 	encoder CacheEncoder,
 	metrics CacheMetrics,
 ) (LocalCache, error) {
-	cache := LocalCache{Encoder: encoder, TracingEnabled: lcc.TracingEnabled}
-	if lcc.Shards != 0 && lcc.Shards%2 != 0 {
-		err := fmt.Errorf("shards must be power of 2 - %v is invalid", lcc.Shards)
+	cache := LocalCache{
+		Encoder:        encoder,
+		TracingEnabled: lcc.TracingEnabled,
+		KeySanitizer:   lcc.KeySanitizer,
+		stats:          &localCacheStats{onEvict: lcc.OnEvict},
+	}
+	if em, ok := metrics.(EvictionMetrics); ok {
+		cache.stats.metrics = em
+	}
+	tracer, err := NewTracer(lcc.TracerBackend)
+	if err != nil {
+		return cache, err
+	}
+	cache.Tracer = tracer
+	config, err := lcc.bigcacheConfig()
+	if err != nil {
 		return cache, err
 	}
+	if cache.MaxEntrySize, err = lcc.maxEntrySize(config); err != nil {
+		return cache, err
+	}
+	cache.stats.maxBytes = config.HardMaxCacheSize * 1024 * 1024
+	cache.Store, err = lcc.newLocalStore(config, cache.stats.onRemove)
+	if bc, ok := cache.Store.(*bigcache.BigCache); ok && err == nil {
+		cache.Cache = bc
+	}
+	if metrics != nil {
+		cache.Metrics = metrics
+	}
+	return cache, err
+}
+
+// bigcacheConfig returns the BigCache configuration corresponding to lcc
+func (lcc LocalCacheConfig) bigcacheConfig() (bigcache.Config, error) {
 	config := bigcache.DefaultConfig(lcc.Eviction)
+	if lcc.Shards != 0 && lcc.Shards&(lcc.Shards-1) != 0 {
+		return config, fmt.Errorf("shards must be power of 2 - %v is invalid", lcc.Shards)
+	}
+	for name, value := range map[string]int{
+		"hard max cache size":   lcc.HardMaxCacheSize,
+		"max entries in window": lcc.MaxEntriesInWindow,
+		"max entry size":        lcc.MaxEntrySize,
+	} {
+		if value < 0 {
+			return config, fmt.Errorf("%v must not be negative - %v is invalid", name, value)
+		}
+	}
+	if lcc.CleanWindow < 0 {
+		return config, fmt.Errorf("clean window must not be negative - %v is invalid", lcc.CleanWindow)
+	}
 	if lcc.TTL != 0 {
 		config.LifeWindow = lcc.TTL
 	}
 	if lcc.Shards != 0 {
 		config.Shards = int(lcc.Shards)
 	}
-	var err error
-	cache.Cache, err = bigcache.NewBigCache(config)
-	if metrics != nil {
-		cache.Metrics = metrics
+	if lcc.MaxEntriesInWindow != 0 {
+		config.MaxEntriesInWindow = lcc.MaxEntriesInWindow
 	}
-	return cache, err
+	if lcc.MaxEntrySize != 0 {
+		config.MaxEntrySize = lcc.MaxEntrySize
+	}
+	config.HardMaxCacheSize = lcc.HardMaxCacheSize
+	config.CleanWindow = lcc.CleanWindow
+	if config.HardMaxCacheSize > 0 && lcc.usesBigCache() {
+		// BigCache allocates its initial capacity regardless of the hard limit
+		initialBytes := config.MaxEntriesInWindow * config.MaxEntrySize
+		if maxBytes := config.HardMaxCacheSize * 1024 * 1024; initialBytes > maxBytes {
+			return config, fmt.Errorf(
+				"max entries in window (%v) times max entry size (%v) is %v bytes, "+
+					"which exceeds the hard max cache size of %v MB",
+				config.MaxEntriesInWindow, config.MaxEntrySize, initialBytes, config.HardMaxCacheSize,
+			)
+		}
+	}
+	return config, nil
 }
 
-// GetBytes gets the requested bytes from local cache
-func (lc LocalCache) GetBytes(ctx context.Context, key string) ([]byte, error) {
-	return lc.Cache.Get(key)
+// usesBigCache returns whether entries are stored in BigCache
+func (lcc LocalCacheConfig) usesBigCache() bool {
+	return lcc.Backend == "" || lcc.Backend == LocalBackendBigCache
 }
 
-// Get retrieves the value from cache, decodes it, and sets the result in target. target must be a
-// pointer.
-func (lc LocalCache) Get(ctx context.Context, key string, target interface{}) error {
-	data, err := lc.GetBytes(ctx, key)
-	if lc.Metrics != nil {
-		if err != nil {
-			lc.Metrics.Miss()
-		} else {
-			lc.Metrics.Hit()
+// maxEntrySize returns the largest entry that can be stored in a cache with the given config. In
+// BigCache an entry must fit in a single shard, so a hard max cache size also limits entry size.
+func (lcc LocalCacheConfig) maxEntrySize(config bigcache.Config) (int, error) {
+	maxEntrySize := lcc.MaxEntrySize
+	if config.HardMaxCacheSize > 0 {
+		shards := 1
+		if lcc.usesBigCache() {
+			shards = config.Shards
+		}
+		maxShardBytes := config.HardMaxCacheSize * 1024 * 1024 / shards
+		if maxEntrySize > maxShardBytes-bigcacheEntryOverhead {
+			return 0, fmt.Errorf(
+				"max entry size (%v) does not fit in a shard of %v bytes - "+
+					"increase the hard max cache size or decrease shards",
+				maxEntrySize, maxShardBytes,
+			)
 		}
+		if maxEntrySize == 0 {
+			maxEntrySize = maxShardBytes - bigcacheEntryOverhead
+		}
+	}
+	return maxEntrySize, nil
+}
+
+// store returns the LocalStore holding the entries of lc, or nil if there is none
+func (lc LocalCache) store() LocalStore {
+	if lc.Store != nil {
+		return lc.Store
+	}
+	if lc.Cache != nil {
+		return lc.Cache
 	}
+	return nil
+}
+
+// chain wraps the local lookup in tracing and metrics middlewares
+func (lc LocalCache) chain() Cache {
+	return instrument(
+		localLookup{lc}, lc.TracingEnabled, lc.Tracer, lc.KeySanitizer, "local-cache", lc.Metrics, TierLocal,
+	)
+}
+
+// GetBytes gets the requested bytes from local cache. Entries past their own expiry are deleted and
+// reported as missing.
+func (lc LocalCache) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	return lc.chain().GetBytes(ctx, key)
+}
+
+// entry returns the value stored under key and its own expiry, deleting it if that has passed
+func (lc LocalCache) entry(key string) ([]byte, time.Time, error) {
+	entry, err := lc.store().Get(key)
 	if err != nil {
-		return err
+		return nil, time.Time{}, err
+	}
+	value, expiresAt, ok := decodeLocalEntry(entry)
+	if !ok || localEntryExpired(expiresAt, time.Now()) {
+		lc.store().Delete(key)
+		return nil, time.Time{}, ErrEntryNotFound
 	}
-	return lc.Encoder.Decode(data, target)
+	return value, expiresAt, nil
 }
 
-// SetBytes sets the provided bytes in the local cache on the provided key
+// setEntry stores value under key until ttl has passed, rejecting entries larger than MaxEntrySize
+func (lc LocalCache) setEntry(key string, value []byte, ttl time.Duration) error {
+	size := len(key) + localEntryHeaderSize + len(value)
+	if lc.MaxEntrySize > 0 && size > lc.MaxEntrySize {
+		return &EntryTooLargeError{Key: key, Size: size, MaxSize: lc.MaxEntrySize}
+	}
+	return lc.store().Set(key, encodeLocalEntry(value, expiryAfter(ttl)))
+}
+
+// Get retrieves the value from cache, decodes it, and sets the result in target. target must be a
+// pointer. Values that fail integrity verification are evicted and returned as a *TamperError.
+func (lc LocalCache) Get(ctx context.Context, key string, target interface{}) error {
+	return lc.chain().Get(ctx, key, target)
+}
+
+// SetBytes sets the provided bytes in the local cache on the provided key. Entries larger than
+// MaxEntrySize are rejected with an *EntryTooLargeError.
 func (lc LocalCache) SetBytes(ctx context.Context, key string, value []byte) error {
-	return lc.Cache.Set(key, value)
+	return lc.chain().SetBytes(ctx, key, value)
+}
+
+// SetBytesWithTTL is like SetBytes, but the entry also expires once ttl has passed. A ttl of zero
+// leaves the entry to expire with the cache TTL.
+func (lc LocalCache) SetBytesWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return setBytesWithTTL(ctx, lc.chain(), key, value, ttl)
 }
 
 // Set encodes the provided value and sets it in the local cache
 func (lc LocalCache) Set(ctx context.Context, key string, value interface{}) error {
-	encodedData, err := lc.Encoder.Encode(value)
-	if lc.Metrics != nil {
-		if err != nil {
-			lc.Metrics.SetCollision()
-		} else {
-			lc.Metrics.Set()
-		}
-	}
-	if err != nil {
-		return err
-	}
-	return lc.SetBytes(ctx, key, encodedData)
+	return lc.chain().Set(ctx, key, value)
+}
+
+// SetWithTTL encodes the provided value and sets it in the local cache until ttl has passed. A ttl
+// of zero leaves the entry to expire with the cache TTL.
+func (lc LocalCache) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return setWithTTL(ctx, lc.chain(), key, value, ttl)
 }
 
 // Delete removes the value from local cache
 func (lc LocalCache) Delete(ctx context.Context, key string) error {
-	err := lc.Cache.Delete(key)
-	if lc.Metrics != nil {
-		if err != nil {
-			lc.Metrics.DeleteMiss()
-		} else {
-			lc.Metrics.DeleteHit()
-		}
-	}
-	return err
+	return lc.chain().Delete(ctx, key)
 }
 
 // Purge wipes out all items in local cache
 func (lc LocalCache) Purge(ctx context.Context) error {
-	err := lc.Cache.Reset()
-	if lc.Metrics != nil {
-		if err != nil {
-			lc.Metrics.PurgeMiss()
-		} else {
-			lc.Metrics.PurgeHit()
+	return lc.chain().Purge(ctx)
+}
+
+// Exists reports whether key is in local cache, without decoding its value
+func (lc LocalCache) Exists(ctx context.Context, key string) (bool, error) {
+	return lc.chain().Exists(ctx, key)
+}
+
+// TTL returns the time left until key expires from local cache, or zero if the entry only expires
+// with the cache TTL. Missing keys return ErrEntryNotFound.
+func (lc LocalCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return lc.chain().TTL(ctx, key)
+}
+
+// Touch extends the expiry of key so that it lives for at least ttl. The entry is rewritten, which
+// also restarts its cache TTL. Missing keys return ErrEntryNotFound.
+func (lc LocalCache) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	return lc.chain().Touch(ctx, key, ttl)
+}
+
+// Expire sets the expiry of key to ttl from now, or leaves it to expire with the cache TTL if ttl
+// is zero. Missing keys return ErrEntryNotFound.
+func (lc LocalCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return lc.chain().Expire(ctx, key, ttl)
+}
+
+// localLookup performs operations against the local store without instrumentation
+type localLookup struct {
+	LocalCache
+}
+
+// GetBytes reads the bytes stored under key
+func (ll localLookup) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := ll.entry(key)
+	return value, err
+}
+
+// Get reads and decodes the value stored under key, tagging the current span with its size and
+// decode time
+func (ll localLookup) Get(ctx context.Context, key string, target interface{}) error {
+	data, _, err := ll.entry(key)
+	if err != nil {
+		return err
+	}
+	err = decodeTraced(tierSpan(ctx, ll.TracingEnabled), ll.Encoder, key, data, target)
+	if _, tampered := err.(*TamperError); tampered {
+		// Treat values that fail verification as a miss and evict them
+		ll.store().Delete(key)
+		if tm, ok := ll.Metrics.(TamperMetrics); ok {
+			tm.Tamper()
 		}
 	}
 	return err
 }
+
+// SetBytes stores the bytes under key
+func (ll localLookup) SetBytes(ctx context.Context, key string, value []byte) error {
+	return ll.setEntry(key, value, 0)
+}
+
+// SetBytesWithTTL stores the bytes under key until ttl has passed
+func (ll localLookup) SetBytesWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return ll.setEntry(key, value, ttl)
+}
+
+// Set encodes the value and stores it under key
+func (ll localLookup) Set(ctx context.Context, key string, value interface{}) error {
+	return ll.SetWithTTL(ctx, key, value, 0)
+}
+
+// SetWithTTL encodes the value and stores it under key until ttl has passed
+func (ll localLookup) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	encodedData, err := encodeValue(ll.Encoder, key, value)
+	if err != nil {
+		return err
+	}
+	return ll.setEntry(key, encodedData, ttl)
+}
+
+// Delete removes the entry stored under key
+func (ll localLookup) Delete(ctx context.Context, key string) error {
+	return ll.store().Delete(key)
+}
+
+// Purge removes every entry
+func (ll localLookup) Purge(ctx context.Context) error {
+	return ll.store().Reset()
+}
+
+// Exists reports whether an unexpired entry is stored under key
+func (ll localLookup) Exists(ctx context.Context, key string) (bool, error) {
+	_, _, err := ll.entry(key)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// TTL returns the time left until the entry under key expires
+func (ll localLookup) TTL(ctx context.Context, key string) (time.Duration, error) {
+	_, expiresAt, err := ll.entry(key)
+	if err != nil || expiresAt.IsZero() {
+		return 0, err
+	}
+	return time.Until(expiresAt), nil
+}
+
+// Touch rewrites the entry under key so that it lives for at least ttl
+func (ll localLookup) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	value, expiresAt, err := ll.entry(key)
+	if err != nil {
+		return err
+	}
+	if !expiresAt.IsZero() && time.Until(expiresAt) < ttl {
+		expiresAt = expiryAfter(ttl)
+	}
+	return ll.store().Set(key, encodeLocalEntry(value, expiresAt))
+}
+
+// Expire rewrites the entry under key to expire ttl from now
+func (ll localLookup) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	value, _, err := ll.entry(key)
+	if err != nil {
+		return err
+	}
+	return ll.store().Set(key, encodeLocalEntry(value, expiryAfter(ttl)))
+}
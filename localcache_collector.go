@@ -0,0 +1,149 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/allegro/bigcache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cacheID identifies a cache registered with a collector
+type cacheID struct {
+	client string
+	name   string
+}
+
+// LocalCacheCollector is a Prometheus collector that reports the size and internal statistics of
+// registered LocalCaches. Values are read from BigCache when metrics are scraped, so registering a
+// cache adds no overhead to cache operations.
+type LocalCacheCollector struct {
+	entries      *prometheus.Desc
+	bytes        *prometheus.Desc
+	maxBytes     *prometheus.Desc
+	hits         *prometheus.Desc
+	misses       *prometheus.Desc
+	deleteHits   *prometheus.Desc
+	deleteMisses *prometheus.Desc
+	collisions   *prometheus.Desc
+	evictions    *prometheus.Desc
+	mutex        sync.RWMutex
+	localCaches  map[cacheID]LocalCache
+}
+
+// NewLocalCacheCollector creates a LocalCacheCollector and registers it as described by opts. If
+// a collector was already registered with the same options it is returned instead.
+func NewLocalCacheCollector(opts PrometheusCacheMetricsOptions) (*LocalCacheCollector, error) {
+	labels := []string{"client", "cache_name"}
+	desc := func(name, help string, labels []string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, name), help, labels, opts.ConstLabels,
+		)
+	}
+	lcc := &LocalCacheCollector{
+		entries:    desc("cache_local_entries", "Number of entries in local cache", labels),
+		bytes:      desc("cache_local_bytes", "Number of bytes allocated or used by local cache", labels),
+		maxBytes:   desc("cache_local_max_bytes", "Maximum number of bytes local cache may allocate", labels),
+		hits:       desc("cache_local_stats_hits", "Total number of keys found in local cache", labels),
+		misses:     desc("cache_local_stats_misses", "Total number of keys not found in local cache", labels),
+		deleteHits: desc("cache_local_stats_delete_hits", "Total number of keys deleted from local cache", labels),
+		deleteMisses: desc(
+			"cache_local_stats_delete_misses", "Total number of deleted keys not found in local cache", labels,
+		),
+		collisions: desc("cache_local_collisions", "Total number of key collisions in local cache", labels),
+		evictions: desc(
+			"cache_local_evictions",
+			"Total number of entries removed from local cache by reason",
+			append(labels, "reason"),
+		),
+		localCaches: make(map[cacheID]LocalCache),
+	}
+	collector, err := registerCollector(opts.registerer(), lcc)
+	if err != nil {
+		return nil, err
+	}
+	existing, ok := collector.(*LocalCacheCollector)
+	if !ok {
+		return nil, fmt.Errorf("collector registered for local cache metrics is not a LocalCacheCollector")
+	}
+	return existing, nil
+}
+
+// Register adds a LocalCache to the collector under the given client and cache name, replacing
+// any cache previously registered under the same names
+func (lcc *LocalCacheCollector) Register(client, cacheName string, cache LocalCache) {
+	lcc.mutex.Lock()
+	defer lcc.mutex.Unlock()
+	lcc.localCaches[cacheID{client, cacheName}] = cache
+}
+
+// Unregister removes the LocalCache registered under the given client and cache name
+func (lcc *LocalCacheCollector) Unregister(client, cacheName string) {
+	lcc.mutex.Lock()
+	defer lcc.mutex.Unlock()
+	delete(lcc.localCaches, cacheID{client, cacheName})
+}
+
+// Describe sends the descriptors of every metric reported by the collector
+func (lcc *LocalCacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		lcc.entries, lcc.bytes, lcc.maxBytes, lcc.hits, lcc.misses,
+		lcc.deleteHits, lcc.deleteMisses, lcc.collisions, lcc.evictions,
+	} {
+		ch <- desc
+	}
+}
+
+// Collect reads the current statistics of every registered LocalCache
+func (lcc *LocalCacheCollector) Collect(ch chan<- prometheus.Metric) {
+	lcc.mutex.RLock()
+	defer lcc.mutex.RUnlock()
+	for id, cache := range lcc.localCaches {
+		store := cache.store()
+		if store == nil {
+			continue
+		}
+		gauge := func(desc *prometheus.Desc, value float64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, id.client, id.name)
+		}
+		counter := func(desc *prometheus.Desc, value float64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, id.client, id.name)
+		}
+		gauge(lcc.entries, float64(store.Len()))
+		if storeStats, ok := store.(localStoreStats); ok {
+			stats := storeStats.Stats()
+			gauge(lcc.bytes, float64(storeStats.Capacity()))
+			counter(lcc.hits, float64(stats.Hits))
+			counter(lcc.misses, float64(stats.Misses))
+			counter(lcc.deleteHits, float64(stats.DelHits))
+			counter(lcc.deleteMisses, float64(stats.DelMisses))
+			counter(lcc.collisions, float64(stats.Collisions))
+		}
+		if cache.stats == nil {
+			continue
+		}
+		if cache.stats.maxBytes > 0 {
+			gauge(lcc.maxBytes, float64(cache.stats.maxBytes))
+		}
+		for reason, label := range evictionReasons {
+			ch <- prometheus.MustNewConstMetric(
+				lcc.evictions, prometheus.CounterValue,
+				float64(cache.stats.evictionCount(bigcache.RemoveReason(reason))), id.client, id.name, string(label),
+			)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatherLocalCacheMetrics returns the value of every gathered metric keyed by name and, for
+// evictions, reason
+func gatherLocalCacheMetrics(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			name := family.GetName()
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "reason" {
+					name += ":" + label.GetValue()
+				}
+			}
+			values[name] = metricValue(metric)
+		}
+	}
+	return values
+}
+
+// metricValue returns the value of a gauge or counter
+func metricValue(metric *dto.Metric) float64 {
+	if metric.GetGauge() != nil {
+		return metric.GetGauge().GetValue()
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestLocalCacheCollector(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	lcc, err := NewLocalCacheCollector(PrometheusCacheMetricsOptions{Registerer: registry})
+	require.NoError(t, err)
+	cache := newLocalCache(t, 0, 0)
+	cache.Metrics = nil
+	lcc.Register("client", "name", cache)
+
+	require.NoError(t, cache.SetBytes(context.Background(), "a", []byte("value")))
+	require.NoError(t, cache.SetBytes(context.Background(), "b", []byte("value")))
+	_, err = cache.GetBytes(context.Background(), "a")
+	require.NoError(t, err)
+	_, err = cache.GetBytes(context.Background(), "missing")
+	require.Error(t, err)
+	require.NoError(t, cache.Cache.Delete("b"))
+
+	values := gatherLocalCacheMetrics(t, registry)
+	assert.Equal(t, float64(1), values["cache_local_entries"])
+	assert.True(t, values["cache_local_bytes"] > 0)
+	assert.Equal(t, float64(1), values["cache_local_stats_hits"])
+	assert.Equal(t, float64(1), values["cache_local_stats_misses"])
+	assert.Equal(t, float64(1), values["cache_local_stats_delete_hits"])
+	assert.Equal(t, float64(0), values["cache_local_collisions"])
+	assert.Equal(t, float64(1), values["cache_local_evictions:deleted"])
+	assert.Equal(t, float64(0), values["cache_local_evictions:expired"])
+	assert.Equal(t, float64(0), values["cache_local_evictions:no_space"])
+
+	lcc.Unregister("client", "name")
+	assert.Empty(t, gatherLocalCacheMetrics(t, registry))
+}
+
+// Test that creating a second collector with the same options returns the registered one
+func TestLocalCacheCollectorAlreadyRegistered(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	opts := PrometheusCacheMetricsOptions{Registerer: registry}
+	first, err := NewLocalCacheCollector(opts)
+	require.NoError(t, err)
+	second, err := NewLocalCacheCollector(opts)
+	require.NoError(t, err)
+	assert.True(t, first == second)
+}
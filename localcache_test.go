@@ -20,6 +20,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/allegro/bigcache"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -44,10 +45,70 @@ func TestLocalInvalidShards(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestLocalCacheConfigValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		lcc   LocalCacheConfig
+		valid bool
+	}{
+		{"defaults", LocalCacheConfig{}, true},
+		{"power of two shards", LocalCacheConfig{Shards: 8}, true},
+		{"even shards that are not a power of two", LocalCacheConfig{Shards: 6}, false},
+		{"negative max entry size", LocalCacheConfig{MaxEntrySize: -1}, false},
+		{"negative clean window", LocalCacheConfig{CleanWindow: -time.Second}, false},
+		{
+			"initial allocation within hard limit",
+			LocalCacheConfig{Shards: 16, HardMaxCacheSize: 1, MaxEntriesInWindow: 100, MaxEntrySize: 1024},
+			true,
+		},
+		{
+			"initial allocation exceeds hard limit",
+			LocalCacheConfig{Shards: 16, HardMaxCacheSize: 1, MaxEntriesInWindow: 10000, MaxEntrySize: 1024},
+			false,
+		},
+		{
+			"max entry size larger than a shard",
+			LocalCacheConfig{Shards: 16, HardMaxCacheSize: 1, MaxEntriesInWindow: 1, MaxEntrySize: 512 * 1024},
+			false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.lcc.Eviction = time.Second
+			_, err := test.lcc.NewCache(&MockedCacheEncoder{}, nil)
+			if test.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestLocalSetBytesTooLarge(t *testing.T) {
+	lcc := LocalCacheConfig{Eviction: time.Second, Shards: 16, HardMaxCacheSize: 1, MaxEntriesInWindow: 10, MaxEntrySize: 100}
+	lc, err := lcc.NewCache(&MockedCacheEncoder{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 100, lc.MaxEntrySize)
+	require.NoError(t, lc.SetBytes(context.Background(), "key", make([]byte, 80)))
+	err = lc.SetBytes(context.Background(), "key", make([]byte, 100))
+	require.IsType(t, &EntryTooLargeError{}, err)
+	assert.Equal(t, 111, err.(*EntryTooLargeError).Size)
+
+	// Without an explicit limit, entries are limited by the size of a shard
+	lcc.MaxEntrySize = 0
+	lc, err = lcc.NewCache(&MockedCacheEncoder{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1024*1024/16-bigcacheEntryOverhead, lc.MaxEntrySize)
+	assert.IsType(t, &EntryTooLargeError{}, lc.SetBytes(context.Background(), "key", make([]byte, 1024*1024/16)))
+}
+
 func TestLocalSetBytes(t *testing.T) {
 	lc := newLocalCache(t, 0, 0)
+	lc.Metrics.(*MockCacheMetrics).On("Set")
 	err := lc.SetBytes(context.Background(), "test-key", []byte("test-value"))
 	assert.Nil(t, err)
+	lc.Metrics.(*MockCacheMetrics).AssertCalled(t, "Set")
 }
 
 func TestLocalSet(t *testing.T) {
@@ -74,11 +135,13 @@ func TestLocalGetBytes(t *testing.T) {
 	lc := newLocalCache(t, 0, 0)
 
 	// Use underlying cache to avoid testing two functions in one test
-	err := lc.Cache.Set("test-key", []byte("test-value"))
+	err := lc.Cache.Set("test-key", encodeLocalEntry([]byte("test-value"), time.Time{}))
 	require.Nil(t, err)
+	lc.Metrics.(*MockCacheMetrics).On("Hit")
 	value, err := lc.GetBytes(context.Background(), "test-key")
 	assert.Nil(t, err)
 	assert.Equal(t, value, []byte("test-value"))
+	lc.Metrics.(*MockCacheMetrics).AssertCalled(t, "Hit")
 }
 
 func TestLocalGet(t *testing.T) {
@@ -86,7 +149,7 @@ func TestLocalGet(t *testing.T) {
 	lc.Metrics.(*MockCacheMetrics).On("Hit")
 
 	// Use underlying cache to avoid testing two functions in one test
-	err := lc.Cache.Set("test-key", []byte("test-value"))
+	err := lc.Cache.Set("test-key", encodeLocalEntry([]byte("test-value"), time.Time{}))
 	require.Nil(t, err)
 	target := struct{}{}
 	lc.Encoder.(*MockedCacheEncoder).On("Decode", []byte("test-value"), target).Return(nil)
@@ -106,11 +169,25 @@ func TestLocalGetError(t *testing.T) {
 	lc.Metrics.(*MockCacheMetrics).AssertCalled(t, "Miss")
 }
 
+func TestLocalGetDecodeError(t *testing.T) {
+	lc := newLocalCache(t, 0, 0)
+	require.NoError(t, lc.Cache.Set("test-key", encodeLocalEntry([]byte("test-value"), time.Time{})))
+
+	// Decode failures are reported the same way by the tier and by middlewares
+	target := struct{}{}
+	lc.Encoder.(*MockedCacheEncoder).On("Decode", []byte("test-value"), target).Return(fmt.Errorf("error"))
+	err := lc.Get(context.Background(), "test-key", target)
+	assert.IsType(t, &DecodeError{}, err)
+	assert.Equal(t, ResultDecodeError, getResult(err))
+}
+
 func TestLocalGetBytesError(t *testing.T) {
 	lc := newLocalCache(t, 0, 0)
+	lc.Metrics.(*MockCacheMetrics).On("Miss")
 	value, err := lc.GetBytes(context.Background(), "test-key")
 	assert.Error(t, err)
 	assert.Nil(t, value)
+	lc.Metrics.(*MockCacheMetrics).AssertCalled(t, "Miss")
 }
 
 func TestLocalDelete(t *testing.T) {
@@ -118,7 +195,7 @@ func TestLocalDelete(t *testing.T) {
 	lc.Metrics.(*MockCacheMetrics).On("DeleteHit")
 
 	// Use underlying cache to avoid testing two functions in one test
-	err := lc.Cache.Set("test-key", []byte("test-value"))
+	err := lc.Cache.Set("test-key", encodeLocalEntry([]byte("test-value"), time.Time{}))
 	assert.Nil(t, err)
 	err = lc.Delete(context.Background(), "test-key")
 	assert.Nil(t, err)
@@ -140,3 +217,160 @@ func TestLocalPurge(t *testing.T) {
 	assert.Nil(t, err)
 	lc.Metrics.(*MockCacheMetrics).AssertCalled(t, "PurgeHit")
 }
+
+func TestLocalGetTampered(t *testing.T) {
+	lc := newLocalCache(t, 0, 0)
+	enc, err := NewSigningCacheEncoder(&GobCacheEncoder{}, []byte("secret"))
+	require.NoError(t, err)
+	lc.Encoder = enc
+	lc.Metrics.(*MockCacheMetrics).On("Miss")
+	lc.Metrics.(*MockCacheMetrics).On("Tamper")
+
+	// Use underlying cache to plant an unsigned value
+	err = lc.Cache.Set("test-key", encodeLocalEntry([]byte("test-value"), time.Time{}))
+	require.Nil(t, err)
+	err = lc.Get(context.Background(), "test-key", &testEncodable{})
+	assert.IsType(t, &TamperError{}, err)
+	lc.Metrics.(*MockCacheMetrics).AssertCalled(t, "Miss")
+	lc.Metrics.(*MockCacheMetrics).AssertCalled(t, "Tamper")
+	_, err = lc.Cache.Get("test-key")
+	assert.Error(t, err)
+}
+
+// evictionRecorder is an EvictionMetrics that remembers the reasons it observed
+type evictionRecorder struct {
+	MockCacheMetrics
+	reasons []EvictionReason
+}
+
+func (er *evictionRecorder) Evict(reason EvictionReason) {
+	er.reasons = append(er.reasons, reason)
+}
+
+func TestLocalOnEvict(t *testing.T) {
+	type eviction struct {
+		key    string
+		value  string
+		reason EvictionReason
+	}
+	var evictions []eviction
+	metrics := &evictionRecorder{}
+	lcc := LocalCacheConfig{
+		TTL:      time.Second,
+		Eviction: time.Second,
+		OnEvict: func(key string, value []byte, reason EvictionReason) {
+			evictions = append(evictions, eviction{key, string(value), reason})
+		},
+	}
+	lc, err := lcc.NewCache(&MockedCacheEncoder{}, metrics)
+	require.NoError(t, err)
+	metrics.On("Set")
+	require.NoError(t, lc.SetBytes(context.Background(), "test-key", []byte("test-value")))
+	require.NoError(t, lc.Cache.Delete("test-key"))
+	assert.Equal(t, []eviction{{"test-key", "test-value", EvictionDeleted}}, evictions)
+	assert.Equal(t, []EvictionReason{EvictionDeleted}, metrics.reasons)
+}
+
+func TestLocalSetBytesWithTTL(t *testing.T) {
+	metrics := &evictionRecorder{}
+	lcc := LocalCacheConfig{TTL: time.Minute, Eviction: time.Minute}
+	lc, err := lcc.NewCache(&MockedCacheEncoder{}, metrics)
+	require.NoError(t, err)
+	metrics.On("Set")
+	metrics.On("Hit")
+	metrics.On("Miss")
+	ctx := context.Background()
+	require.NoError(t, lc.SetBytesWithTTL(ctx, "short", []byte("test-value"), 10*time.Millisecond))
+	require.NoError(t, lc.SetBytesWithTTL(ctx, "long", []byte("test-value"), 0))
+	value, err := lc.GetBytes(ctx, "short")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("test-value"), value)
+
+	time.Sleep(20 * time.Millisecond)
+	_, err = lc.GetBytes(ctx, "short")
+	assert.Equal(t, ErrEntryNotFound, err)
+	_, err = lc.GetBytes(ctx, "long")
+	assert.NoError(t, err)
+	// The expired entry is deleted lazily and recorded as expired
+	_, err = lc.Cache.Get("short")
+	assert.Error(t, err)
+	assert.Equal(t, []EvictionReason{EvictionExpired}, metrics.reasons)
+}
+
+func TestLocalBackends(t *testing.T) {
+	for _, backend := range []string{LocalBackendBigCache, LocalBackendLRU, LocalBackendTinyLFU, LocalBackendMap} {
+		t.Run(backend, func(t *testing.T) {
+			lcc := LocalCacheConfig{Backend: backend, Eviction: time.Second, HardMaxCacheSize: 1, MaxEntriesInWindow: 100}
+			lc, err := lcc.NewCache(&GobCacheEncoder{}, nil)
+			require.NoError(t, err)
+			assert.Equal(t, backend == LocalBackendBigCache, lc.Cache != nil)
+			require.NoError(t, lc.Set(context.Background(), "test-key", "test-value"))
+			var target string
+			require.NoError(t, lc.Get(context.Background(), "test-key", &target))
+			assert.Equal(t, "test-value", target)
+			require.NoError(t, lc.Delete(context.Background(), "test-key"))
+			assert.Error(t, lc.Get(context.Background(), "test-key", &target))
+		})
+	}
+}
+
+func TestLocalCacheWithoutStore(t *testing.T) {
+	// A LocalCache built around a BigCache without setting Store uses the BigCache
+	bc, err := bigcache.NewBigCache(bigcache.DefaultConfig(time.Minute))
+	require.NoError(t, err)
+	lc := LocalCache{Cache: bc, Encoder: &GobCacheEncoder{}}
+	require.NoError(t, lc.Set(context.Background(), "test-key", "test-value"))
+	var target string
+	require.NoError(t, lc.Get(context.Background(), "test-key", &target))
+	assert.Equal(t, "test-value", target)
+	assert.Equal(t, 1, bc.Len())
+}
+
+func TestLocalExistsTTLTouchExpire(t *testing.T) {
+	lc := newLocalCache(t, time.Minute, time.Minute)
+	lc.Metrics.(*MockCacheMetrics).On("Set")
+	lc.Metrics.(*MockCacheMetrics).On("Hit")
+	ctx := context.Background()
+	require.NoError(t, lc.SetBytesWithTTL(ctx, "key", []byte("value"), time.Second))
+
+	found, err := lc.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = lc.Exists(ctx, "missing")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	ttl, err := lc.TTL(ctx, "key")
+	require.NoError(t, err)
+	assert.InDelta(t, float64(time.Second), float64(ttl), float64(100*time.Millisecond))
+	_, err = lc.TTL(ctx, "missing")
+	assert.Equal(t, ErrEntryNotFound, err)
+
+	// Touch extends the expiry but never shortens it
+	require.NoError(t, lc.Touch(ctx, "key", time.Hour))
+	ttl, _ = lc.TTL(ctx, "key")
+	assert.True(t, ttl > time.Minute)
+	require.NoError(t, lc.Touch(ctx, "key", time.Second))
+	ttl, _ = lc.TTL(ctx, "key")
+	assert.True(t, ttl > time.Minute)
+	assert.Equal(t, ErrEntryNotFound, lc.Touch(ctx, "missing", time.Hour))
+
+	// Expire sets the expiry exactly, and zero leaves the entry to the cache TTL
+	require.NoError(t, lc.Expire(ctx, "key", time.Second))
+	ttl, _ = lc.TTL(ctx, "key")
+	assert.True(t, ttl <= time.Second)
+	require.NoError(t, lc.Expire(ctx, "key", 0))
+	ttl, _ = lc.TTL(ctx, "key")
+	assert.Zero(t, ttl)
+	value, err := lc.GetBytes(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+	assert.Equal(t, ErrEntryNotFound, lc.Expire(ctx, "missing", time.Second))
+
+	// Entries whose expiry has passed no longer exist
+	require.NoError(t, lc.Expire(ctx, "key", time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	found, err = lc.Exists(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, found)
+}
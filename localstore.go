@@ -0,0 +1,246 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/allegro/bigcache"
+)
+
+// Local cache backends selectable by name
+const (
+	// LocalBackendBigCache stores entries in BigCache, which evicts the oldest entries first
+	LocalBackendBigCache = "bigcache"
+	// LocalBackendLRU stores entries in a size-bounded cache that evicts the least recently used
+	// entries first
+	LocalBackendLRU = "lru"
+	// LocalBackendTinyLFU stores entries in a size-bounded W-TinyLFU cache, which only admits new
+	// entries that are used more frequently than the entries they would replace
+	LocalBackendTinyLFU = "tinylfu"
+	// LocalBackendMap stores entries in an unbounded map. It is intended for tests.
+	LocalBackendMap = "map"
+)
+
+// ErrEntryNotFound is returned by LocalStores for keys they do not hold
+var ErrEntryNotFound = bigcache.ErrEntryNotFound
+
+// LocalStore stores the entries of a LocalCache. *bigcache.BigCache implements it.
+type LocalStore interface {
+	Get(key string) ([]byte, error)
+	Set(key string, entry []byte) error
+	Delete(key string) error
+	Reset() error
+	Len() int
+}
+
+// localStoreStats is implemented by LocalStores that report BigCache-style statistics
+type localStoreStats interface {
+	Stats() bigcache.Stats
+	Capacity() int
+}
+
+// removeCallback is called when an entry is removed from a LocalStore
+type removeCallback func(key string, entry []byte, reason bigcache.RemoveReason)
+
+// newLocalStore creates the LocalStore for the configured backend. onRemove is called whenever an
+// entry is removed other than by Reset.
+func (lcc LocalCacheConfig) newLocalStore(config bigcache.Config, onRemove removeCallback) (LocalStore, error) {
+	maxBytes := config.HardMaxCacheSize * 1024 * 1024
+	switch lcc.Backend {
+	case "", LocalBackendBigCache:
+		config.OnRemoveWithReason = onRemove
+		return bigcache.NewBigCache(config)
+	case LocalBackendMap:
+		return newMapStore(config.LifeWindow, onRemove), nil
+	case LocalBackendLRU:
+		if maxBytes == 0 {
+			return nil, fmt.Errorf("the lru backend requires a hard max cache size")
+		}
+		return newLRUStore(maxBytes, config.LifeWindow, onRemove), nil
+	case LocalBackendTinyLFU:
+		if maxBytes == 0 {
+			return nil, fmt.Errorf("the tinylfu backend requires a hard max cache size")
+		}
+		return newTinyLFUStore(maxBytes, maxBytes/config.MaxEntrySize, config.LifeWindow, onRemove), nil
+	}
+	return nil, fmt.Errorf("unknown local cache backend %q", lcc.Backend)
+}
+
+// storeStats counts the outcome of LocalStore operations
+type storeStats struct {
+	hits      int64
+	misses    int64
+	delHits   int64
+	delMisses int64
+}
+
+// Stats returns the counts in the form reported by BigCache
+func (ss *storeStats) Stats() bigcache.Stats {
+	return bigcache.Stats{
+		Hits:      atomic.LoadInt64(&ss.hits),
+		Misses:    atomic.LoadInt64(&ss.misses),
+		DelHits:   atomic.LoadInt64(&ss.delHits),
+		DelMisses: atomic.LoadInt64(&ss.delMisses),
+	}
+}
+
+// recordGet counts a read as a hit or miss
+func (ss *storeStats) recordGet(found bool) {
+	if found {
+		atomic.AddInt64(&ss.hits, 1)
+	} else {
+		atomic.AddInt64(&ss.misses, 1)
+	}
+}
+
+// recordDelete counts a deletion as a hit or miss
+func (ss *storeStats) recordDelete(found bool) {
+	if found {
+		atomic.AddInt64(&ss.delHits, 1)
+	} else {
+		atomic.AddInt64(&ss.delMisses, 1)
+	}
+}
+
+// storeEntry is an entry held by one of the LocalStores in this package
+type storeEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time // Zero if the entry never expires
+}
+
+// newStoreEntry copies value into a new entry that expires after lifeWindow, if it is not zero
+func newStoreEntry(key string, value []byte, now time.Time, lifeWindow time.Duration) *storeEntry {
+	entry := &storeEntry{key: key, value: append([]byte{}, value...)}
+	if lifeWindow > 0 {
+		entry.expiresAt = now.Add(lifeWindow)
+	}
+	return entry
+}
+
+// valueCopy returns a copy of the entry's value, so that callers cannot modify the stored entry,
+// as BigCache does
+func (se *storeEntry) valueCopy() []byte {
+	return append([]byte{}, se.value...)
+}
+
+// size returns the number of bytes the entry counts against a size limit
+func (se *storeEntry) size() int {
+	return len(se.key) + len(se.value)
+}
+
+// expired returns whether the entry has outlived its life window
+func (se *storeEntry) expired(now time.Time) bool {
+	return !se.expiresAt.IsZero() && !now.Before(se.expiresAt)
+}
+
+// mapStore is an unbounded LocalStore backed by a map. Expired entries are removed when read.
+type mapStore struct {
+	storeStats
+	mutex      sync.Mutex
+	entries    map[string]*storeEntry
+	bytes      int
+	lifeWindow time.Duration
+	onRemove   removeCallback
+	now        func() time.Time
+}
+
+// newMapStore creates an empty mapStore
+func newMapStore(lifeWindow time.Duration, onRemove removeCallback) *mapStore {
+	return &mapStore{
+		entries:    make(map[string]*storeEntry),
+		lifeWindow: lifeWindow,
+		onRemove:   onRemove,
+		now:        time.Now,
+	}
+}
+
+// Get returns a copy of the value stored under key
+func (ms *mapStore) Get(key string) ([]byte, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	entry, ok := ms.entries[key]
+	if ok && entry.expired(ms.now()) {
+		ms.remove(entry, bigcache.Expired)
+		ok = false
+	}
+	ms.recordGet(ok)
+	if !ok {
+		return nil, ErrEntryNotFound
+	}
+	return entry.valueCopy(), nil
+}
+
+// Set stores a copy of value under key
+func (ms *mapStore) Set(key string, value []byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if old, ok := ms.entries[key]; ok {
+		ms.bytes -= old.size()
+	}
+	entry := newStoreEntry(key, value, ms.now(), ms.lifeWindow)
+	ms.entries[key] = entry
+	ms.bytes += entry.size()
+	return nil
+}
+
+// Delete removes the value stored under key
+func (ms *mapStore) Delete(key string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	entry, ok := ms.entries[key]
+	ms.recordDelete(ok)
+	if !ok {
+		return ErrEntryNotFound
+	}
+	ms.remove(entry, bigcache.Deleted)
+	return nil
+}
+
+// remove removes an entry and reports it to the remove callback
+func (ms *mapStore) remove(entry *storeEntry, reason bigcache.RemoveReason) {
+	delete(ms.entries, entry.key)
+	ms.bytes -= entry.size()
+	if ms.onRemove != nil {
+		ms.onRemove(entry.key, entry.value, reason)
+	}
+}
+
+// Reset removes every entry
+func (ms *mapStore) Reset() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.entries = make(map[string]*storeEntry)
+	ms.bytes = 0
+	return nil
+}
+
+// Len returns the number of entries
+func (ms *mapStore) Len() int {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return len(ms.entries)
+}
+
+// Capacity returns the number of bytes used by keys and values
+func (ms *mapStore) Capacity() int {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.bytes
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/allegro/bigcache"
+)
+
+// lruSegment is a list of entries ordered from most to least recently used, bounded by the total
+// size of its entries
+type lruSegment struct {
+	entries  *list.List // Of *storeEntry
+	bytes    int
+	maxBytes int
+}
+
+// newLRUSegment creates an empty segment holding up to maxBytes
+func newLRUSegment(maxBytes int) *lruSegment {
+	return &lruSegment{entries: list.New(), maxBytes: maxBytes}
+}
+
+// pushFront adds an entry as the most recently used and returns its element
+func (ls *lruSegment) pushFront(entry *storeEntry) *list.Element {
+	ls.bytes += entry.size()
+	return ls.entries.PushFront(entry)
+}
+
+// remove removes an element from the segment
+func (ls *lruSegment) remove(element *list.Element) {
+	ls.bytes -= element.Value.(*storeEntry).size()
+	ls.entries.Remove(element)
+}
+
+// back returns the least recently used element, or nil if the segment is empty
+func (ls *lruSegment) back() *list.Element {
+	return ls.entries.Back()
+}
+
+// overCapacity returns whether the entries exceed the size of the segment
+func (ls *lruSegment) overCapacity() bool {
+	return ls.bytes > ls.maxBytes
+}
+
+// lruStore is a LocalStore that evicts the least recently used entries once the total size of
+// keys and values exceeds its limit. Expired entries are removed when read or evicted.
+type lruStore struct {
+	storeStats
+	mutex      sync.Mutex
+	elements   map[string]*list.Element
+	segment    *lruSegment
+	lifeWindow time.Duration
+	onRemove   removeCallback
+	now        func() time.Time
+}
+
+// newLRUStore creates an empty lruStore holding up to maxBytes of keys and values
+func newLRUStore(maxBytes int, lifeWindow time.Duration, onRemove removeCallback) *lruStore {
+	return &lruStore{
+		elements:   make(map[string]*list.Element),
+		segment:    newLRUSegment(maxBytes),
+		lifeWindow: lifeWindow,
+		onRemove:   onRemove,
+		now:        time.Now,
+	}
+}
+
+// Get returns a copy of the value stored under key and marks it as most recently used
+func (ls *lruStore) Get(key string) ([]byte, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	element, ok := ls.elements[key]
+	if ok && element.Value.(*storeEntry).expired(ls.now()) {
+		ls.remove(element, bigcache.Expired)
+		ok = false
+	}
+	ls.recordGet(ok)
+	if !ok {
+		return nil, ErrEntryNotFound
+	}
+	ls.segment.entries.MoveToFront(element)
+	return element.Value.(*storeEntry).valueCopy(), nil
+}
+
+// Set stores a copy of value under key, evicting the least recently used entries to make room
+func (ls *lruStore) Set(key string, value []byte) error {
+	entry := newStoreEntry(key, value, ls.now(), ls.lifeWindow)
+	if entry.size() > ls.segment.maxBytes {
+		return fmt.Errorf("entry is bigger than max cache size")
+	}
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	if old, ok := ls.elements[key]; ok {
+		delete(ls.elements, key)
+		ls.segment.remove(old)
+	}
+	ls.elements[key] = ls.segment.pushFront(entry)
+	for ls.segment.overCapacity() {
+		ls.remove(ls.segment.back(), bigcache.NoSpace)
+	}
+	return nil
+}
+
+// Delete removes the value stored under key
+func (ls *lruStore) Delete(key string) error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	element, ok := ls.elements[key]
+	ls.recordDelete(ok)
+	if !ok {
+		return ErrEntryNotFound
+	}
+	ls.remove(element, bigcache.Deleted)
+	return nil
+}
+
+// remove removes an element and reports it to the remove callback. Expired entries are reported
+// as expired regardless of reason.
+func (ls *lruStore) remove(element *list.Element, reason bigcache.RemoveReason) {
+	entry := element.Value.(*storeEntry)
+	delete(ls.elements, entry.key)
+	ls.segment.remove(element)
+	if reason == bigcache.NoSpace && entry.expired(ls.now()) {
+		reason = bigcache.Expired
+	}
+	if ls.onRemove != nil {
+		ls.onRemove(entry.key, entry.value, reason)
+	}
+}
+
+// Reset removes every entry
+func (ls *lruStore) Reset() error {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.elements = make(map[string]*list.Element)
+	ls.segment = newLRUSegment(ls.segment.maxBytes)
+	return nil
+}
+
+// Len returns the number of entries
+func (ls *lruStore) Len() int {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return len(ls.elements)
+}
+
+// Capacity returns the number of bytes used by keys and values
+func (ls *lruStore) Capacity() int {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.segment.bytes
+}
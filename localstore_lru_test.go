@@ -0,0 +1,64 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/allegro/bigcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	recorder := &removalRecorder{}
+	// Each entry is 2 bytes, so three fit
+	ls := newLRUStore(6, 0, recorder.onRemove)
+	require.NoError(t, ls.Set("a", []byte("1")))
+	require.NoError(t, ls.Set("b", []byte("2")))
+	require.NoError(t, ls.Set("c", []byte("3")))
+	_, err := ls.Get("a")
+	require.NoError(t, err)
+	require.NoError(t, ls.Set("d", []byte("4")))
+
+	_, err = ls.Get("b")
+	assert.Equal(t, ErrEntryNotFound, err)
+	for _, key := range []string{"a", "c", "d"} {
+		_, err = ls.Get(key)
+		assert.NoError(t, err, key)
+	}
+	assert.Equal(t, []removal{{"b", bigcache.NoSpace}}, recorder.removals)
+	assert.Equal(t, 6, ls.Capacity())
+}
+
+func TestLRUStoreTooLarge(t *testing.T) {
+	ls := newLRUStore(4, 0, nil)
+	assert.Error(t, ls.Set("key", []byte("value")))
+	assert.Equal(t, 0, ls.Len())
+}
+
+func TestLRUStoreExpiry(t *testing.T) {
+	recorder := &removalRecorder{}
+	ls := newLRUStore(100, time.Minute, recorder.onRemove)
+	now := time.Now()
+	ls.now = func() time.Time { return now }
+	require.NoError(t, ls.Set("key", []byte("value")))
+	now = now.Add(time.Minute)
+	_, err := ls.Get("key")
+	assert.Equal(t, ErrEntryNotFound, err)
+	assert.Equal(t, []removal{{"key", bigcache.Expired}}, recorder.removals)
+	assert.Equal(t, 0, ls.Len())
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allegro/bigcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// removal is a call to a removeCallback
+type removal struct {
+	key    string
+	reason bigcache.RemoveReason
+}
+
+// removalRecorder is a removeCallback that remembers the removals it was called with
+type removalRecorder struct {
+	mutex    sync.Mutex
+	removals []removal
+}
+
+func (rr *removalRecorder) onRemove(key string, entry []byte, reason bigcache.RemoveReason) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+	// BigCache builds the key with an unsafe conversion, so it must be copied
+	rr.removals = append(rr.removals, removal{string(append([]byte{}, key...)), reason})
+}
+
+// localStoreBackends creates a LocalStore for every backend, holding 1 MB with a one minute TTL
+func localStoreBackends(t *testing.T, onRemove removeCallback) map[string]LocalStore {
+	stores := make(map[string]LocalStore)
+	for _, backend := range []string{LocalBackendBigCache, LocalBackendLRU, LocalBackendTinyLFU, LocalBackendMap} {
+		lcc := LocalCacheConfig{
+			Backend: backend, Eviction: time.Minute, Shards: 16, HardMaxCacheSize: 1, MaxEntriesInWindow: 100,
+		}
+		config, err := lcc.bigcacheConfig()
+		require.NoError(t, err)
+		config.Verbose = false
+		stores[backend], err = lcc.newLocalStore(config, onRemove)
+		require.NoError(t, err)
+	}
+	return stores
+}
+
+// TestLocalStoreConformance runs every backend through the behavior LocalCache relies on
+func TestLocalStoreConformance(t *testing.T) {
+	for backend, store := range localStoreBackends(t, nil) {
+		t.Run(backend, func(t *testing.T) {
+			_, err := store.Get("missing")
+			assert.Equal(t, ErrEntryNotFound, err)
+			assert.Equal(t, ErrEntryNotFound, store.Delete("missing"))
+
+			value := []byte("value")
+			require.NoError(t, store.Set("key", value))
+			value[0] = 'V'
+			stored, err := store.Get("key")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("value"), stored, "Set must copy the value")
+			stored[0] = 'V'
+			stored, err = store.Get("key")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("value"), stored, "Get must return a copy of the value")
+
+			require.NoError(t, store.Set("key", []byte("replaced")))
+			stored, err = store.Get("key")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("replaced"), stored)
+			assert.Equal(t, 1, store.Len())
+
+			require.NoError(t, store.Delete("key"))
+			_, err = store.Get("key")
+			assert.Equal(t, ErrEntryNotFound, err)
+
+			for i := 0; i < 10; i++ {
+				require.NoError(t, store.Set(fmt.Sprintf("key-%d", i), []byte("value")))
+			}
+			assert.Equal(t, 10, store.Len())
+			require.NoError(t, store.Reset())
+			assert.Equal(t, 0, store.Len())
+			_, err = store.Get("key-0")
+			assert.Equal(t, ErrEntryNotFound, err)
+
+			stats, ok := store.(localStoreStats)
+			require.True(t, ok)
+			assert.True(t, stats.Stats().Hits > 0)
+			assert.True(t, stats.Stats().DelHits > 0)
+		})
+	}
+}
+
+func TestLocalStoreConformanceDeleteCallback(t *testing.T) {
+	recorder := &removalRecorder{}
+	for backend, store := range localStoreBackends(t, recorder.onRemove) {
+		t.Run(backend, func(t *testing.T) {
+			recorder.removals = nil
+			require.NoError(t, store.Set("key", []byte("value")))
+			require.NoError(t, store.Delete("key"))
+			assert.Equal(t, []removal{{"key", bigcache.Deleted}}, recorder.removals)
+		})
+	}
+}
+
+func TestLocalStoreConformanceConcurrency(t *testing.T) {
+	for backend, store := range localStoreBackends(t, nil) {
+		t.Run(backend, func(t *testing.T) {
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						key := fmt.Sprintf("key-%d", j%10)
+						store.Set(key, []byte("value"))
+						store.Get(key)
+						if j%7 == i {
+							store.Delete(key)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+			assert.True(t, store.Len() <= 10)
+		})
+	}
+}
+
+func TestLocalStoreUnknownBackend(t *testing.T) {
+	_, err := LocalCacheConfig{Backend: "memcached", Eviction: time.Second}.NewCache(&MockedCacheEncoder{}, nil)
+	assert.Error(t, err)
+	_, err = LocalCacheConfig{Backend: LocalBackendLRU, Eviction: time.Second}.NewCache(&MockedCacheEncoder{}, nil)
+	assert.Error(t, err, "lru requires a size limit")
+}
+
+func TestMapStoreExpiry(t *testing.T) {
+	recorder := &removalRecorder{}
+	ms := newMapStore(time.Minute, recorder.onRemove)
+	now := time.Now()
+	ms.now = func() time.Time { return now }
+	require.NoError(t, ms.Set("key", []byte("value")))
+	assert.Equal(t, len("key")+len("value"), ms.Capacity())
+	now = now.Add(time.Minute)
+	_, err := ms.Get("key")
+	assert.Equal(t, ErrEntryNotFound, err)
+	assert.Equal(t, []removal{{"key", bigcache.Expired}}, recorder.removals)
+	assert.Equal(t, 0, ms.Capacity())
+}
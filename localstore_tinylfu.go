@@ -0,0 +1,275 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/allegro/bigcache"
+)
+
+// countMinDepth is the number of rows in a countMinSketch
+const countMinDepth = 4
+
+// countMinMax is the largest value a countMinSketch counter holds
+const countMinMax = 15
+
+// countMinSketch estimates how often keys have been seen using a fixed amount of memory. Counters
+// are halved periodically so that estimates favor recent activity.
+type countMinSketch struct {
+	rows      [countMinDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+// newCountMinSketch creates a sketch sized for the given number of distinct keys
+func newCountMinSketch(expectedKeys int) *countMinSketch {
+	width := 16
+	for width < expectedKeys {
+		width *= 2
+	}
+	cms := &countMinSketch{mask: uint64(width - 1), resetAt: 10 * width}
+	for i := range cms.rows {
+		cms.rows[i] = make([]uint8, width)
+	}
+	return cms
+}
+
+// indexes returns the counter in each row that key maps to
+func (cms *countMinSketch) indexes(key string) [countMinDepth]uint64 {
+	return sketchIndexes(key, cms.mask)
+}
+
+// sketchIndexes returns the counter in each row of a count-min sketch that key maps to, for rows
+// whose width is mask+1
+func sketchIndexes(key string, mask uint64) [countMinDepth]uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	hash := hasher.Sum64()
+	h1, h2 := hash, hash>>32|hash<<32
+	var indexes [countMinDepth]uint64
+	for i := range indexes {
+		indexes[i] = (h1 + uint64(i)*h2) & mask
+	}
+	return indexes
+}
+
+// increment records an occurrence of key
+func (cms *countMinSketch) increment(key string) {
+	for row, index := range cms.indexes(key) {
+		if cms.rows[row][index] < countMinMax {
+			cms.rows[row][index]++
+		}
+	}
+	cms.additions++
+	if cms.additions >= cms.resetAt {
+		for _, row := range cms.rows {
+			for i := range row {
+				row[i] /= 2
+			}
+		}
+		cms.additions /= 2
+	}
+}
+
+// estimate returns the approximate number of recent occurrences of key
+func (cms *countMinSketch) estimate(key string) uint8 {
+	estimate := uint8(countMinMax)
+	for row, index := range cms.indexes(key) {
+		if count := cms.rows[row][index]; count < estimate {
+			estimate = count
+		}
+	}
+	return estimate
+}
+
+// tinyLFUItem locates an entry held by a tinyLFUStore
+type tinyLFUItem struct {
+	element *list.Element
+	segment *lruSegment
+}
+
+// tinyLFUStore is a LocalStore implementing W-TinyLFU. New entries enter a small LRU window.
+// Entries leaving the window are admitted to the main cache only if they have been used more often
+// than the entry they would evict. The main cache is a segmented LRU, in which entries read a
+// second time are protected from eviction by entries that have only been read once.
+type tinyLFUStore struct {
+	storeStats
+	mutex        sync.Mutex
+	items        map[string]*tinyLFUItem
+	window       *lruSegment
+	probation    *lruSegment
+	protected    *lruSegment
+	mainMaxBytes int
+	sketch       *countMinSketch
+	expectedKeys int
+	lifeWindow   time.Duration
+	onRemove     removeCallback
+	now          func() time.Time
+}
+
+// newTinyLFUStore creates an empty tinyLFUStore holding up to maxBytes of keys and values and
+// tracking the frequency of around expectedKeys keys
+func newTinyLFUStore(maxBytes, expectedKeys int, lifeWindow time.Duration, onRemove removeCallback) *tinyLFUStore {
+	tls := &tinyLFUStore{
+		expectedKeys: expectedKeys,
+		lifeWindow:   lifeWindow,
+		onRemove:     onRemove,
+		now:          time.Now,
+	}
+	windowBytes := maxBytes / 100
+	tls.mainMaxBytes = maxBytes - windowBytes
+	tls.window = newLRUSegment(windowBytes)
+	tls.probation = newLRUSegment(tls.mainMaxBytes)
+	tls.protected = newLRUSegment(tls.mainMaxBytes * 8 / 10)
+	tls.items = make(map[string]*tinyLFUItem)
+	tls.sketch = newCountMinSketch(expectedKeys)
+	return tls
+}
+
+// Get returns a copy of the value stored under key. Entries read from probation are promoted to the
+// protected segment.
+func (tls *tinyLFUStore) Get(key string) ([]byte, error) {
+	tls.mutex.Lock()
+	defer tls.mutex.Unlock()
+	tls.sketch.increment(key)
+	item, ok := tls.items[key]
+	if ok && item.element.Value.(*storeEntry).expired(tls.now()) {
+		tls.remove(item, bigcache.Expired)
+		ok = false
+	}
+	tls.recordGet(ok)
+	if !ok {
+		return nil, ErrEntryNotFound
+	}
+	entry := item.element.Value.(*storeEntry)
+	if item.segment != tls.probation {
+		item.segment.entries.MoveToFront(item.element)
+		return entry.valueCopy(), nil
+	}
+	tls.probation.remove(item.element)
+	item.element, item.segment = tls.protected.pushFront(entry), tls.protected
+	for tls.protected.overCapacity() {
+		demoted := tls.items[tls.protected.back().Value.(*storeEntry).key]
+		tls.protected.remove(demoted.element)
+		demoted.element = tls.probation.pushFront(demoted.element.Value.(*storeEntry))
+		demoted.segment = tls.probation
+	}
+	return entry.valueCopy(), nil
+}
+
+// Set stores a copy of value under key in the window, moving the least recently used window
+// entries on to admission
+func (tls *tinyLFUStore) Set(key string, value []byte) error {
+	entry := newStoreEntry(key, value, tls.now(), tls.lifeWindow)
+	if entry.size() > tls.mainMaxBytes {
+		return fmt.Errorf("entry is bigger than max cache size")
+	}
+	tls.mutex.Lock()
+	defer tls.mutex.Unlock()
+	tls.sketch.increment(key)
+	if old, ok := tls.items[key]; ok {
+		delete(tls.items, key)
+		old.segment.remove(old.element)
+	}
+	tls.items[key] = &tinyLFUItem{element: tls.window.pushFront(entry), segment: tls.window}
+	for tls.window.overCapacity() {
+		candidate := tls.window.back()
+		tls.window.remove(candidate)
+		tls.admit(candidate.Value.(*storeEntry))
+	}
+	return nil
+}
+
+// admit moves an entry leaving the window into probation if it is used more often than the
+// entries that must be evicted to make room for it. Otherwise the entry itself is evicted.
+func (tls *tinyLFUStore) admit(candidate *storeEntry) {
+	for tls.probation.bytes+tls.protected.bytes+candidate.size() > tls.mainMaxBytes {
+		victim := tls.probation.back()
+		if victim == nil {
+			victim = tls.protected.back()
+		}
+		victimEntry := victim.Value.(*storeEntry)
+		if !victimEntry.expired(tls.now()) &&
+			tls.sketch.estimate(candidate.key) <= tls.sketch.estimate(victimEntry.key) {
+			tls.discard(candidate, bigcache.NoSpace)
+			return
+		}
+		tls.remove(tls.items[victimEntry.key], bigcache.NoSpace)
+	}
+	tls.items[candidate.key] = &tinyLFUItem{element: tls.probation.pushFront(candidate), segment: tls.probation}
+}
+
+// Delete removes the value stored under key
+func (tls *tinyLFUStore) Delete(key string) error {
+	tls.mutex.Lock()
+	defer tls.mutex.Unlock()
+	item, ok := tls.items[key]
+	tls.recordDelete(ok)
+	if !ok {
+		return ErrEntryNotFound
+	}
+	tls.remove(item, bigcache.Deleted)
+	return nil
+}
+
+// remove removes an item from its segment and discards its entry
+func (tls *tinyLFUStore) remove(item *tinyLFUItem, reason bigcache.RemoveReason) {
+	item.segment.remove(item.element)
+	tls.discard(item.element.Value.(*storeEntry), reason)
+}
+
+// discard forgets an entry that is no longer in any segment and reports it to the remove
+// callback. Expired entries are reported as expired regardless of reason.
+func (tls *tinyLFUStore) discard(entry *storeEntry, reason bigcache.RemoveReason) {
+	delete(tls.items, entry.key)
+	if reason == bigcache.NoSpace && entry.expired(tls.now()) {
+		reason = bigcache.Expired
+	}
+	if tls.onRemove != nil {
+		tls.onRemove(entry.key, entry.value, reason)
+	}
+}
+
+// Reset removes every entry and forgets key frequencies
+func (tls *tinyLFUStore) Reset() error {
+	tls.mutex.Lock()
+	defer tls.mutex.Unlock()
+	tls.items = make(map[string]*tinyLFUItem)
+	tls.window = newLRUSegment(tls.window.maxBytes)
+	tls.probation = newLRUSegment(tls.probation.maxBytes)
+	tls.protected = newLRUSegment(tls.protected.maxBytes)
+	tls.sketch = newCountMinSketch(tls.expectedKeys)
+	return nil
+}
+
+// Len returns the number of entries
+func (tls *tinyLFUStore) Len() int {
+	tls.mutex.Lock()
+	defer tls.mutex.Unlock()
+	return len(tls.items)
+}
+
+// Capacity returns the number of bytes used by keys and values
+func (tls *tinyLFUStore) Capacity() int {
+	tls.mutex.Lock()
+	defer tls.mutex.Unlock()
+	return tls.window.bytes + tls.probation.bytes + tls.protected.bytes
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	cms := newCountMinSketch(100)
+	for i := 0; i < 5; i++ {
+		cms.increment("hot")
+	}
+	cms.increment("cold")
+	assert.Equal(t, uint8(5), cms.estimate("hot"))
+	assert.Equal(t, uint8(1), cms.estimate("cold"))
+	assert.Equal(t, uint8(0), cms.estimate("unseen"))
+
+	for i := 0; i < 20; i++ {
+		cms.increment("hot")
+	}
+	assert.Equal(t, uint8(countMinMax), cms.estimate("hot"), "counters saturate")
+}
+
+func TestCountMinSketchAging(t *testing.T) {
+	cms := newCountMinSketch(16)
+	for i := 0; i < 8; i++ {
+		cms.increment("old")
+	}
+	for i := 0; cms.additions > 0 && i < cms.resetAt; i++ {
+		cms.increment(fmt.Sprintf("key-%d", i))
+	}
+	assert.True(t, cms.estimate("old") < 8, "counters are halved periodically")
+}
+
+// Test that a scan of keys seen once does not displace keys that are used repeatedly
+func TestTinyLFUStoreResistsScans(t *testing.T) {
+	tls := newTinyLFUStore(10000, 1000, 0, nil)
+	hot := make([]string, 50)
+	for i := range hot {
+		hot[i] = fmt.Sprintf("hot-%03d", i)
+		require.NoError(t, tls.Set(hot[i], make([]byte, 100)))
+	}
+	for round := 0; round < 3; round++ {
+		for _, key := range hot {
+			_, err := tls.Get(key)
+			require.NoError(t, err)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, tls.Set(fmt.Sprintf("scan-%04d", i), make([]byte, 100)))
+	}
+	for _, key := range hot {
+		_, err := tls.Get(key)
+		assert.NoError(t, err, key)
+	}
+	assert.True(t, tls.Capacity() <= 10000)
+
+	// The same workload evicts every hot key from an LRU of the same size
+	ls := newLRUStore(10000, 0, nil)
+	for _, key := range hot {
+		require.NoError(t, ls.Set(key, make([]byte, 100)))
+	}
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, ls.Set(fmt.Sprintf("scan-%04d", i), make([]byte, 100)))
+	}
+	_, err := ls.Get(hot[0])
+	assert.Equal(t, ErrEntryNotFound, err)
+}
+
+func TestTinyLFUStorePromotion(t *testing.T) {
+	tls := newTinyLFUStore(10000, 100, 0, nil)
+	require.NoError(t, tls.Set("key", make([]byte, 200)))
+	// The entry is larger than the window, so it moves straight on to probation
+	assert.True(t, tls.items["key"].segment == tls.probation)
+	_, err := tls.Get("key")
+	require.NoError(t, err)
+	assert.True(t, tls.items["key"].segment == tls.protected)
+}
@@ -0,0 +1,352 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+)
+
+const (
+	// DefaultLockKeyPrefix is prepended to lock names to form their Redis keys when no prefix is
+	// configured
+	DefaultLockKeyPrefix = "lock:"
+	// DefaultLockMinBackoff is the first wait between attempts to acquire a held lock when none is
+	// configured
+	DefaultLockMinBackoff = 10 * time.Millisecond
+	// DefaultLockMaxBackoff is the longest wait between attempts to acquire a held lock when none
+	// is configured
+	DefaultLockMaxBackoff = time.Second
+)
+
+// ErrLockNotAcquired is returned by TryLock when the lock is held by someone else
+var ErrLockNotAcquired = fmt.Errorf("lock is held by another owner")
+
+// ErrLockNotHeld is returned when releasing or renewing a lock that has expired or been acquired
+// by someone else
+var ErrLockNotHeld = fmt.Errorf("lock is no longer held")
+
+// acquireScript sets KEYS[1] to the token ARGV[1] for ARGV[2] milliseconds if it is not set, and
+// returns the next fencing token from the counter at KEYS[2]. It returns 0 if the lock is held.
+var acquireScript = redis.NewScript(2, `
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return redis.call("INCR", KEYS[2])
+end
+return 0
+`)
+
+// renewScript sets the expiry of KEYS[1] to ARGV[2] milliseconds if it holds the token ARGV[1]. It
+// returns 0 if it does not.
+var renewScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseScript deletes KEYS[1] if it holds the token ARGV[1]. It returns 0 if it does not.
+var releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// LockerConfig is the configuration for a Locker
+type LockerConfig struct {
+	KeyPrefix  string        // Prepended to lock names to form their Redis keys
+	MinBackoff time.Duration // First wait between attempts to acquire a held lock
+	MaxBackoff time.Duration // Longest wait between attempts to acquire a held lock
+}
+
+// Locker provides mutual exclusion between processes sharing a remote cache. Each lock is a Redis
+// key holding the unique token of its owner, so only the owner can renew or release it. Every
+// acquisition also takes a fencing token from a counter in the same hash slot, which increases
+// with each acquisition of the lock; storage written under a lock can reject writes carrying a
+// fencing token lower than one it has already seen, so an owner whose lock expired while it was
+// paused cannot overwrite the work of the next owner.
+type Locker struct {
+	remote RemoteCache
+	config LockerConfig
+}
+
+// NewLocker creates a Locker that keeps its locks in remote
+func NewLocker(remote RemoteCache, config LockerConfig) (*Locker, error) {
+	if config.MinBackoff < 0 || config.MaxBackoff < 0 {
+		return nil, fmt.Errorf("lock backoff must not be negative")
+	}
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = DefaultLockKeyPrefix
+	}
+	if config.MinBackoff == 0 {
+		config.MinBackoff = DefaultLockMinBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = DefaultLockMaxBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		return nil, fmt.Errorf("maximum lock backoff must not be less than the minimum")
+	}
+	return &Locker{remote: remote, config: config}, nil
+}
+
+// Lock acquires the named lock for ttl, waiting with jittered exponential backoff while it is held
+// by someone else, until ctx is done. The lock is renewed in the background until it is released.
+func (l *Locker) Lock(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	backoff := l.config.MinBackoff
+	for {
+		lock, err := l.TryLock(ctx, name, ttl)
+		if err != ErrLockNotAcquired {
+			return lock, err
+		}
+		// Wait between half and all of the backoff so that waiters do not retry in step
+		wait := backoff/2 + time.Duration(mathrand.Int63n(int64(backoff/2)+1))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > l.config.MaxBackoff {
+			backoff = l.config.MaxBackoff
+		}
+	}
+}
+
+// TryLock makes a single attempt to acquire the named lock for ttl, returning ErrLockNotAcquired if
+// it is held by someone else. The lock is renewed in the background until it is released.
+func (l *Locker) TryLock(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	if ttl < time.Millisecond {
+		return nil, fmt.Errorf("lock TTL must be at least 1ms - %v is invalid", ttl)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	key := l.config.KeyPrefix + name
+	var fence int64
+	err = l.do(key, func(conn redis.Conn) error {
+		var err error
+		fence, err = redis.Int64(acquireScript.Do(
+			conn, key, hashSlotPrefix(key)+":fence", token, int64(ttl/time.Millisecond)))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if fence == 0 {
+		return nil, ErrLockNotAcquired
+	}
+	return l.newLock(name, key, token, fence, ttl), nil
+}
+
+// tryLease makes a single attempt to acquire the named lock for ttl like TryLock, but without
+// taking a fencing token, so it leaves nothing behind in Redis once it is released or expires. It
+// suits short-lived locks on unbounded sets of names, such as load leases, whose holders write
+// nothing that needs fencing. The returned Lock has a FencingToken of 0.
+func (l *Locker) tryLease(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	if ttl < time.Millisecond {
+		return nil, fmt.Errorf("lease TTL must be at least 1ms - %v is invalid", ttl)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	key := l.config.KeyPrefix + name
+	var reply interface{}
+	err = l.do(key, func(conn redis.Conn) error {
+		var err error
+		reply, err = conn.Do("SET", key, token, "NX", "PX", int64(ttl/time.Millisecond))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrLockNotAcquired
+	}
+	return l.newLock(name, key, token, 0, ttl), nil
+}
+
+// newLock returns a Lock held under token and starts renewing it in the background
+func (l *Locker) newLock(name, key, token string, fence int64, ttl time.Duration) *Lock {
+	renewCtx, stop := context.WithCancel(context.Background())
+	lock := &Lock{
+		locker:   l,
+		name:     name,
+		key:      key,
+		token:    token,
+		fence:    fence,
+		ttl:      ttl,
+		renewCtx: renewCtx,
+		stop:     stop,
+		stopped:  make(chan struct{}),
+		lost:     make(chan struct{}),
+	}
+	go lock.renew()
+	return lock
+}
+
+// do runs fn on a connection bound to the node serving key
+func (l *Locker) do(key string, fn func(conn redis.Conn) error) error {
+	conn := l.remote.cluster.Get()
+	defer conn.Close()
+	if err := redisc.BindConn(conn, key); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// newToken returns a random token identifying the owner of a lock or lease
+func newToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// Lock is a held distributed lock. It is renewed every third of its TTL until Unlock is called or
+// renewal finds it is no longer held, at which point Lost is closed.
+type Lock struct {
+	locker   *Locker
+	name     string
+	key      string
+	token    string
+	fence    int64
+	ttl      time.Duration
+	renewCtx context.Context    // Done once renewal is stopped, cancelling a refresh in flight
+	stop     context.CancelFunc // Cancels renewCtx
+	stopped  chan struct{}
+	lost     chan struct{}
+}
+
+// Name returns the name the lock was acquired under
+func (lk *Lock) Name() string {
+	return lk.name
+}
+
+// Token returns the unique token identifying this owner of the lock
+func (lk *Lock) Token() string {
+	return lk.token
+}
+
+// FencingToken returns the fencing token of this acquisition, which is greater than that of every
+// earlier acquisition of the same lock
+func (lk *Lock) FencingToken() int64 {
+	return lk.fence
+}
+
+// Lost returns a channel that is closed if the lock is found to be no longer held while renewing
+// it, for example because renewal failed for longer than its TTL
+func (lk *Lock) Lost() <-chan struct{} {
+	return lk.lost
+}
+
+// Unlock stops renewing the lock and releases it. ErrLockNotHeld is returned if the lock had
+// already expired or been acquired by someone else, in which case it is left untouched. If ctx is
+// done first, its error is returned and the lock may or may not have been released; it expires at
+// the end of its TTL either way, since renewal has stopped.
+func (lk *Lock) Unlock(ctx context.Context) error {
+	lk.stop()
+	select {
+	case <-lk.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return doWithContext(ctx, func() error {
+		return lk.locker.do(lk.key, func(conn redis.Conn) error {
+			released, err := redis.Bool(releaseScript.Do(conn, lk.key, lk.token))
+			if err == nil && !released {
+				err = ErrLockNotHeld
+			}
+			return err
+		})
+	})
+}
+
+// Refresh extends the lock to expire ttl from now, returning ErrLockNotHeld if it is no longer held.
+// If ctx is done before Redis replies, its error is returned without waiting for the reply, and
+// the lock may or may not have been extended.
+func (lk *Lock) Refresh(ctx context.Context, ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return fmt.Errorf("lock TTL must be at least 1ms - %v is invalid", ttl)
+	}
+	return doWithContext(ctx, func() error {
+		return lk.locker.do(lk.key, func(conn redis.Conn) error {
+			renewed, err := redis.Bool(renewScript.Do(conn, lk.key, lk.token, int64(ttl/time.Millisecond)))
+			if err == nil && !renewed {
+				err = ErrLockNotHeld
+			}
+			return err
+		})
+	})
+}
+
+// doWithContext runs fn unless ctx is already done, and returns ctx's error without waiting for fn
+// if ctx ends first. Cluster connections cannot time out a single command, so fn is left to finish
+// on its own.
+func doWithContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return fn()
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- fn()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// renew refreshes the lock every third of its TTL until it is released or lost. Failed refreshes
+// are retried at the next interval, since the lock may outlive a brief outage. Stopping renewal
+// cancels a refresh in flight, so a hung node cannot hold up Unlock.
+func (lk *Lock) renew() {
+	defer close(lk.stopped)
+	ticker := time.NewTicker(lk.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lk.renewCtx.Done():
+			return
+		case <-ticker.C:
+			if err := lk.Refresh(lk.renewCtx, lk.ttl); err == ErrLockNotHeld {
+				close(lk.lost)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/mna/redisc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestLocker returns a Locker backed by a fresh miniredis server
+func newTestLocker(t *testing.T) (*Locker, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}}
+	locker, err := NewLocker(rc, LockerConfig{MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	require.NoError(t, err)
+	return locker, s
+}
+
+func TestLockerTryLock(t *testing.T) {
+	locker, s := newTestLocker(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	lock, err := locker.TryLock(ctx, "facility", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "facility", lock.Name())
+	assert.NotEmpty(t, lock.Token())
+	value, err := s.Get("lock:facility")
+	require.NoError(t, err)
+	assert.Equal(t, lock.Token(), value)
+	assert.Equal(t, time.Minute, s.TTL("lock:facility"))
+
+	_, err = locker.TryLock(ctx, "facility", time.Minute)
+	assert.Equal(t, ErrLockNotAcquired, err)
+
+	// Each acquisition has a higher fencing token and a new token
+	require.NoError(t, lock.Unlock(ctx))
+	assert.False(t, s.Exists("lock:facility"))
+	next, err := locker.TryLock(ctx, "facility", time.Minute)
+	require.NoError(t, err)
+	defer next.Unlock(ctx)
+	assert.True(t, next.FencingToken() > lock.FencingToken())
+	assert.NotEqual(t, lock.Token(), next.Token())
+
+	_, err = locker.TryLock(ctx, "facility", 0)
+	assert.Error(t, err)
+}
+
+func TestLockerLockWaits(t *testing.T) {
+	locker, s := newTestLocker(t)
+	defer s.Close()
+	ctx := context.Background()
+	held, err := locker.TryLock(ctx, "facility", time.Minute)
+	require.NoError(t, err)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		held.Unlock(ctx)
+	}()
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	lock, err := locker.Lock(waitCtx, "facility", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, lock.FencingToken() > held.FencingToken())
+	require.NoError(t, lock.Unlock(ctx))
+}
+
+func TestLockerLockContext(t *testing.T) {
+	locker, s := newTestLocker(t)
+	defer s.Close()
+	ctx := context.Background()
+	held, err := locker.TryLock(ctx, "facility", time.Minute)
+	require.NoError(t, err)
+	defer held.Unlock(ctx)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = locker.Lock(waitCtx, "facility", time.Minute)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestLockUnlockOtherOwner(t *testing.T) {
+	locker, s := newTestLocker(t)
+	defer s.Close()
+	ctx := context.Background()
+	lock, err := locker.TryLock(ctx, "facility", time.Minute)
+	require.NoError(t, err)
+
+	// The lock expired and was acquired by someone else, whose lock must survive
+	s.Set("lock:facility", "other-token")
+	assert.Equal(t, ErrLockNotHeld, lock.Unlock(ctx))
+	value, err := s.Get("lock:facility")
+	require.NoError(t, err)
+	assert.Equal(t, "other-token", value)
+	assert.Equal(t, ErrLockNotHeld, lock.Refresh(ctx, time.Minute))
+}
+
+func TestLockRefresh(t *testing.T) {
+	locker, s := newTestLocker(t)
+	defer s.Close()
+	ctx := context.Background()
+	lock, err := locker.TryLock(ctx, "facility", time.Minute)
+	require.NoError(t, err)
+	defer lock.Unlock(ctx)
+
+	require.NoError(t, lock.Refresh(ctx, 2*time.Minute))
+	assert.Equal(t, 2*time.Minute, s.TTL("lock:facility"))
+
+	// TTLs under a millisecond are rejected rather than deleting the lock
+	assert.Error(t, lock.Refresh(ctx, time.Microsecond))
+	assert.Equal(t, 2*time.Minute, s.TTL("lock:facility"))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(t, context.Canceled, lock.Refresh(canceled, time.Minute))
+	assert.Equal(t, 2*time.Minute, s.TTL("lock:facility"))
+}
+
+func TestLockUnlockHungNode(t *testing.T) {
+	// A node that accepts connections but never replies
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	var mutex sync.Mutex
+	var conns []net.Conn
+	defer func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			conns = append(conns, conn)
+			mutex.Unlock()
+		}
+	}()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{listener.Addr().String()}}}
+	locker, err := NewLocker(rc, LockerConfig{})
+	require.NoError(t, err)
+
+	// Renewal is stuck waiting on the node when Unlock is called, and so is the release
+	lock := locker.newLock("facility", "lock:facility", "token", 0, 30*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, lock.Unlock(ctx))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestLockRenewal(t *testing.T) {
+	locker, s := newTestLocker(t)
+	defer s.Close()
+	ctx := context.Background()
+	lock, err := locker.TryLock(ctx, "facility", 300*time.Millisecond)
+	require.NoError(t, err)
+
+	s.FastForward(200 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return s.TTL("lock:facility") > 250*time.Millisecond
+	}, time.Second, 10*time.Millisecond)
+
+	// Renewal reports the lock as lost once someone else holds it
+	s.Set("lock:facility", "other-token")
+	select {
+	case <-lock.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lock was not reported lost")
+	}
+	assert.Equal(t, ErrLockNotHeld, lock.Unlock(ctx))
+}
+
+func TestLockerConfigValidation(t *testing.T) {
+	for _, config := range []LockerConfig{
+		{MinBackoff: -time.Second},
+		{MinBackoff: time.Second, MaxBackoff: time.Millisecond},
+	} {
+		_, err := NewLocker(RemoteCache{}, config)
+		assert.Error(t, err)
+	}
+}
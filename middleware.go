@@ -0,0 +1,554 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"time"
+)
+
+// Middleware wraps a Cache to add behavior around its operations, such as logging, key rewriting
+// or access control. Middlewares typically embed the Cache they wrap and override the methods they
+// are interested in. A TieredCache only routes the methods of the Cache interface through its
+// middlewares; counters, Update, SetIfNotExists, CompareAndSwap, leases, GetReader and SetReader
+// go to the tiers directly, as does the value stored by GetOrLoad when remote cache supports
+// leases.
+type Middleware func(Cache) Cache
+
+// Chain wraps cache in middlewares. The first middleware is outermost, so it sees each operation
+// first and its result last.
+func Chain(cache Cache, middlewares ...Middleware) Cache {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		cache = middlewares[i](cache)
+	}
+	return cache
+}
+
+// instrument wraps cache in a TracingMiddleware, if tracing is enabled, followed by a
+// MetricsMiddleware
+func instrument(
+	cache Cache, tracingEnabled bool, tracer Tracer, sanitizer KeySanitizer, spanPrefix string,
+	metrics CacheMetrics, tier Tier,
+) Cache {
+	cache = MetricsMiddleware(metrics, tier)(cache)
+	if tracingEnabled {
+		cache = TracingMiddleware(tracer, sanitizer, spanPrefix)(cache)
+	}
+	return cache
+}
+
+// bytesTTLGetter is implemented by caches that can report how long the bytes they return have left
+// to live. A TTL of zero means the value does not expire.
+type bytesTTLGetter interface {
+	GetBytesWithTTL(ctx context.Context, key string) ([]byte, time.Duration, error)
+}
+
+// bytesTTLSetter is implemented by caches that can store bytes for a limited time. A TTL of zero
+// leaves the value to expire by the cache's own policy.
+type bytesTTLSetter interface {
+	SetBytesWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// getWithTTL retrieves the value from cache along with its TTL, which is read separately if cache
+// is not a TTLGetter
+func getWithTTL(ctx context.Context, cache Cache, key string, target interface{}) (time.Duration, error) {
+	if getter, ok := cache.(TTLGetter); ok {
+		return getter.GetWithTTL(ctx, key, target)
+	}
+	if err := cache.Get(ctx, key, target); err != nil {
+		return 0, err
+	}
+	return cache.TTL(ctx, key)
+}
+
+// getBytesWithTTL retrieves the bytes from cache along with their TTL, which is read separately if
+// cache is not a bytesTTLGetter
+func getBytesWithTTL(ctx context.Context, cache Cache, key string) ([]byte, time.Duration, error) {
+	if getter, ok := cache.(bytesTTLGetter); ok {
+		return getter.GetBytesWithTTL(ctx, key)
+	}
+	data, err := cache.GetBytes(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl, err := cache.TTL(ctx, key)
+	return data, ttl, err
+}
+
+// setBytesWithTTL sets the bytes in cache, expiring them after ttl if ttl is positive
+func setBytesWithTTL(ctx context.Context, cache Cache, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return cache.SetBytes(ctx, key, value)
+	}
+	if setter, ok := cache.(bytesTTLSetter); ok {
+		return setter.SetBytesWithTTL(ctx, key, value, ttl)
+	}
+	err := cache.SetBytes(ctx, key, value)
+	if err == nil {
+		err = cache.Expire(ctx, key, ttl)
+	}
+	return err
+}
+
+// getResult classifies the outcome of a Get the same way the tiers do. Values that were found but
+// could not be decoded or decrypted are decode errors, while values that failed integrity
+// verification were evicted and are misses. Other errors are misses if the key did not exist, or
+// errors.
+func getResult(err error) Result {
+	switch err.(type) {
+	case nil:
+		return ResultHit
+	case *DecodeError, *DecryptionError:
+		return ResultDecodeError
+	case *TamperError:
+		return ResultMiss
+	}
+	return missOrError(err)
+}
+
+// Hooks are callbacks invoked after cache operations. Any hook may be nil.
+type Hooks struct {
+	OnHit    func(ctx context.Context, key string)
+	OnMiss   func(ctx context.Context, key string)
+	OnSet    func(ctx context.Context, key string)
+	OnDelete func(ctx context.Context, key string) // Called when a key is deleted
+	// OnError is called when an operation fails for any reason other than a missing key on Get.
+	// key is empty for Purge.
+	OnError func(ctx context.Context, operation Operation, key string, err error)
+}
+
+// HooksMiddleware returns a Middleware that invokes hooks after each operation
+func HooksMiddleware(hooks Hooks) Middleware {
+	return func(cache Cache) Cache {
+		return hooksCache{Cache: cache, hooks: hooks}
+	}
+}
+
+// hooksCache invokes hooks after operations on the wrapped Cache
+type hooksCache struct {
+	Cache
+	hooks Hooks
+}
+
+// GetBytes retrieves the bytes from the wrapped cache and calls OnHit, OnMiss or OnError
+func (hc hooksCache) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	data, err := hc.Cache.GetBytes(ctx, key)
+	hc.onGet(ctx, key, err)
+	return data, err
+}
+
+// Get retrieves the value from the wrapped cache and calls OnHit, OnMiss or OnError
+func (hc hooksCache) Get(ctx context.Context, key string, target interface{}) error {
+	err := hc.Cache.Get(ctx, key, target)
+	hc.onGet(ctx, key, err)
+	return err
+}
+
+// onGet calls OnHit, OnMiss or OnError for the outcome of a read
+func (hc hooksCache) onGet(ctx context.Context, key string, err error) {
+	switch getResult(err) {
+	case ResultHit:
+		if hc.hooks.OnHit != nil {
+			hc.hooks.OnHit(ctx, key)
+		}
+	case ResultMiss:
+		if hc.hooks.OnMiss != nil {
+			hc.hooks.OnMiss(ctx, key)
+		}
+	default:
+		hc.onError(ctx, OperationGet, key, err)
+	}
+}
+
+// SetBytes sets the bytes in the wrapped cache and calls OnSet or OnError
+func (hc hooksCache) SetBytes(ctx context.Context, key string, value []byte) error {
+	err := hc.Cache.SetBytes(ctx, key, value)
+	hc.onSet(ctx, key, err)
+	return err
+}
+
+// Set sets the value in the wrapped cache and calls OnSet or OnError
+func (hc hooksCache) Set(ctx context.Context, key string, value interface{}) error {
+	err := hc.Cache.Set(ctx, key, value)
+	hc.onSet(ctx, key, err)
+	return err
+}
+
+// onSet calls OnSet or OnError for the outcome of a write
+func (hc hooksCache) onSet(ctx context.Context, key string, err error) {
+	if err != nil {
+		hc.onError(ctx, OperationSet, key, err)
+	} else if hc.hooks.OnSet != nil {
+		hc.hooks.OnSet(ctx, key)
+	}
+}
+
+// Delete removes the value from the wrapped cache and calls OnDelete or OnError
+func (hc hooksCache) Delete(ctx context.Context, key string) error {
+	err := hc.Cache.Delete(ctx, key)
+	if err != nil {
+		hc.onError(ctx, OperationDelete, key, err)
+	} else if hc.hooks.OnDelete != nil {
+		hc.hooks.OnDelete(ctx, key)
+	}
+	return err
+}
+
+// Purge wipes out the wrapped cache and calls OnError if it fails
+func (hc hooksCache) Purge(ctx context.Context) error {
+	err := hc.Cache.Purge(ctx)
+	if err != nil {
+		hc.onError(ctx, OperationPurge, "", err)
+	}
+	return err
+}
+
+// Exists checks the wrapped cache and calls OnError if the check fails
+func (hc hooksCache) Exists(ctx context.Context, key string) (bool, error) {
+	found, err := hc.Cache.Exists(ctx, key)
+	if err != nil {
+		hc.onError(ctx, OperationExists, key, err)
+	}
+	return found, err
+}
+
+// TTL reads the TTL from the wrapped cache and calls OnError if it fails for a reason other than a
+// missing key
+func (hc hooksCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := hc.Cache.TTL(ctx, key)
+	if lookupResult(err) == ResultError {
+		hc.onError(ctx, OperationTTL, key, err)
+	}
+	return ttl, err
+}
+
+// Touch extends the lifetime of key in the wrapped cache and calls OnError if it fails for a reason
+// other than a missing key
+func (hc hooksCache) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	err := hc.Cache.Touch(ctx, key, ttl)
+	if lookupResult(err) == ResultError {
+		hc.onError(ctx, OperationTouch, key, err)
+	}
+	return err
+}
+
+// Expire sets the expiry of key in the wrapped cache and calls OnError if it fails for a reason
+// other than a missing key
+func (hc hooksCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	err := hc.Cache.Expire(ctx, key, ttl)
+	if lookupResult(err) == ResultError {
+		hc.onError(ctx, OperationExpire, key, err)
+	}
+	return err
+}
+
+// onError calls the OnError hook if one is set
+func (hc hooksCache) onError(ctx context.Context, operation Operation, key string, err error) {
+	if hc.hooks.OnError != nil {
+		hc.hooks.OnError(ctx, operation, key, err)
+	}
+}
+
+// MetricsMiddleware returns a Middleware that records the result and latency of each operation on
+// metrics as belonging to tier. Byte operations are recorded as gets and sets. LocalCache and
+// RemoteCache record their own operations with it too.
+func MetricsMiddleware(metrics CacheMetrics, tier Tier) Middleware {
+	return func(cache Cache) Cache {
+		if metrics == nil {
+			return cache
+		}
+		return metricsCache{Cache: cache, metrics: metrics, tier: tier}
+	}
+}
+
+// metricsCache records metrics for operations on the wrapped Cache
+type metricsCache struct {
+	Cache
+	metrics CacheMetrics
+	tier    Tier
+}
+
+// GetBytes retrieves the bytes from the wrapped cache and records the result
+func (mc metricsCache) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	start := time.Now()
+	data, err := mc.Cache.GetBytes(ctx, key)
+	observeOperation(mc.metrics, mc.tier, OperationGet, getResult(err), start)
+	return data, err
+}
+
+// GetBytesWithTTL retrieves the bytes and their TTL from the wrapped cache and records the result
+func (mc metricsCache) GetBytesWithTTL(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	start := time.Now()
+	data, ttl, err := getBytesWithTTL(ctx, mc.Cache, key)
+	observeOperation(mc.metrics, mc.tier, OperationGet, getResult(err), start)
+	return data, ttl, err
+}
+
+// Get retrieves the value from the wrapped cache and records the result
+func (mc metricsCache) Get(ctx context.Context, key string, target interface{}) error {
+	start := time.Now()
+	err := mc.Cache.Get(ctx, key, target)
+	observeOperation(mc.metrics, mc.tier, OperationGet, getResult(err), start)
+	return err
+}
+
+// GetWithTTL retrieves the value and its TTL from the wrapped cache and records the result
+func (mc metricsCache) GetWithTTL(ctx context.Context, key string, target interface{}) (time.Duration, error) {
+	start := time.Now()
+	ttl, err := getWithTTL(ctx, mc.Cache, key, target)
+	observeOperation(mc.metrics, mc.tier, OperationGet, getResult(err), start)
+	return ttl, err
+}
+
+// SetBytes sets the bytes in the wrapped cache and records the result
+func (mc metricsCache) SetBytes(ctx context.Context, key string, value []byte) error {
+	return mc.SetBytesWithTTL(ctx, key, value, 0)
+}
+
+// SetBytesWithTTL sets the bytes in the wrapped cache until ttl has passed and records the result
+func (mc metricsCache) SetBytesWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	start := time.Now()
+	err := setBytesWithTTL(ctx, mc.Cache, key, value, ttl)
+	observeOperation(mc.metrics, mc.tier, OperationSet, resultOf(err, ResultOK, ResultError), start)
+	return err
+}
+
+// Set sets the value in the wrapped cache and records the result
+func (mc metricsCache) Set(ctx context.Context, key string, value interface{}) error {
+	return mc.SetWithTTL(ctx, key, value, 0)
+}
+
+// SetWithTTL sets the value in the wrapped cache until ttl has passed and records the result
+func (mc metricsCache) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	start := time.Now()
+	err := setWithTTL(ctx, mc.Cache, key, value, ttl)
+	observeOperation(mc.metrics, mc.tier, OperationSet, resultOf(err, ResultOK, ResultError), start)
+	return err
+}
+
+// Delete removes the value from the wrapped cache and records the result
+func (mc metricsCache) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := mc.Cache.Delete(ctx, key)
+	observeOperation(mc.metrics, mc.tier, OperationDelete, lookupResult(err), start)
+	return err
+}
+
+// Purge wipes out the wrapped cache and records the result
+func (mc metricsCache) Purge(ctx context.Context) error {
+	start := time.Now()
+	err := mc.Cache.Purge(ctx)
+	observeOperation(mc.metrics, mc.tier, OperationPurge, resultOf(err, ResultOK, ResultError), start)
+	return err
+}
+
+// Exists checks the wrapped cache and records the result
+func (mc metricsCache) Exists(ctx context.Context, key string) (bool, error) {
+	start := time.Now()
+	found, err := mc.Cache.Exists(ctx, key)
+	observeOperation(mc.metrics, mc.tier, OperationExists, existsResult(found, err), start)
+	return found, err
+}
+
+// TTL reads the TTL from the wrapped cache and records the result
+func (mc metricsCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	start := time.Now()
+	ttl, err := mc.Cache.TTL(ctx, key)
+	observeOperation(mc.metrics, mc.tier, OperationTTL, lookupResult(err), start)
+	return ttl, err
+}
+
+// Touch extends the lifetime of key in the wrapped cache and records the result
+func (mc metricsCache) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	start := time.Now()
+	err := mc.Cache.Touch(ctx, key, ttl)
+	observeOperation(mc.metrics, mc.tier, OperationTouch, lookupResult(err), start)
+	return err
+}
+
+// Expire sets the expiry of key in the wrapped cache and records the result
+func (mc metricsCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	start := time.Now()
+	err := mc.Cache.Expire(ctx, key, ttl)
+	observeOperation(mc.metrics, mc.tier, OperationExpire, lookupResult(err), start)
+	return err
+}
+
+// existsResult classifies the outcome of an Exists check
+func existsResult(found bool, err error) Result {
+	if err != nil {
+		return ResultError
+	} else if !found {
+		return ResultMiss
+	}
+	return ResultHit
+}
+
+// spanContextKey is the context key under which TracingMiddleware stores the current span
+type spanContextKey struct{}
+
+// spanFromContext returns the span stored in ctx by TracingMiddleware, or nil
+func spanFromContext(ctx context.Context) Span {
+	span, _ := ctx.Value(spanContextKey{}).(Span)
+	return span
+}
+
+// tierSpan returns the span stored in ctx by the TracingMiddleware of a cache tier, or nil if the
+// tier does not trace, in which case any span in ctx belongs to another tier
+func tierSpan(ctx context.Context, tracingEnabled bool) Span {
+	if !tracingEnabled {
+		return nil
+	}
+	return spanFromContext(ctx)
+}
+
+// TracingMiddleware returns a Middleware that traces each operation with tracer. Spans are named
+// spanPrefix followed by the operation, for example "tiered-cache-get", or "tiered-cache-get-bytes"
+// for byte operations. The wrapped cache may tag the span, which it can find in the context it is
+// passed. LocalCache and RemoteCache trace their own operations with it too.
+func TracingMiddleware(tracer Tracer, sanitizer KeySanitizer, spanPrefix string) Middleware {
+	return func(cache Cache) Cache {
+		return tracingCache{Cache: cache, tracer: tracer, sanitizer: sanitizer, spanPrefix: spanPrefix}
+	}
+}
+
+// tracingCache traces operations on the wrapped Cache
+type tracingCache struct {
+	Cache
+	tracer     Tracer
+	sanitizer  KeySanitizer
+	spanPrefix string
+}
+
+// startSpan starts a span for the operation and stores it in the returned context
+func (tc tracingCache) startSpan(ctx context.Context, operation Operation, key string) (Span, context.Context) {
+	return tc.startNamedSpan(ctx, string(operation), key)
+}
+
+// startNamedSpan starts a span named after the prefix and name and stores it in the returned
+// context. An empty key is not tagged.
+func (tc tracingCache) startNamedSpan(ctx context.Context, name, key string) (Span, context.Context) {
+	span, ctx := startSpan(ctx, true, tc.tracer, tc.spanPrefix+"-"+name)
+	if key != "" {
+		tagKey(span, tc.sanitizer, key)
+	}
+	return span, context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// GetBytes retrieves the bytes from the wrapped cache within a span
+func (tc tracingCache) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	span, ctx := tc.startNamedSpan(ctx, "get-bytes", key)
+	data, err := tc.Cache.GetBytes(ctx, key)
+	finishSpan(span, OperationGet, getResult(err))
+	return data, err
+}
+
+// GetBytesWithTTL retrieves the bytes and their TTL from the wrapped cache within a span
+func (tc tracingCache) GetBytesWithTTL(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	span, ctx := tc.startNamedSpan(ctx, "get-bytes", key)
+	data, ttl, err := getBytesWithTTL(ctx, tc.Cache, key)
+	finishSpan(span, OperationGet, getResult(err))
+	return data, ttl, err
+}
+
+// Get retrieves the value from the wrapped cache within a span
+func (tc tracingCache) Get(ctx context.Context, key string, target interface{}) error {
+	span, ctx := tc.startSpan(ctx, OperationGet, key)
+	err := tc.Cache.Get(ctx, key, target)
+	finishSpan(span, OperationGet, getResult(err))
+	return err
+}
+
+// GetWithTTL retrieves the value and its TTL from the wrapped cache within a span
+func (tc tracingCache) GetWithTTL(ctx context.Context, key string, target interface{}) (time.Duration, error) {
+	span, ctx := tc.startSpan(ctx, OperationGet, key)
+	ttl, err := getWithTTL(ctx, tc.Cache, key, target)
+	finishSpan(span, OperationGet, getResult(err))
+	return ttl, err
+}
+
+// SetBytes sets the bytes in the wrapped cache within a span
+func (tc tracingCache) SetBytes(ctx context.Context, key string, value []byte) error {
+	return tc.SetBytesWithTTL(ctx, key, value, 0)
+}
+
+// SetBytesWithTTL sets the bytes in the wrapped cache until ttl has passed within a span
+func (tc tracingCache) SetBytesWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	span, ctx := tc.startNamedSpan(ctx, "set-bytes", key)
+	err := setBytesWithTTL(ctx, tc.Cache, key, value, ttl)
+	finishSpan(span, OperationSet, resultOf(err, ResultOK, ResultError))
+	return err
+}
+
+// Set sets the value in the wrapped cache within a span
+func (tc tracingCache) Set(ctx context.Context, key string, value interface{}) error {
+	return tc.SetWithTTL(ctx, key, value, 0)
+}
+
+// SetWithTTL sets the value in the wrapped cache until ttl has passed within a span
+func (tc tracingCache) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	span, ctx := tc.startSpan(ctx, OperationSet, key)
+	err := setWithTTL(ctx, tc.Cache, key, value, ttl)
+	finishSpan(span, OperationSet, resultOf(err, ResultOK, ResultError))
+	return err
+}
+
+// Delete removes the value from the wrapped cache within a span
+func (tc tracingCache) Delete(ctx context.Context, key string) error {
+	span, ctx := tc.startSpan(ctx, OperationDelete, key)
+	err := tc.Cache.Delete(ctx, key)
+	finishSpan(span, OperationDelete, lookupResult(err))
+	return err
+}
+
+// Purge wipes out the wrapped cache within a span
+func (tc tracingCache) Purge(ctx context.Context) error {
+	span, ctx := tc.startNamedSpan(ctx, string(OperationPurge), "")
+	err := tc.Cache.Purge(ctx)
+	finishSpan(span, OperationPurge, resultOf(err, ResultOK, ResultError))
+	return err
+}
+
+// Exists checks the wrapped cache within a span
+func (tc tracingCache) Exists(ctx context.Context, key string) (bool, error) {
+	span, ctx := tc.startSpan(ctx, OperationExists, key)
+	found, err := tc.Cache.Exists(ctx, key)
+	finishSpan(span, OperationExists, existsResult(found, err))
+	return found, err
+}
+
+// TTL reads the TTL from the wrapped cache within a span
+func (tc tracingCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	span, ctx := tc.startSpan(ctx, OperationTTL, key)
+	ttl, err := tc.Cache.TTL(ctx, key)
+	finishSpan(span, OperationTTL, lookupResult(err))
+	return ttl, err
+}
+
+// Touch extends the lifetime of key in the wrapped cache within a span
+func (tc tracingCache) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	span, ctx := tc.startSpan(ctx, OperationTouch, key)
+	err := tc.Cache.Touch(ctx, key, ttl)
+	finishSpan(span, OperationTouch, lookupResult(err))
+	return err
+}
+
+// Expire sets the expiry of key in the wrapped cache within a span
+func (tc tracingCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	span, ctx := tc.startSpan(ctx, OperationExpire, key)
+	err := tc.Cache.Expire(ctx, key, ttl)
+	finishSpan(span, OperationExpire, lookupResult(err))
+	return err
+}
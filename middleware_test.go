@@ -0,0 +1,264 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// prefixCache is a middleware cache that rewrites keys and records the order it was called in
+type prefixCache struct {
+	Cache
+	prefix string
+	calls  *[]string
+}
+
+func (pc prefixCache) Get(ctx context.Context, key string, target interface{}) error {
+	*pc.calls = append(*pc.calls, pc.prefix)
+	return pc.Cache.Get(ctx, pc.prefix+key, target)
+}
+
+func (pc prefixCache) Set(ctx context.Context, key string, value interface{}) error {
+	*pc.calls = append(*pc.calls, pc.prefix)
+	return pc.Cache.Set(ctx, pc.prefix+key, value)
+}
+
+func (pc prefixCache) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	*pc.calls = append(*pc.calls, pc.prefix)
+	return pc.Cache.GetBytes(ctx, pc.prefix+key)
+}
+
+func (pc prefixCache) SetBytes(ctx context.Context, key string, value []byte) error {
+	*pc.calls = append(*pc.calls, pc.prefix)
+	return pc.Cache.SetBytes(ctx, pc.prefix+key, value)
+}
+
+// unavailableCache is a cache whose deletes fail as if its backend were down
+type unavailableCache struct {
+	Cache
+}
+
+func (uc unavailableCache) Delete(ctx context.Context, key string) error {
+	return fmt.Errorf("connection refused")
+}
+
+func prefixMiddleware(prefix string, calls *[]string) Middleware {
+	return func(cache Cache) Cache {
+		return prefixCache{Cache: cache, prefix: prefix, calls: calls}
+	}
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mc := NewMockCache(&GobCacheEncoder{})
+	cache := Chain(mc, prefixMiddleware("a:", &calls), prefixMiddleware("b:", &calls))
+	require.NoError(t, cache.Set(context.Background(), "key", "value"))
+	assert.Equal(t, []string{"a:", "b:"}, calls)
+	_, ok := mc.Cache["b:a:key"]
+	assert.True(t, ok)
+}
+
+func TestHooksMiddleware(t *testing.T) {
+	var events []string
+	record := func(event string) func(ctx context.Context, key string) {
+		return func(ctx context.Context, key string) {
+			events = append(events, event+":"+key)
+		}
+	}
+	cache := HooksMiddleware(Hooks{
+		OnHit:    record("hit"),
+		OnMiss:   record("miss"),
+		OnSet:    record("set"),
+		OnDelete: record("delete"),
+		OnError: func(ctx context.Context, operation Operation, key string, err error) {
+			events = append(events, "error:"+string(operation)+":"+key)
+		},
+	})(NewMockCache(&GobCacheEncoder{}))
+
+	var target string
+	require.NoError(t, cache.Set(context.Background(), "key", "value"))
+	require.NoError(t, cache.Get(context.Background(), "key", &target))
+	require.NoError(t, cache.Delete(context.Background(), "key"))
+	require.Error(t, cache.Get(context.Background(), "key", &target))
+	require.Error(t, cache.Delete(context.Background(), "key"))
+	assert.Equal(t, []string{"set:key", "hit:key", "delete:key", "miss:key", "error:delete:key"}, events)
+
+	// Byte operations invoke the same hooks
+	events = nil
+	require.NoError(t, cache.SetBytes(context.Background(), "bytes", []byte("value")))
+	_, err := cache.GetBytes(context.Background(), "bytes")
+	require.NoError(t, err)
+	_, err = cache.GetBytes(context.Background(), "missing")
+	require.Error(t, err)
+	assert.Equal(t, []string{"set:bytes", "hit:bytes", "miss:missing"}, events)
+}
+
+func TestHooksMiddlewareNilHooks(t *testing.T) {
+	cache := HooksMiddleware(Hooks{})(NewMockCache(&GobCacheEncoder{}))
+	var target string
+	assert.NoError(t, cache.Set(context.Background(), "key", "value"))
+	assert.NoError(t, cache.Get(context.Background(), "key", &target))
+	assert.Error(t, cache.Get(context.Background(), "missing", &target))
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	metrics := &operationRecorder{}
+	cache := MetricsMiddleware(metrics, TierLocal)(NewMockCache(&GobCacheEncoder{}))
+	var target string
+	require.NoError(t, cache.Set(context.Background(), "key", "value"))
+	require.NoError(t, cache.Get(context.Background(), "key", &target))
+	require.NoError(t, cache.Delete(context.Background(), "key"))
+	require.Error(t, cache.Delete(context.Background(), "key"))
+	assert.Equal(t, []string{"local:set:ok", "local:get:hit", "local:delete:hit", "local:delete:miss"}, metrics.observed)
+
+	// Byte operations are recorded as sets and gets
+	metrics.observed = nil
+	require.NoError(t, cache.SetBytes(context.Background(), "bytes", []byte("value")))
+	_, err := cache.GetBytes(context.Background(), "bytes")
+	require.NoError(t, err)
+	_, err = cache.GetBytes(context.Background(), "missing")
+	require.Error(t, err)
+	assert.Equal(t, []string{"local:set:ok", "local:get:hit", "local:get:miss"}, metrics.observed)
+
+	// Failed deletes are errors rather than misses
+	metrics.observed = nil
+	cache = MetricsMiddleware(metrics, TierLocal)(unavailableCache{NewMockCache(&GobCacheEncoder{})})
+	require.Error(t, cache.Delete(context.Background(), "key"))
+	assert.Equal(t, []string{"local:delete:error"}, metrics.observed)
+
+	mc := NewMockCache(&GobCacheEncoder{})
+	assert.True(t, MetricsMiddleware(nil, TierLocal)(mc) == Cache(mc))
+}
+
+func TestMetricsMiddlewareExpiration(t *testing.T) {
+	metrics := &operationRecorder{}
+	cache := MetricsMiddleware(metrics, TierRemote)(NewMockCache(&GobCacheEncoder{}))
+	ctx := context.Background()
+	require.NoError(t, cache.Set(ctx, "key", "value"))
+	metrics.observed = nil
+	_, err := cache.Exists(ctx, "key")
+	require.NoError(t, err)
+	_, err = cache.Exists(ctx, "missing")
+	require.NoError(t, err)
+	require.NoError(t, cache.Expire(ctx, "key", time.Minute))
+	require.NoError(t, cache.Touch(ctx, "key", time.Hour))
+	_, err = cache.TTL(ctx, "missing")
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		"remote:exists:hit", "remote:exists:miss", "remote:expire:hit", "remote:touch:hit", "remote:ttl:miss",
+	}, metrics.observed)
+}
+
+func TestGetResult(t *testing.T) {
+	// Middlewares classify errors the same way the tiers do
+	tests := []struct {
+		name     string
+		err      error
+		expected Result
+	}{
+		{"hit", nil, ResultHit},
+		{"local miss", ErrEntryNotFound, ResultMiss},
+		{"remote miss", redis.ErrNil, ResultMiss},
+		{"tampered", &TamperError{}, ResultMiss},
+		{"undecryptable", &DecryptionError{}, ResultDecodeError},
+		{"undecodable", &DecodeError{Err: fmt.Errorf("type mismatch")}, ResultDecodeError},
+		{"unavailable", fmt.Errorf("connection refused"), ResultError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, getResult(test.err))
+		})
+	}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	tracer, recorder := newRecordingTracer()
+	cache := TracingMiddleware(tracer, HashKey, "test-cache")(NewMockCache(&GobCacheEncoder{}))
+	var target string
+	require.NoError(t, cache.Set(context.Background(), "key", "value"))
+	require.Error(t, cache.Get(context.Background(), "missing", &target))
+	require.NoError(t, cache.SetBytes(context.Background(), "bytes", []byte("value")))
+	_, err := cache.GetBytes(context.Background(), "bytes")
+	require.NoError(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 4)
+	assert.Equal(t, "test-cache-set", spans[0].Name())
+	assert.Equal(t, HashKey("key"), spanAttributes(spans[0])["key"].AsString())
+	assert.Equal(t, "test-cache-get", spans[1].Name())
+	assert.Equal(t, "miss", spanAttributes(spans[1])["result"].AsString())
+	assert.Equal(t, "test-cache-set-bytes", spans[2].Name())
+	assert.Equal(t, "test-cache-get-bytes", spans[3].Name())
+	assert.True(t, spanAttributes(spans[3])["cache.hit"].AsBool())
+}
+
+func TestTieredMiddlewares(t *testing.T) {
+	var calls []string
+	var errs []error
+	mtc := TieredCache{
+		Local:  NewMockCache(&GobCacheEncoder{}),
+		Remote: NewMockCache(&GobCacheEncoder{}),
+		Middlewares: []Middleware{
+			prefixMiddleware("tenant:", &calls),
+			HooksMiddleware(Hooks{OnError: func(ctx context.Context, operation Operation, key string, err error) {
+				errs = append(errs, fmt.Errorf("%v %v: %v", operation, key, err))
+			}}),
+		},
+	}
+	require.NoError(t, mtc.Set(context.Background(), "key", "value"))
+	var target string
+	require.NoError(t, mtc.Get(context.Background(), "key", &target))
+	assert.Equal(t, "value", target)
+	_, ok := mtc.Local.(*MockCache).Cache["tenant:key"]
+	assert.True(t, ok)
+	_, ok = mtc.Remote.(*MockCache).Cache["tenant:key"]
+	assert.True(t, ok)
+	assert.Equal(t, []string{"tenant:", "tenant:"}, calls)
+	assert.Empty(t, errs)
+
+	// Byte operations pass through the middlewares too
+	calls = nil
+	require.NoError(t, mtc.SetBytes(context.Background(), "bytes", []byte("value")))
+	data, err := mtc.GetBytes(context.Background(), "bytes")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), data)
+	_, ok = mtc.Remote.(*MockCache).Cache["tenant:bytes"]
+	assert.True(t, ok)
+	assert.Equal(t, []string{"tenant:", "tenant:"}, calls)
+}
+
+func TestTieredMiddlewaresBuiltOnce(t *testing.T) {
+	var built int
+	mtc := TieredCache{
+		Local:  NewMockCache(&GobCacheEncoder{}),
+		Remote: NewMockCache(&GobCacheEncoder{}),
+		Middlewares: []Middleware{func(cache Cache) Cache {
+			built++
+			return cache
+		}},
+	}
+	mtc.chained = mtc.buildChain()
+	require.NoError(t, mtc.Set(context.Background(), "key", "value"))
+	var target string
+	require.NoError(t, mtc.Get(context.Background(), "key", &target))
+	assert.Equal(t, 1, built)
+}
@@ -16,16 +16,17 @@ package tieredcache
 
 import (
 	"context"
-	"fmt"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 )
 
 // MockCache mocks the Cache implementation for use in test caches
 type MockCache struct {
-	Cache   map[string][]byte
-	Encoder CacheEncoder
-	Metrics CacheMetrics
+	Cache       map[string][]byte
+	Expirations map[string]time.Time // Expiry of keys set with Expire or Touch
+	Encoder     CacheEncoder
+	Metrics     CacheMetrics
 }
 
 // MockCacheMetrics provides a mock cache metrics implementation
@@ -36,17 +37,19 @@ type MockCacheMetrics struct {
 // NewMockCache constructs a new cache for testing
 func NewMockCache(encoder CacheEncoder) *MockCache {
 	return &MockCache{
-		Cache:   make(map[string][]byte),
-		Encoder: encoder,
-		Metrics: &MockCacheMetrics{},
+		Cache:       make(map[string][]byte),
+		Expirations: make(map[string]time.Time),
+		Encoder:     encoder,
+		Metrics:     &MockCacheMetrics{},
 	}
 }
 
 // GetBytes is a mock GetBytes implementation for cache
 func (mc *MockCache) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	mc.expire(key)
 	value, ok := mc.Cache[key]
 	if !ok {
-		return nil, fmt.Errorf("key not found")
+		return nil, ErrEntryNotFound
 	}
 	return value, nil
 }
@@ -57,18 +60,19 @@ func (mc *MockCache) Get(ctx context.Context, key string, target interface{}) er
 	if err != nil {
 		return err
 	}
-	return mc.Encoder.Decode(data, target)
+	return decodeValue(mc.Encoder, key, data, target)
 }
 
 // SetBytes is a mock SetBytes implementation for cache
 func (mc *MockCache) SetBytes(ctx context.Context, key string, value []byte) error {
 	mc.Cache[key] = value
+	delete(mc.Expirations, key)
 	return nil
 }
 
 // Set is a mock Set implementation for cache
 func (mc *MockCache) Set(ctx context.Context, key string, value interface{}) error {
-	cacheBytes, err := mc.Encoder.Encode(value)
+	cacheBytes, err := encodeValue(mc.Encoder, key, value)
 	if err != nil {
 		return err
 	}
@@ -78,18 +82,79 @@ func (mc *MockCache) Set(ctx context.Context, key string, value interface{}) err
 // Delete is a mock Delete implementation for cache
 func (mc *MockCache) Delete(ctx context.Context, key string) error {
 	if _, ok := mc.Cache[key]; !ok {
-		return fmt.Errorf("key not found for deletion")
+		return ErrEntryNotFound
 	}
 	delete(mc.Cache, key)
+	delete(mc.Expirations, key)
 	return nil
 }
 
 // Purge is a mock Purge implementation for cache
 func (mc *MockCache) Purge(ctx context.Context) error {
 	mc.Cache = make(map[string][]byte)
+	mc.Expirations = make(map[string]time.Time)
 	return nil
 }
 
+// Exists is a mock Exists implementation for cache
+func (mc *MockCache) Exists(ctx context.Context, key string) (bool, error) {
+	mc.expire(key)
+	_, ok := mc.Cache[key]
+	return ok, nil
+}
+
+// TTL is a mock TTL implementation for cache
+func (mc *MockCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	if ok, _ := mc.Exists(ctx, key); !ok {
+		return 0, ErrEntryNotFound
+	}
+	if expiresAt, ok := mc.Expirations[key]; ok {
+		return time.Until(expiresAt), nil
+	}
+	return 0, nil
+}
+
+// Touch is a mock Touch implementation for cache
+func (mc *MockCache) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	current, err := mc.TTL(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current > 0 && current < ttl {
+		mc.setExpiration(key, ttl)
+	}
+	return nil
+}
+
+// Expire is a mock Expire implementation for cache
+func (mc *MockCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	if ok, _ := mc.Exists(ctx, key); !ok {
+		return ErrEntryNotFound
+	}
+	if ttl > 0 {
+		mc.setExpiration(key, ttl)
+	} else {
+		delete(mc.Expirations, key)
+	}
+	return nil
+}
+
+// setExpiration sets key to expire after ttl
+func (mc *MockCache) setExpiration(key string, ttl time.Duration) {
+	if mc.Expirations == nil {
+		mc.Expirations = make(map[string]time.Time)
+	}
+	mc.Expirations[key] = time.Now().Add(ttl)
+}
+
+// expire removes key if its expiry has passed
+func (mc *MockCache) expire(key string) {
+	if expiresAt, ok := mc.Expirations[key]; ok && !time.Now().Before(expiresAt) {
+		delete(mc.Cache, key)
+		delete(mc.Expirations, key)
+	}
+}
+
 // MockCacheEncoder is a fake encoder for use in tests
 type MockCacheEncoder struct{}
 
@@ -143,6 +208,16 @@ func (mcc *MockCacheMetrics) PurgeMiss() {
 	mcc.Called()
 }
 
+// Tamper is a mock metrics Tamper implementation
+func (mcc *MockCacheMetrics) Tamper() {
+	mcc.Called()
+}
+
+// Compressed is a mock metrics Compressed implementation
+func (mcc *MockCacheMetrics) Compressed(originalBytes, storedBytes int) {
+	mcc.Called(originalBytes, storedBytes)
+}
+
 // MockTieredCacheCreator provides a mock tiered cache config implementation
 type MockTieredCacheCreator struct {
 	mock.Mock
@@ -0,0 +1,197 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// OpenTelemetryCacheMetrics records cache metrics with OpenTelemetry instruments. It is an
+// alternative to PrometheusCacheMetrics for services that export metrics through OpenTelemetry.
+type OpenTelemetryCacheMetrics struct {
+	attributes            metric.MeasurementOption
+	hits                  metric.Int64Counter
+	misses                metric.Int64Counter
+	sets                  metric.Int64Counter
+	setsCollisions        metric.Int64Counter
+	deletesHits           metric.Int64Counter
+	deletesMisses         metric.Int64Counter
+	purgesHits            metric.Int64Counter
+	purgesMisses          metric.Int64Counter
+	compressionRatio      metric.Float64Histogram
+	compressionBytesSaved metric.Int64Counter
+	tampers               metric.Int64Counter
+	evictions             metric.Int64Counter
+	keyFilterChecks       metric.Int64Counter
+	operationDurations    metric.Float64Histogram
+}
+
+// NewOpenTelemetryCacheMetrics creates and returns an OpenTelemetry cache metrics recorder using
+// instruments from provider. If provider is nil the global meter provider is used.
+func NewOpenTelemetryCacheMetrics(
+	provider metric.MeterProvider,
+	client, cacheName string,
+) (*OpenTelemetryCacheMetrics, error) {
+	if provider == nil {
+		provider = otel.GetMeterProvider()
+	}
+	meter := provider.Meter(instrumentationName)
+	otcm := &OpenTelemetryCacheMetrics{
+		attributes: metric.WithAttributes(
+			attribute.String("client", client),
+			attribute.String("cache_name", cacheName),
+		),
+	}
+	counters := []struct {
+		counter *metric.Int64Counter
+		name    string
+		help    string
+	}{
+		{&otcm.hits, "cache.hits", "Total number of cache hits"},
+		{&otcm.misses, "cache.misses", "Total number of cache misses"},
+		{&otcm.sets, "cache.sets", "Total number of cache sets"},
+		{&otcm.setsCollisions, "cache.sets.collisions", "Total number of cache sets collisions"},
+		{&otcm.deletesHits, "cache.deletes.hits", "Total number of cache deletes hits"},
+		{&otcm.deletesMisses, "cache.deletes.misses", "Total number of cache deletes misses"},
+		{&otcm.purgesHits, "cache.purges.hits", "Total number of cache purges hits"},
+		{&otcm.purgesMisses, "cache.purges.misses", "Total number of cache purges misses"},
+		{
+			&otcm.compressionBytesSaved,
+			"cache.compression.bytes_saved",
+			"Total number of bytes saved by compressing cache values",
+		},
+		{&otcm.tampers, "cache.tampers", "Total number of cached values that failed integrity verification"},
+		{&otcm.evictions, "cache.evictions", "Total number of entries removed from local cache by reason"},
+		{
+			&otcm.keyFilterChecks,
+			"cache.key_filter.checks",
+			"Total number of remote lookups checked against the key filter by result",
+		},
+	}
+	var err error
+	for _, counter := range counters {
+		*counter.counter, err = meter.Int64Counter(counter.name, metric.WithDescription(counter.help))
+		if err != nil {
+			return nil, err
+		}
+	}
+	otcm.compressionRatio, err = meter.Float64Histogram(
+		"cache.compression.ratio",
+		metric.WithDescription("Ratio of stored to uncompressed size for compressed cache values"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	otcm.operationDurations, err = meter.Float64Histogram(
+		"cache.operation.duration",
+		metric.WithDescription("Latency of cache operations by tier, operation and result"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return otcm, nil
+}
+
+// Hit defines a cache hit
+func (otcm *OpenTelemetryCacheMetrics) Hit() {
+	otcm.hits.Add(context.Background(), 1, otcm.attributes)
+}
+
+// Miss defines a cache miss
+func (otcm *OpenTelemetryCacheMetrics) Miss() {
+	otcm.misses.Add(context.Background(), 1, otcm.attributes)
+}
+
+// Set defines a cache set
+func (otcm *OpenTelemetryCacheMetrics) Set() {
+	otcm.sets.Add(context.Background(), 1, otcm.attributes)
+}
+
+// SetCollision defines a cache set collision
+func (otcm *OpenTelemetryCacheMetrics) SetCollision() {
+	otcm.setsCollisions.Add(context.Background(), 1, otcm.attributes)
+}
+
+// DeleteHit defines a deletion hit from cache
+func (otcm *OpenTelemetryCacheMetrics) DeleteHit() {
+	otcm.deletesHits.Add(context.Background(), 1, otcm.attributes)
+}
+
+// DeleteMiss defines a deletion miss from cache
+func (otcm *OpenTelemetryCacheMetrics) DeleteMiss() {
+	otcm.deletesMisses.Add(context.Background(), 1, otcm.attributes)
+}
+
+// PurgeHit defines a purge hit of cache
+func (otcm *OpenTelemetryCacheMetrics) PurgeHit() {
+	otcm.purgesHits.Add(context.Background(), 1, otcm.attributes)
+}
+
+// PurgeMiss defines a purge miss of cache
+func (otcm *OpenTelemetryCacheMetrics) PurgeMiss() {
+	otcm.purgesMisses.Add(context.Background(), 1, otcm.attributes)
+}
+
+// Compressed records the ratio and bytes saved for a compressed cache value
+func (otcm *OpenTelemetryCacheMetrics) Compressed(originalBytes, storedBytes int) {
+	if originalBytes <= 0 {
+		return
+	}
+	otcm.compressionRatio.Record(
+		context.Background(), float64(storedBytes)/float64(originalBytes), otcm.attributes)
+	if saved := originalBytes - storedBytes; saved > 0 {
+		otcm.compressionBytesSaved.Add(context.Background(), int64(saved), otcm.attributes)
+	}
+}
+
+// Tamper defines a cached value that failed integrity verification
+func (otcm *OpenTelemetryCacheMetrics) Tamper() {
+	otcm.tampers.Add(context.Background(), 1, otcm.attributes)
+}
+
+// Evict defines an entry removed from local cache
+func (otcm *OpenTelemetryCacheMetrics) Evict(reason EvictionReason) {
+	otcm.evictions.Add(
+		context.Background(), 1, otcm.attributes,
+		metric.WithAttributes(attribute.String("reason", string(reason))),
+	)
+}
+
+// KeyFilterCheck defines a remote lookup checked against the key filter
+func (otcm *OpenTelemetryCacheMetrics) KeyFilterCheck(result KeyFilterResult) {
+	otcm.keyFilterChecks.Add(
+		context.Background(), 1, otcm.attributes,
+		metric.WithAttributes(attribute.String("result", string(result))),
+	)
+}
+
+// ObserveOperation records the latency of a cache operation and increments the matching counter
+func (otcm *OpenTelemetryCacheMetrics) ObserveOperation(tier Tier, operation Operation, result Result, duration time.Duration) {
+	otcm.operationDurations.Record(
+		context.Background(), duration.Seconds(), otcm.attributes,
+		metric.WithAttributes(
+			attribute.String("tier", string(tier)),
+			attribute.String("operation", string(operation)),
+			attribute.String("result", string(result)),
+		),
+	)
+	CacheMetricsAdapter{otcm}.ObserveOperation(tier, operation, result, duration)
+}
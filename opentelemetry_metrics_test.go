@@ -0,0 +1,104 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// newTestOpenTelemetryCacheMetrics returns metrics backed by a reader that can be collected on demand
+func newTestOpenTelemetryCacheMetrics(t *testing.T) (*OpenTelemetryCacheMetrics, *sdkmetric.ManualReader) {
+	reader := sdkmetric.NewManualReader()
+	otcm, err := NewOpenTelemetryCacheMetrics(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)), "client", "name")
+	require.NoError(t, err)
+	return otcm, reader
+}
+
+// collectOpenTelemetryMetrics returns the collected metrics keyed by instrument name
+func collectOpenTelemetryMetrics(t *testing.T, reader *sdkmetric.ManualReader) map[string]metricdata.Aggregation {
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	collected := make(map[string]metricdata.Aggregation)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			collected[m.Name] = m.Data
+		}
+	}
+	return collected
+}
+
+func TestOpenTelemetryCacheMetricsCounters(t *testing.T) {
+	otcm, reader := newTestOpenTelemetryCacheMetrics(t)
+	otcm.Hit()
+	otcm.Hit()
+	otcm.Miss()
+	otcm.Set()
+	otcm.SetCollision()
+	otcm.DeleteHit()
+	otcm.DeleteMiss()
+	otcm.PurgeHit()
+	otcm.PurgeMiss()
+	otcm.Tamper()
+	otcm.Compressed(100, 40)
+	otcm.Evict(EvictionExpired)
+	otcm.KeyFilterCheck(KeyFilterFalsePositive)
+
+	collected := collectOpenTelemetryMetrics(t, reader)
+	for name, expected := range map[string]int64{
+		"cache.hits":                    2,
+		"cache.misses":                  1,
+		"cache.sets":                    1,
+		"cache.sets.collisions":         1,
+		"cache.deletes.hits":            1,
+		"cache.deletes.misses":          1,
+		"cache.purges.hits":             1,
+		"cache.purges.misses":           1,
+		"cache.tampers":                 1,
+		"cache.compression.bytes_saved": 60,
+		"cache.evictions":               1,
+		"cache.key_filter.checks":       1,
+	} {
+		sum, ok := collected[name].(metricdata.Sum[int64])
+		require.True(t, ok, name)
+		require.Len(t, sum.DataPoints, 1, name)
+		assert.Equal(t, expected, sum.DataPoints[0].Value, name)
+	}
+	ratio, ok := collected["cache.compression.ratio"].(metricdata.Histogram[float64])
+	require.True(t, ok)
+	assert.Equal(t, 0.4, ratio.DataPoints[0].Sum)
+}
+
+func TestOpenTelemetryCacheMetricsObserveOperation(t *testing.T) {
+	otcm, reader := newTestOpenTelemetryCacheMetrics(t)
+	otcm.ObserveOperation(TierLocal, OperationGet, ResultHit, time.Millisecond)
+
+	collected := collectOpenTelemetryMetrics(t, reader)
+	durations, ok := collected["cache.operation.duration"].(metricdata.Histogram[float64])
+	require.True(t, ok)
+	require.Len(t, durations.DataPoints, 1)
+	tier, _ := durations.DataPoints[0].Attributes.Value("tier")
+	assert.Equal(t, "local", tier.AsString())
+	assert.Equal(t, uint64(1), durations.DataPoints[0].Count)
+	hits, ok := collected["cache.hits"].(metricdata.Sum[int64])
+	require.True(t, ok)
+	assert.Equal(t, int64(1), hits.DataPoints[0].Value)
+}
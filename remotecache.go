@@ -15,14 +15,55 @@
 package tieredcache
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"net"
+	"strconv"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/mna/redisc"
-	opentracing "github.com/opentracing/opentracing-go"
 )
 
+// scanCount is the number of keys SCAN is asked to examine per call
+const scanCount = 1000
+
+// touchScript extends the expiry of KEYS[1] to ARGV[1] milliseconds unless it already lives
+// longer. It returns 0 if the key does not exist, 2 if its value starts with ARGV[2] and 1
+// otherwise.
+var touchScript = redis.NewScript(1, `
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl == -2 then
+	return 0
+end
+if ttl >= 0 and ttl < tonumber(ARGV[1]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+if redis.call("GETRANGE", KEYS[1], 0, string.len(ARGV[2]) - 1) == ARGV[2] then
+	return 2
+end
+return 1
+`)
+
+// expireScript sets the expiry of KEYS[1] to ARGV[1] milliseconds, or removes it if ARGV[1] is 0.
+// It returns 0 if the key does not exist, 2 if its value starts with ARGV[2] and 1 otherwise.
+var expireScript = redis.NewScript(1, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+local ttl = tonumber(ARGV[1])
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+else
+	redis.call("PERSIST", KEYS[1])
+end
+if redis.call("GETRANGE", KEYS[1], 0, string.len(ARGV[2]) - 1) == ARGV[2] then
+	return 2
+end
+return 1
+`)
+
 // RemoteCache defines a remote-caching approach in which keys are stored remotely in a separate
 // process.
 type RemoteCache struct {
@@ -30,6 +71,11 @@ type RemoteCache struct {
 	Encoder        CacheEncoder
 	Metrics        CacheMetrics
 	TracingEnabled bool
+	Tracer         Tracer        // Defaults to OpenTracingTracer if nil
+	KeySanitizer   KeySanitizer  // Applied to keys before they are attached to spans
+	ChunkSize      int           // Size in bytes of the chunks SetReader splits values into
+	LeaseTTL       time.Duration // Lifetime of the leases GetWithLease hands out
+	authToken      string        // Sent with AUTH on the connections dialed to each node
 }
 
 // RemoteCacheConfig is the necessary configuration for instantiating a RemoteCache struct
@@ -38,6 +84,10 @@ type RemoteCacheConfig struct {
 	AuthToken      string
 	Timeout        time.Duration
 	TracingEnabled bool
+	TracerBackend  string       // TracerOpenTracing or TracerOpenTelemetry
+	KeySanitizer   KeySanitizer // Applied to keys before they are attached to spans
+	ChunkSize      int
+	LeaseTTL       time.Duration
 }
 
 // createPool creates and returns a Redis connection pool
@@ -61,6 +111,10 @@ func (rcc RemoteCacheConfig) NewCache(
 	encoder CacheEncoder,
 	metrics CacheMetrics,
 ) (RemoteCache, error) {
+	tracer, err := NewTracer(rcc.TracerBackend)
+	if err != nil {
+		return RemoteCache{}, err
+	}
 	sharedCluster.onceCreate.Do(func() {
 		sharedCluster.cluster = &redisc.Cluster{
 			StartupNodes: rcc.URLs,
@@ -68,7 +122,7 @@ func (rcc RemoteCacheConfig) NewCache(
 			CreatePool:   rcc.createPool,
 		}
 	})
-	err := sharedCluster.cluster.Refresh()
+	err = sharedCluster.cluster.Refresh()
 	if err == nil && rcc.AuthToken != "" {
 		conn := sharedCluster.cluster.Get()
 		defer conn.Close()
@@ -79,6 +133,11 @@ func (rcc RemoteCacheConfig) NewCache(
 		Encoder:        encoder,
 		Metrics:        metrics,
 		TracingEnabled: rcc.TracingEnabled,
+		Tracer:         tracer,
+		KeySanitizer:   rcc.KeySanitizer,
+		ChunkSize:      rcc.ChunkSize,
+		LeaseTTL:       rcc.LeaseTTL,
+		authToken:      rcc.AuthToken,
 	}, err
 }
 
@@ -89,148 +148,594 @@ func (rc RemoteCache) Close() {
 	})
 }
 
-// GetBytes gets the requested bytes from remote cache
+// chain wraps the remote lookup in tracing and metrics middlewares
+func (rc RemoteCache) chain() Cache {
+	return instrument(
+		remoteLookup{rc}, rc.TracingEnabled, rc.Tracer, rc.KeySanitizer, "remote-cache", rc.Metrics, TierRemote,
+	)
+}
+
+// GetBytes gets the requested bytes from remote cache. Values written with SetReader must be read
+// with GetReader instead; reading them returns ErrStreamedValue.
 func (rc RemoteCache) GetBytes(ctx context.Context, key string) ([]byte, error) {
-	var span opentracing.Span
-	if rc.TracingEnabled {
-		span, _ = opentracing.StartSpanFromContext(ctx, "remote-cache-get-bytes")
-		span.SetTag("command", "GET")
-		span.SetTag("key", key)
+	return rc.chain().GetBytes(ctx, key)
+}
+
+// GetBytesWithTTL gets the requested bytes from remote cache along with the time left until they
+// expire. A TTL of zero means the value does not expire.
+func (rc RemoteCache) GetBytesWithTTL(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	return getBytesWithTTL(ctx, rc.chain(), key)
+}
+
+// getWithPTTL fetches the value at key and its remaining TTL in a single round trip
+func getWithPTTL(conn redis.Conn, key string) ([]byte, time.Duration, error) {
+	conn.Send("GET", key)
+	conn.Send("PTTL", key)
+	if err := conn.Flush(); err != nil {
+		return nil, 0, err
 	}
-	conn := rc.cluster.Get()
-	defer conn.Close()
-	data, err := redis.Bytes(conn.Do("GET", key))
-	if rc.TracingEnabled {
-		if err != nil {
-			span.SetTag("result", "miss")
-		} else {
-			span.SetTag("result", "hit")
-		}
-		span.Finish()
+	data, err := redis.Bytes(conn.Receive())
+	pttl, ttlErr := redis.Int64(conn.Receive())
+	if err != nil {
+		return nil, 0, err
 	}
-	return data, err
+	if ttlErr != nil {
+		return nil, 0, ttlErr
+	}
+	// The key may have expired between GET and PTTL
+	ttl, err := pttlDuration(pttl)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, ttl, nil
+}
+
+// pttlDuration converts a PTTL reply to a TTL, which is zero for keys without an expiry.
+// redis.ErrNil is returned for missing keys. Keys with less than a millisecond left are reported
+// to expire in a millisecond, so they are not mistaken for keys without an expiry.
+func pttlDuration(pttl int64) (time.Duration, error) {
+	switch {
+	case pttl == -2:
+		return 0, redis.ErrNil
+	case pttl < 0:
+		return 0, nil
+	case pttl == 0:
+		return time.Millisecond, nil
+	}
+	return time.Duration(pttl) * time.Millisecond, nil
+}
+
+// expiryMilliseconds converts ttl to the milliseconds Redis expiries are given in, rounding up so
+// that a positive ttl is never sent as 0, which the expiry scripts read as no expiry
+func expiryMilliseconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Millisecond - 1) / time.Millisecond)
+}
+
+// checkExpiryTTL returns an error if ttl is negative
+func checkExpiryTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		return fmt.Errorf("ttl must not be negative - %v is invalid", ttl)
+	}
+	return nil
 }
 
 // Get retrieves the value from cache, decodes it, and sets the result in target. target must be a
-// pointer.
+// pointer. Values that fail integrity verification are evicted and returned as a *TamperError, and
+// values written with SetReader return ErrStreamedValue.
 func (rc RemoteCache) Get(ctx context.Context, key string, target interface{}) error {
-	data, err := rc.GetBytes(ctx, key)
-	if rc.Metrics != nil {
-		if err != nil {
-			rc.Metrics.Miss()
-		} else {
-			rc.Metrics.Hit()
-		}
-	}
-	if err != nil {
-		return err
+	return rc.chain().Get(ctx, key, target)
+}
+
+// GetWithTTL is like Get, but also returns the time left until the value expires. A TTL of zero
+// means the value does not expire.
+func (rc RemoteCache) GetWithTTL(ctx context.Context, key string, target interface{}) (time.Duration, error) {
+	return getWithTTL(ctx, rc.chain(), key, target)
+}
+
+// missOrError classifies a failed read as a miss if the key did not exist, or an error
+func missOrError(err error) Result {
+	if isNotFound(err) {
+		return ResultMiss
 	}
-	return rc.Encoder.Decode(data, target)
+	return ResultError
+}
+
+// evict removes exactly the given key from remote cache, without pattern matching
+func (rc RemoteCache) evict(key string) error {
+	conn := rc.cluster.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", key)
+	return err
 }
 
 // SetBytes sets the provided bytes in the remote cache on the provided key
 func (rc RemoteCache) SetBytes(ctx context.Context, key string, value []byte) error {
-	var span opentracing.Span
+	return rc.chain().SetBytes(ctx, key, value)
+}
+
+// SetBytesWithTTL is like SetBytes, but the value expires once ttl has passed. A ttl of zero
+// stores the value without an expiry.
+func (rc RemoteCache) SetBytesWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return setBytesWithTTL(ctx, rc.chain(), key, value, ttl)
+}
+
+// Set encodes the provided value and sets it in the remote cache
+func (rc RemoteCache) Set(ctx context.Context, key string, value interface{}) error {
+	return rc.chain().Set(ctx, key, value)
+}
+
+// SetWithTTL encodes the provided value and sets it in the remote cache until ttl has passed. A ttl
+// of zero stores the value without an expiry.
+func (rc RemoteCache) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return setWithTTL(ctx, rc.chain(), key, value, ttl)
+}
+
+// Delete removes the value from remote cache. Because Redis doesnt support Fuzzy matches for
+// delete, this function first gets all matching keys, and then proceeds to pipeline deletion of
+// those keys
+func (rc RemoteCache) Delete(ctx context.Context, key string) error {
+	err := rc.chain().Delete(ctx, key)
+	if err == redis.ErrNil {
+		// No key matched, which the middlewares have recorded as a miss
+		return nil
+	}
+	return err
+}
+
+// Purge wipes out all items under control of this cache in Redis
+func (rc RemoteCache) Purge(ctx context.Context) error {
+	return rc.chain().Purge(ctx)
+}
+
+// ScanKeys calls fn with every key in Redis matching pattern, stopping at the first error fn
+// returns. Every master node of the cluster is scanned with SCAN, so the scan does not block Redis
+// the way KEYS does. Keys written during the scan may or may not be reported.
+func (rc RemoteCache) ScanKeys(ctx context.Context, pattern string, fn func(key string) error) error {
+	var span Span
 	if rc.TracingEnabled {
-		span, _ = opentracing.StartSpanFromContext(ctx, "remote-cache-set-bytes")
-		span.SetTag("command", "SET")
-		span.SetTag("key", key)
+		span, _ = startRemoteSpan(ctx, rc.Tracer, "remote-cache-scan", "SCAN")
+	}
+	_, conns, err := rc.nodeConns()
+	var numKeys int
+	for _, conn := range conns {
+		if err == nil {
+			err = scanNode(conn, pattern, func(key string) error {
+				numKeys++
+				return fn(key)
+			})
+		}
+		conn.Close()
 	}
-	conn := rc.cluster.Get()
-	defer conn.Close()
-	_, err := conn.Do("SET", key, value)
 	if rc.TracingEnabled {
 		if err != nil {
 			span.SetTag("result", "fail")
 		} else {
-			span.SetTag("result", "set")
+			span.SetTag("result", "scan")
 		}
+		span.SetTag("num_keys", numKeys)
 		span.Finish()
 	}
 	return err
 }
 
-// Set encodes the provided value and sets it in the remote cache
-func (rc RemoteCache) Set(ctx context.Context, key string, value interface{}) error {
-	encodedData, err := rc.Encoder.Encode(value)
-	if rc.Metrics != nil {
+// nodeConns returns the address of and a connection to every master node listed by CLUSTER
+// SLOTS. Servers that are not running in cluster mode are reached through a single cluster
+// connection, addressed by the first startup node.
+func (rc RemoteCache) nodeConns() ([]string, []redis.Conn, error) {
+	conn := rc.cluster.Get()
+	slots, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil || len(slots) == 0 {
+		var addr string
+		if len(rc.cluster.StartupNodes) > 0 {
+			addr = rc.cluster.StartupNodes[0]
+		}
+		return []string{addr}, []redis.Conn{conn}, nil
+	}
+	conn.Close()
+	var addrs []string
+	var conns []redis.Conn
+	seen := make(map[string]bool)
+	for _, slot := range slots {
+		// Each slot range is [start, end, [master host, master port, ...], replicas...]
+		slotRange, err := redis.Values(slot, nil)
+		if err != nil || len(slotRange) < 3 {
+			continue
+		}
+		master, err := redis.Values(slotRange[2], nil)
+		if err != nil || len(master) < 2 {
+			continue
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		nodeConn, err := rc.dialNode(addr)
 		if err != nil {
-			rc.Metrics.SetCollision()
-		} else {
-			rc.Metrics.Set()
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, nil, err
 		}
+		addrs = append(addrs, addr)
+		conns = append(conns, nodeConn)
 	}
-	if err != nil {
+	return addrs, conns, nil
+}
+
+// dialNode connects to the node at addr, authenticating like the connections of the cluster
+func (rc RemoteCache) dialNode(addr string) (redis.Conn, error) {
+	conn, err := redis.Dial("tcp", addr, rc.cluster.DialOptions...)
+	if err != nil || rc.authToken == "" {
+		return conn, err
+	}
+	if _, err := conn.Do("AUTH", rc.authToken); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// scanNode calls fn with every key on a single node matching pattern
+func scanNode(conn redis.Conn, pattern string, fn func(key string) error) error {
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", scanCount))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// Exists reports whether key is in remote cache, without fetching its value
+func (rc RemoteCache) Exists(ctx context.Context, key string) (bool, error) {
+	return rc.chain().Exists(ctx, key)
+}
+
+// TTL returns the time left until key expires from remote cache, or zero if it does not expire.
+// Missing keys return redis.ErrNil.
+func (rc RemoteCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return rc.chain().TTL(ctx, key)
+}
+
+// Touch extends the expiry of key so that it lives for at least ttl, rounded up to a whole
+// millisecond. Keys without an expiry are left unchanged. The chunks of values written with
+// SetReader are kept staleChunkTTL longer than the value. Missing keys return redis.ErrNil, and
+// negative TTLs are rejected.
+func (rc RemoteCache) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	return rc.chain().Touch(ctx, key, ttl)
+}
+
+// Expire sets the expiry of key to ttl from now, rounded up to a whole millisecond, or removes it if
+// ttl is zero. The chunks of values written with SetReader are kept staleChunkTTL longer than the
+// value. Missing keys return redis.ErrNil, and negative TTLs are rejected.
+func (rc RemoteCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return rc.chain().Expire(ctx, key, ttl)
+}
+
+// expiryScriptResult converts the reply of touchScript or expireScript on key to an error. When
+// the script found a chunk manifest, the expiry of its chunks is brought in line with it.
+func (rc RemoteCache) expiryScriptResult(conn redis.Conn, key string, reply interface{}, err error) error {
+	status, err := redis.Int(reply, err)
+	switch {
+	case err != nil:
 		return err
+	case status == 0:
+		return redis.ErrNil
+	case status == 2:
+		return rc.syncChunkExpiry(conn, key)
 	}
-	return rc.SetBytes(ctx, key, encodedData)
+	return nil
 }
 
-// Delete removes the value from remote cache. Because Redis doesnt support Fuzzy matches for
-// delete, this function first gets all matching keys, and then proceeds to pipeline deletion of
-// those keys
-func (rc RemoteCache) Delete(ctx context.Context, key string) error {
-	var span opentracing.Span
-	if rc.TracingEnabled {
-		span, _ = opentracing.StartSpanFromContext(ctx, "remote-cache-delete")
-		span.SetTag("command", "Pipeline:KEYS:MULTI:DEL:EXEC")
-		span.SetTag("key", key)
+// pipelineReceiver handles the reply to the command pipelined for key, or the error received in
+// its place. conn is bound to the node holding key and may be used for further commands.
+type pipelineReceiver func(conn redis.Conn, key string, reply interface{}, err error) error
+
+// pipeline sends a command for each key with send, pipelining the commands for keys in the same
+// hash slot on one connection, and returns the first error encountered. Once every reply for a slot
+// has been read, each is passed to receive, or checked for an error if receive is nil.
+func (rc RemoteCache) pipeline(
+	keys []string, send func(conn redis.Conn, key string) error, receive pipelineReceiver,
+) error {
+	slots := make(map[int][]string)
+	for _, key := range keys {
+		slot := redisc.Slot(key)
+		slots[slot] = append(slots[slot], key)
 	}
+	var firstErr error
+	for _, slotKeys := range slots {
+		if err := rc.pipelineSlot(slotKeys, send, receive); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// pipelineSlot pipelines a command for each of keys, which must share a hash slot. Every reply is
+// read before any is handled, so none is left on the connection when it returns to the pool.
+func (rc RemoteCache) pipelineSlot(
+	keys []string, send func(conn redis.Conn, key string) error, receive pipelineReceiver,
+) error {
 	conn := rc.cluster.Get()
 	defer conn.Close()
-	keysToDelete, err := redis.Strings(conn.Do("KEYS", key))
-
-	// Execute a Redis Pipeline which bulk delets all matching keys
-	err = conn.Send("MULTI")
-	if rc.TracingEnabled {
-		span.SetTag("num_keys", len(keysToDelete))
+	if err := redisc.BindConn(conn, keys[0]); err != nil {
+		return err
 	}
-	if rc.Metrics != nil {
-		if err != nil || len(keysToDelete) <= 0 {
-			rc.Metrics.DeleteMiss()
-		} else {
-			rc.Metrics.DeleteHit()
+	for _, key := range keys {
+		if err := send(conn, key); err != nil {
+			return err
 		}
 	}
-	for _, keyToDelete := range keysToDelete {
-		err = conn.Send("DEL", keyToDelete)
+	if err := conn.Flush(); err != nil {
+		return err
 	}
-	_, err = conn.Do("EXEC")
-	if rc.TracingEnabled {
-		if err != nil {
-			span.SetTag("result", "fail")
-		} else {
-			span.SetTag("result", "delete")
+	replies := make([]interface{}, len(keys))
+	errs := make([]error, len(keys))
+	for i := range keys {
+		replies[i], errs[i] = conn.Receive()
+	}
+	var firstErr error
+	for i, key := range keys {
+		err := errs[i]
+		if receive != nil {
+			err = receive(conn, key, replies[i], err)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
-		span.Finish()
 	}
-	return err
+	return firstErr
 }
 
-// Purge wipes out all items under control of this cache in Redis
-func (rc RemoteCache) Purge(ctx context.Context) error {
-	var span opentracing.Span
+// observe runs an operation on key over a connection bound to its node, within a span, and records
+// its result
+func (rc RemoteCache) observe(
+	ctx context.Context, operation Operation, command, key string, fn func(conn redis.Conn) (Result, error),
+) error {
+	var span Span
 	if rc.TracingEnabled {
-		span, _ = opentracing.StartSpanFromContext(ctx, "remote-cache-delete")
-		span.SetTag("command", "FLUSHALL")
+		span, _ = startRemoteSpan(ctx, rc.Tracer, "remote-cache-"+string(operation), command)
+		tagKey(span, rc.KeySanitizer, key)
 	}
+	start := time.Now()
+	result, err := rc.onKeyConn(key, fn)
+	observeOperation(rc.Metrics, TierRemote, operation, result, start)
+	finishSpan(span, operation, result)
+	return err
+}
+
+// onKeyConn runs an operation on key over a connection bound to its node
+func (rc RemoteCache) onKeyConn(key string, fn func(conn redis.Conn) (Result, error)) (Result, error) {
 	conn := rc.cluster.Get()
 	defer conn.Close()
-	_, err := conn.Do("FLUSHALL")
-	if rc.Metrics != nil {
-		if err != nil {
-			rc.Metrics.PurgeMiss()
-		} else {
-			rc.Metrics.PurgeHit()
+	if err := redisc.BindConn(conn, key); err != nil {
+		return ResultError, err
+	}
+	return fn(conn)
+}
+
+// remoteLookup performs operations against Redis without instrumentation. It tags the span of the
+// current operation with the Redis commands it runs.
+type remoteLookup struct {
+	RemoteCache
+}
+
+// span returns the span of the current operation, or nil if remote cache does not trace
+func (rl remoteLookup) span(ctx context.Context) Span {
+	return tierSpan(ctx, rl.TracingEnabled)
+}
+
+// GetBytes runs GET on key
+func (rl remoteLookup) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	data, _, err := rl.getBytes(ctx, key, false)
+	return data, err
+}
+
+// GetBytesWithTTL runs GET on key, pipelined with PTTL
+func (rl remoteLookup) GetBytesWithTTL(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	return rl.getBytes(ctx, key, true)
+}
+
+// getBytes runs GET on key, pipelined with PTTL if withTTL is set. Values written with SetReader
+// return ErrStreamedValue.
+func (rl remoteLookup) getBytes(ctx context.Context, key string, withTTL bool) ([]byte, time.Duration, error) {
+	conn := rl.cluster.Get()
+	defer conn.Close()
+	var data []byte
+	var ttl time.Duration
+	var err error
+	if withTTL {
+		tagRemoteCommand(rl.span(ctx), "GET", "GET PTTL")
+		data, ttl, err = getWithPTTL(conn, key)
+	} else {
+		tagRemoteCommand(rl.span(ctx), "GET", "GET")
+		data, err = redis.Bytes(conn.Do("GET", key))
+	}
+	if err == nil && bytes.HasPrefix(data, chunkManifestMagic) {
+		return nil, 0, ErrStreamedValue
+	}
+	return data, ttl, err
+}
+
+// Get reads and decodes the value at key
+func (rl remoteLookup) Get(ctx context.Context, key string, target interface{}) error {
+	_, err := rl.get(ctx, key, target, false)
+	return err
+}
+
+// GetWithTTL reads and decodes the value at key along with its TTL
+func (rl remoteLookup) GetWithTTL(ctx context.Context, key string, target interface{}) (time.Duration, error) {
+	return rl.get(ctx, key, target, true)
+}
+
+// get reads and decodes the value at key, along with its TTL if withTTL is set, tagging the current
+// span with its size and decode time
+func (rl remoteLookup) get(ctx context.Context, key string, target interface{}, withTTL bool) (time.Duration, error) {
+	data, ttl, err := rl.getBytes(ctx, key, withTTL)
+	if err != nil {
+		return 0, err
+	}
+	err = decodeTraced(rl.span(ctx), rl.Encoder, key, data, target)
+	if _, tampered := err.(*TamperError); tampered {
+		// Treat values that fail verification as a miss and evict them
+		rl.evict(key)
+		if tm, ok := rl.Metrics.(TamperMetrics); ok {
+			tm.Tamper()
 		}
 	}
-	if rc.TracingEnabled {
-		if err != nil {
-			span.SetTag("result", "fail")
-		} else {
-			span.SetTag("result", "purge")
+	return ttl, err
+}
+
+// SetBytes runs SET on key
+func (rl remoteLookup) SetBytes(ctx context.Context, key string, value []byte) error {
+	return rl.SetBytesWithTTL(ctx, key, value, 0)
+}
+
+// SetBytesWithTTL runs SET on key, expiring it after ttl if ttl is positive
+func (rl remoteLookup) SetBytesWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	tagRemoteCommand(rl.span(ctx), "SET", "SET")
+	conn := rl.cluster.Get()
+	defer conn.Close()
+	args := []interface{}{key, value}
+	if ttl > 0 {
+		args = append(args, "PX", expiryMilliseconds(ttl))
+	}
+	_, err := conn.Do("SET", args...)
+	return err
+}
+
+// Set encodes the value and runs SET on key
+func (rl remoteLookup) Set(ctx context.Context, key string, value interface{}) error {
+	return rl.SetWithTTL(ctx, key, value, 0)
+}
+
+// SetWithTTL encodes the value and runs SET on key, expiring it after ttl if ttl is positive
+func (rl remoteLookup) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	encodedData, err := encodeValue(rl.Encoder, key, value)
+	if err != nil {
+		return err
+	}
+	return rl.SetBytesWithTTL(ctx, key, encodedData, ttl)
+}
+
+// Delete deletes the keys matching key, along with the chunks of streamed values and any leases on
+// them or on key. redis.ErrNil is returned if no key matched.
+func (rl remoteLookup) Delete(ctx context.Context, key string) error {
+	span := rl.span(ctx)
+	tagRemoteCommand(span, "DEL", "Pipeline:KEYS:MULTI:DEL:EXEC")
+	conn := rl.cluster.Get()
+	defer conn.Close()
+	keysToDelete, err := redis.Strings(conn.Do("KEYS", key))
+	if err != nil {
+		return err
+	}
+	if span != nil {
+		span.SetTag("num_keys", len(keysToDelete))
+	}
+	// Values written with SetReader also own chunk keys which must be removed with them
+	chunkKeys, err := chunkKeysOf(conn, keysToDelete)
+	if err != nil {
+		return err
+	}
+	// Execute a Redis Pipeline which bulk delets all matching keys
+	conn.Send("MULTI")
+	for _, keyToDelete := range append(keysToDelete, chunkKeys...) {
+		conn.Send("DEL", keyToDelete)
+	}
+	// Deleting a key invalidates any outstanding lease on it, so a value loaded before the delete
+	// cannot be set with that lease. A lease is also taken on a key that is missing, so the lease
+	// on key itself goes even when nothing matched.
+	matchedKey := false
+	for _, keyToDelete := range keysToDelete {
+		conn.Send("DEL", leaseKey(keyToDelete))
+		matchedKey = matchedKey || keyToDelete == key
+	}
+	if !matchedKey {
+		conn.Send("DEL", leaseKey(key))
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
+	}
+	if len(keysToDelete) == 0 {
+		return redis.ErrNil
+	}
+	return nil
+}
+
+// Purge runs FLUSHALL
+func (rl remoteLookup) Purge(ctx context.Context) error {
+	tagRemoteCommand(rl.span(ctx), "FLUSHALL", "FLUSHALL")
+	conn := rl.cluster.Get()
+	defer conn.Close()
+	_, err := conn.Do("FLUSHALL")
+	return err
+}
+
+// Exists runs EXISTS on key
+func (rl remoteLookup) Exists(ctx context.Context, key string) (bool, error) {
+	tagRemoteCommand(rl.span(ctx), "EXISTS", "EXISTS")
+	var found bool
+	_, err := rl.onKeyConn(key, func(conn redis.Conn) (Result, error) {
+		var err error
+		found, err = redis.Bool(conn.Do("EXISTS", key))
+		return existsResult(found, err), err
+	})
+	return found, err
+}
+
+// TTL runs PTTL on key
+func (rl remoteLookup) TTL(ctx context.Context, key string) (time.Duration, error) {
+	tagRemoteCommand(rl.span(ctx), "PTTL", "PTTL")
+	var ttl time.Duration
+	_, err := rl.onKeyConn(key, func(conn redis.Conn) (Result, error) {
+		pttl, err := redis.Int64(conn.Do("PTTL", key))
+		if err == nil {
+			ttl, err = pttlDuration(pttl)
 		}
-		span.Finish()
+		return lookupResult(err), err
+	})
+	return ttl, err
+}
+
+// Touch runs touchScript on key
+func (rl remoteLookup) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	if err := checkExpiryTTL(ttl); err != nil {
+		return err
 	}
+	tagRemoteCommand(rl.span(ctx), "EVALSHA", "EVALSHA")
+	_, err := rl.onKeyConn(key, func(conn redis.Conn) (Result, error) {
+		reply, err := touchScript.Do(conn, key, expiryMilliseconds(ttl), chunkManifestMagic)
+		err = rl.expiryScriptResult(conn, key, reply, err)
+		return lookupResult(err), err
+	})
+	return err
+}
+
+// Expire runs expireScript on key
+func (rl remoteLookup) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	if err := checkExpiryTTL(ttl); err != nil {
+		return err
+	}
+	tagRemoteCommand(rl.span(ctx), "EVALSHA", "EVALSHA")
+	_, err := rl.onKeyConn(key, func(conn redis.Conn) (Result, error) {
+		reply, err := expireScript.Do(conn, key, expiryMilliseconds(ttl), chunkManifestMagic)
+		err = rl.expiryScriptResult(conn, key, reply, err)
+		return lookupResult(err), err
+	})
 	return err
 }
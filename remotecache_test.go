@@ -18,8 +18,10 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis"
+	"github.com/gomodule/redigo/redis"
 	"github.com/mna/redisc"
 	"github.com/stretchr/testify/assert"
 )
@@ -54,6 +56,19 @@ func TestRemoteSet(t *testing.T) {
 	mcm.AssertCalled(t, "Set")
 }
 
+func TestRemoteSetWithTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer s.Close()
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+
+	rc := RemoteCache{cluster: mockCluster, Encoder: &GobCacheEncoder{}}
+	assert.NoError(t, rc.SetWithTTL(context.Background(), "test-key", "value", time.Minute))
+	assert.Equal(t, time.Minute, s.TTL("test-key"))
+	assert.NoError(t, rc.SetWithTTL(context.Background(), "test-key", "value", 0))
+	assert.Zero(t, s.TTL("test-key"))
+}
+
 func TestRemoteSetError(t *testing.T) {
 	encoder := &MockedCacheEncoder{}
 	value := "don't care"
@@ -125,6 +140,75 @@ func TestRemoteGetBytesError(t *testing.T) {
 	assert.Nil(t, value)
 }
 
+func TestRemoteGetBytesWithTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer s.Close()
+	s.Set("expiring", "test-value")
+	s.SetTTL("expiring", 10*time.Second)
+	s.Set("persistent", "test-value")
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+
+	rc := RemoteCache{cluster: mockCluster}
+	value, ttl, err := rc.GetBytesWithTTL(context.Background(), "expiring")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("test-value"), value)
+	assert.Equal(t, 10*time.Second, ttl)
+	_, ttl, err = rc.GetBytesWithTTL(context.Background(), "persistent")
+	assert.NoError(t, err)
+	assert.Zero(t, ttl)
+	_, _, err = rc.GetBytesWithTTL(context.Background(), "missing")
+	assert.Error(t, err)
+
+	// Keys about to expire are not mistaken for keys without an expiry
+	s.Set("expiring-now", "test-value")
+	s.SetTTL("expiring-now", 500*time.Microsecond)
+	_, ttl, err = rc.GetBytesWithTTL(context.Background(), "expiring-now")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Millisecond, ttl)
+}
+
+func TestPTTLDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		pttl     int64
+		expected time.Duration
+		err      error
+	}{
+		{"missing", -2, 0, redis.ErrNil},
+		{"no expiry", -1, 0, nil},
+		{"expiring now", 0, time.Millisecond, nil},
+		{"expiring", 1500, 1500 * time.Millisecond, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ttl, err := pttlDuration(test.pttl)
+			assert.Equal(t, test.err, err)
+			assert.Equal(t, test.expected, ttl)
+		})
+	}
+}
+
+func TestRemoteGetWithTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer s.Close()
+	s.Set("test-key", "test-value")
+	s.SetTTL("test-key", time.Minute)
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+
+	encoder := &MockedCacheEncoder{}
+	target := struct{}{}
+	encoder.On("Decode", []byte("test-value"), target).Return(nil)
+	mcm := &MockCacheMetrics{}
+	mcm.On("Hit")
+	rc := RemoteCache{cluster: mockCluster, Encoder: encoder, Metrics: mcm}
+	ttl, err := rc.GetWithTTL(context.Background(), "test-key", target)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, ttl)
+	mcm.AssertCalled(t, "Hit")
+}
+
 func TestRemoteDelete(t *testing.T) {
 	s, err := miniredis.Run()
 	assert.NoError(t, err)
@@ -180,3 +264,143 @@ func TestRemotePurgeError(t *testing.T) {
 	assert.Error(t, err)
 	mcm.AssertCalled(t, "PurgeMiss")
 }
+
+func TestRemoteGetTampered(t *testing.T) {
+	s, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer s.Close()
+	s.Set("test-key", "test-value")
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+
+	encoder, err := NewSigningCacheEncoder(&GobCacheEncoder{}, []byte("secret"))
+	assert.NoError(t, err)
+	mcm := &MockCacheMetrics{}
+	mcm.On("Miss")
+	mcm.On("Tamper")
+	rc := RemoteCache{cluster: mockCluster, Encoder: encoder, Metrics: mcm}
+	err = rc.Get(context.Background(), "test-key", &testEncodable{})
+	assert.IsType(t, &TamperError{}, err)
+	mcm.AssertCalled(t, "Miss")
+	mcm.AssertCalled(t, "Tamper")
+	assert.False(t, s.Exists("test-key"))
+}
+
+func TestRemoteSetSigned(t *testing.T) {
+	s, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer s.Close()
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+
+	encoder, err := NewSigningCacheEncoder(&GobCacheEncoder{}, []byte("secret"))
+	assert.NoError(t, err)
+	rc := RemoteCache{cluster: mockCluster, Encoder: encoder}
+	assert.NoError(t, rc.Set(context.Background(), "test-key", testEncodable{A: 1}))
+	target := testEncodable{}
+	assert.NoError(t, rc.Get(context.Background(), "test-key", &target))
+	assert.Equal(t, 1, target.A)
+
+	// a signed value copied to another key does not verify
+	value, err := s.Get("test-key")
+	assert.NoError(t, err)
+	s.Set("other-key", value)
+	err = rc.Get(context.Background(), "other-key", &target)
+	assert.IsType(t, &TamperError{}, err)
+}
+
+func TestRemoteScanKeys(t *testing.T) {
+	s, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer s.Close()
+	for _, key := range []string{"user:1", "user:2", "item:1"} {
+		s.Set(key, "test-value")
+	}
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+
+	rc := RemoteCache{cluster: mockCluster}
+	var keys []string
+	err = rc.ScanKeys(context.Background(), "user:*", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"user:1", "user:2"}, keys)
+
+	// Errors returned by the callback stop the scan
+	err = rc.ScanKeys(context.Background(), "*", func(key string) error {
+		return fmt.Errorf("error")
+	})
+	assert.Error(t, err)
+}
+
+func TestRemoteExistsTTLTouchExpire(t *testing.T) {
+	s, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer s.Close()
+	s.Set("key", "test-value")
+	s.SetTTL("key", time.Minute)
+	s.Set("persistent", "test-value")
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+	rc := RemoteCache{cluster: mockCluster}
+	ctx := context.Background()
+
+	found, err := rc.Exists(ctx, "key")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	found, err = rc.Exists(ctx, "missing")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	ttl, err := rc.TTL(ctx, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, ttl)
+	ttl, err = rc.TTL(ctx, "persistent")
+	assert.NoError(t, err)
+	assert.Zero(t, ttl)
+	_, err = rc.TTL(ctx, "missing")
+	assert.Equal(t, redis.ErrNil, err)
+
+	// Touch extends the expiry but never shortens it or adds one
+	assert.NoError(t, rc.Touch(ctx, "key", time.Hour))
+	assert.Equal(t, time.Hour, s.TTL("key"))
+	assert.NoError(t, rc.Touch(ctx, "key", time.Second))
+	assert.Equal(t, time.Hour, s.TTL("key"))
+	assert.NoError(t, rc.Touch(ctx, "persistent", time.Second))
+	assert.Zero(t, s.TTL("persistent"))
+	assert.Equal(t, redis.ErrNil, rc.Touch(ctx, "missing", time.Second))
+
+	// Expire sets the expiry exactly, and zero removes it
+	assert.NoError(t, rc.Expire(ctx, "key", time.Second))
+	assert.Equal(t, time.Second, s.TTL("key"))
+	assert.NoError(t, rc.Expire(ctx, "key", 0))
+	assert.Zero(t, s.TTL("key"))
+	assert.Equal(t, redis.ErrNil, rc.Expire(ctx, "missing", time.Second))
+}
+
+func TestRemoteExpireSubMillisecond(t *testing.T) {
+	s, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer s.Close()
+	s.Set("key", "test-value")
+	s.Set("touched", "test-value")
+	s.SetTTL("touched", time.Minute)
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}}
+	ctx := context.Background()
+
+	// A TTL under a millisecond is rounded up rather than down to 0, which would remove the expiry
+	assert.NoError(t, rc.Expire(ctx, "key", 500*time.Microsecond))
+	assert.Equal(t, time.Millisecond, s.TTL("key"))
+	assert.NoError(t, rc.Expire(ctx, "key", 1500*time.Microsecond))
+	assert.Equal(t, 2*time.Millisecond, s.TTL("key"))
+	_, err = rc.ExpireBatch(ctx, map[string]time.Duration{"key": time.Microsecond})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Millisecond, s.TTL("key"))
+	assert.NoError(t, rc.SetBytesWithTTL(ctx, "set", []byte("test-value"), time.Microsecond))
+	assert.Equal(t, time.Millisecond, s.TTL("set"))
+
+	// Negative TTLs are rejected without touching the key
+	assert.Error(t, rc.Expire(ctx, "touched", -time.Second))
+	assert.Error(t, rc.Touch(ctx, "touched", -time.Second))
+	_, err = rc.ExpireBatch(ctx, map[string]time.Duration{"touched": -time.Second})
+	assert.Error(t, err)
+	assert.Equal(t, time.Minute, s.TTL("touched"))
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+)
+
+// KeyedCacheEncoder is implemented by encoders whose output depends on the key the value is stored
+// under. Caches prefer these methods over Encode and Decode when the encoder implements them.
+type KeyedCacheEncoder interface {
+	CacheEncoder
+	// value must be a pointer
+	EncodeKey(key string, value interface{}) ([]byte, error)
+	// target must be a pointer
+	DecodeKey(key string, cachedValue []byte, target interface{}) error
+}
+
+// TamperMetrics defines an interface for recording cached values that failed integrity checks.
+// CacheMetrics implementations may optionally implement it.
+type TamperMetrics interface {
+	Tamper()
+}
+
+// TamperError is returned when a cached value fails its integrity check. Keys may hold sensitive
+// data, so Key is left out of the error message; apply a KeySanitizer before logging it.
+type TamperError struct {
+	Key string
+}
+
+// Error returns a description of the integrity failure
+func (te *TamperError) Error() string {
+	return "cached value failed integrity verification"
+}
+
+// SigningCacheEncoder wraps another CacheEncoder and appends an HMAC-SHA256 computed over the key
+// and the encoded value. Because the key is part of the MAC, a value copied from one key to another
+// fails verification. SigningCacheEncoder should be the outermost encoder so that the MAC covers
+// exactly the bytes stored in cache.
+type SigningCacheEncoder struct {
+	Encoder CacheEncoder
+	secret  []byte
+}
+
+// NewSigningCacheEncoder constructs and returns a SigningCacheEncoder wrapping encoder
+func NewSigningCacheEncoder(encoder CacheEncoder, secret []byte) (*SigningCacheEncoder, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("signing secret must not be empty")
+	}
+	return &SigningCacheEncoder{Encoder: encoder, secret: secret}, nil
+}
+
+// Encode signs the encoded value without binding it to a key. Caches call EncodeKey instead.
+// value must be a pointer.
+func (sce *SigningCacheEncoder) Encode(value interface{}) ([]byte, error) {
+	return sce.EncodeKey("", value)
+}
+
+// Decode verifies a value signed without a key. Caches call DecodeKey instead. target must be a
+// pointer.
+func (sce *SigningCacheEncoder) Decode(cachedValue []byte, target interface{}) error {
+	return sce.DecodeKey("", cachedValue, target)
+}
+
+// EncodeKey encodes the value with the wrapped encoder and appends a MAC over key and value.
+// value must be a pointer.
+func (sce *SigningCacheEncoder) EncodeKey(key string, value interface{}) ([]byte, error) {
+	data, err := encodeValue(sce.Encoder, key, value)
+	if err != nil {
+		return nil, err
+	}
+	return sce.mac(key, data).Sum(data), nil
+}
+
+// DecodeKey verifies the MAC on the cached value and decodes it with the wrapped encoder. A missing
+// or mismatched MAC is returned as a *TamperError. target must be a pointer.
+func (sce *SigningCacheEncoder) DecodeKey(key string, cachedValue []byte, target interface{}) error {
+	if len(cachedValue) < sha256.Size {
+		return &TamperError{Key: key}
+	}
+	data := cachedValue[:len(cachedValue)-sha256.Size]
+	if !hmac.Equal(sce.mac(key, data).Sum(nil), cachedValue[len(data):]) {
+		return &TamperError{Key: key}
+	}
+	return decodeValue(sce.Encoder, key, data, target)
+}
+
+// mac returns an HMAC that has consumed the length-prefixed key followed by data
+func (sce *SigningCacheEncoder) mac(key string, data []byte) hash.Hash {
+	mac := hmac.New(sha256.New, sce.secret)
+	keyLen := make([]byte, binary.MaxVarintLen64)
+	mac.Write(keyLen[:binary.PutUvarint(keyLen, uint64(len(key)))])
+	mac.Write([]byte(key))
+	mac.Write(data)
+	return mac
+}
+
+// encodeValue encodes value for storage under key, using the keyed methods of the encoder if
+// available
+func encodeValue(encoder CacheEncoder, key string, value interface{}) ([]byte, error) {
+	if keyed, ok := encoder.(KeyedCacheEncoder); ok {
+		return keyed.EncodeKey(key, value)
+	}
+	return encoder.Encode(value)
+}
+
+// DecodeError is returned when a value was found in cache but its encoder failed to decode it, for
+// example because it was stored as a different type than the target
+type DecodeError struct {
+	Err error
+}
+
+// Error returns a description of the decoding failure
+func (de *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode cached value: %v", de.Err)
+}
+
+// Unwrap returns the error reported by the encoder
+func (de *DecodeError) Unwrap() error {
+	return de.Err
+}
+
+// decodeValue decodes a value stored under key, using the keyed methods of the encoder if
+// available. Failures other than a *DecryptionError or *TamperError are returned as a
+// *DecodeError, so every layer classifies them alike.
+func decodeValue(encoder CacheEncoder, key string, cachedValue []byte, target interface{}) error {
+	var err error
+	if keyed, ok := encoder.(KeyedCacheEncoder); ok {
+		err = keyed.DecodeKey(key, cachedValue, target)
+	} else {
+		err = encoder.Decode(cachedValue, target)
+	}
+	switch err.(type) {
+	case nil, *DecodeError, *DecryptionError, *TamperError:
+		return err
+	}
+	return &DecodeError{Err: err}
+}
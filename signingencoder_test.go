@@ -0,0 +1,69 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigningCacheEncoder_EncodeDecode(t *testing.T) {
+	result := testEncodable{
+		A: 5,
+		B: map[int]int{0: 5, 1: 6, 2: 7},
+		C: &testNestedEncodable{"thank"},
+	}
+	enc, err := NewSigningCacheEncoder(&GobCacheEncoder{}, []byte("secret"))
+	require.NoError(t, err)
+	data, err := enc.EncodeKey("test-key", result)
+	require.NoError(t, err)
+	decodedResult := testEncodable{}
+	require.NoError(t, enc.DecodeKey("test-key", data, &decodedResult))
+	assert.Equal(t, result, decodedResult)
+
+	data, err = enc.Encode(result)
+	require.NoError(t, err)
+	decodedResult = testEncodable{}
+	require.NoError(t, enc.Decode(data, &decodedResult))
+	assert.Equal(t, result, decodedResult)
+}
+
+// Test that a value cannot be moved to another key or modified without detection
+func TestSigningCacheEncoder_Tamper(t *testing.T) {
+	enc, err := NewSigningCacheEncoder(&GobCacheEncoder{}, []byte("secret"))
+	require.NoError(t, err)
+	data, err := enc.EncodeKey("test-key", testEncodable{A: 1})
+	require.NoError(t, err)
+	err = enc.DecodeKey("other-key", data, &testEncodable{})
+	assert.IsType(t, &TamperError{}, err)
+	assert.NotContains(t, err.Error(), "other-key")
+
+	data[0] ^= 0xff
+	assert.IsType(t, &TamperError{}, enc.DecodeKey("test-key", data, &testEncodable{}))
+	assert.IsType(t, &TamperError{}, enc.DecodeKey("test-key", []byte("short"), &testEncodable{}))
+
+	otherEnc, err := NewSigningCacheEncoder(&GobCacheEncoder{}, []byte("other-secret"))
+	require.NoError(t, err)
+	data, err = otherEnc.EncodeKey("test-key", testEncodable{A: 1})
+	require.NoError(t, err)
+	assert.IsType(t, &TamperError{}, enc.DecodeKey("test-key", data, &testEncodable{}))
+}
+
+func TestSigningCacheEncoder_EmptySecret(t *testing.T) {
+	_, err := NewSigningCacheEncoder(&GobCacheEncoder{}, nil)
+	assert.Error(t, err)
+}
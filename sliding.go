@@ -0,0 +1,205 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// DefaultTTLRefreshInterval is the interval between batched remote TTL refreshes when none is
+// configured
+const DefaultTTLRefreshInterval = time.Second
+
+// slidingTTLContextKey is the context key under which a per-call sliding TTL is stored
+type slidingTTLContextKey struct{}
+
+// WithSlidingTTL returns a context that overrides the sliding TTL of a TieredCache for the calls
+// made with it. A ttl of zero disables sliding expiration for those calls.
+func WithSlidingTTL(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, slidingTTLContextKey{}, ttl)
+}
+
+// slidingTTLFromContext returns the sliding TTL stored in ctx, if any
+func slidingTTLFromContext(ctx context.Context) (time.Duration, bool) {
+	ttl, ok := ctx.Value(slidingTTLContextKey{}).(time.Duration)
+	return ttl, ok
+}
+
+// BatchExpirer is implemented by caches that can set the expiry of many keys at once. Keys that
+// are missing are skipped and returned.
+type BatchExpirer interface {
+	ExpireBatch(ctx context.Context, ttls map[string]time.Duration) (missing []string, err error)
+}
+
+// TTLRefresher queues TTL refreshes for remote cache and applies them in batches, so that sliding
+// expiration costs at most one remote command per key per interval no matter how often the key is
+// read. Failed refreshes are dropped; the next read of the key queues it again.
+type TTLRefresher struct {
+	remote   Cache
+	local    Cache // Copies of keys found missing from remote are deleted from it if set
+	interval time.Duration
+	mutex    sync.Mutex
+	pending  map[string]time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewTTLRefresher creates a TTLRefresher that applies queued refreshes to remote every interval
+// until Stop is called
+func NewTTLRefresher(remote Cache, interval time.Duration) (*TTLRefresher, error) {
+	if interval < 0 {
+		return nil, fmt.Errorf("refresh interval must not be negative - %v is invalid", interval)
+	}
+	if interval == 0 {
+		interval = DefaultTTLRefreshInterval
+	}
+	tr := &TTLRefresher{
+		remote:   remote,
+		interval: interval,
+		pending:  make(map[string]time.Duration),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go tr.run()
+	return tr, nil
+}
+
+// Refresh queues key to expire ttl after the next flush. Refreshing a key that is already queued
+// replaces its TTL.
+func (tr *TTLRefresher) Refresh(key string, ttl time.Duration) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.pending[key] = ttl
+}
+
+// Flush applies every queued refresh now. Keys found missing from remote cache were deleted or
+// expired since they were read, so their local copies are deleted too.
+func (tr *TTLRefresher) Flush(ctx context.Context) error {
+	tr.mutex.Lock()
+	pending := tr.pending
+	tr.pending = make(map[string]time.Duration)
+	tr.mutex.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	missing, err := tr.expire(ctx, pending)
+	if tr.local != nil {
+		for _, key := range missing {
+			// The local copy may already be gone, so failing to delete it is not an error
+			tr.local.Delete(ctx, key)
+		}
+	}
+	return err
+}
+
+// expire applies the refreshes in pending to remote cache and returns the keys it is missing
+func (tr *TTLRefresher) expire(ctx context.Context, pending map[string]time.Duration) ([]string, error) {
+	if remote, ok := tr.remote.(BatchExpirer); ok {
+		return remote.ExpireBatch(ctx, pending)
+	}
+	var missing []string
+	var firstErr error
+	for key, ttl := range pending {
+		err := tr.remote.Expire(ctx, key, ttl)
+		if isNotFound(err) {
+			missing = append(missing, key)
+		} else if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return missing, firstErr
+}
+
+// Stop flushes any queued refreshes and ends periodic flushing. Stop is a no-op on a nil
+// *TTLRefresher.
+func (tr *TTLRefresher) Stop() {
+	if tr == nil {
+		return
+	}
+	tr.stopOnce.Do(func() {
+		close(tr.stop)
+	})
+	<-tr.done
+}
+
+// run flushes queued refreshes every interval until stopped
+func (tr *TTLRefresher) run() {
+	defer close(tr.done)
+	ticker := time.NewTicker(tr.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			tr.Flush(context.Background())
+		case <-tr.stop:
+			tr.Flush(context.Background())
+			return
+		}
+	}
+}
+
+// ExpireBatch sets the time left until each key expires to its TTL, or removes its expiry if the
+// TTL is zero. Missing keys are skipped and returned. Like Expire, TTLs are rounded up to a whole
+// millisecond, negative TTLs are rejected, and the chunks of values written with SetReader are kept
+// staleChunkTTL longer than the value.
+func (rc RemoteCache) ExpireBatch(ctx context.Context, ttls map[string]time.Duration) ([]string, error) {
+	start := time.Now()
+	var span Span
+	if rc.TracingEnabled {
+		span, _ = startRemoteSpan(ctx, rc.Tracer, "remote-cache-expire-batch", "EVALSHA")
+		span.SetTag("keys", len(ttls))
+	}
+	keys := make([]string, 0, len(ttls))
+	var err error
+	for key, ttl := range ttls {
+		if err == nil {
+			err = checkExpiryTTL(ttl)
+		}
+		keys = append(keys, key)
+	}
+	var missing []string
+	if err == nil {
+		err = rc.pipeline(keys, func(conn redis.Conn, key string) error {
+			return expireScript.SendHash(conn, key, expiryMilliseconds(ttls[key]), chunkManifestMagic)
+		}, func(conn redis.Conn, key string, reply interface{}, err error) error {
+			if isNoScript(err) {
+				// The script is not loaded on this node yet; Do loads it while running it
+				reply, err = expireScript.Do(conn, key, expiryMilliseconds(ttls[key]), chunkManifestMagic)
+			}
+			if err = rc.expiryScriptResult(conn, key, reply, err); isNotFound(err) {
+				missing = append(missing, key)
+				return nil
+			}
+			return err
+		})
+	}
+	result := resultOf(err, ResultOK, ResultError)
+	observeOperation(rc.Metrics, TierRemote, OperationExpire, result, start)
+	finishSpan(span, OperationExpire, result)
+	return missing, err
+}
+
+// isNoScript reports whether err is Redis's reply to EVALSHA for a script it has not loaded
+func isNoScript(err error) bool {
+	redisErr, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(redisErr), "NOSCRIPT ")
+}
@@ -0,0 +1,291 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/mna/redisc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithSlidingTTL(t *testing.T) {
+	tc := TieredCache{SlidingTTL: time.Minute}
+	assert.Equal(t, time.Minute, tc.slidingTTL(context.Background()))
+	assert.Equal(t, time.Hour, tc.slidingTTL(WithSlidingTTL(context.Background(), time.Hour)))
+	assert.Zero(t, tc.slidingTTL(WithSlidingTTL(context.Background(), 0)))
+}
+
+func TestRemoteExpireBatch(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	s.Set("a", "value")
+	s.Set("b", "value")
+	s.SetTTL("b", time.Minute)
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}}
+
+	// TTLs passed through expireScript stay under a million milliseconds in these tests, as miniredis
+	// hands larger Lua numbers to PEXPIRE in exponent form
+	missing, err := rc.ExpireBatch(context.Background(), map[string]time.Duration{
+		"a": 10 * time.Minute, "b": 0, "missing": 10 * time.Minute,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"missing"}, missing)
+	assert.Equal(t, 10*time.Minute, s.TTL("a"))
+	assert.Zero(t, s.TTL("b"))
+	assert.False(t, s.Exists("missing"))
+}
+
+func TestRemoteExpireBatchChunks(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, ChunkSize: 4}
+	ctx := context.Background()
+	require.NoError(t, rc.SetReaderWithTTL(ctx, "test-key", strings.NewReader("streamed value"), time.Minute))
+
+	// The chunks of a streamed value are extended along with it
+	_, err = rc.ExpireBatch(ctx, map[string]time.Duration{"test-key": 10 * time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, s.TTL("test-key"))
+	chunks := 0
+	for _, key := range s.Keys() {
+		if key != "test-key" {
+			chunks++
+			assert.Equal(t, 10*time.Minute+staleChunkTTL, s.TTL(key), key)
+		}
+	}
+	assert.Equal(t, 4, chunks)
+	reader, err := rc.GetReader(ctx, "test-key")
+	require.NoError(t, err)
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "streamed value", string(data))
+}
+
+func TestRemoteExpireBatchError(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	s.Set("{tag}a", "value")
+	s.Lpush("{tag}list", "value")
+	s.Set("{tag}b", "value")
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}}
+
+	// A failure for one key in a slot is returned without stopping the others from being refreshed
+	_, err = rc.ExpireBatch(context.Background(), map[string]time.Duration{
+		"{tag}a": 10 * time.Minute, "{tag}list": 10 * time.Minute, "{tag}b": 10 * time.Minute,
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 10*time.Minute, s.TTL("{tag}a"))
+	assert.Equal(t, 10*time.Minute, s.TTL("{tag}b"))
+
+	// The connection goes back to the pool with no replies left unread
+	_, err = rc.ExpireBatch(context.Background(), map[string]time.Duration{"{tag}a": time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, s.TTL("{tag}a"))
+}
+
+func TestTTLRefresher(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	s.Set("a", "value")
+	s.Set("b", "value")
+	rc := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}}
+	tr, err := NewTTLRefresher(rc, time.Hour)
+	require.NoError(t, err)
+	defer tr.Stop()
+
+	// Repeated refreshes of a key within an interval are sent once, with the latest TTL. Each runs
+	// expireScript, which issues three commands of its own.
+	conn := rc.cluster.Get()
+	require.NoError(t, expireScript.Load(conn))
+	conn.Close()
+	tr.Refresh("a", time.Minute)
+	tr.Refresh("a", 10*time.Minute)
+	tr.Refresh("b", time.Minute)
+	assert.Zero(t, s.TTL("a"))
+	before := s.CommandCount()
+	require.NoError(t, tr.Flush(context.Background()))
+	assert.Equal(t, 2*4, s.CommandCount()-before)
+	assert.Equal(t, 10*time.Minute, s.TTL("a"))
+	assert.Equal(t, time.Minute, s.TTL("b"))
+
+	before = s.CommandCount()
+	require.NoError(t, tr.Flush(context.Background()))
+	assert.Equal(t, before, s.CommandCount())
+}
+
+func TestTTLRefresherStop(t *testing.T) {
+	remote := NewMockCache(&GobCacheEncoder{})
+	ctx := context.Background()
+	require.NoError(t, remote.Set(ctx, "test-key", "value"))
+	tr, err := NewTTLRefresher(remote, time.Hour)
+	require.NoError(t, err)
+
+	// Stopping flushes queued refreshes, and missing keys are skipped
+	tr.Refresh("test-key", time.Minute)
+	tr.Refresh("missing", time.Minute)
+	tr.Stop()
+	tr.Stop()
+	ttl, err := remote.TTL(ctx, "test-key")
+	require.NoError(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Minute)
+
+	_, err = NewTTLRefresher(remote, -time.Second)
+	assert.Error(t, err)
+	var nilRefresher *TTLRefresher
+	nilRefresher.Stop()
+}
+
+func TestTieredSlidingTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	encoder := &GobCacheEncoder{}
+	lcc := LocalCacheConfig{TTL: time.Hour, Eviction: time.Hour}
+	local, err := lcc.NewCache(encoder, nil)
+	require.NoError(t, err)
+	remote := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	tr, err := NewTTLRefresher(remote, time.Hour)
+	require.NoError(t, err)
+	defer tr.Stop()
+	mtc := TieredCache{Local: local, Remote: remote, SlidingTTL: time.Minute, TTLRefresher: tr}
+	ctx := context.Background()
+
+	// Sets expire after the sliding TTL in both tiers
+	require.NoError(t, mtc.Set(ctx, "test-key", "value"))
+	assert.Equal(t, time.Minute, s.TTL("test-key"))
+	localTTL, err := local.TTL(ctx, "test-key")
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute, localTTL, float64(time.Second))
+
+	// Reads extend the local copy and queue the remote refresh, which extends remote to at least
+	// as long
+	var target string
+	require.NoError(t, mtc.Get(WithSlidingTTL(ctx, 10*time.Minute), "test-key", &target))
+	localTTL, err = local.TTL(ctx, "test-key")
+	require.NoError(t, err)
+	assert.InDelta(t, 10*time.Minute, localTTL, float64(time.Second))
+	assert.Equal(t, time.Minute, s.TTL("test-key"))
+	require.NoError(t, tr.Flush(ctx))
+	assert.Equal(t, 10*time.Minute, s.TTL("test-key"))
+	_, err = mtc.GetBytes(WithSlidingTTL(ctx, 5*time.Minute), "test-key")
+	require.NoError(t, err)
+	require.NoError(t, tr.Flush(ctx))
+	assert.Equal(t, 5*time.Minute, s.TTL("test-key"))
+
+	// Without a TTLRefresher both tiers are extended by the read itself
+	mtc.TTLRefresher = nil
+	require.NoError(t, mtc.Get(WithSlidingTTL(ctx, 15*time.Minute), "test-key", &target))
+	localTTL, err = local.TTL(ctx, "test-key")
+	require.NoError(t, err)
+	assert.InDelta(t, 15*time.Minute, localTTL, float64(time.Second))
+	assert.Equal(t, 15*time.Minute, s.TTL("test-key"))
+	mtc.TTLRefresher = tr
+
+	// Values read from remote are backfilled for the sliding TTL
+	require.NoError(t, local.Delete(ctx, "test-key"))
+	require.NoError(t, mtc.Get(ctx, "test-key", &target))
+	localTTL, err = local.TTL(ctx, "test-key")
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute, localTTL, float64(time.Second))
+	require.NoError(t, tr.Flush(ctx))
+	assert.Equal(t, time.Minute, s.TTL("test-key"))
+
+	// Sliding expiration can be disabled per call
+	require.NoError(t, mtc.Set(WithSlidingTTL(ctx, 0), "other-key", "value"))
+	assert.Zero(t, s.TTL("other-key"))
+}
+
+func TestTieredSlidingTTLHotKeyExpiresLocally(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	encoder := &GobCacheEncoder{}
+	lcc := LocalCacheConfig{TTL: time.Hour, Eviction: time.Hour}
+	local, err := lcc.NewCache(encoder, nil)
+	require.NoError(t, err)
+	remote := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	mtc := TieredCache{Local: local, Remote: remote, SlidingTTL: 100 * time.Millisecond}
+	ctx := context.Background()
+
+	// A key read far more often than its TTL still leaves local cache once deleted remotely
+	require.NoError(t, mtc.Set(ctx, "test-key", "value"))
+	s.Del("test-key")
+	var target string
+	require.Eventually(t, func() bool {
+		return isNotFound(mtc.Get(ctx, "test-key", &target))
+	}, time.Second, time.Millisecond)
+}
+
+func TestTieredSlidingTTLDeletedRemotely(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	encoder := &GobCacheEncoder{}
+	lcc := LocalCacheConfig{TTL: time.Hour, Eviction: time.Hour}
+	local, err := lcc.NewCache(encoder, nil)
+	require.NoError(t, err)
+	remote := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	tr, err := NewTTLRefresher(remote, time.Hour)
+	require.NoError(t, err)
+	defer tr.Stop()
+	tr.local = local
+	ctx := context.Background()
+
+	// A local hit extends the local copy, which is deleted once the batched refresh finds the key
+	// deleted remotely
+	mtc := TieredCache{Local: local, Remote: remote, SlidingTTL: time.Minute, TTLRefresher: tr}
+	require.NoError(t, mtc.Set(ctx, "test-key", "value"))
+	var target string
+	require.NoError(t, mtc.Get(WithSlidingTTL(ctx, 10*time.Minute), "test-key", &target))
+	localTTL, err := local.TTL(ctx, "test-key")
+	require.NoError(t, err)
+	assert.InDelta(t, 10*time.Minute, localTTL, float64(time.Second))
+	s.Del("test-key")
+	require.NoError(t, tr.Flush(ctx))
+	_, err = local.GetBytes(ctx, "test-key")
+	assert.Equal(t, ErrEntryNotFound, err)
+
+	// Without a TTLRefresher the refresh made by the read deletes the local copy
+	mtc.TTLRefresher = nil
+	require.NoError(t, mtc.Set(ctx, "test-key", "value"))
+	s.Del("test-key")
+	require.NoError(t, mtc.Get(ctx, "test-key", &target))
+	_, err = local.GetBytes(ctx, "test-key")
+	assert.Equal(t, ErrEntryNotFound, err)
+}
+
+func TestTieredSlidingTTLConfigValidation(t *testing.T) {
+	for _, tcc := range []TieredCacheConfig{
+		{SlidingTTL: -time.Minute},
+		{SlidingTTL: time.Minute, SlidingTTLRefreshInterval: time.Minute},
+		{SlidingTTL: 500 * time.Millisecond},
+		{SlidingTTLRefreshInterval: -time.Second},
+	} {
+		_, err := tcc.NewCache(&GobCacheEncoder{}, nil, nil, nil)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,437 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+)
+
+// DefaultChunkSize is the size in bytes of the chunks values are split into by SetReader when no
+// chunk size is configured
+const DefaultChunkSize = 512 * 1024
+
+// staleChunkTTL is how much longer chunks are kept than the manifest pointing at them, whether it
+// was replaced or expired, so that readers which already fetched the manifest can finish streaming
+const staleChunkTTL = time.Minute
+
+// chunkManifestMagic prefixes manifests so they can be told apart from regular values
+var chunkManifestMagic = []byte("tieredcache-chunks\x00")
+
+// ErrStreamedValue is returned when a value written with SetReader is read with Get or GetBytes,
+// which would otherwise return its manifest rather than the value
+var ErrStreamedValue = fmt.Errorf("value was written with SetReader and must be read with GetReader")
+
+// StreamingCache is implemented by caches that can store and retrieve values without holding the
+// whole value in memory
+type StreamingCache interface {
+	SetReader(ctx context.Context, key string, r io.Reader) error
+	SetReaderWithTTL(ctx context.Context, key string, r io.Reader, ttl time.Duration) error
+	GetReader(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// chunkManifest is stored under the key of a streamed value and describes its chunks
+type chunkManifest struct {
+	Version string
+	Chunks  int
+	Size    int64
+}
+
+// encodeManifest returns the stored representation of a manifest
+func encodeManifest(manifest chunkManifest) ([]byte, error) {
+	buf := bytes.NewBuffer(append([]byte{}, chunkManifestMagic...))
+	if err := gob.NewEncoder(buf).Encode(manifest); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeManifest parses a stored manifest. ok is false if data is not a manifest.
+func decodeManifest(data []byte) (manifest chunkManifest, ok bool, err error) {
+	if !bytes.HasPrefix(data, chunkManifestMagic) {
+		return manifest, false, nil
+	}
+	err = gob.NewDecoder(bytes.NewReader(data[len(chunkManifestMagic):])).Decode(&manifest)
+	return manifest, true, err
+}
+
+// clusterSlots is the number of hash slots in a Redis Cluster
+const clusterSlots = 16384
+
+// slotTags holds a short hash tag for every Redis Cluster slot, built on first use
+var slotTags struct {
+	once sync.Once
+	tags [clusterSlots]string
+}
+
+// slotTagWidth is the length of every hash tag returned by slotTag
+const slotTagWidth = 6
+
+// slotTag returns a hash tag of slotTagWidth digits that hashes to the given Redis Cluster slot
+func slotTag(slot int) string {
+	slotTags.once.Do(func() {
+		for found, i := 0, 0; found < clusterSlots; i++ {
+			tag := fmt.Sprintf("%0*d", slotTagWidth, i)
+			if tagSlot := redisc.Slot(tag); slotTags.tags[tagSlot] == "" {
+				slotTags.tags[tagSlot] = tag
+				found++
+			}
+		}
+	})
+	return slotTags.tags[slot]
+}
+
+// hashSlotPrefix returns a prefix for keys derived from key that hashes to the same Redis Cluster
+// slot as key itself: key preceded by a hash tag of slotTagWidth digits for its slot. Since the
+// tag always has the same form, the prefixes of different keys never collide, even when one key is
+// another wrapped in braces.
+func hashSlotPrefix(key string) string {
+	return "{" + slotTag(redisc.Slot(key)) + "}" + key
+}
+
+// chunkKey returns the key under which chunk i of the given manifest version is stored
+func chunkKey(key, version string, i int) string {
+	return hashSlotPrefix(key) + ":chunk:" + version + ":" + strconv.Itoa(i)
+}
+
+// chunkKeysOf returns the keys of the chunks owned by those of keys that hold manifests. Only the
+// start of each value is fetched to tell manifests apart from other values.
+func chunkKeysOf(conn redis.Conn, keys []string) ([]string, error) {
+	for _, key := range keys {
+		conn.Send("GETRANGE", key, 0, len(chunkManifestMagic)-1)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	var manifestKeys []string
+	var firstErr error
+	for _, key := range keys {
+		prefix, err := redis.Bytes(conn.Receive())
+		if err != nil && firstErr == nil {
+			firstErr = err
+		} else if bytes.Equal(prefix, chunkManifestMagic) {
+			manifestKeys = append(manifestKeys, key)
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	var chunkKeys []string
+	for _, key := range manifestKeys {
+		data, err := redis.Bytes(conn.Do("GET", key))
+		if err == redis.ErrNil {
+			// The value was removed since its prefix was read, along with any claim to its chunks
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		manifest, ok, err := decodeManifest(data)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; ok && i < manifest.Chunks; i++ {
+			chunkKeys = append(chunkKeys, chunkKey(key, manifest.Version, i))
+		}
+	}
+	return chunkKeys, nil
+}
+
+// SetReader streams the contents of r into remote cache. The value is split into chunks of
+// ChunkSize bytes, each stored under its own key in the same hash slot as key, and a manifest
+// describing the chunks is then written to key. Because readers always start from the manifest,
+// a value is replaced atomically once the new manifest is written.
+//
+// Chunks are removed by Delete and when the value is replaced by SetReader. Replacing the value
+// with Set or SetBytes leaves its chunks behind until they expire, so values that may be replaced
+// that way should be stored with SetReaderWithTTL.
+func (rc RemoteCache) SetReader(ctx context.Context, key string, r io.Reader) error {
+	return rc.SetReaderWithTTL(ctx, key, r, 0)
+}
+
+// SetReaderWithTTL is like SetReader, but the value expires once ttl has passed. Its chunks expire
+// staleChunkTTL later, and Touch and Expire carry them along with the value. A ttl of zero stores
+// the value without an expiry.
+func (rc RemoteCache) SetReaderWithTTL(ctx context.Context, key string, r io.Reader, ttl time.Duration) error {
+	var span Span
+	if rc.TracingEnabled {
+		span, _ = startRemoteSpan(ctx, rc.Tracer, "remote-cache-set-reader", "SET")
+		tagKey(span, rc.KeySanitizer, key)
+	}
+	start := time.Now()
+	conn := rc.cluster.Get()
+	defer conn.Close()
+	manifest, err := rc.writeChunks(conn, key, r, ttl)
+	observeOperation(rc.Metrics, TierRemote, OperationSet, resultOf(err, ResultOK, ResultError), start)
+	if rc.TracingEnabled {
+		if err != nil {
+			span.SetTag("result", "fail")
+		} else {
+			span.SetTag("result", "set")
+			span.SetTag("num_chunks", manifest.Chunks)
+			span.SetTag("size", manifest.Size)
+		}
+		span.Finish()
+	}
+	return err
+}
+
+// writeChunks writes r as chunks, then swaps the manifest at key to point at them. The manifest
+// expires after ttl and the chunks staleChunkTTL later, unless ttl is zero.
+func (rc RemoteCache) writeChunks(
+	conn redis.Conn, key string, r io.Reader, ttl time.Duration,
+) (chunkManifest, error) {
+	chunkSize := rc.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	versionBytes := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, versionBytes); err != nil {
+		return chunkManifest{}, err
+	}
+	manifest := chunkManifest{Version: hex.EncodeToString(versionBytes)}
+	var chunkExpiry []interface{}
+	if ttl > 0 {
+		chunkExpiry = []interface{}{"PX", expiryMilliseconds(ttl + staleChunkTTL)}
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			args := append([]interface{}{chunkKey(key, manifest.Version, manifest.Chunks), buf[:n]}, chunkExpiry...)
+			if _, setErr := conn.Do("SET", args...); setErr != nil {
+				err = setErr
+			} else {
+				manifest.Chunks++
+				manifest.Size += int64(n)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			rc.expireChunks(conn, key, manifest, 0)
+			return manifest, err
+		}
+	}
+	encodedManifest, err := encodeManifest(manifest)
+	if err != nil {
+		rc.expireChunks(conn, key, manifest, 0)
+		return manifest, err
+	}
+	// GETSET discards any previous expiry, so the new one is set in the same transaction
+	conn.Send("MULTI")
+	conn.Send("GETSET", key, encodedManifest)
+	if ttl > 0 {
+		conn.Send("PEXPIRE", key, expiryMilliseconds(ttl))
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		rc.expireChunks(conn, key, manifest, 0)
+		return manifest, err
+	}
+	previous, _ := redis.Bytes(replies[0], nil)
+	if old, ok, _ := decodeManifest(previous); ok {
+		rc.expireChunks(conn, key, old, staleChunkTTL)
+	}
+	return manifest, nil
+}
+
+// expireChunks removes the chunks of a manifest after ttl, or immediately if ttl is zero
+func (rc RemoteCache) expireChunks(conn redis.Conn, key string, manifest chunkManifest, ttl time.Duration) error {
+	if ttl > 0 {
+		return sendChunks(conn, key, manifest, "PEXPIRE", expiryMilliseconds(ttl))
+	}
+	return sendChunks(conn, key, manifest, "DEL")
+}
+
+// syncChunkExpiry makes the chunks of the manifest stored at key expire staleChunkTTL after the
+// manifest, or not at all if the manifest does not expire. Values that are not manifests are left
+// untouched.
+func (rc RemoteCache) syncChunkExpiry(conn redis.Conn, key string) error {
+	conn.Send("GET", key)
+	conn.Send("PTTL", key)
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	data, err := redis.Bytes(conn.Receive())
+	pttl, pttlErr := redis.Int64(conn.Receive())
+	if err != nil {
+		return err
+	}
+	if pttlErr != nil {
+		return pttlErr
+	}
+	manifest, ok, err := decodeManifest(data)
+	if !ok || err != nil {
+		return err
+	}
+	if pttl < 0 {
+		return sendChunks(conn, key, manifest, "PERSIST")
+	}
+	return rc.expireChunks(conn, key, manifest, time.Duration(pttl)*time.Millisecond+staleChunkTTL)
+}
+
+// sendChunks pipelines command with args for each chunk of a manifest, returning the first error
+func sendChunks(conn redis.Conn, key string, manifest chunkManifest, command string, args ...interface{}) error {
+	for i := 0; i < manifest.Chunks; i++ {
+		if err := conn.Send(command, append([]interface{}{chunkKey(key, manifest.Version, i)}, args...)...); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	var firstErr error
+	for i := 0; i < manifest.Chunks; i++ {
+		if _, err := conn.Receive(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// GetReader returns a reader that streams the value stored at key. Values written with SetReader
+// are fetched one chunk at a time; values written with SetBytes or Set are returned as-is. The
+// caller must Close the reader to release its connection.
+func (rc RemoteCache) GetReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	var span Span
+	if rc.TracingEnabled {
+		span, _ = startRemoteSpan(ctx, rc.Tracer, "remote-cache-get-reader", "GET")
+		tagKey(span, rc.KeySanitizer, key)
+	}
+	start := time.Now()
+	conn := rc.cluster.Get()
+	data, err := redis.Bytes(conn.Do("GET", key))
+	var reader io.ReadCloser
+	if err == nil {
+		var manifest chunkManifest
+		var isManifest bool
+		manifest, isManifest, err = decodeManifest(data)
+		if err == nil && isManifest {
+			reader = &chunkReader{conn: conn, key: key, manifest: manifest}
+		} else if err == nil {
+			reader = ioutil.NopCloser(bytes.NewReader(data))
+		}
+	}
+	if _, ok := reader.(*chunkReader); !ok {
+		conn.Close()
+	}
+	result := ResultHit
+	if err != nil {
+		result = missOrError(err)
+	}
+	observeOperation(rc.Metrics, TierRemote, OperationGet, result, start)
+	if rc.TracingEnabled {
+		if err != nil {
+			span.SetTag("result", "miss")
+		} else {
+			span.SetTag("result", "hit")
+		}
+		span.SetTag("cache.hit", err == nil)
+		span.Finish()
+	}
+	return reader, err
+}
+
+// chunkReader streams the chunks described by a manifest, fetching one chunk at a time
+type chunkReader struct {
+	conn     redis.Conn
+	key      string
+	manifest chunkManifest
+	next     int
+	buf      []byte
+}
+
+// Read reads from the current chunk, fetching the next chunk when it is exhausted
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.next >= cr.manifest.Chunks {
+			return 0, io.EOF
+		}
+		chunk, err := redis.Bytes(cr.conn.Do("GET", chunkKey(cr.key, cr.manifest.Version, cr.next)))
+		if err == redis.ErrNil {
+			return 0, fmt.Errorf("chunk %d of %d is missing", cr.next, cr.manifest.Chunks)
+		} else if err != nil {
+			return 0, err
+		}
+		cr.buf = chunk
+		cr.next++
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+// Close releases the connection held by the reader
+func (cr *chunkReader) Close() error {
+	return cr.conn.Close()
+}
+
+// SetReader streams the contents of r into remote cache and removes any copy of the value from
+// local cache, which is not suited to holding large values
+func (tc TieredCache) SetReader(ctx context.Context, key string, r io.Reader) error {
+	return tc.SetReaderWithTTL(ctx, key, r, 0)
+}
+
+// SetReaderWithTTL is like SetReader, but the value expires from remote cache once ttl has passed.
+// A ttl of zero stores the value without an expiry.
+func (tc TieredCache) SetReaderWithTTL(ctx context.Context, key string, r io.Reader, ttl time.Duration) error {
+	remote, ok := tc.Remote.(StreamingCache)
+	if !ok {
+		return fmt.Errorf("remote cache does not support streaming")
+	}
+	tc.KeyFilter.Add(key)
+	if err := remote.SetReaderWithTTL(ctx, key, r, ttl); err != nil {
+		return err
+	}
+	// The local copy may not exist, so failing to delete it is not an error
+	tc.Local.Delete(ctx, key)
+	return nil
+}
+
+// GetReader returns a reader for the value stored at key. Local cache first, then remote.
+func (tc TieredCache) GetReader(ctx context.Context, key string) (io.ReadCloser, error) {
+	if data, err := tc.Local.GetBytes(ctx, key); err == nil {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	var reader io.ReadCloser
+	err := tc.filterRemote(key, func() error {
+		remote, ok := tc.Remote.(StreamingCache)
+		if !ok {
+			data, err := tc.Remote.GetBytes(ctx, key)
+			if err != nil {
+				return err
+			}
+			reader = ioutil.NopCloser(bytes.NewReader(data))
+			return nil
+		}
+		var err error
+		reader, err = remote.GetReader(ctx, key)
+		return err
+	})
+	return reader, err
+}
@@ -0,0 +1,284 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/mna/redisc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashSlotPrefix(t *testing.T) {
+	assert.Equal(t, "{"+slotTag(redisc.Slot("test-key"))+"}test-key", hashSlotPrefix("test-key"))
+	// Keys that differ only by braces hash alike but get different prefixes
+	assert.NotEqual(t, hashSlotPrefix("a"), hashSlotPrefix("{a}"))
+	assert.NotEqual(t, leaseKey("a"), leaseKey("{a}"))
+	for _, key := range []string{
+		"test-key", "user:{123}:cart", "user:{123", "a{}b", "a}b{c}", "{}{x}", "a}b", "user:{}:cart", "",
+	} {
+		t.Run(key, func(t *testing.T) {
+			slot := redisc.Slot(key)
+			for _, derived := range []string{leaseKey(key), chunkKey(key, "v", 0), hashSlotPrefix(key) + ":fence"} {
+				assert.Equal(t, slot, redisc.Slot(derived), derived)
+			}
+		})
+	}
+}
+
+func TestSlotTag(t *testing.T) {
+	for slot := 0; slot < clusterSlots; slot++ {
+		require.Equal(t, slot, redisc.Slot(slotTag(slot)))
+		require.Len(t, slotTag(slot), slotTagWidth)
+	}
+}
+
+func TestRemoteSetGetReader(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+
+	mcm := &MockCacheMetrics{}
+	mcm.On("Set")
+	mcm.On("Hit")
+	rc := RemoteCache{cluster: mockCluster, Metrics: mcm, ChunkSize: 4}
+	value := "a value that spans several chunks"
+	err = rc.SetReader(context.Background(), "test-key", strings.NewReader(value))
+	require.NoError(t, err)
+	mcm.AssertCalled(t, "Set")
+	// 34 bytes in 4 byte chunks plus the manifest
+	assert.Len(t, s.Keys(), 10)
+
+	reader, err := rc.GetReader(context.Background(), "test-key")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, value, string(data))
+	mcm.AssertCalled(t, "Hit")
+}
+
+// Test that replacing a streamed value expires the chunks of the previous value
+func TestRemoteSetReaderReplace(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+
+	rc := RemoteCache{cluster: mockCluster, ChunkSize: 4}
+	require.NoError(t, rc.SetReader(context.Background(), "test-key", strings.NewReader("first value")))
+	require.NoError(t, rc.SetReader(context.Background(), "test-key", strings.NewReader("second")))
+	s.FastForward(staleChunkTTL)
+	// 6 bytes in 4 byte chunks plus the manifest
+	assert.Len(t, s.Keys(), 3)
+
+	reader, err := rc.GetReader(context.Background(), "test-key")
+	require.NoError(t, err)
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+}
+
+func TestRemoteSetReaderWithTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+	ctx := context.Background()
+
+	// Chunks outlive the manifest, and Touch and Expire carry them along with it
+	rc := RemoteCache{cluster: mockCluster, ChunkSize: 4}
+	require.NoError(t, rc.SetReaderWithTTL(ctx, "test-key", strings.NewReader("some value"), time.Hour))
+	chunkTTLs := func() []time.Duration {
+		var ttls []time.Duration
+		for _, key := range s.Keys() {
+			if key != "test-key" {
+				ttls = append(ttls, s.TTL(key))
+			}
+		}
+		return ttls
+	}
+	assert.Equal(t, time.Hour, s.TTL("test-key"))
+	// 10 bytes in 4 byte chunks
+	require.Len(t, chunkTTLs(), 3)
+	for _, ttl := range chunkTTLs() {
+		assert.Equal(t, time.Hour+staleChunkTTL, ttl)
+	}
+
+	require.NoError(t, rc.Touch(ctx, "test-key", 2*time.Hour))
+	assert.Equal(t, 2*time.Hour, s.TTL("test-key"))
+	for _, ttl := range chunkTTLs() {
+		assert.Equal(t, 2*time.Hour+staleChunkTTL, ttl)
+	}
+	require.NoError(t, rc.Expire(ctx, "test-key", time.Minute))
+	for _, ttl := range chunkTTLs() {
+		assert.Equal(t, time.Minute+staleChunkTTL, ttl)
+	}
+	require.NoError(t, rc.Expire(ctx, "test-key", 0))
+	for _, ttl := range chunkTTLs() {
+		assert.Zero(t, ttl)
+	}
+
+	// Chunks of a value with a TTL that is overwritten with Set expire rather than being orphaned
+	require.NoError(t, rc.SetReaderWithTTL(ctx, "other-key", strings.NewReader("other value"), time.Hour))
+	require.NoError(t, rc.SetBytes(ctx, "other-key", []byte("plain")))
+	s.FastForward(time.Hour + staleChunkTTL)
+	for _, key := range s.Keys() {
+		assert.False(t, strings.HasPrefix(key, "{other-key}"), key)
+	}
+}
+
+func TestRemoteGetReaderMissingChunk(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+
+	rc := RemoteCache{cluster: mockCluster, ChunkSize: 4}
+	require.NoError(t, rc.SetReader(context.Background(), "test-key", strings.NewReader("some value")))
+	for _, key := range s.Keys() {
+		if strings.HasSuffix(key, ":1") {
+			s.Del(key)
+		}
+	}
+	reader, err := rc.GetReader(context.Background(), "test-key")
+	require.NoError(t, err)
+	defer reader.Close()
+	_, err = ioutil.ReadAll(reader)
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "test-key")
+}
+
+func TestRemoteGetReaderPlainValue(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	s.Set("test-key", "test-value")
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+
+	rc := RemoteCache{cluster: mockCluster}
+	reader, err := rc.GetReader(context.Background(), "test-key")
+	require.NoError(t, err)
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-value", string(data))
+
+	_, err = rc.GetReader(context.Background(), "missing-key")
+	assert.Error(t, err)
+}
+
+func TestRemoteDeleteChunks(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+
+	rc := RemoteCache{cluster: mockCluster, ChunkSize: 4}
+	require.NoError(t, rc.SetReader(context.Background(), "test-key", strings.NewReader("some value")))
+	require.NoError(t, rc.SetReader(context.Background(), "test-key-2", strings.NewReader("other")))
+	require.NoError(t, rc.Delete(context.Background(), "test-key"))
+	// Only the chunks of the deleted value are removed: 5 bytes in 4 byte chunks plus the manifest
+	assert.Len(t, s.Keys(), 3)
+	require.NoError(t, rc.Delete(context.Background(), "test-key-2"))
+	assert.Empty(t, s.Keys())
+}
+
+func TestGetStreamedValue(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	rc := RemoteCache{
+		cluster:   &redisc.Cluster{StartupNodes: []string{s.Addr()}},
+		Encoder:   &GobCacheEncoder{},
+		ChunkSize: 4,
+	}
+	ctx := context.Background()
+	require.NoError(t, rc.SetReader(ctx, "test-key", strings.NewReader("streamed value")))
+
+	// Reading a streamed value whole reports how it must be read instead of returning its manifest
+	_, err = rc.GetBytes(ctx, "test-key")
+	assert.Equal(t, ErrStreamedValue, err)
+	_, _, err = rc.GetBytesWithTTL(ctx, "test-key")
+	assert.Equal(t, ErrStreamedValue, err)
+	var target string
+	assert.Equal(t, ErrStreamedValue, rc.Get(ctx, "test-key", &target))
+	_, err = rc.GetWithTTL(ctx, "test-key", &target)
+	assert.Equal(t, ErrStreamedValue, err)
+
+	mtc := TieredCache{Local: NewMockCache(&GobCacheEncoder{}), Remote: rc}
+	assert.Equal(t, ErrStreamedValue, mtc.Get(ctx, "test-key", &target))
+	_, err = mtc.GetBytes(ctx, "test-key")
+	assert.Equal(t, ErrStreamedValue, err)
+	// GetOrLoad leaves the streamed value in place rather than loading over it
+	err = mtc.GetOrLoad(ctx, "test-key", &target, func(ctx context.Context) (interface{}, error) {
+		return "loaded", nil
+	})
+	assert.Equal(t, ErrStreamedValue, err)
+
+	reader, err := mtc.GetReader(ctx, "test-key")
+	require.NoError(t, err)
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "streamed value", string(data))
+}
+
+func TestTieredSetReader(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	mockCluster := &redisc.Cluster{StartupNodes: []string{s.Addr()}}
+
+	mtc := TieredCache{
+		Local:  NewMockCache(nil),
+		Remote: RemoteCache{cluster: mockCluster, ChunkSize: 4},
+	}
+	mtc.Local.(*MockCache).Cache["test-key"] = []byte("stale")
+	require.NoError(t, mtc.SetReader(context.Background(), "test-key", strings.NewReader("fresh value")))
+	_, ok := mtc.Local.(*MockCache).Cache["test-key"]
+	assert.False(t, ok)
+
+	reader, err := mtc.GetReader(context.Background(), "test-key")
+	require.NoError(t, err)
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "fresh value", string(data))
+}
+
+func TestTieredGetReaderLocal(t *testing.T) {
+	mtc := TieredCache{
+		Local:  NewMockCache(nil),
+		Remote: NewMockCache(nil),
+	}
+	mtc.Local.(*MockCache).Cache["test-key"] = []byte("test-value")
+	reader, err := mtc.GetReader(context.Background(), "test-key")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-value", string(data))
+
+	err = mtc.SetReader(context.Background(), "test-key", strings.NewReader("test-value"))
+	assert.Error(t, err)
+}
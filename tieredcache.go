@@ -16,8 +16,11 @@ package tieredcache
 
 import (
 	"context"
+	"fmt"
 	"sync"
+	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/mna/redisc"
 )
 
@@ -41,6 +44,31 @@ type Cache interface {
 	Set(ctx context.Context, key string, value interface{}) error
 	Delete(ctx context.Context, key string) error
 	Purge(ctx context.Context) error
+	// Exists reports whether key is present without decoding its value
+	Exists(ctx context.Context, key string) (bool, error)
+	// TTL returns the time left until key expires, or zero if it has no expiry of its own
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// Touch extends the lifetime of key so that it lives for at least ttl, without shortening it
+	Touch(ctx context.Context, key string, ttl time.Duration) error
+	// Expire sets the time left until key expires to ttl, or removes its expiry if ttl is zero
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// isNotFound returns whether err reports a missing key in local or remote cache
+func isNotFound(err error) bool {
+	return err == ErrEntryNotFound || err == redis.ErrNil
+}
+
+// TTLGetter is implemented by caches that can report how long a value has left to live. A TTL of
+// zero means the value does not expire.
+type TTLGetter interface {
+	GetWithTTL(ctx context.Context, key string, target interface{}) (time.Duration, error)
+}
+
+// TTLSetter is implemented by caches that can store a value for a limited time. A TTL of zero
+// leaves the value to expire by the cache's own policy.
+type TTLSetter interface {
+	SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error
 }
 
 // TieredCache defines a combined local and remote-caching approach in which keys are stored
@@ -50,6 +78,27 @@ type TieredCache struct {
 	Local          Cache
 	Metrics        CacheMetrics
 	TracingEnabled bool
+	Tracer         Tracer         // Defaults to OpenTracingTracer if nil
+	KeySanitizer   KeySanitizer   // Applied to keys before they are attached to spans
+	Middlewares    []Middleware   // Wrap the Cache methods, first middleware outermost; see Middleware
+	HotKeys        *HotKeyTracker // Tracks the most accessed keys in each tier if set
+	KeyFilter      *KeyFilter     // Skips remote lookups for keys known to be absent if set
+	// SlidingTTL makes keys expire this long after they were last set or read in either tier, zero
+	// to disable. It can be overridden per call with WithSlidingTTL. A local copy is deleted early
+	// when its remote refresh finds the key gone.
+	SlidingTTL time.Duration
+	// TTLRefresher batches the remote TTL refreshes made by sliding expiration if set. Otherwise
+	// remote cache is refreshed on every read.
+	TTLRefresher *TTLRefresher
+	// Counters buffers counter increments in process and flushes them to remote cache if set. A
+	// buffer built by TieredCacheConfig.NewCache adds the counters it flushes to KeyFilter.
+	Counters *CounterBuffer
+	// Loader coalesces the loads made by GetOrLoad if set
+	Loader *Loader
+	// chained is the middleware chain built by NewCache, which holds a copy of the cache, so fields
+	// changed after NewCache returns do not apply to the Cache methods. Caches built without
+	// NewCache build the chain on each call instead.
+	chained Cache
 }
 
 // TieredCacheConfig is the necessary configuration for instantiating a TieredCache struct
@@ -58,6 +107,26 @@ type TieredCacheConfig struct {
 	LocalConfig    LocalCacheConfig
 	Encoder        CacheEncoder
 	TracingEnabled bool
+	TracerBackend  string       // TracerOpenTracing or TracerOpenTelemetry
+	KeySanitizer   KeySanitizer // Applied to keys before they are attached to spans, in every tier
+	Middlewares    []Middleware // Wrap the Cache methods, first middleware outermost; see Middleware
+	// HotKeys enables hot-key tracking if set. KeySanitizer is used for its metric labels unless
+	// it has its own.
+	HotKeys *HotKeyTrackerConfig
+	// KeyFilter enables a filter of the keys present in remote cache if set. The filter is built
+	// in the background when the cache is created. Keys set by other processes read as misses until
+	// the next rebuild; see KeyFilter.
+	KeyFilter *KeyFilterConfig
+	// SlidingTTL makes keys expire this long after they were last set or read, zero to disable
+	SlidingTTL time.Duration
+	// SlidingTTLRefreshInterval is the interval between batched remote TTL refreshes, defaulting
+	// to DefaultTTLRefreshInterval when SlidingTTL is set. It must be shorter than SlidingTTL. Set
+	// it alone to batch refreshes for calls that enable sliding expiration with WithSlidingTTL.
+	SlidingTTLRefreshInterval time.Duration
+	// CounterBuffer enables locally aggregated counters, flushed to remote cache, if set
+	CounterBuffer *CounterBufferConfig
+	// Loader coalesces the loads made by GetOrLoad, across processes if distributed, if set
+	Loader *LoaderConfig
 }
 
 // TieredCacheCreator defines an interface to create and return a Tiered Cache
@@ -70,13 +139,33 @@ type TieredCacheCreator interface {
 	) (Cache, error)
 }
 
-// NewCache constructs and returns a TieredCache given configuration
+// NewCache constructs and returns a TieredCache given configuration. The middleware chain is built
+// once here, so fields changed on the returned cache do not apply to the Cache methods.
 func (tcc TieredCacheConfig) NewCache(
 	encoder CacheEncoder,
 	metrics CacheMetrics,
 	localMetrics CacheMetrics,
 	remoteMetrics CacheMetrics,
 ) (Cache, error) {
+	tracer, err := NewTracer(tcc.TracerBackend)
+	if err != nil {
+		return TieredCache{}, err
+	}
+	if tcc.SlidingTTL < 0 || tcc.SlidingTTLRefreshInterval < 0 {
+		return TieredCache{}, fmt.Errorf("sliding TTL and its refresh interval must not be negative")
+	}
+	if tcc.SlidingTTL > 0 && tcc.SlidingTTLRefreshInterval == 0 {
+		tcc.SlidingTTLRefreshInterval = DefaultTTLRefreshInterval
+	}
+	if tcc.SlidingTTL > 0 && tcc.SlidingTTLRefreshInterval >= tcc.SlidingTTL {
+		return TieredCache{}, fmt.Errorf(
+			"sliding TTL refresh interval must be shorter than the sliding TTL - %v is invalid",
+			tcc.SlidingTTLRefreshInterval)
+	}
+	if tcc.KeySanitizer != nil {
+		tcc.RemoteConfig.KeySanitizer = tcc.KeySanitizer
+		tcc.LocalConfig.KeySanitizer = tcc.KeySanitizer
+	}
 	remote, err := tcc.RemoteConfig.NewCache(encoder, remoteMetrics)
 	if err != nil {
 		return TieredCache{}, err
@@ -85,98 +174,413 @@ func (tcc TieredCacheConfig) NewCache(
 	if err != nil {
 		return TieredCache{}, err
 	}
-	return TieredCache{
+	var hotKeys *HotKeyTracker
+	if tcc.HotKeys != nil {
+		hotKeyConfig := *tcc.HotKeys
+		if hotKeyConfig.KeySanitizer == nil {
+			hotKeyConfig.KeySanitizer = tcc.KeySanitizer
+		}
+		if hotKeys, err = NewHotKeyTracker(hotKeyConfig); err != nil {
+			return TieredCache{}, err
+		}
+	}
+	var keyFilter *KeyFilter
+	if tcc.KeyFilter != nil {
+		if keyFilter, err = NewKeyFilter(*tcc.KeyFilter); err != nil {
+			return TieredCache{}, err
+		}
+		keyFilter.Start(remote)
+	}
+	var refresher *TTLRefresher
+	if tcc.SlidingTTLRefreshInterval != 0 {
+		if refresher, err = NewTTLRefresher(remote, tcc.SlidingTTLRefreshInterval); err != nil {
+			keyFilter.Stop()
+			return TieredCache{}, err
+		}
+		refresher.local = local
+	}
+	var counters *CounterBuffer
+	if tcc.CounterBuffer != nil {
+		if counters, err = newCounterBuffer(remote, *tcc.CounterBuffer, keyFilter); err != nil {
+			keyFilter.Stop()
+			refresher.Stop()
+			return TieredCache{}, err
+		}
+	}
+	var loader *Loader
+	if tcc.Loader != nil {
+		var locker *Locker
+		if tcc.Loader.Distributed {
+			locker, err = NewLocker(remote, LockerConfig{
+				MinBackoff: tcc.Loader.MinBackoff,
+				MaxBackoff: tcc.Loader.MaxBackoff,
+			})
+		}
+		if err == nil {
+			loader, err = NewLoader(*tcc.Loader, locker)
+		}
+		if err != nil {
+			keyFilter.Stop()
+			refresher.Stop()
+			counters.Stop()
+			return TieredCache{}, err
+		}
+	}
+	tc := TieredCache{
 		Remote:         remote,
 		Local:          local,
 		Metrics:        metrics,
 		TracingEnabled: tcc.TracingEnabled,
-	}, nil
+		Tracer:         tracer,
+		KeySanitizer:   tcc.KeySanitizer,
+		Middlewares:    tcc.Middlewares,
+		HotKeys:        hotKeys,
+		KeyFilter:      keyFilter,
+		SlidingTTL:     tcc.SlidingTTL,
+		TTLRefresher:   refresher,
+		Counters:       counters,
+		Loader:         loader,
+	}
+	tc.chained = tc.buildChain()
+	return tc, nil
 }
 
 // Close cleans up cache and removes any open connections
 func (tc TieredCache) Close() {
+	tc.KeyFilter.Stop()
+	tc.TTLRefresher.Stop()
+	tc.Counters.Stop()
 	tc.Remote.(RemoteCache).Close()
 }
 
 // GetBytes gets the requested bytes from from tiered cache. Local first, then remote.
 func (tc TieredCache) GetBytes(ctx context.Context, key string) ([]byte, error) {
-	data, err := tc.Local.GetBytes(ctx, key)
-	if err != nil {
-		data, err = tc.Remote.GetBytes(ctx, key)
-	}
-	return data, err
+	return tc.chain().GetBytes(ctx, key)
 }
 
 // Get retrieves the value from the tiered cache, cache, decodes it, and sets the result in target.
-// Local cache first, then remote. target must be a pointer.
+// Local cache first, then remote. target must be a pointer. A value that was found but could not be
+// decrypted is returned as a *DecryptionError and is not recorded as a miss.
 func (tc TieredCache) Get(ctx context.Context, key string, target interface{}) error {
-	err := tc.Local.Get(ctx, key, target)
-	if err != nil {
-		err = tc.Remote.Get(ctx, key, target)
+	return tc.chain().Get(ctx, key, target)
+}
+
+// SetBytes sets the provided bytes in the local and remote caches on the provided key
+func (tc TieredCache) SetBytes(ctx context.Context, key string, value []byte) error {
+	return tc.chain().SetBytes(ctx, key, value)
+}
+
+// Set encodes the provided value and sets it in the local and remote cache
+func (tc TieredCache) Set(ctx context.Context, key string, value interface{}) error {
+	return tc.chain().Set(ctx, key, value)
+}
+
+// Delete removes the value from local cache and remote cache
+func (tc TieredCache) Delete(ctx context.Context, key string) error {
+	return tc.chain().Delete(ctx, key)
+}
+
+// Purge wipes out all items locally, and all items under control of this cache in Redis
+func (tc TieredCache) Purge(ctx context.Context) error {
+	return tc.chain().Purge(ctx)
+}
+
+// Exists reports whether key is present in local cache, then remote
+func (tc TieredCache) Exists(ctx context.Context, key string) (bool, error) {
+	return tc.chain().Exists(ctx, key)
+}
+
+// TTL returns the time left until key expires from remote cache, which owns the lifetime of every
+// key. Local copies never outlive their remote value unless pinned as hot keys.
+func (tc TieredCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return tc.chain().TTL(ctx, key)
+}
+
+// Touch extends the lifetime of key in remote cache, then in local cache if it holds a copy
+func (tc TieredCache) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	return tc.chain().Touch(ctx, key, ttl)
+}
+
+// Expire sets the time left until key expires in remote cache, then in local cache if it holds a
+// copy
+func (tc TieredCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return tc.chain().Expire(ctx, key, ttl)
+}
+
+// Incr adds delta to the counter at key in remote cache, creating it at zero if it is missing, and
+// returns the new value
+func (tc TieredCache) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	return tc.IncrWithTTL(ctx, key, delta, 0)
+}
+
+// Decr subtracts delta from the counter at key in remote cache, creating it at zero if it is
+// missing, and returns the new value
+func (tc TieredCache) Decr(ctx context.Context, key string, delta int64) (int64, error) {
+	return tc.IncrWithTTL(ctx, key, -delta, 0)
+}
+
+// IncrWithTTL is like Incr, but a counter created by the call expires after ttl if ttl is
+// positive. Counters live in remote cache only, so any local copy of key is removed.
+func (tc TieredCache) IncrWithTTL(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	remote, ok := tc.Remote.(Counter)
+	if !ok {
+		return 0, fmt.Errorf("remote cache does not support counters")
 	}
-	if tc.Metrics != nil {
-		if err != nil {
-			tc.Metrics.Miss()
-		} else {
-			tc.Metrics.Hit()
-		}
+	value, err := remote.IncrWithTTL(ctx, key, delta, ttl)
+	tc.invalidateLocal(ctx, key, err == nil)
+	return value, err
+}
+
+// skipTooLarge handles the error from setting key in local cache. Values too large for local cache
+// are stored in remote cache only, so any stale local copy is removed and no error is returned.
+func (tc TieredCache) skipTooLarge(ctx context.Context, key string, err error) error {
+	if _, ok := err.(*EntryTooLargeError); !ok {
+		return err
+	}
+	// The local copy may not exist, so failing to delete it is not an error
+	tc.Local.Delete(ctx, key)
+	return nil
+}
+
+// slidingTTL returns the sliding TTL for calls made with ctx, or zero if sliding expiration is
+// disabled
+func (tc TieredCache) slidingTTL(ctx context.Context) time.Duration {
+	if ttl, ok := slidingTTLFromContext(ctx); ok {
+		return ttl
+	}
+	return tc.SlidingTTL
+}
+
+// slide extends the lifetime of key after a successful read when sliding expiration is enabled.
+// The remote refresh is queued on the TTLRefresher when there is one. The local copy, if read, is
+// extended by the same TTL, never past the expiry the remote refresh sets: without a TTLRefresher
+// it is extended only once remote cache has been. A key the refresh finds missing from remote cache
+// has its local copy deleted. Failing to extend only shortens the lifetime of the key, so other
+// errors are ignored.
+func (tc TieredCache) slide(ctx context.Context, key string, local bool) {
+	ttl := tc.slidingTTL(ctx)
+	if ttl <= 0 {
+		return
+	}
+	if tc.TTLRefresher != nil {
+		tc.TTLRefresher.Refresh(key, ttl)
+	} else if err := tc.Remote.Expire(ctx, key, ttl); isNotFound(err) {
+		tc.Local.Delete(ctx, key)
+		return
+	} else if err != nil {
+		return
+	}
+	if local {
+		tc.Local.Touch(ctx, key, ttl)
+	}
+}
+
+// setWithTTL sets the value in cache, expiring it after ttl if ttl is positive
+func setWithTTL(ctx context.Context, cache Cache, key string, value interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		return cache.Set(ctx, key, value)
+	}
+	if setter, ok := cache.(TTLSetter); ok {
+		return setter.SetWithTTL(ctx, key, value, ttl)
+	}
+	err := cache.Set(ctx, key, value)
+	if err == nil {
+		err = cache.Expire(ctx, key, ttl)
 	}
 	return err
 }
 
-// SetBytes sets the provided bytes in the local and remote caches on the provided key
-func (tc TieredCache) SetBytes(ctx context.Context, key string, value []byte) error {
-	err := tc.Local.SetBytes(ctx, key, value)
+// filterRemote performs the remote lookup get unless the key filter rules key out, in which case
+// redis.ErrNil is returned as Redis would have. The outcome of the check is recorded on Metrics.
+func (tc TieredCache) filterRemote(key string, get func() error) error {
+	if tc.KeyFilter == nil || !tc.KeyFilter.Ready() {
+		return get()
+	}
+	if !tc.KeyFilter.MayContain(key) {
+		tc.KeyFilter.record(tc.Metrics, KeyFilterNegative)
+		return redis.ErrNil
+	}
+	err := get()
+	switch err {
+	case nil:
+		tc.KeyFilter.record(tc.Metrics, KeyFilterTruePositive)
+	case redis.ErrNil:
+		tc.KeyFilter.record(tc.Metrics, KeyFilterFalsePositive)
+	}
+	return err
+}
+
+// chain returns the middleware chain built by NewCache, or builds it if there is none
+func (tc TieredCache) chain() Cache {
+	if tc.chained != nil {
+		return tc.chained
+	}
+	return tc.buildChain()
+}
+
+// buildChain wraps the tiered lookup in the configured middlewares, followed by tracing and metrics
+func (tc TieredCache) buildChain() Cache {
+	lookup := instrument(
+		tieredLookup{tc}, tc.TracingEnabled, tc.Tracer, tc.KeySanitizer, "tiered-cache", tc.Metrics, TierTiered,
+	)
+	return Chain(lookup, tc.Middlewares...)
+}
+
+// tieredLookup performs operations against local and remote cache without instrumentation
+type tieredLookup struct {
+	TieredCache
+}
+
+// Get retrieves the value from local cache, then remote, and tags the current span with the tier
+// that served it. Values found remotely are backfilled into local cache for the rest of their
+// remote TTL, or longer if the key is hot enough to be pinned. With sliding expiration, the key is
+// extended in both tiers, and values found remotely are backfilled for the sliding TTL instead.
+func (tl tieredLookup) Get(ctx context.Context, key string, target interface{}) error {
+	tier := TierLocal
+	err := tl.Local.Get(ctx, key, target)
 	if err == nil {
-		err = tc.Remote.SetBytes(ctx, key, value)
+		tl.HotKeys.record(key, TierTiered, TierLocal)
+		tl.slide(ctx, key, true)
+	} else {
+		tier = TierRemote
+		tl.HotKeys.record(key, TierTiered, TierLocal, TierRemote)
+		var ttl time.Duration
+		err = tl.filterRemote(key, func() error {
+			if remote, ok := tl.Remote.(TTLGetter); ok {
+				ttl, err = remote.GetWithTTL(ctx, key, target)
+				return err
+			}
+			return tl.Remote.Get(ctx, key, target)
+		})
+		if err == nil {
+			if sliding := tl.slidingTTL(ctx); sliding > 0 {
+				ttl = sliding
+				tl.slide(ctx, key, false)
+			}
+			tl.backfill(ctx, key, target, tl.HotKeys.pinTTL(key, ttl))
+		}
+	}
+	if span := spanFromContext(ctx); span != nil && err == nil {
+		span.SetTag("tier", string(tier))
 	}
 	return err
 }
 
-// Set encodes the provided value and sets it in the local and remote cache
-func (tc TieredCache) Set(ctx context.Context, key string, value interface{}) error {
-	err := tc.Local.Set(ctx, key, value)
+// GetBytes reads the bytes from local cache, then remote
+func (tl tieredLookup) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	data, err := tl.Local.GetBytes(ctx, key)
 	if err == nil {
-		err = tc.Remote.Set(ctx, key, value)
+		tl.slide(ctx, key, true)
+		return data, nil
 	}
-	if tc.Metrics != nil {
-		if err != nil {
-			tc.Metrics.SetCollision()
-		} else {
-			tc.Metrics.Set()
-		}
+	err = tl.filterRemote(key, func() error {
+		data, err = tl.Remote.GetBytes(ctx, key)
+		return err
+	})
+	if err == nil {
+		tl.slide(ctx, key, false)
+	}
+	return data, err
+}
+
+// backfill stores a value read from remote cache in local cache. Failing to backfill only costs a
+// later remote read, so errors are ignored.
+func (tl tieredLookup) backfill(ctx context.Context, key string, value interface{}, ttl time.Duration) {
+	if local, ok := tl.Local.(TTLSetter); ok {
+		local.SetWithTTL(ctx, key, value, ttl)
+		return
+	}
+	tl.Local.Set(ctx, key, value)
+}
+
+// Set sets the value in local cache, then remote. With sliding expiration, the value expires from
+// both tiers once the sliding TTL has passed without it being read.
+func (tl tieredLookup) Set(ctx context.Context, key string, value interface{}) error {
+	tl.HotKeys.record(key, TierTiered, TierLocal, TierRemote)
+	tl.KeyFilter.Add(key)
+	ttl := tl.slidingTTL(ctx)
+	err := tl.skipTooLarge(ctx, key, setWithTTL(ctx, tl.Local, key, value, ttl))
+	if err == nil {
+		err = setWithTTL(ctx, tl.Remote, key, value, ttl)
 	}
 	return err
 }
 
-// Delete removes the value from local cache and remote cache
-func (tc TieredCache) Delete(ctx context.Context, key string) error {
-	err := tc.Local.Delete(ctx, key)
+// SetBytes sets the bytes in local cache, then remote
+func (tl tieredLookup) SetBytes(ctx context.Context, key string, value []byte) error {
+	tl.KeyFilter.Add(key)
+	err := tl.skipTooLarge(ctx, key, tl.Local.SetBytes(ctx, key, value))
 	if err == nil {
-		err = tc.Remote.Delete(ctx, key)
+		err = tl.Remote.SetBytes(ctx, key, value)
 	}
-	if tc.Metrics != nil {
-		if err != nil {
-			tc.Metrics.DeleteMiss()
-		} else {
-			tc.Metrics.DeleteHit()
+	return err
+}
+
+// Exists checks local cache, then remote
+func (tl tieredLookup) Exists(ctx context.Context, key string) (bool, error) {
+	if found, err := tl.Local.Exists(ctx, key); err == nil && found {
+		return true, nil
+	}
+	err := tl.filterRemote(key, func() error {
+		found, err := tl.Remote.Exists(ctx, key)
+		if err == nil && !found {
+			return redis.ErrNil
 		}
+		return err
+	})
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// TTL reads the time left until key expires from remote cache
+func (tl tieredLookup) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return tl.Remote.TTL(ctx, key)
+}
+
+// Touch extends the lifetime of key in remote cache, then local
+func (tl tieredLookup) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	err := tl.Remote.Touch(ctx, key, ttl)
+	if err == nil {
+		err = tl.ignoreNotFound(tl.Local.Touch(ctx, key, ttl))
 	}
 	return err
 }
 
-// Purge wipes out all items locally, and all items under control of this cache in Redis
-func (tc TieredCache) Purge(ctx context.Context) error {
-	err := tc.Local.Purge(ctx)
+// Expire sets the time left until key expires in remote cache, then local
+func (tl tieredLookup) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	err := tl.Remote.Expire(ctx, key, ttl)
 	if err == nil {
-		err = tc.Remote.Purge(ctx)
+		err = tl.ignoreNotFound(tl.Local.Expire(ctx, key, ttl))
 	}
-	if tc.Metrics != nil {
-		if err != nil {
-			tc.Metrics.PurgeMiss()
-		} else {
-			tc.Metrics.PurgeHit()
-		}
+	return err
+}
+
+// ignoreNotFound returns nil if err reports a missing key. Local cache holds a subset of remote
+// keys, so a key may be missing locally.
+func (tl tieredLookup) ignoreNotFound(err error) error {
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Delete removes the value from local cache, then remote. The value is removed from remote cache
+// even if local cache fails, so that other instances stop reading it.
+func (tl tieredLookup) Delete(ctx context.Context, key string) error {
+	err := tl.ignoreNotFound(tl.Local.Delete(ctx, key))
+	if remoteErr := tl.Remote.Delete(ctx, key); remoteErr != nil {
+		err = remoteErr
+	}
+	return err
+}
+
+// Purge wipes out local cache, then remote
+func (tl tieredLookup) Purge(ctx context.Context) error {
+	err := tl.Local.Purge(ctx)
+	if err == nil {
+		err = tl.Remote.Purge(ctx)
 	}
 	return err
 }
@@ -15,6 +15,9 @@
 package tieredcache
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -30,126 +33,310 @@ type CacheMetrics interface {
 	PurgeMiss()
 }
 
-var (
-	hits           *prometheus.CounterVec
-	misses         *prometheus.CounterVec
-	sets           *prometheus.CounterVec
-	setsCollisions *prometheus.CounterVec
-	deletesHits    *prometheus.CounterVec
-	deletesMisses  *prometheus.CounterVec
-	purgesHits     *prometheus.CounterVec
-	purgesMisses   *prometheus.CounterVec
+// Tier identifies the cache tier an operation was performed against
+type Tier string
+
+const (
+	// TierLocal is the in-process cache tier
+	TierLocal Tier = "local"
+	// TierRemote is the Redis cache tier
+	TierRemote Tier = "remote"
+	// TierTiered is the combined local and remote cache
+	TierTiered Tier = "tiered"
+)
+
+// Operation identifies a cache operation
+type Operation string
+
+const (
+	// OperationGet is a cache read
+	OperationGet Operation = "get"
+	// OperationSet is a cache write
+	OperationSet Operation = "set"
+	// OperationDelete is a cache deletion
+	OperationDelete Operation = "delete"
+	// OperationPurge is a wipe of the whole cache
+	OperationPurge Operation = "purge"
+	// OperationExists is a check for the presence of a key
+	OperationExists Operation = "exists"
+	// OperationTTL is a read of the time left until a key expires
+	OperationTTL Operation = "ttl"
+	// OperationTouch is an extension of the lifetime of a key
+	OperationTouch Operation = "touch"
+	// OperationExpire is a change of the time left until a key expires
+	OperationExpire Operation = "expire"
+	// OperationIncr is an atomic change of a counter
+	OperationIncr Operation = "incr"
+	// OperationUpdate is an atomic read, modify and write of a value
+	OperationUpdate Operation = "update"
+	// OperationCompareAndSwap is a write conditional on the version of the current value
+	OperationCompareAndSwap Operation = "compare_and_swap"
+)
+
+// Result identifies the outcome of a cache operation
+type Result string
+
+const (
+	// ResultHit is a get or delete that found its key
+	ResultHit Result = "hit"
+	// ResultMiss is a get or delete that did not find its key
+	ResultMiss Result = "miss"
+	// ResultOK is a successful set or purge
+	ResultOK Result = "ok"
+	// ResultError is an operation that failed
+	ResultError Result = "error"
+	// ResultConflict is a conditional write that was not made because the value had changed or
+	// already existed
+	ResultConflict Result = "conflict"
+	// ResultDecodeError is a get that found its key but could not decode the value
+	ResultDecodeError Result = "decode_error"
 )
 
+// OperationMetrics defines an interface for recording the outcome and latency of each cache
+// operation. CacheMetrics implementations may optionally implement it; those that do not are
+// wrapped in a CacheMetricsAdapter.
+type OperationMetrics interface {
+	ObserveOperation(tier Tier, operation Operation, result Result, duration time.Duration)
+}
+
+// CacheMetricsAdapter records operations on a CacheMetrics that only supports counters. Timings
+// are discarded, decode errors are counted as neither hits nor misses, and operations without a
+// counter of their own, such as Exists, are not recorded.
+type CacheMetricsAdapter struct {
+	CacheMetrics
+}
+
+// ObserveOperation increments the CacheMetrics counter corresponding to the operation and result
+func (cma CacheMetricsAdapter) ObserveOperation(tier Tier, operation Operation, result Result, duration time.Duration) {
+	switch operation {
+	case OperationGet:
+		switch result {
+		case ResultHit:
+			cma.Hit()
+		case ResultMiss, ResultError:
+			cma.Miss()
+		}
+	case OperationSet:
+		if result == ResultOK {
+			cma.Set()
+		} else {
+			cma.SetCollision()
+		}
+	case OperationDelete:
+		if result == ResultHit {
+			cma.DeleteHit()
+		} else {
+			cma.DeleteMiss()
+		}
+	case OperationPurge:
+		if result == ResultOK {
+			cma.PurgeHit()
+		} else {
+			cma.PurgeMiss()
+		}
+	}
+}
+
+// observeOperation records an operation that began at start on metrics, which may be nil
+func observeOperation(metrics CacheMetrics, tier Tier, operation Operation, result Result, start time.Time) {
+	if metrics == nil {
+		return
+	}
+	om, ok := metrics.(OperationMetrics)
+	if !ok {
+		om = CacheMetricsAdapter{metrics}
+	}
+	om.ObserveOperation(tier, operation, result, time.Since(start))
+}
+
+// resultOf returns success if err is nil and failure otherwise
+func resultOf(err error, success, failure Result) Result {
+	if err != nil {
+		return failure
+	}
+	return success
+}
+
+// lookupResult classifies the outcome of an operation on a single key as a hit, a miss if the key
+// was not found, or an error
+func lookupResult(err error) Result {
+	if err == nil {
+		return ResultHit
+	} else if isNotFound(err) {
+		return ResultMiss
+	}
+	return ResultError
+}
+
 // PrometheusCacheMetrics surfaces cache metrics for usage with Prometheus
 type PrometheusCacheMetrics struct {
-	client         string
-	name           string
-	hits           *prometheus.CounterVec
-	misses         *prometheus.CounterVec
-	sets           *prometheus.CounterVec
-	setsCollisions *prometheus.CounterVec
-	deletesHits    *prometheus.CounterVec
-	deletesMisses  *prometheus.CounterVec
-	purgesHits     *prometheus.CounterVec
-	purgesMisses   *prometheus.CounterVec
-}
-
-// NewPrometheusCacheMetrics creates and returns a Prometheus cache metrics recorder
+	client                string
+	name                  string
+	hits                  *prometheus.CounterVec
+	misses                *prometheus.CounterVec
+	sets                  *prometheus.CounterVec
+	setsCollisions        *prometheus.CounterVec
+	deletesHits           *prometheus.CounterVec
+	deletesMisses         *prometheus.CounterVec
+	purgesHits            *prometheus.CounterVec
+	purgesMisses          *prometheus.CounterVec
+	compressionRatio      *prometheus.HistogramVec
+	compressionBytesSaved *prometheus.CounterVec
+	tampers               *prometheus.CounterVec
+	keyFilterChecks       *prometheus.CounterVec
+	operationDurations    *prometheus.HistogramVec
+}
+
+// PrometheusCacheMetricsOptions configures where and how PrometheusCacheMetrics registers its
+// collectors
+type PrometheusCacheMetricsOptions struct {
+	Registerer  prometheus.Registerer // Defaults to prometheus.DefaultRegisterer
+	Namespace   string                // Prepended to every metric name
+	Subsystem   string                // Prepended to every metric name, after Namespace
+	ConstLabels prometheus.Labels     // Added to every metric
+}
+
+// registerer returns the configured Registerer, or the default registerer if none was set
+func (opts PrometheusCacheMetricsOptions) registerer() prometheus.Registerer {
+	if opts.Registerer == nil {
+		return prometheus.DefaultRegisterer
+	}
+	return opts.Registerer
+}
+
+// counterVec creates and registers a CounterVec. If an identical collector is already registered
+// it is returned instead, so constructing metrics for several caches shares one set of collectors.
+func (opts PrometheusCacheMetricsOptions) counterVec(name, help string, labels []string) (*prometheus.CounterVec, error) {
+	collector, err := registerCollector(opts.registerer(), prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: opts.ConstLabels,
+		},
+		labels,
+	))
+	if err != nil {
+		return nil, err
+	}
+	counterVec, ok := collector.(*prometheus.CounterVec)
+	if !ok {
+		return nil, fmt.Errorf("collector registered as %v is not a counter", name)
+	}
+	return counterVec, nil
+}
+
+// histogramVec creates and registers a HistogramVec. If an identical collector is already
+// registered it is returned instead.
+func (opts PrometheusCacheMetricsOptions) histogramVec(
+	name, help string, buckets []float64, labels []string,
+) (*prometheus.HistogramVec, error) {
+	collector, err := registerCollector(opts.registerer(), prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   opts.Subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: opts.ConstLabels,
+			Buckets:     buckets,
+		},
+		labels,
+	))
+	if err != nil {
+		return nil, err
+	}
+	histogramVec, ok := collector.(*prometheus.HistogramVec)
+	if !ok {
+		return nil, fmt.Errorf("collector registered as %v is not a histogram", name)
+	}
+	return histogramVec, nil
+}
+
+// registerCollector registers collector, returning the already registered collector if an
+// identical one exists
+func registerCollector(registerer prometheus.Registerer, collector prometheus.Collector) (prometheus.Collector, error) {
+	if err := registerer.Register(collector); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector, nil
+		}
+		return nil, err
+	}
+	return collector, nil
+}
+
+// NewPrometheusCacheMetrics creates and returns a Prometheus cache metrics recorder registered with
+// the default Prometheus registerer. It panics if the metrics cannot be registered.
 func NewPrometheusCacheMetrics(client, cacheName string) *PrometheusCacheMetrics {
+	pcm, err := NewPrometheusCacheMetricsWithOptions(client, cacheName, PrometheusCacheMetricsOptions{})
+	if err != nil {
+		panic(err)
+	}
+	return pcm
+}
+
+// NewPrometheusCacheMetricsWithOptions creates and returns a Prometheus cache metrics recorder
+// registered as described by opts. Creating metrics for several caches with the same options is
+// safe; the caches share collectors and are distinguished by the client and cache_name labels.
+func NewPrometheusCacheMetricsWithOptions(
+	client, cacheName string,
+	opts PrometheusCacheMetricsOptions,
+) (*PrometheusCacheMetrics, error) {
 	labels := []string{"client", "cache_name"}
-	if hits == nil {
-		hits = prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "cache_hits",
-				Help: "Total number of cache hits",
-			},
-			labels,
-		)
-		prometheus.MustRegister(hits)
-	}
-	if misses == nil {
-		misses = prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "cache_misses",
-				Help: "Total number of cache misses",
-			},
-			labels,
-		)
-		prometheus.MustRegister(misses)
-	}
-	if sets == nil {
-		sets = prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "cache_sets",
-				Help: "Total number of cache sets",
-			},
-			labels,
-		)
-		prometheus.MustRegister(sets)
-	}
-	if setsCollisions == nil {
-		setsCollisions = prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "cache_sets_collisions",
-				Help: "Total number of cache sets collisions",
-			},
-			labels,
-		)
-		prometheus.MustRegister(setsCollisions)
-	}
-	if deletesHits == nil {
-		deletesHits = prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "cache_deletes_hits",
-				Help: "Total number of cache deletes hits",
-			},
-			labels,
-		)
-		prometheus.MustRegister(deletesHits)
-	}
-	if deletesMisses == nil {
-		deletesMisses = prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "cache_deletes_misses",
-				Help: "Total number of cache deletes misses",
-			},
-			labels,
-		)
-		prometheus.MustRegister(deletesMisses)
-	}
-	if purgesHits == nil {
-		purgesHits = prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "cache_purges_hits",
-				Help: "Total number of cache purges hits",
-			},
-			labels,
-		)
-		prometheus.MustRegister(purgesHits)
-	}
-	if purgesMisses == nil {
-		purgesMisses = prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "cache_purges_misses",
-				Help: "Total number of cache purges misses",
-			},
-			labels,
-		)
-		prometheus.MustRegister(purgesMisses)
-	}
-	return &PrometheusCacheMetrics{
-		client:         client,
-		name:           cacheName,
-		hits:           hits,
-		misses:         misses,
-		sets:           sets,
-		setsCollisions: setsCollisions,
-		deletesHits:    deletesHits,
-		deletesMisses:  deletesMisses,
-		purgesHits:     purgesHits,
-		purgesMisses:   purgesMisses,
+	pcm := &PrometheusCacheMetrics{client: client, name: cacheName}
+	counters := []struct {
+		counterVec **prometheus.CounterVec
+		name       string
+		help       string
+	}{
+		{&pcm.hits, "cache_hits", "Total number of cache hits"},
+		{&pcm.misses, "cache_misses", "Total number of cache misses"},
+		{&pcm.sets, "cache_sets", "Total number of cache sets"},
+		{&pcm.setsCollisions, "cache_sets_collisions", "Total number of cache sets collisions"},
+		{&pcm.deletesHits, "cache_deletes_hits", "Total number of cache deletes hits"},
+		{&pcm.deletesMisses, "cache_deletes_misses", "Total number of cache deletes misses"},
+		{&pcm.purgesHits, "cache_purges_hits", "Total number of cache purges hits"},
+		{&pcm.purgesMisses, "cache_purges_misses", "Total number of cache purges misses"},
+		{
+			&pcm.compressionBytesSaved,
+			"cache_compression_bytes_saved",
+			"Total number of bytes saved by compressing cache values",
+		},
+		{&pcm.tampers, "cache_tampers", "Total number of cached values that failed integrity verification"},
+	}
+	var err error
+	for _, counter := range counters {
+		if *counter.counterVec, err = opts.counterVec(counter.name, counter.help, labels); err != nil {
+			return nil, err
+		}
+	}
+	pcm.keyFilterChecks, err = opts.counterVec(
+		"cache_key_filter_checks",
+		"Total number of remote lookups checked against the key filter by result",
+		append(labels, "result"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	pcm.compressionRatio, err = opts.histogramVec(
+		"cache_compression_ratio",
+		"Ratio of stored to uncompressed size for compressed cache values",
+		prometheus.LinearBuckets(0.1, 0.1, 10),
+		labels,
+	)
+	if err != nil {
+		return nil, err
 	}
+	pcm.operationDurations, err = opts.histogramVec(
+		"cache_operation_duration_seconds",
+		"Latency of cache operations by tier, operation and result",
+		prometheus.ExponentialBuckets(0.0001, 2, 16),
+		append(labels, "tier", "operation", "result"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pcm, nil
 }
 
 // Hit defines a cache hit
@@ -191,3 +378,33 @@ func (pcm *PrometheusCacheMetrics) PurgeHit() {
 func (pcm *PrometheusCacheMetrics) PurgeMiss() {
 	pcm.purgesMisses.WithLabelValues(pcm.client, pcm.name).Inc()
 }
+
+// Compressed records the ratio and bytes saved for a compressed cache value
+func (pcm *PrometheusCacheMetrics) Compressed(originalBytes, storedBytes int) {
+	if originalBytes <= 0 {
+		return
+	}
+	pcm.compressionRatio.WithLabelValues(pcm.client, pcm.name).Observe(
+		float64(storedBytes) / float64(originalBytes))
+	if saved := originalBytes - storedBytes; saved > 0 {
+		pcm.compressionBytesSaved.WithLabelValues(pcm.client, pcm.name).Add(float64(saved))
+	}
+}
+
+// Tamper defines a cached value that failed integrity verification
+func (pcm *PrometheusCacheMetrics) Tamper() {
+	pcm.tampers.WithLabelValues(pcm.client, pcm.name).Inc()
+}
+
+// KeyFilterCheck defines a remote lookup checked against the key filter
+func (pcm *PrometheusCacheMetrics) KeyFilterCheck(result KeyFilterResult) {
+	pcm.keyFilterChecks.WithLabelValues(pcm.client, pcm.name, string(result)).Inc()
+}
+
+// ObserveOperation records the latency of a cache operation and increments the matching counter
+func (pcm *PrometheusCacheMetrics) ObserveOperation(tier Tier, operation Operation, result Result, duration time.Duration) {
+	pcm.operationDurations.WithLabelValues(
+		pcm.client, pcm.name, string(tier), string(operation), string(result),
+	).Observe(duration.Seconds())
+	CacheMetricsAdapter{pcm}.ObserveOperation(tier, operation, result, duration)
+}
@@ -15,7 +15,9 @@
 package tieredcache
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
@@ -39,6 +41,11 @@ func deregister(pcm *PrometheusCacheMetrics) {
 	prometheus.Unregister(pcm.deletesMisses)
 	prometheus.Unregister(pcm.purgesHits)
 	prometheus.Unregister(pcm.purgesMisses)
+	prometheus.Unregister(pcm.compressionRatio)
+	prometheus.Unregister(pcm.compressionBytesSaved)
+	prometheus.Unregister(pcm.tampers)
+	prometheus.Unregister(pcm.keyFilterChecks)
+	prometheus.Unregister(pcm.operationDurations)
 }
 
 func TestPrometheusCacheHit(t *testing.T) {
@@ -104,3 +111,161 @@ func TestPrometheusCachePurgeMiss(t *testing.T) {
 	assert.Equal(t, 1, getCounter(t, pcm.purgesMisses))
 	deregister(pcm)
 }
+
+func TestPrometheusCacheCompressed(t *testing.T) {
+	pcm := NewPrometheusCacheMetrics("c", "n")
+	assert.Equal(t, 0, getCounter(t, pcm.compressionBytesSaved))
+	pcm.Compressed(100, 40)
+	assert.Equal(t, 60, getCounter(t, pcm.compressionBytesSaved))
+	observer, err := pcm.compressionRatio.GetMetricWith(prometheus.Labels{"client": "c", "cache_name": "n"})
+	assert.NoError(t, err)
+	pb := &dto.Metric{}
+	observer.(prometheus.Histogram).Write(pb)
+	assert.Equal(t, uint64(1), pb.Histogram.GetSampleCount())
+	assert.InDelta(t, 0.4, pb.Histogram.GetSampleSum(), 0.0001)
+	deregister(pcm)
+}
+
+func TestPrometheusCacheTamper(t *testing.T) {
+	pcm := NewPrometheusCacheMetrics("c", "n")
+	assert.Equal(t, 0, getCounter(t, pcm.tampers))
+	pcm.Tamper()
+	assert.Equal(t, 1, getCounter(t, pcm.tampers))
+	deregister(pcm)
+}
+
+func TestPrometheusCacheObserveOperation(t *testing.T) {
+	pcm := NewPrometheusCacheMetrics("c", "n")
+	hits := getCounter(t, pcm.hits)
+	pcm.ObserveOperation(TierRemote, OperationGet, ResultHit, 2*time.Millisecond)
+	observer, err := pcm.operationDurations.GetMetricWith(prometheus.Labels{
+		"client": "c", "cache_name": "n", "tier": "remote", "operation": "get", "result": "hit",
+	})
+	assert.NoError(t, err)
+	pb := &dto.Metric{}
+	observer.(prometheus.Histogram).Write(pb)
+	assert.Equal(t, uint64(1), pb.Histogram.GetSampleCount())
+	assert.InDelta(t, 0.002, pb.Histogram.GetSampleSum(), 0.0001)
+	// the legacy counters are still incremented
+	assert.Equal(t, hits+1, getCounter(t, pcm.hits))
+	deregister(pcm)
+}
+
+func TestCacheMetricsAdapter(t *testing.T) {
+	tests := []struct {
+		operation Operation
+		result    Result
+		expected  string
+	}{
+		{OperationGet, ResultHit, "Hit"},
+		{OperationGet, ResultMiss, "Miss"},
+		{OperationGet, ResultError, "Miss"},
+		{OperationSet, ResultOK, "Set"},
+		{OperationSet, ResultError, "SetCollision"},
+		{OperationDelete, ResultHit, "DeleteHit"},
+		{OperationDelete, ResultMiss, "DeleteMiss"},
+		{OperationPurge, ResultOK, "PurgeHit"},
+		{OperationPurge, ResultError, "PurgeMiss"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.operation)+"-"+string(test.result), func(t *testing.T) {
+			mcm := &MockCacheMetrics{}
+			mcm.On(test.expected)
+			CacheMetricsAdapter{mcm}.ObserveOperation(TierLocal, test.operation, test.result, time.Millisecond)
+			mcm.AssertNumberOfCalls(t, test.expected, 1)
+		})
+	}
+	// decode errors are neither hits nor misses
+	mcm := &MockCacheMetrics{}
+	CacheMetricsAdapter{mcm}.ObserveOperation(TierLocal, OperationGet, ResultDecodeError, time.Millisecond)
+	assert.Empty(t, mcm.Calls)
+}
+
+// operationRecorder is an OperationMetrics that remembers the operations it observed
+type operationRecorder struct {
+	MockCacheMetrics
+	observed []string
+}
+
+func (or *operationRecorder) ObserveOperation(tier Tier, operation Operation, result Result, duration time.Duration) {
+	or.observed = append(or.observed, string(tier)+":"+string(operation)+":"+string(result))
+}
+
+func TestCacheObserveOperation(t *testing.T) {
+	localMetrics := &operationRecorder{}
+	tieredMetrics := &operationRecorder{}
+	lc := newLocalCache(t, 0, 0)
+	lc.Metrics = localMetrics
+	lc.Encoder = &GobCacheEncoder{}
+	mtc := TieredCache{
+		Local:   lc,
+		Remote:  NewMockCache(&GobCacheEncoder{}),
+		Metrics: tieredMetrics,
+	}
+	assert.NoError(t, mtc.Set(context.Background(), "test-key", 1))
+	target := 0
+	assert.NoError(t, mtc.Get(context.Background(), "test-key", &target))
+	assert.Error(t, mtc.Get(context.Background(), "missing-key", &target))
+	assert.Equal(t, []string{"local:set:ok", "local:get:hit", "local:get:miss"}, localMetrics.observed)
+	assert.Equal(t, []string{"tiered:set:ok", "tiered:get:hit", "tiered:get:miss"}, tieredMetrics.observed)
+}
+
+func TestPrometheusCacheMetricsWithOptions(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	opts := PrometheusCacheMetricsOptions{
+		Registerer:  registry,
+		Namespace:   "svc",
+		Subsystem:   "availability",
+		ConstLabels: prometheus.Labels{"region": "us"},
+	}
+	pcm, err := NewPrometheusCacheMetricsWithOptions("c", "n", opts)
+	assert.NoError(t, err)
+	// registering again with the same options shares the existing collectors
+	other, err := NewPrometheusCacheMetricsWithOptions("c", "other", opts)
+	assert.NoError(t, err)
+	assert.True(t, pcm.hits == other.hits)
+	pcm.Hit()
+	other.Hit()
+
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	var found bool
+	for _, family := range families {
+		if family.GetName() != "svc_availability_cache_hits" {
+			continue
+		}
+		found = true
+		assert.Len(t, family.GetMetric(), 2)
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			assert.Equal(t, "us", labels["region"])
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestPrometheusCacheMetricsWithOptionsConflict(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cache_hits",
+		Help: "An unrelated metric with a conflicting name",
+	}))
+	_, err := NewPrometheusCacheMetricsWithOptions("c", "n", PrometheusCacheMetricsOptions{Registerer: registry})
+	assert.Error(t, err)
+}
+
+func TestPrometheusCacheKeyFilterCheck(t *testing.T) {
+	pcm := NewPrometheusCacheMetrics("c", "n")
+	pcm.KeyFilterCheck(KeyFilterFalsePositive)
+	counter, err := pcm.keyFilterChecks.GetMetricWith(prometheus.Labels{
+		"client": "c", "cache_name": "n", "result": "false_positive",
+	})
+	assert.NoError(t, err)
+	pb := &dto.Metric{}
+	counter.Write(pb)
+	assert.Equal(t, float64(1), pb.Counter.GetValue())
+	deregister(pcm)
+}
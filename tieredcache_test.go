@@ -16,10 +16,14 @@ package tieredcache
 
 import (
 	"context"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis"
 	"github.com/mna/redisc"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTieredSetBytes(t *testing.T) {
@@ -102,6 +106,7 @@ func TestTieredGetRemote(t *testing.T) {
 	encoder := &MockedCacheEncoder{}
 	target := struct{}{}
 	encoder.On("Decode", []byte("test-value"), target).Return(nil)
+	encoder.On("Encode", target).Return([]byte("test-value"), nil)
 	mcm := &MockCacheMetrics{}
 	mcm.On("Hit")
 	mtc := TieredCache{
@@ -113,6 +118,8 @@ func TestTieredGetRemote(t *testing.T) {
 	err := mtc.Get(context.Background(), "test-key", target)
 	assert.Nil(t, err)
 	mcm.AssertCalled(t, "Hit")
+	// The remote value is backfilled into local cache
+	assert.Equal(t, []byte("test-value"), mtc.Local.(*MockCache).Cache["test-key"])
 }
 
 // TestTieredGetError tests a fall-through on both local and remote
@@ -176,6 +183,18 @@ func TestTieredDeleteError(t *testing.T) {
 	mcm.AssertCalled(t, "DeleteMiss")
 }
 
+func TestTieredDeleteRemoteOnly(t *testing.T) {
+	// Keys missing from local cache are still removed from remote cache
+	mtc := TieredCache{
+		Local:  NewMockCache(nil),
+		Remote: NewMockCache(nil),
+	}
+	mtc.Remote.(*MockCache).Cache["test-key"] = []byte("test-value")
+	err := mtc.Delete(context.Background(), "test-key")
+	assert.Nil(t, err)
+	assert.NotContains(t, mtc.Remote.(*MockCache).Cache, "test-key")
+}
+
 func TestTieredPurge(t *testing.T) {
 	mcm := &MockCacheMetrics{}
 	mcm.On("PurgeHit")
@@ -213,3 +232,101 @@ func TestTieredPurgeError(t *testing.T) {
 	assert.Error(t, err)
 	mcm.AssertCalled(t, "PurgeMiss")
 }
+
+// TestTieredGetDecryptionError tests that a value that cannot be decrypted is not recorded as a miss
+func TestTieredGetDecryptionError(t *testing.T) {
+	enc, err := NewEncryptingCacheEncoder(&GobCacheEncoder{}, newTestKeyring("k1", "k1"))
+	assert.NoError(t, err)
+	mcm := &MockCacheMetrics{}
+	mtc := TieredCache{
+		Local:   NewMockCache(enc),
+		Remote:  NewMockCache(enc),
+		Metrics: mcm,
+	}
+	mtc.Remote.(*MockCache).Cache["test-key"] = []byte("not encrypted")
+	err = mtc.Get(context.Background(), "test-key", &testEncodable{})
+	assert.IsType(t, &DecryptionError{}, err)
+	mcm.AssertNotCalled(t, "Miss")
+}
+
+// Test that values too large for local cache are only stored remotely
+func TestTieredSetTooLargeForLocal(t *testing.T) {
+	lcc := LocalCacheConfig{Eviction: time.Second, MaxEntrySize: 64}
+	local, err := lcc.NewCache(&GobCacheEncoder{}, nil)
+	require.NoError(t, err)
+	mtc := TieredCache{Local: local, Remote: NewMockCache(&GobCacheEncoder{})}
+	require.NoError(t, mtc.Set(context.Background(), "test-key", "small"))
+	_, err = local.GetBytes(context.Background(), "test-key")
+	require.NoError(t, err)
+
+	large := strings.Repeat("large", 100)
+	require.NoError(t, mtc.Set(context.Background(), "test-key", large))
+	_, err = local.GetBytes(context.Background(), "test-key")
+	assert.Error(t, err)
+	var target string
+	require.NoError(t, mtc.Get(context.Background(), "test-key", &target))
+	assert.Equal(t, large, target)
+}
+
+func TestTieredGetBackfillsRemoteTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	encoder := &GobCacheEncoder{}
+	data, err := encoder.Encode("value")
+	require.NoError(t, err)
+	s.Set("test-key", string(data))
+	s.SetTTL("test-key", time.Minute)
+	lcc := LocalCacheConfig{TTL: time.Hour, Eviction: time.Hour}
+	local, err := lcc.NewCache(encoder, nil)
+	require.NoError(t, err)
+	remote := RemoteCache{cluster: &redisc.Cluster{StartupNodes: []string{s.Addr()}}, Encoder: encoder}
+	mtc := TieredCache{Local: local, Remote: remote}
+
+	before := time.Now()
+	var target string
+	require.NoError(t, mtc.Get(context.Background(), "test-key", &target))
+	assert.Equal(t, "value", target)
+	entry, err := local.Cache.Get("test-key")
+	require.NoError(t, err)
+	_, expiresAt, ok := decodeLocalEntry(entry)
+	require.True(t, ok)
+	assert.WithinDuration(t, before.Add(time.Minute), expiresAt, time.Second)
+}
+
+func TestTieredExistsTTLTouchExpire(t *testing.T) {
+	encoder := &GobCacheEncoder{}
+	local := NewMockCache(encoder)
+	remote := NewMockCache(encoder)
+	mtc := TieredCache{Local: local, Remote: remote}
+	ctx := context.Background()
+	require.NoError(t, remote.Set(ctx, "remote-only", "value"))
+	require.NoError(t, remote.Expire(ctx, "remote-only", time.Minute))
+	require.NoError(t, mtc.Set(ctx, "both", "value"))
+	require.NoError(t, mtc.Expire(ctx, "both", time.Minute))
+
+	for key, expected := range map[string]bool{"remote-only": true, "both": true, "missing": false} {
+		found, err := mtc.Exists(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, expected, found, key)
+	}
+
+	// Remote cache owns the TTL of every key
+	ttl, err := mtc.TTL(ctx, "remote-only")
+	require.NoError(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Minute)
+
+	// Touch and Expire apply to both tiers, and to remote alone when local has no copy
+	require.NoError(t, mtc.Touch(ctx, "both", time.Hour))
+	for _, tier := range []Cache{local, remote} {
+		ttl, err := tier.TTL(ctx, "both")
+		require.NoError(t, err)
+		assert.True(t, ttl > time.Minute)
+	}
+	require.NoError(t, mtc.Expire(ctx, "remote-only", time.Hour))
+	ttl, err = remote.TTL(ctx, "remote-only")
+	require.NoError(t, err)
+	assert.True(t, ttl > time.Minute)
+	assert.Error(t, mtc.Touch(ctx, "missing", time.Hour))
+	assert.Error(t, mtc.Expire(ctx, "missing", time.Hour))
+}
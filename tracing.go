@@ -0,0 +1,206 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies this library to OpenTelemetry
+const instrumentationName = "github.com/spothero/tieredcache"
+
+// Tracer backends selectable by name
+const (
+	// TracerOpenTracing traces with the global OpenTracing tracer
+	TracerOpenTracing = "opentracing"
+	// TracerOpenTelemetry traces with the global OpenTelemetry tracer provider
+	TracerOpenTelemetry = "opentelemetry"
+)
+
+// Span is a traced cache operation
+type Span interface {
+	SetTag(key string, value interface{})
+	Finish()
+}
+
+// Tracer starts spans for cache operations. The returned context carries the new span so that
+// spans started from it become its children.
+type Tracer interface {
+	StartSpan(ctx context.Context, operationName string) (Span, context.Context)
+}
+
+// NewTracer returns the Tracer for the named backend. An empty name selects OpenTracing.
+func NewTracer(backend string) (Tracer, error) {
+	switch backend {
+	case "", TracerOpenTracing:
+		return OpenTracingTracer{}, nil
+	case TracerOpenTelemetry:
+		return NewOpenTelemetryTracer(nil), nil
+	}
+	return nil, fmt.Errorf("unknown tracer backend %q", backend)
+}
+
+// tracerOrDefault returns tracer, or an OpenTracingTracer if tracer is nil
+func tracerOrDefault(tracer Tracer) Tracer {
+	if tracer == nil {
+		return OpenTracingTracer{}
+	}
+	return tracer
+}
+
+// startRemoteSpan starts a span for a Redis command, tagged with the database semantic conventions
+func startRemoteSpan(ctx context.Context, tracer Tracer, operationName, command string) (Span, context.Context) {
+	return startRemotePipelineSpan(ctx, tracer, operationName, command, command)
+}
+
+// startRemotePipelineSpan starts a span for a pipeline of Redis commands performing the given
+// database operation
+func startRemotePipelineSpan(
+	ctx context.Context, tracer Tracer, operationName, operation, pipeline string,
+) (Span, context.Context) {
+	span, ctx := tracerOrDefault(tracer).StartSpan(ctx, operationName)
+	tagRemoteCommand(span, operation, pipeline)
+	return span, ctx
+}
+
+// tagRemoteCommand tags span with the database semantic conventions for a pipeline of Redis
+// commands performing the given database operation. span may be nil.
+func tagRemoteCommand(span Span, operation, pipeline string) {
+	if span == nil {
+		return
+	}
+	span.SetTag("db.system", "redis")
+	span.SetTag("db.operation", operation)
+	span.SetTag("command", pipeline)
+}
+
+// OpenTracingTracer starts spans with the global OpenTracing tracer
+type OpenTracingTracer struct{}
+
+// StartSpan starts an OpenTracing span as a child of any span in ctx
+func (OpenTracingTracer) StartSpan(ctx context.Context, operationName string) (Span, context.Context) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, operationName)
+	return openTracingSpan{span}, ctx
+}
+
+// openTracingSpan adapts an OpenTracing span to the Span interface
+type openTracingSpan struct {
+	span opentracing.Span
+}
+
+// SetTag sets a tag on the span
+func (ots openTracingSpan) SetTag(key string, value interface{}) {
+	ots.span.SetTag(key, value)
+}
+
+// Finish finishes the span
+func (ots openTracingSpan) Finish() {
+	ots.span.Finish()
+}
+
+// OpenTelemetryTracer starts spans with an OpenTelemetry tracer
+type OpenTelemetryTracer struct {
+	Tracer trace.Tracer
+}
+
+// NewOpenTelemetryTracer returns an OpenTelemetryTracer using a tracer from provider. If provider is
+// nil the global tracer provider is used.
+func NewOpenTelemetryTracer(provider trace.TracerProvider) OpenTelemetryTracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return OpenTelemetryTracer{Tracer: provider.Tracer(instrumentationName)}
+}
+
+// StartSpan starts an OpenTelemetry span as a child of any span in ctx
+func (ott OpenTelemetryTracer) StartSpan(ctx context.Context, operationName string) (Span, context.Context) {
+	tracer := ott.Tracer
+	if tracer == nil {
+		tracer = otel.Tracer(instrumentationName)
+	}
+	ctx, span := tracer.Start(ctx, operationName)
+	return openTelemetrySpan{span}, ctx
+}
+
+// openTelemetrySpan adapts an OpenTelemetry span to the Span interface
+type openTelemetrySpan struct {
+	span trace.Span
+}
+
+// SetTag sets the tag as a span attribute
+func (ots openTelemetrySpan) SetTag(key string, value interface{}) {
+	var kv attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		kv = attribute.String(key, v)
+	case bool:
+		kv = attribute.Bool(key, v)
+	case int:
+		kv = attribute.Int(key, v)
+	case int64:
+		kv = attribute.Int64(key, v)
+	case float64:
+		kv = attribute.Float64(key, v)
+	default:
+		kv = attribute.String(key, fmt.Sprint(v))
+	}
+	ots.span.SetAttributes(kv)
+}
+
+// Finish ends the span
+func (ots openTelemetrySpan) Finish() {
+	ots.span.End()
+}
+
+// startSpan starts a span if tracing is enabled. Otherwise the returned span is nil and ctx is
+// returned unchanged.
+func startSpan(ctx context.Context, enabled bool, tracer Tracer, operationName string) (Span, context.Context) {
+	if !enabled {
+		return nil, ctx
+	}
+	return tracerOrDefault(tracer).StartSpan(ctx, operationName)
+}
+
+// finishSpan tags span with the result of its operation and finishes it. span may be nil.
+func finishSpan(span Span, operation Operation, result Result) {
+	if span == nil {
+		return
+	}
+	span.SetTag("result", string(result))
+	if operation == OperationGet {
+		span.SetTag("cache.hit", result == ResultHit)
+	}
+	span.Finish()
+}
+
+// decodeTraced decodes a value stored under key, tagging span with the encoded size and the time
+// spent decoding. span may be nil.
+func decodeTraced(span Span, encoder CacheEncoder, key string, data []byte, target interface{}) error {
+	if span == nil {
+		return decodeValue(encoder, key, data, target)
+	}
+	start := time.Now()
+	err := decodeValue(encoder, key, data, target)
+	span.SetTag("size", len(data))
+	span.SetTag("decode_duration_ms", float64(time.Since(start))/float64(time.Millisecond))
+	return err
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 SpotHero
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tieredcache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/mna/redisc"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newRecordingTracer returns an OpenTelemetryTracer whose finished spans are kept by the recorder
+func newRecordingTracer() (OpenTelemetryTracer, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	return NewOpenTelemetryTracer(provider), recorder
+}
+
+// spanAttributes returns the attributes of a span keyed by name
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func TestNewTracer(t *testing.T) {
+	tracer, err := NewTracer("")
+	require.NoError(t, err)
+	assert.IsType(t, OpenTracingTracer{}, tracer)
+	tracer, err = NewTracer(TracerOpenTelemetry)
+	require.NoError(t, err)
+	assert.IsType(t, OpenTelemetryTracer{}, tracer)
+	_, err = NewTracer("zipkin")
+	assert.Error(t, err)
+}
+
+func TestOpenTracingTracer(t *testing.T) {
+	mt := mocktracer.New()
+	opentracing.SetGlobalTracer(mt)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	span, ctx := OpenTracingTracer{}.StartSpan(context.Background(), "parent")
+	child, _ := OpenTracingTracer{}.StartSpan(ctx, "child")
+	child.SetTag("size", 5)
+	child.Finish()
+	span.Finish()
+
+	spans := mt.FinishedSpans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "child", spans[0].OperationName)
+	assert.Equal(t, 5, spans[0].Tag("size"))
+	assert.Equal(t, spans[1].SpanContext.SpanID, spans[0].ParentID)
+}
+
+func TestOpenTelemetryTracerRemoteGet(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	s.Set("test-key", "test-value")
+	tracer, recorder := newRecordingTracer()
+	rc := RemoteCache{
+		cluster:        &redisc.Cluster{StartupNodes: []string{s.Addr()}},
+		TracingEnabled: true,
+		Tracer:         tracer,
+	}
+	_, err = rc.GetBytes(context.Background(), "test-key")
+	require.NoError(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "remote-cache-get-bytes", spans[0].Name())
+	attributes := spanAttributes(spans[0])
+	assert.Equal(t, "redis", attributes["db.system"].AsString())
+	assert.Equal(t, "GET", attributes["db.operation"].AsString())
+	assert.True(t, attributes["cache.hit"].AsBool())
+}
+
+func TestOpenTelemetryTracerRemoteDelete(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	tracer, recorder := newRecordingTracer()
+	rc := RemoteCache{
+		cluster:        &redisc.Cluster{StartupNodes: []string{s.Addr()}},
+		TracingEnabled: true,
+		Tracer:         tracer,
+	}
+	require.NoError(t, rc.Delete(context.Background(), "test-key"))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	attributes := spanAttributes(spans[0])
+	assert.Equal(t, "DEL", attributes["db.operation"].AsString())
+	assert.Equal(t, "Pipeline:KEYS:MULTI:DEL:EXEC", attributes["command"].AsString())
+}
+
+func TestOpenTelemetryTracerTieredGet(t *testing.T) {
+	tracer, recorder := newRecordingTracer()
+	local := newLocalCache(t, 0, 0)
+	local.Encoder = &GobCacheEncoder{}
+	local.TracingEnabled = true
+	local.Tracer = tracer
+	local.Metrics = nil
+	remote := NewMockCache(&GobCacheEncoder{})
+	require.NoError(t, remote.Set(context.Background(), "key", "value"))
+	tc := TieredCache{Local: local, Remote: remote, TracingEnabled: true, Tracer: tracer}
+	var target string
+	require.NoError(t, tc.Get(context.Background(), "key", &target))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	assert.Equal(t, "local-cache-get", spans[0].Name())
+	assert.False(t, spanAttributes(spans[0])["cache.hit"].AsBool())
+	// The remote value is backfilled into local cache
+	assert.Equal(t, "local-cache-set", spans[1].Name())
+	assert.Equal(t, "tiered-cache-get", spans[2].Name())
+	assert.True(t, spanAttributes(spans[2])["cache.hit"].AsBool())
+	assert.Equal(t, "remote", spanAttributes(spans[2])["tier"].AsString())
+	assert.Equal(t, spans[2].SpanContext().SpanID(), spans[0].Parent().SpanID())
+	assert.Equal(t, spans[2].SpanContext().SpanID(), spans[1].Parent().SpanID())
+}
+
+func TestOpenTelemetryTracerTieredGetRemote(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	tracer, recorder := newRecordingTracer()
+	encoder := &GobCacheEncoder{}
+	local := newLocalCache(t, 0, 0)
+	local.Encoder = encoder
+	local.Metrics = nil
+	local.TracingEnabled = true
+	local.Tracer = tracer
+	remote := RemoteCache{
+		cluster:        &redisc.Cluster{StartupNodes: []string{s.Addr()}},
+		Encoder:        encoder,
+		TracingEnabled: true,
+		Tracer:         tracer,
+	}
+	data, err := encoder.Encode("value")
+	require.NoError(t, err)
+	s.Set("key", string(data))
+	tc := TieredCache{Local: local, Remote: remote, TracingEnabled: true, Tracer: tracer}
+	var target string
+	require.NoError(t, tc.Get(context.Background(), "key", &target))
+	assert.Equal(t, "value", target)
+
+	spans := recorder.Ended()
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name()
+	}
+	require.Equal(t, []string{"local-cache-get", "remote-cache-get", "local-cache-set", "tiered-cache-get"}, names)
+	tiered := spans[3]
+	assert.Equal(t, "remote", spanAttributes(tiered)["tier"].AsString())
+	for _, span := range spans[:3] {
+		assert.Equal(t, tiered.SpanContext().SpanID(), span.Parent().SpanID())
+	}
+	// The remote span carries both the Redis command and the decode
+	remoteAttributes := spanAttributes(spans[1])
+	assert.Equal(t, "GET", remoteAttributes["db.operation"].AsString())
+	assert.Equal(t, "GET PTTL", remoteAttributes["command"].AsString())
+	assert.Equal(t, int64(len(data)), remoteAttributes["size"].AsInt64())
+	_, ok := remoteAttributes["decode_duration_ms"]
+	assert.True(t, ok)
+}